@@ -3,18 +3,37 @@ module gofluentd
 go 1.16
 
 require (
+	github.com/DrmagicE/gmqtt v0.4.1
 	github.com/Laisky/gin-middlewares v1.1.1
 	github.com/Laisky/go-journal v1.1.6
-	github.com/Laisky/go-kafka v1.0.1
 	github.com/Laisky/go-syslog v2.3.3+incompatible
 	github.com/Laisky/go-utils v1.14.6
 	github.com/Laisky/zap v1.12.2
-	github.com/Shopify/sarama v1.26.4
+	github.com/Shopify/sarama v1.27.2
+	github.com/alicebob/miniredis/v2 v2.30.0
 	github.com/cespare/xxhash v1.1.0
+	github.com/coreos/go-systemd v0.0.0-20191104093116-d3cd4ed1dbcf // indirect
+	github.com/eclipse/paho.golang v0.11.0
+	github.com/eclipse/paho.mqtt.golang v1.4.2
 	github.com/gin-contrib/pprof v1.3.0
 	github.com/gin-gonic/gin v1.6.3
+	github.com/go-redis/redis/v8 v8.11.4
 	github.com/json-iterator/go v1.1.11
+	github.com/klauspost/compress v1.13.4
+	github.com/modern-go/reflect2 v1.0.2 // indirect
+	github.com/nats-io/nats-server/v2 v2.6.6
+	github.com/nats-io/nats.go v1.14.0
+	github.com/pelletier/go-toml v1.6.0 // indirect
 	github.com/pkg/errors v0.9.1
+	github.com/spf13/afero v1.2.2 // indirect
 	github.com/spf13/cobra v1.0.0
+	github.com/spf13/jwalterweatherman v1.1.0 // indirect
 	github.com/tinylib/msgp v1.1.2
+	github.com/xdg/scram v0.0.0-20180814205039-7eeb5667e42c
+	go.opentelemetry.io/proto/otlp v0.19.0
+	go.uber.org/multierr v1.5.0 // indirect
+	golang.org/x/sys v0.0.0-20210615035016-665e8c7367d1
+	google.golang.org/grpc v1.42.0
+	google.golang.org/protobuf v1.27.1
+	gopkg.in/ini.v1 v1.55.0 // indirect
 )
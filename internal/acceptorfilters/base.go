@@ -27,7 +27,11 @@ func (f *BaseFilter) SetMsgPool(msgPool *sync.Pool) {
 	f.msgPool = msgPool
 }
 
+// DiscardMsg recycle msg that filtered out,
+// filtered msg is regarded as processed, so it will be acked.
 func (f *BaseFilter) DiscardMsg(msg *library.FluentMsg) {
 	msg.ExtIds = nil
+	msg.Ack()
+	msg.AckCommit()
 	f.msgPool.Put(msg)
 }
@@ -119,6 +119,8 @@ func (f *AcceptorPipeline) registerMonitor() {
 
 func (f *AcceptorPipeline) DiscardMsg(msg *library.FluentMsg) {
 	msg.ExtIds = nil
+	msg.Ackers = nil
+	msg.CommitAckers = nil
 	f.MsgPool.Put(msg)
 }
 
@@ -175,7 +177,7 @@ func (f *AcceptorPipeline) Wrap(ctx context.Context, asyncInChan, syncInChan cha
 					case skipDumpChan <- msg: // baidu has low disk performance
 					default:
 						log.Logger.Error("discard msg since disk & downstream are busy", zap.String("tag", msg.Tag))
-						f.MsgPool.Put(msg)
+						f.DiscardMsg(msg)
 					}
 				}
 			}
@@ -3,6 +3,7 @@ package controller
 import (
 	"context"
 	"encoding/hex"
+	"os"
 	"regexp"
 	"runtime"
 	"sync"
@@ -17,7 +18,6 @@ import (
 	"gofluentd/library"
 	"gofluentd/library/log"
 
-	"github.com/Laisky/go-kafka"
 	gutils "github.com/Laisky/go-utils"
 	"github.com/Laisky/zap"
 	"github.com/cespare/xxhash"
@@ -65,13 +65,6 @@ func (c *Controllor) initRecvs(env string) []recvs.AcceptorRecvItf {
 	// init tcp recvs
 	receivers := []recvs.AcceptorRecvItf{}
 
-	// init kafka plugins recvs
-	sharingKMsgPool := &sync.Pool{
-		New: func() interface{} {
-			return &kafka.KafkaMsg{}
-		},
-	}
-
 	switch gutils.Settings.Get("settings.acceptor.recvs.plugins").(type) {
 	case map[string]interface{}:
 		for name := range gutils.Settings.Get("settings.acceptor.recvs.plugins").(map[string]interface{}) {
@@ -95,6 +88,16 @@ func (c *Controllor) initRecvs(env string) []recvs.AcceptorRecvItf {
 					ConcatorWait:           gutils.Settings.GetDuration("settings.acceptor.recvs.plugins."+name+".concat_with_sec") * time.Second,
 					ConcatorBufSize:        gutils.Settings.GetInt("settings.acceptor.recvs.plugins." + name + ".internal_buf_size"),
 					ConcatCfg:              library.LoadTagsMapAppendEnv(env, gutils.Settings.GetStringMap("settings.acceptor.recvs.plugins."+name+".concat")),
+					AckTimeout:             gutils.Settings.GetDuration("settings.acceptor.recvs.plugins."+name+".ack_timeout_sec") * time.Second,
+					MaxChunkSize:           gutils.Settings.GetInt64("settings.acceptor.recvs.plugins." + name + ".max_chunk_byte"),
+					Security:               loadForwardSecurityCfg("settings.acceptor.recvs.plugins." + name),
+					TLS:                    loadTLSCfg("settings.acceptor.recvs.plugins." + name),
+					Addrs:                  gutils.Settings.GetStringSlice("settings.acceptor.recvs.plugins." + name + ".addrs"),
+					UnixSocketMode:         os.FileMode(gutils.Settings.GetInt("settings.acceptor.recvs.plugins." + name + ".unix_socket_mode")),
+					UnixSocketOwner:        gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".unix_socket_owner"),
+					UnixSocketGroup:        gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".unix_socket_group"),
+					IsReusePort:            gutils.Settings.GetBool("settings.acceptor.recvs.plugins." + name + ".is_reuse_port"),
+					NAcceptors:             gutils.Settings.GetInt("settings.acceptor.recvs.plugins." + name + ".n_acceptors"),
 				}))
 			case "rsyslog":
 				receivers = append(receivers, recvs.NewRsyslogRecv(&recvs.RsyslogCfg{
@@ -108,6 +111,13 @@ func (c *Controllor) initRecvs(env string) []recvs.AcceptorRecvItf {
 					NewTimeFormat: gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".new_time_format"),
 					TimeKey:       gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".time_key"),
 					NewTimeKey:    gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".new_time_key"),
+					Format:        gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".format"),
+					TLSAddr:       gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".tls_addr"),
+					TLS:           loadTLSCfg("settings.acceptor.recvs.plugins." + name),
+					MaxTags:       gutils.Settings.GetInt("settings.acceptor.recvs.plugins." + name + ".max_tags"),
+					FallbackTag:   library.LoadTagReplaceEnv(env, gutils.Settings.GetString("settings.acceptor.recvs.plugins."+name+".fallback_tag")),
+					SourceMappings: recvs.ParseRsyslogSourceMappings(env,
+						gutils.Settings.Get("settings.acceptor.recvs.plugins."+name+".source_mappings")),
 				}))
 			case "http":
 				receivers = append(receivers, recvs.NewHTTPRecv(&recvs.HTTPRecvCfg{ // wechat mini program
@@ -127,10 +137,18 @@ func (c *Controllor) initRecvs(env string) []recvs.AcceptorRecvItf {
 					TimeFormat:         gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".time_format"),
 					MaxAllowedDelaySec: gutils.Settings.GetDuration("settings.acceptor.recvs.plugins."+name+".max_allowed_delay_sec") * time.Second,
 					MaxAllowedAheadSec: gutils.Settings.GetDuration("settings.acceptor.recvs.plugins."+name+".max_allowed_ahead_sec") * time.Second,
+					Mode:               gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".mode"),
+					TagField:           gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".tag_field"),
+					MaxRecordSize:      gutils.Settings.GetInt("settings.acceptor.recvs.plugins." + name + ".max_record_byte"),
+					Auth: &recvs.HTTPAuthCfg{
+						Type:           gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".auth.type"),
+						KeyFile:        gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".auth.key_file"),
+						ReloadInterval: gutils.Settings.GetDuration("settings.acceptor.recvs.plugins."+name+".auth.reload_interval_sec") * time.Second,
+						ReplayWindow:   gutils.Settings.GetDuration("settings.acceptor.recvs.plugins."+name+".auth.replay_window_sec") * time.Second,
+					},
 				}))
 			case "kafka":
 				kafkaCfg := &recvs.KafkaCfg{
-					KMsgPool:          sharingKMsgPool,
 					Name:              name,
 					MsgKey:            gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".msg_key"),
 					Brokers:           gutils.Settings.GetStringSlice("settings.acceptor.recvs.plugins." + name + ".brokers." + env),
@@ -143,10 +161,229 @@ func (c *Controllor) initRecvs(env string) []recvs.AcceptorRecvItf {
 					RewriteTag:        recvs.GetKafkaRewriteTag(gutils.Settings.GetString("settings.acceptor.recvs.plugins."+name+".rewrite_tag"), env),
 					NConsumer:         gutils.Settings.GetInt("settings.acceptor.recvs.plugins." + name + ".nconsumer"),
 					ReconnectInterval: gutils.Settings.GetDuration("settings.acceptor.recvs.plugins."+name+".reconnect_sec") * time.Second,
+					TopicCfgs:         recvs.ParseKafkaTopicCfgs(env, gutils.Settings.Get("settings.acceptor.recvs.plugins."+name+".subscriptions")),
+					Version:           gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".version"),
+					SASL: &recvs.KafkaSASLCfg{
+						Mechanism: gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".sasl.mechanism"),
+						Username:  gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".sasl.username"),
+						Password:  gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".sasl.password"),
+					},
+					TLS:              loadTLSCfg("settings.acceptor.recvs.plugins." + name),
+					AckMode:          gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".ack_mode"),
+					MaxPending:       gutils.Settings.GetInt("settings.acceptor.recvs.plugins." + name + ".max_pending"),
+					AckTimeout:       gutils.Settings.GetDuration("settings.acceptor.recvs.plugins."+name+".ack_timeout_sec") * time.Second,
+					HTTPSrv:          server,
+					IsEnableBackfill: gutils.Settings.GetBool("settings.acceptor.recvs.plugins." + name + ".is_enable_backfill"),
+					BackfillAuth: &recvs.HTTPAuthCfg{
+						Type:           gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".backfill_auth.type"),
+						KeyFile:        gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".backfill_auth.key_file"),
+						ReloadInterval: gutils.Settings.GetDuration("settings.acceptor.recvs.plugins."+name+".backfill_auth.reload_interval_sec") * time.Second,
+						ReplayWindow:   gutils.Settings.GetDuration("settings.acceptor.recvs.plugins."+name+".backfill_auth.replay_window_sec") * time.Second,
+					},
+					BackfillTag: library.LoadTagReplaceEnv(env, gutils.Settings.GetString("settings.acceptor.recvs.plugins."+name+".backfill_tag")),
+					Metadata: &recvs.KafkaMetadataCfg{
+						KeyField:       gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".metadata.key_field"),
+						HeadersField:   gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".metadata.headers_field"),
+						TopicField:     gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".metadata.topic_field"),
+						PartitionField: gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".metadata.partition_field"),
+						OffsetField:    gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".metadata.offset_field"),
+						TimestampField: gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".metadata.timestamp_field"),
+						IsEventTime:    gutils.Settings.GetBool("settings.acceptor.recvs.plugins." + name + ".metadata.is_event_time"),
+					},
 				}
 				kafkaCfg.IntervalNum = gutils.Settings.GetInt("settings.acceptor.recvs.plugins." + name + ".interval_num")
 				kafkaCfg.IntervalDuration = gutils.Settings.GetDuration("settings.acceptor.recvs.plugins."+name+".interval_sec") * time.Second
 				receivers = append(receivers, recvs.NewKafkaRecv(kafkaCfg))
+			case "tail":
+				receivers = append(receivers, recvs.NewTailRecv(&recvs.TailRecvCfg{
+					Name:           name,
+					Paths:          gutils.Settings.GetStringSlice("settings.acceptor.recvs.plugins." + name + ".paths"),
+					ExcludePaths:   gutils.Settings.GetStringSlice("settings.acceptor.recvs.plugins." + name + ".exclude_paths"),
+					PosFile:        gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".pos_file"),
+					Tag:            library.LoadTagReplaceEnv(env, gutils.Settings.GetString("settings.acceptor.recvs.plugins."+name+".tag")),
+					TagKey:         gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".tag_key"),
+					MsgKey:         gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".msg_key"),
+					PathKey:        gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".path_key"),
+					InodeKey:       gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".inode_key"),
+					PollInterval:   gutils.Settings.GetDuration("settings.acceptor.recvs.plugins."+name+".poll_interval_sec") * time.Second,
+					RotateWait:     gutils.Settings.GetDuration("settings.acceptor.recvs.plugins."+name+".rotate_wait_sec") * time.Second,
+					IsReadFromHead: gutils.Settings.GetBool("settings.acceptor.recvs.plugins." + name + ".is_read_from_head"),
+					MaxLineSize:    gutils.Settings.GetInt("settings.acceptor.recvs.plugins." + name + ".max_line_size"),
+					Format:         gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".format"),
+					K8s: &recvs.K8sMetaCfg{
+						Enable:             gutils.Settings.GetBool("settings.acceptor.recvs.plugins." + name + ".k8s.enable"),
+						APIServer:          gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".k8s.api_server"),
+						TokenFile:          gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".k8s.token_file"),
+						CAFile:             gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".k8s.ca_file"),
+						InsecureSkipVerify: gutils.Settings.GetBool("settings.acceptor.recvs.plugins." + name + ".k8s.insecure_skip_verify"),
+						CacheTTL:           gutils.Settings.GetDuration("settings.acceptor.recvs.plugins."+name+".k8s.cache_ttl_sec") * time.Second,
+						Timeout:            gutils.Settings.GetDuration("settings.acceptor.recvs.plugins."+name+".k8s.timeout_sec") * time.Second,
+					},
+				}))
+			case "otlp":
+				receivers = append(receivers, recvs.NewOTLPRecv(&recvs.OTLPRecvCfg{
+					Name:        name,
+					HTTPAddr:    gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".http_addr"),
+					GRPCAddr:    gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".grpc_addr"),
+					Tag:         library.LoadTagReplaceEnv(env, gutils.Settings.GetString("settings.acceptor.recvs.plugins."+name+".tag")),
+					FallbackTag: library.LoadTagReplaceEnv(env, gutils.Settings.GetString("settings.acceptor.recvs.plugins."+name+".fallback_tag")),
+					MaxTags:     gutils.Settings.GetInt("settings.acceptor.recvs.plugins." + name + ".max_tags"),
+					TagKey:      gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".tag_key"),
+					MsgKey:      gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".msg_key"),
+					TimeKey:     gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".time_key"),
+					MaxBodySize: gutils.Settings.GetInt64("settings.acceptor.recvs.plugins." + name + ".max_body_byte"),
+					MinSeverity: int32(gutils.Settings.GetInt("settings.acceptor.recvs.plugins." + name + ".min_severity")),
+				}))
+			case "gelf":
+				receivers = append(receivers, recvs.NewGELFRecv(&recvs.GELFRecvCfg{
+					Name:           name,
+					Addr:           gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".addr"),
+					TCPAddr:        gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".tcp_addr"),
+					Tag:            library.LoadTagReplaceEnv(env, gutils.Settings.GetString("settings.acceptor.recvs.plugins."+name+".tag")),
+					FallbackTag:    library.LoadTagReplaceEnv(env, gutils.Settings.GetString("settings.acceptor.recvs.plugins."+name+".fallback_tag")),
+					MaxTags:        gutils.Settings.GetInt("settings.acceptor.recvs.plugins." + name + ".max_tags"),
+					TagKey:         gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".tag_key"),
+					MsgKey:         gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".msg_key"),
+					TimeKey:        gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".time_key"),
+					ChunkTimeout:   gutils.Settings.GetDuration("settings.acceptor.recvs.plugins."+name+".chunk_timeout_sec") * time.Second,
+					MaxChunks:      gutils.Settings.GetInt("settings.acceptor.recvs.plugins." + name + ".max_chunks"),
+					MaxPendingMsgs: gutils.Settings.GetInt("settings.acceptor.recvs.plugins." + name + ".max_pending_msgs"),
+					MaxMessageSize: gutils.Settings.GetInt("settings.acceptor.recvs.plugins." + name + ".max_message_byte"),
+				}))
+			case "es-bulk":
+				receivers = append(receivers, recvs.NewESBulkRecv(&recvs.ESBulkRecvCfg{
+					Name:        name,
+					HTTPSrv:     server,
+					Path:        gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".path"),
+					IndexTagMap: recvs.LoadESIndexTagMap(env, gutils.Settings.Get("settings.acceptor.recvs.plugins."+name+".indices")),
+					DefaultTag:  library.LoadTagReplaceEnv(env, gutils.Settings.GetString("settings.acceptor.recvs.plugins."+name+".default_tag")),
+					TagKey:      gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".tag_key"),
+					IndexKey:    gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".index_key"),
+					TimeKey:     gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".time_key"),
+					TimeFormat:  gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".time_format"),
+					MaxBodySize: gutils.Settings.GetInt64("settings.acceptor.recvs.plugins." + name + ".max_body_byte"),
+					Version:     gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".version"),
+				}))
+			case "loki":
+				receivers = append(receivers, recvs.NewLokiRecv(&recvs.LokiRecvCfg{
+					Name:        name,
+					HTTPSrv:     server,
+					Path:        gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".path"),
+					Tag:         library.LoadTagReplaceEnv(env, gutils.Settings.GetString("settings.acceptor.recvs.plugins."+name+".tag")),
+					FallbackTag: library.LoadTagReplaceEnv(env, gutils.Settings.GetString("settings.acceptor.recvs.plugins."+name+".fallback_tag")),
+					MaxTags:     gutils.Settings.GetInt("settings.acceptor.recvs.plugins." + name + ".max_tags"),
+					TagKey:      gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".tag_key"),
+					MsgKey:      gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".msg_key"),
+					LabelPrefix: gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".label_prefix"),
+					TenantKey:   gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".tenant_key"),
+					TimeKey:     gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".time_key"),
+					MaxBodySize: gutils.Settings.GetInt64("settings.acceptor.recvs.plugins." + name + ".max_body_byte"),
+				}))
+			case "lumberjack":
+				receivers = append(receivers, recvs.NewLumberjackRecv(&recvs.LumberjackRecvCfg{
+					Name:              name,
+					Addr:              gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".addr"),
+					Tag:               library.LoadTagReplaceEnv(env, gutils.Settings.GetString("settings.acceptor.recvs.plugins."+name+".tag")),
+					FallbackTag:       library.LoadTagReplaceEnv(env, gutils.Settings.GetString("settings.acceptor.recvs.plugins."+name+".fallback_tag")),
+					MaxTags:           gutils.Settings.GetInt("settings.acceptor.recvs.plugins." + name + ".max_tags"),
+					TagKey:            gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".tag_key"),
+					MetadataKey:       gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".metadata_key"),
+					AckTimeout:        gutils.Settings.GetDuration("settings.acceptor.recvs.plugins."+name+".ack_timeout_sec") * time.Second,
+					KeepaliveInterval: gutils.Settings.GetDuration("settings.acceptor.recvs.plugins."+name+".keepalive_interval_sec") * time.Second,
+					MaxFrameSize:      gutils.Settings.GetInt("settings.acceptor.recvs.plugins." + name + ".max_frame_byte"),
+					TLS:               loadTLSCfg("settings.acceptor.recvs.plugins." + name),
+				}))
+			case "splunk-hec":
+				receivers = append(receivers, recvs.NewSplunkHECRecv(&recvs.SplunkHECRecvCfg{
+					Name:           name,
+					HTTPSrv:        server,
+					Path:           gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".path"),
+					Tokens:         recvs.ParseSplunkHECTokens(env, gutils.Settings.Get("settings.acceptor.recvs.plugins."+name+".tokens")),
+					TagKey:         gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".tag_key"),
+					MsgKey:         gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".msg_key"),
+					TimeKey:        gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".time_key"),
+					MaxBodySize:    gutils.Settings.GetInt64("settings.acceptor.recvs.plugins." + name + ".max_body_byte"),
+					IsAckEnabled:   gutils.Settings.GetBool("settings.acceptor.recvs.plugins." + name + ".is_ack_enabled"),
+					ChannelTTL:     gutils.Settings.GetDuration("settings.acceptor.recvs.plugins."+name+".channel_ttl_sec") * time.Second,
+					AckTTL:         gutils.Settings.GetDuration("settings.acceptor.recvs.plugins."+name+".ack_ttl_sec") * time.Second,
+					MaxPendingAcks: gutils.Settings.GetInt("settings.acceptor.recvs.plugins." + name + ".max_pending_acks"),
+				}))
+			case "mqtt":
+				receivers = append(receivers, recvs.NewMQTTRecv(&recvs.MQTTRecvCfg{
+					Name:            name,
+					Addr:            gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".addr"),
+					ClientID:        gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".client_id"),
+					Username:        gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".username"),
+					Password:        gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".password"),
+					ProtocolVersion: gutils.Settings.GetInt("settings.acceptor.recvs.plugins." + name + ".protocol_version"),
+					IsCleanSession:  gutils.Settings.GetBool("settings.acceptor.recvs.plugins." + name + ".is_clean_session"),
+					SessionExpiry:   gutils.Settings.GetDuration("settings.acceptor.recvs.plugins."+name+".session_expiry_sec") * time.Second,
+					KeepAlive:       gutils.Settings.GetDuration("settings.acceptor.recvs.plugins."+name+".keepalive_sec") * time.Second,
+					ConnectTimeout:  gutils.Settings.GetDuration("settings.acceptor.recvs.plugins."+name+".connect_timeout_sec") * time.Second,
+					AckTimeout:      gutils.Settings.GetDuration("settings.acceptor.recvs.plugins."+name+".ack_timeout_sec") * time.Second,
+					MaxInflight:     gutils.Settings.GetInt("settings.acceptor.recvs.plugins." + name + ".max_inflight"),
+					MaxPacketSize:   gutils.Settings.GetInt("settings.acceptor.recvs.plugins." + name + ".max_packet_byte"),
+					TagKey:          gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".tag_key"),
+					MsgKey:          gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".msg_key"),
+					TopicKey:        gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".topic_key"),
+					MaxTags:         gutils.Settings.GetInt("settings.acceptor.recvs.plugins." + name + ".max_tags"),
+					Subscriptions:   recvs.ParseMQTTSubscriptions(env, gutils.Settings.Get("settings.acceptor.recvs.plugins."+name+".subscriptions")),
+					TLS:             loadTLSCfg("settings.acceptor.recvs.plugins." + name),
+				}))
+			case "nats":
+				receivers = append(receivers, recvs.NewNATSRecv(&recvs.NATSRecvCfg{
+					NATSConnCfg:   loadNATSConnCfg("settings.acceptor.recvs.plugins." + name),
+					Name:          name,
+					Subjects:      gutils.Settings.GetStringSlice("settings.acceptor.recvs.plugins." + name + ".subjects"),
+					Queue:         gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".queue"),
+					IsJetStream:   gutils.Settings.GetBool("settings.acceptor.recvs.plugins." + name + ".is_jetstream"),
+					Durable:       gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".durable"),
+					AckMode:       gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".ack_mode"),
+					AckWait:       gutils.Settings.GetDuration("settings.acceptor.recvs.plugins."+name+".ack_wait_sec") * time.Second,
+					MaxAckPending: gutils.Settings.GetInt("settings.acceptor.recvs.plugins." + name + ".max_ack_pending"),
+					FetchBatch:    gutils.Settings.GetInt("settings.acceptor.recvs.plugins." + name + ".fetch_batch"),
+					Tag:           library.LoadTagReplaceEnv(env, gutils.Settings.GetString("settings.acceptor.recvs.plugins."+name+".tag")),
+					FallbackTag:   library.LoadTagReplaceEnv(env, gutils.Settings.GetString("settings.acceptor.recvs.plugins."+name+".fallback_tag")),
+					MaxTags:       gutils.Settings.GetInt("settings.acceptor.recvs.plugins." + name + ".max_tags"),
+					TagKey:        gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".tag_key"),
+					MsgKey:        gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".msg_key"),
+					SubjectKey:    gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".subject_key"),
+					IsJSONFormat:  gutils.Settings.GetBool("settings.acceptor.recvs.plugins." + name + ".is_json_format"),
+				}))
+			case "redis-stream":
+				receivers = append(receivers, recvs.NewRedisStreamRecv(&recvs.RedisStreamRecvCfg{
+					RedisConnCfg:  loadRedisConnCfg("settings.acceptor.recvs.plugins." + name),
+					Name:          name,
+					Streams:       recvs.ParseRedisStreamCfgs(env, gutils.Settings.Get("settings.acceptor.recvs.plugins."+name+".streams")),
+					Group:         gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".group"),
+					Consumer:      gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".consumer"),
+					GroupStartID:  gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".group_start_id"),
+					AckMode:       gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".ack_mode"),
+					BatchSize:     gutils.Settings.GetInt("settings.acceptor.recvs.plugins." + name + ".batch_size"),
+					Block:         gutils.Settings.GetDuration("settings.acceptor.recvs.plugins."+name+".block_sec") * time.Second,
+					ClaimInterval: gutils.Settings.GetDuration("settings.acceptor.recvs.plugins."+name+".claim_interval_sec") * time.Second,
+					ClaimMinIdle:  gutils.Settings.GetDuration("settings.acceptor.recvs.plugins."+name+".claim_min_idle_sec") * time.Second,
+					MaxTags:       gutils.Settings.GetInt("settings.acceptor.recvs.plugins." + name + ".max_tags"),
+					TagKey:        gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".tag_key"),
+					IDKey:         gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".id_key"),
+					StreamKey:     gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".stream_key"),
+				}))
+			case "lines":
+				receivers = append(receivers, recvs.NewLinesRecv(&recvs.LinesRecvCfg{
+					Name:                   name,
+					Network:                gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".network"),
+					Addr:                   gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".addr"),
+					Framing:                gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".framing"),
+					Delimiter:              gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".delimiter"),
+					Format:                 gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".format"),
+					MsgKey:                 gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".msg_key"),
+					MaxLineLen:             gutils.Settings.GetInt("settings.acceptor.recvs.plugins." + name + ".max_line_len"),
+					Tag:                    library.LoadTagReplaceEnv(env, gutils.Settings.GetString("settings.acceptor.recvs.plugins."+name+".tag")),
+					TagKey:                 gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".tag_key"),
+					IsRewriteTagFromTagKey: gutils.Settings.GetBool("settings.acceptor.recvs.plugins." + name + ".is_rewrite_tag_from_tag_key"),
+					OriginRewriteTagKey:    gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".origin_rewrite_tag_key"),
+					SourceKey:              gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".source_key"),
+				}))
 			default:
 				log.Logger.Panic("unknown recv type",
 					zap.String("type", t),
@@ -396,6 +633,53 @@ func StringListContains(ls []string, v string) bool {
 	return false
 }
 
+// loadForwardSecurityCfg load forward protocol handshake config under `<prefix>.security`
+func loadForwardSecurityCfg(prefix string) *library.ForwardSecurityCfg {
+	prefix += ".security"
+	return &library.ForwardSecurityCfg{
+		SharedKey:    gutils.Settings.GetString(prefix + ".shared_key"),
+		SelfHostname: gutils.Settings.GetString(prefix + ".self_hostname"),
+		Users:        gutils.Settings.GetStringMapString(prefix + ".users"),
+		Username:     gutils.Settings.GetString(prefix + ".username"),
+		Password:     gutils.Settings.GetString(prefix + ".password"),
+	}
+}
+
+// loadTLSCfg load tls config under `<prefix>.tls`
+func loadTLSCfg(prefix string) *library.TLSCfg {
+	prefix += ".tls"
+	return &library.TLSCfg{
+		Enable:             gutils.Settings.GetBool(prefix + ".enable"),
+		CertFile:           gutils.Settings.GetString(prefix + ".cert_file"),
+		KeyFile:            gutils.Settings.GetString(prefix + ".key_file"),
+		CAFile:             gutils.Settings.GetString(prefix + ".ca_file"),
+		IsVerifyClient:     gutils.Settings.GetBool(prefix + ".is_verify_client"),
+		ServerName:         gutils.Settings.GetString(prefix + ".server_name"),
+		InsecureSkipVerify: gutils.Settings.GetBool(prefix + ".insecure_skip_verify"),
+		ReloadInterval:     gutils.Settings.GetDuration(prefix+".reload_interval_sec") * time.Second,
+	}
+}
+
+// loadNATSConnCfg load nats servers & auth from settings
+func loadNATSConnCfg(prefix string) *library.NATSConnCfg {
+	return &library.NATSConnCfg{
+		Servers:  gutils.Settings.GetStringSlice(prefix + ".servers"),
+		Username: gutils.Settings.GetString(prefix + ".username"),
+		Password: gutils.Settings.GetString(prefix + ".password"),
+		Token:    gutils.Settings.GetString(prefix + ".token"),
+		TLS:      loadTLSCfg(prefix),
+	}
+}
+
+func loadRedisConnCfg(prefix string) *library.RedisConnCfg {
+	return &library.RedisConnCfg{
+		Addr:     gutils.Settings.GetString(prefix + ".addr"),
+		Password: gutils.Settings.GetString(prefix + ".password"),
+		DB:       gutils.Settings.GetInt(prefix + ".db"),
+		TLS:      loadTLSCfg(prefix),
+	}
+}
+
 func (c *Controllor) initSenders(env string) []senders.SenderItf {
 	ss := []senders.SenderItf{}
 	switch gutils.Settings.Get("settings.producer.plugins").(type) {
@@ -418,6 +702,9 @@ func (c *Controllor) initSenders(env string) []senders.SenderItf {
 					NFork:                gutils.Settings.GetInt("settings.producer.plugins." + name + ".forks"),
 					Tags:                 gutils.Settings.GetStringSlice("settings.producer.plugins." + name + ".tags"), // do not append env
 					IsDiscardWhenBlocked: gutils.Settings.GetBool("settings.producer.plugins." + name + ".is_discard_when_blocked"),
+					IsIntegerTime:        gutils.Settings.GetBool("settings.producer.plugins." + name + ".is_integer_time"),
+					Security:             loadForwardSecurityCfg("settings.producer.plugins." + name),
+					TLS:                  loadTLSCfg("settings.producer.plugins." + name),
 				}))
 			case "kafka":
 				ss = append(ss, senders.NewKafkaSender(&senders.KafkaSenderCfg{
@@ -455,6 +742,35 @@ func (c *Controllor) initSenders(env string) []senders.SenderItf {
 					IsCommit:             gutils.Settings.GetBool("settings.producer.plugins." + name + ".is_commit"),
 					IsDiscardWhenBlocked: gutils.Settings.GetBool("settings.producer.plugins." + name + ".is_discard_when_blocked"),
 				}))
+			case "nats":
+				ss = append(ss, senders.NewNATSSender(&senders.NATSSenderCfg{
+					NATSConnCfg:          loadNATSConnCfg("settings.producer.plugins." + name),
+					Name:                 name,
+					Subject:              library.LoadTagReplaceEnv(env, gutils.Settings.GetString("settings.producer.plugins."+name+".subject")),
+					IsJetStream:          gutils.Settings.GetBool("settings.producer.plugins." + name + ".is_jetstream"),
+					PublishTimeout:       gutils.Settings.GetDuration("settings.producer.plugins."+name+".publish_timeout_sec") * time.Second,
+					BatchSize:            gutils.Settings.GetInt("settings.producer.plugins." + name + ".msg_batch_size"),
+					MaxWait:              gutils.Settings.GetDuration("settings.producer.plugins."+name+".max_wait_sec") * time.Second,
+					InChanSize:           gutils.Settings.GetInt("settings.producer.sender_inchan_size"),
+					NFork:                gutils.Settings.GetInt("settings.producer.plugins." + name + ".forks"),
+					Tags:                 library.LoadTagsReplaceEnv(env, gutils.Settings.GetStringSlice("settings.producer.plugins."+name+".tags")),
+					IsDiscardWhenBlocked: gutils.Settings.GetBool("settings.producer.plugins." + name + ".is_discard_when_blocked"),
+				}))
+			case "redis-stream":
+				ss = append(ss, senders.NewRedisStreamSender(&senders.RedisStreamSenderCfg{
+					RedisConnCfg:         loadRedisConnCfg("settings.producer.plugins." + name),
+					Name:                 name,
+					TagStreamMap:         senders.LoadRedisStreamTagMap(env, gutils.Settings.Get("settings.producer.plugins."+name+".streams")),
+					MaxLen:               gutils.Settings.GetInt64("settings.producer.plugins." + name + ".max_len"),
+					IsExactMaxLen:        gutils.Settings.GetBool("settings.producer.plugins." + name + ".is_exact_max_len"),
+					PayloadKey:           gutils.Settings.GetString("settings.producer.plugins." + name + ".payload_key"),
+					BatchSize:            gutils.Settings.GetInt("settings.producer.plugins." + name + ".msg_batch_size"),
+					MaxWait:              gutils.Settings.GetDuration("settings.producer.plugins."+name+".max_wait_sec") * time.Second,
+					InChanSize:           gutils.Settings.GetInt("settings.producer.sender_inchan_size"),
+					NFork:                gutils.Settings.GetInt("settings.producer.plugins." + name + ".forks"),
+					Tags:                 library.LoadTagsReplaceEnv(env, gutils.Settings.GetStringSlice("settings.producer.plugins."+name+".tags")),
+					IsDiscardWhenBlocked: gutils.Settings.GetBool("settings.producer.plugins." + name + ".is_discard_when_blocked"),
+				}))
 			default:
 				log.Logger.Panic("unknown sender type",
 					zap.String("type", t),
@@ -26,6 +26,8 @@ const (
 	intervalToStartingLegacy  = 3 * time.Second
 	defaultJournalLegacyWait  = 1 * time.Second
 	defaultIntervalSecForceGC = 1 * time.Minute
+	// legacyCommitAckersTTL ackers of recvs are useless after recvs' ack timeout
+	legacyCommitAckersTTL = 10 * time.Minute
 )
 
 type JournalCfg struct {
@@ -56,6 +58,16 @@ type Journal struct {
 	tag2JJCommitChanMap, // map[string]chan *library.FluentMsg
 	tag2IDsCounter,
 	tag2DataCounter *sync.Map
+
+	// legacyCommitAckers id -> *legacyCommitAckers,
+	// commit ackers of msgs that discarded after dump,
+	// will be notified when id committed after reproduced in legacy stage
+	legacyCommitAckers *sync.Map
+}
+
+type legacyCommitAckers struct {
+	ackers []library.AckerItf
+	ts     time.Time
 }
 
 // NewJournal create new Journal with `bufDirPath` and `BufSizeBytes`
@@ -70,6 +82,7 @@ func NewJournal(ctx context.Context, cfg *JournalCfg) *Journal {
 		tag2JJCommitChanMap: &sync.Map{},
 		tag2IDsCounter:      &sync.Map{},
 		tag2DataCounter:     &sync.Map{},
+		legacyCommitAckers:  &sync.Map{},
 	}
 	j.commitChan = make(chan *library.FluentMsg, cfg.CommitIDChanLen)
 	j.outChan = make(chan *library.FluentMsg, cfg.JournalOutChanLen)
@@ -241,6 +254,7 @@ func (j *Journal) ProcessLegacyMsg(dumpChan chan *library.FluentMsg) (maxID int6
 				// create new map to avoid old data contaminate
 				msg = j.MsgPool.Get().(*library.FluentMsg)
 				data.Data["message"] = nil
+				data.Data["time"] = nil
 				if err = jj.LoadLegacyBuf(data); err == io.EOF {
 					log.Logger.Debug("load legacy buf done",
 						zap.Float64("sec", utils.Clock.GetUTCNow().Sub(startTs).Seconds()),
@@ -277,6 +291,12 @@ func (j *Journal) ProcessLegacyMsg(dumpChan chan *library.FluentMsg) (maxID int6
 				msg.ID = data.ID
 				msg.Tag = string(data.Data["tag"].(string))
 				msg.Message = data.Data["message"].(map[string]interface{})
+				switch ts := data.Data["time"].(type) {
+				case int64:
+					msg.Time = time.Unix(0, ts).UTC()
+				default: // legacy data without event time
+					msg.Time = time.Time{}
+				}
 				if msg.ID > innerMaxID {
 					innerMaxID = msg.ID
 				}
@@ -395,6 +415,7 @@ func (j *Journal) createJournalRunner(ctx context.Context, tag string) {
 			if err != nil && nRetry == maxRetry {
 				log.Logger.Error("try to write id to journal got error", zap.Error(err))
 			}
+			j.ackLegacyCommit(msg.ID)
 
 			if msg.ExtIds != nil {
 				for _, mid = range msg.ExtIds {
@@ -409,10 +430,15 @@ func (j *Journal) createJournalRunner(ctx context.Context, tag string) {
 					if err != nil && nRetry == maxRetry {
 						log.Logger.Error("try to write id to journal got error", zap.Error(err))
 					}
+					j.ackLegacyCommit(mid)
 				}
 				msg.ExtIds = nil
 			}
 
+			// msgs persisted by data writer have been acked,
+			// ack msgs that skipped dump after delivered.
+			msg.Ack()
+			msg.AckCommit()
 			j.MsgPool.Put(msg)
 		}
 	}()
@@ -454,6 +480,11 @@ func (j *Journal) createJournalRunner(ctx context.Context, tag string) {
 			data.ID = msg.ID
 			data.Data["message"] = msg.Message
 			data.Data["tag"] = msg.Tag
+			if msg.Time.IsZero() {
+				delete(data.Data, "time")
+			} else {
+				data.Data["time"] = msg.Time.UnixNano()
+			}
 			nRetry = 0
 			counter.Count()
 			for nRetry < maxRetry {
@@ -469,6 +500,10 @@ func (j *Journal) createJournalRunner(ctx context.Context, tag string) {
 					zap.Error(err),
 					zap.String("tag", msg.Tag),
 				)
+				// do not ack, let upstream resend
+				msg.Ackers = nil
+			} else {
+				msg.Ack()
 			}
 
 			select {
@@ -476,12 +511,46 @@ func (j *Journal) createJournalRunner(ctx context.Context, tag string) {
 			default:
 				// msg will reproduce in legacy stage,
 				// so you can discard msg without any side-effect.
+				j.saveLegacyCommitAckers(msg)
 				j.MsgPool.Put(msg)
 			}
 		}
 	}()
 }
 
+// saveLegacyCommitAckers keep commit ackers of msg that will reproduce in legacy stage
+func (j *Journal) saveLegacyCommitAckers(msg *library.FluentMsg) {
+	if len(msg.CommitAckers) == 0 {
+		return
+	}
+
+	j.legacyCommitAckers.Store(msg.ID, &legacyCommitAckers{
+		ackers: msg.CommitAckers,
+		ts:     utils.Clock.GetUTCNow(),
+	})
+	msg.CommitAckers = nil
+}
+
+// ackLegacyCommit notify commit ackers saved by `saveLegacyCommitAckers`
+func (j *Journal) ackLegacyCommit(id int64) {
+	if v, ok := j.legacyCommitAckers.LoadAndDelete(id); ok {
+		for _, acker := range v.(*legacyCommitAckers).ackers {
+			acker.Ack()
+		}
+	}
+}
+
+// expireLegacyCommitAckers remove commit ackers that wait too long
+func (j *Journal) expireLegacyCommitAckers() {
+	now := utils.Clock.GetUTCNow()
+	j.legacyCommitAckers.Range(func(k, v interface{}) bool {
+		if now.Sub(v.(*legacyCommitAckers).ts) > legacyCommitAckersTTL {
+			j.legacyCommitAckers.Delete(k)
+		}
+		return true
+	})
+}
+
 func (j *Journal) GetOutChan() chan *library.FluentMsg {
 	return j.outChan
 }
@@ -490,6 +559,9 @@ func (j *Journal) ConvertMsg2Buf(msg *library.FluentMsg, data *map[string]interf
 	(*data)["id"] = msg.ID
 	(*data)["tag"] = msg.Tag
 	(*data)["message"] = msg.Message
+	if !msg.Time.IsZero() {
+		(*data)["time"] = msg.Time.UnixNano()
+	}
 }
 
 func (j *Journal) DumpMsgFlow(ctx context.Context, msgPool *sync.Pool, dumpChan, skipDumpChan chan *library.FluentMsg) chan *library.FluentMsg {
@@ -518,6 +590,7 @@ func (j *Journal) DumpMsgFlow(ctx context.Context, msgPool *sync.Pool, dumpChan,
 			case <-ctx.Done():
 				return
 			default:
+				j.expireLegacyCommitAckers()
 				utils.ForceGCBlocking()
 				time.Sleep(j.GCIntervalSec)
 			}
@@ -585,6 +658,8 @@ func (j *Journal) DumpMsgFlow(ctx context.Context, msgPool *sync.Pool, dumpChan,
 							zap.String("tag", msg.Tag),
 							zap.String("msg", fmt.Sprint(msg)),
 						)
+						msg.Ackers = nil
+						msg.CommitAckers = nil
 						j.MsgPool.Put(msg)
 					}
 				}
@@ -640,6 +715,8 @@ func (j *Journal) startCommitRunner(ctx context.Context) {
 						zap.String("tag", msg.Tag),
 						zap.Int64("id", msg.ID),
 					)
+					msg.Ackers = nil
+					msg.CommitAckers = nil
 					j.MsgPool.Put(msg)
 				}
 			}
@@ -0,0 +1,85 @@
+package controller
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"gofluentd/library"
+)
+
+type testAcker struct {
+	n int
+}
+
+func (a *testAcker) Ack() {
+	a.n++
+}
+
+func TestJournalLegacyCommitAckers(t *testing.T) {
+	j := &Journal{legacyCommitAckers: &sync.Map{}}
+	acker := &testAcker{}
+	msg := &library.FluentMsg{ID: 1, CommitAckers: []library.AckerItf{acker}}
+	j.saveLegacyCommitAckers(msg)
+	if msg.CommitAckers != nil {
+		t.Fatalf("got %+v", msg.CommitAckers)
+	}
+
+	j.ackLegacyCommit(2)
+	if acker.n != 0 {
+		t.Fatalf("got %d", acker.n)
+	}
+	j.ackLegacyCommit(1)
+	j.ackLegacyCommit(1)
+	if acker.n != 1 {
+		t.Fatalf("got %d", acker.n)
+	}
+}
+
+type testChanAcker chan struct{}
+
+func (a testChanAcker) Ack() {
+	a <- struct{}{}
+}
+
+func TestJournalAckSkipDumpMsg(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	msgPool := &sync.Pool{New: func() interface{} { return &library.FluentMsg{} }}
+	j := NewJournal(ctx, &JournalCfg{
+		BufDirPath: t.TempDir(),
+		MsgPool:    msgPool,
+	})
+	dumpChan := make(chan *library.FluentMsg, 10)
+	skipDumpChan := make(chan *library.FluentMsg, 10)
+	outChan := j.DumpMsgFlow(ctx, msgPool, dumpChan, skipDumpChan)
+
+	acker := make(testChanAcker, 1)
+	skipDumpChan <- &library.FluentMsg{
+		ID:      1,
+		Tag:     "test.sit",
+		Message: map[string]interface{}{"log": "hello"},
+		Ackers:  []library.AckerItf{acker},
+	}
+
+	var msg *library.FluentMsg
+	select {
+	case msg = <-outChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("can not load msg")
+	}
+	select {
+	case <-acker:
+		t.Fatal("should not ack before delivered")
+	default:
+	}
+
+	// delivered by senders
+	j.GetCommitChan() <- msg
+	select {
+	case <-acker:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not acked after committed")
+	}
+}
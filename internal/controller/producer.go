@@ -152,6 +152,8 @@ func (p *Producer) discardMsg(pmsg *pendingDiscardMsg) {
 		p.CommitChan <- pmsg.msg
 	} else {
 		// committed msg will recycled in journal
+		pmsg.msg.Ackers = nil
+		pmsg.msg.CommitAckers = nil
 		p.MsgPool.Put(pmsg.msg)
 	}
 
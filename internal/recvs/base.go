@@ -7,6 +7,7 @@ package recvs
 
 import (
 	"context"
+	"fmt"
 	"sync"
 
 	"gofluentd/library"
@@ -47,3 +48,28 @@ func (r *BaseRecv) SetMsgPool(msgPool *sync.Pool) {
 func (r *BaseRecv) SetCounter(counter library.CounterIft) {
 	r.counter = counter
 }
+
+// normalizeSettingVal convert `map[interface{}]interface{}` loaded from yaml
+// to `map[string]interface{}` recursively
+func normalizeSettingVal(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for k, vi := range v {
+			m[fmt.Sprint(k)] = normalizeSettingVal(vi)
+		}
+		return m
+	case map[string]interface{}:
+		for k, vi := range v {
+			v[k] = normalizeSettingVal(vi)
+		}
+		return v
+	case []interface{}:
+		for i, vi := range v {
+			v[i] = normalizeSettingVal(vi)
+		}
+		return v
+	default:
+		return v
+	}
+}
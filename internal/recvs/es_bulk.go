@@ -0,0 +1,469 @@
+package recvs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gofluentd/internal/monitor"
+	"gofluentd/library"
+	"gofluentd/library/log"
+
+	utils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultESBulkPath        = "/es"
+	defaultESBulkVersion     = "7.10.2"
+	defaultESBulkMaxBodySize = 10 * 1024 * 1024
+)
+
+// LoadESIndexTagMap load `index: tag` from settings, the inverse of `senders.LoadESTagIndexMap`.
+// index can end with `*` to match all indices with the prefix.
+func LoadESIndexTagMap(env string, mapi interface{}) map[string]string {
+	indexTagMap := map[string]string{}
+	m, ok := mapi.(map[string]interface{})
+	if !ok {
+		return indexTagMap
+	}
+	for index, tagi := range m {
+		indexTagMap[strings.Replace(index, "{env}", env, -1)] = strings.Replace(fmt.Sprint(tagi), "{env}", env, -1)
+	}
+
+	return indexTagMap
+}
+
+// ESBulkRecvCfg is the configuration for ESBulkRecv
+type ESBulkRecvCfg struct {
+	HTTPSrv *gin.Engine
+	Name    string
+	// Path: prefix of all endpoints, clients should set it as the path of elasticsearch,
+	// can not be `/` since it conflicts with other endpoints of HTTPSrv
+	Path string
+	// IndexTagMap: map index to tag, index can end with `*` as prefix,
+	// the longest matched prefix works
+	IndexTagMap map[string]string
+	// DefaultTag: tag for unmapped indices, unmapped items will be rejected if empty
+	DefaultTag string
+	// TagKey: set `msg.Message[TagKey] = msg.Tag`
+	// IndexKey: optional, set `msg.Message[IndexKey] = <index>`
+	TagKey, IndexKey string
+	// TimeKey & TimeFormat: optional, parse event time from `msg.Message[TimeKey]`
+	TimeKey, TimeFormat string
+	MaxBodySize         int64
+	// Version: elasticsearch version replied to clients
+	Version string
+}
+
+// ESBulkRecv recv compatible with elasticsearch `_bulk` API
+type ESBulkRecv struct {
+	*BaseRecv
+	*ESBulkRecvCfg
+
+	// indexPrefixes indices end with `*`, sorted by length desc
+	indexPrefixes    []string
+	acceptedCounter  *utils.Counter
+	rejectedCounter  *utils.Counter
+	unmappedCounter  *utils.Counter
+	requestCounter   *utils.Counter
+	startupTimestamp string
+}
+
+// esBulkItemError error of bulk item
+type esBulkItemError struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+// esBulkItemResult result of bulk item, same as elasticsearch
+type esBulkItemResult struct {
+	Index       string                 `json:"_index"`
+	Type        string                 `json:"_type"`
+	ID          string                 `json:"_id"`
+	Version     int                    `json:"_version,omitempty"`
+	Result      string                 `json:"result,omitempty"`
+	Shards      map[string]interface{} `json:"_shards,omitempty"`
+	SeqNo       int64                  `json:"_seq_no,omitempty"`
+	PrimaryTerm int                    `json:"_primary_term,omitempty"`
+	Status      int                    `json:"status"`
+	Error       *esBulkItemError       `json:"error,omitempty"`
+}
+
+// esBulkResp response of bulk request, same as elasticsearch
+type esBulkResp struct {
+	Took   int64                          `json:"took"`
+	Errors bool                           `json:"errors"`
+	Items  []map[string]*esBulkItemResult `json:"items"`
+}
+
+// NewESBulkRecv create new ESBulkRecv and register endpoints on HTTPSrv
+func NewESBulkRecv(cfg *ESBulkRecvCfg) *ESBulkRecv {
+	r := &ESBulkRecv{
+		BaseRecv:         &BaseRecv{},
+		ESBulkRecvCfg:    cfg,
+		acceptedCounter:  utils.NewCounter(),
+		rejectedCounter:  utils.NewCounter(),
+		unmappedCounter:  utils.NewCounter(),
+		requestCounter:   utils.NewCounter(),
+		startupTimestamp: utils.Clock.GetUTCNow().Format(time.RFC3339),
+	}
+	if err := r.valid(); err != nil {
+		log.Logger.Panic("config invalid", zap.Error(err))
+	}
+
+	log.Logger.Info("create ESBulkRecv",
+		zap.String("name", r.Name),
+		zap.String("path", r.Path),
+		zap.String("default_tag", r.DefaultTag),
+		zap.Int("n_indices", len(r.IndexTagMap)))
+
+	// gin can not register `_bulk` and `:index` at the same position,
+	// so `_bulk` & `_license` are dispatched by esPathHandler
+	r.HTTPSrv.GET(r.Path+"/", r.InfoHandler)
+	r.HTTPSrv.HEAD(r.Path+"/", r.InfoHandler)
+	r.HTTPSrv.GET(r.Path+"/:index", r.esPathHandler)
+	r.HTTPSrv.POST(r.Path+"/:index", r.esPathHandler)
+	r.HTTPSrv.PUT(r.Path+"/:index", r.esPathHandler)
+	r.HTTPSrv.POST(r.Path+"/:index/_bulk", r.BulkHandler)
+	r.HTTPSrv.PUT(r.Path+"/:index/_bulk", r.BulkHandler)
+	return r
+}
+
+func (r *ESBulkRecv) valid() error {
+	if r.HTTPSrv == nil {
+		return errors.New("http server should not be nil")
+	}
+	if r.DefaultTag == "" && len(r.IndexTagMap) == 0 {
+		return errors.New("one of default_tag and indices should be set")
+	}
+
+	r.Path = strings.TrimRight(r.Path, "/")
+	if r.Path == "" {
+		r.Path = defaultESBulkPath
+		log.Logger.Info("reset path", zap.String("path", r.Path))
+	}
+	if !strings.HasPrefix(r.Path, "/") {
+		return errors.Errorf("path `%s` should start with `/`", r.Path)
+	}
+	if r.TagKey == "" {
+		r.TagKey = "tag"
+		log.Logger.Info("reset tag_key", zap.String("tag_key", r.TagKey))
+	}
+	if r.TimeKey != "" && r.TimeFormat == "" {
+		r.TimeFormat = time.RFC3339Nano
+		log.Logger.Info("reset time_format", zap.String("time_format", r.TimeFormat))
+	}
+	if r.MaxBodySize <= 0 {
+		r.MaxBodySize = defaultESBulkMaxBodySize
+		log.Logger.Info("reset max_body_byte", zap.Int64("max_body_byte", r.MaxBodySize))
+	}
+	if r.Version == "" {
+		r.Version = defaultESBulkVersion
+		log.Logger.Info("reset version", zap.String("version", r.Version))
+	}
+
+	for index := range r.IndexTagMap {
+		if strings.HasSuffix(index, "*") {
+			r.indexPrefixes = append(r.indexPrefixes, index)
+		}
+	}
+	sort.Slice(r.indexPrefixes, func(i, j int) bool {
+		return len(r.indexPrefixes[i]) > len(r.indexPrefixes[j])
+	})
+	return nil
+}
+
+// GetName get the name of recv
+func (r *ESBulkRecv) GetName() string {
+	return r.Name
+}
+
+// Run only register metrics, requests are handled by HTTPSrv
+func (r *ESBulkRecv) Run(ctx context.Context) {
+	log.Logger.Info("run ESBulkRecv", zap.String("name", r.Name))
+	monitor.AddMetric("esbulkrecv."+r.Name, func() map[string]interface{} {
+		return map[string]interface{}{
+			"requestTotal":  r.requestCounter.Get(),
+			"acceptedTotal": r.acceptedCounter.Get(),
+			"rejectedTotal": r.rejectedCounter.Get(),
+			"unmappedTotal": r.unmappedCounter.Get(),
+		}
+	})
+}
+
+// getTag map index to tag
+func (r *ESBulkRecv) getTag(index string) (string, bool) {
+	if tag, ok := r.IndexTagMap[index]; ok {
+		return tag, true
+	}
+	for _, prefix := range r.indexPrefixes {
+		if strings.HasPrefix(index, prefix[:len(prefix)-1]) {
+			return r.IndexTagMap[prefix], true
+		}
+	}
+	if r.DefaultTag != "" {
+		return r.DefaultTag, true
+	}
+	return "", false
+}
+
+func (r *ESBulkRecv) setHeaders(ctx *gin.Context) {
+	// required by elasticsearch clients since 7.14
+	ctx.Header("X-Elastic-Product", "Elasticsearch")
+}
+
+// abort reply error like elasticsearch
+func (r *ESBulkRecv) abort(ctx *gin.Context, status int, errType, reason string) {
+	log.Logger.Warn("reject es bulk request",
+		zap.String("name", r.Name),
+		zap.String("remote", ctx.ClientIP()),
+		zap.String("error", reason))
+	r.setHeaders(ctx)
+	ctx.AbortWithStatusJSON(status, map[string]interface{}{
+		"error": map[string]interface{}{
+			"type":   errType,
+			"reason": reason,
+		},
+		"status": status,
+	})
+}
+
+// InfoHandler reply `GET /`, clients check the version before sending
+func (r *ESBulkRecv) InfoHandler(ctx *gin.Context) {
+	r.setHeaders(ctx)
+	ctx.JSON(http.StatusOK, map[string]interface{}{
+		"name":         r.Name,
+		"cluster_name": "gofluentd",
+		"cluster_uuid": r.Name,
+		"version": map[string]interface{}{
+			"number":                              r.Version,
+			"build_flavor":                        "default",
+			"build_type":                          "docker",
+			"build_snapshot":                      false,
+			"lucene_version":                      "8.7.0",
+			"minimum_wire_compatibility_version":  "6.8.0",
+			"minimum_index_compatibility_version": "6.0.0-beta1",
+		},
+		"tagline": "You Know, for Search",
+	})
+}
+
+// LicenseHandler reply `GET /_license`
+func (r *ESBulkRecv) LicenseHandler(ctx *gin.Context) {
+	r.setHeaders(ctx)
+	ctx.JSON(http.StatusOK, map[string]interface{}{
+		"license": map[string]interface{}{
+			"status":               "active",
+			"uid":                  r.Name,
+			"type":                 "basic",
+			"issue_date":           r.startupTimestamp,
+			"issued_to":            "gofluentd",
+			"issuer":               "elasticsearch",
+			"start_date_in_millis": -1,
+		},
+	})
+}
+
+// esPathHandler dispatch `/_bulk` & `/_license`
+func (r *ESBulkRecv) esPathHandler(ctx *gin.Context) {
+	switch {
+	case ctx.Param("index") == "_bulk" && ctx.Request.Method != http.MethodGet:
+		r.BulkHandler(ctx)
+	case ctx.Param("index") == "_license" && ctx.Request.Method == http.MethodGet:
+		r.LicenseHandler(ctx)
+	default:
+		r.abort(ctx, http.StatusNotFound, "not_found", "unsupported api")
+	}
+}
+
+// BulkHandler process `POST /_bulk` & `POST /<index>/_bulk`,
+// only `index` & `create` actions are supported.
+func (r *ESBulkRecv) BulkHandler(ctx *gin.Context) {
+	r.requestCounter.Count()
+	startAt := utils.Clock.GetUTCNow()
+	if ctx.Request.ContentLength > r.MaxBodySize {
+		r.abort(ctx, http.StatusRequestEntityTooLarge, "content_too_long_exception", fmt.Sprintf("content size must less than %d bytes", r.MaxBodySize))
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(ctx.Request.Body, r.MaxBodySize+1))
+	if err != nil {
+		r.abort(ctx, http.StatusBadRequest, "parse_exception", "read body: "+err.Error())
+		return
+	}
+	if int64(len(body)) > r.MaxBodySize {
+		r.abort(ctx, http.StatusRequestEntityTooLarge, "content_too_long_exception", fmt.Sprintf("body size must less than %d bytes", r.MaxBodySize))
+		return
+	}
+	if body, err = decompressHTTPBody(ctx.Request, body, r.MaxBodySize); err != nil {
+		r.abort(ctx, http.StatusBadRequest, "parse_exception", err.Error())
+		return
+	}
+
+	var (
+		defaultIndex = ctx.Param("index")
+		lines        = splitESBulkLines(body)
+		resp         = &esBulkResp{Items: []map[string]*esBulkItemResult{}}
+		msgs         []*library.FluentMsg
+	)
+	if defaultIndex == "_bulk" {
+		defaultIndex = ""
+	}
+	for i := 0; i < len(lines); i++ {
+		action, meta, err := parseESBulkAction(lines[i])
+		if err != nil {
+			r.abort(ctx, http.StatusBadRequest, "illegal_argument_exception", fmt.Sprintf("line %d: %s", i+1, err.Error()))
+			r.putMsgs(msgs)
+			return
+		}
+		if action != "delete" { // other actions are followed by source
+			if i++; i >= len(lines) {
+				r.abort(ctx, http.StatusBadRequest, "illegal_argument_exception", "the bulk request must be terminated by a newline [\\n]")
+				r.putMsgs(msgs)
+				return
+			}
+		}
+
+		item := &esBulkItemResult{
+			Index: meta.Index,
+			Type:  "_doc",
+			ID:    meta.ID,
+		}
+		if item.Index == "" {
+			item.Index = defaultIndex
+		}
+		resp.Items = append(resp.Items, map[string]*esBulkItemResult{action: item})
+
+		msg, err := r.parseESBulkSource(action, item, lines[i])
+		if err != nil {
+			r.rejectedCounter.Count()
+			resp.Errors = true
+			continue
+		}
+
+		msgs = append(msgs, msg)
+		item.Version = 1
+		item.Result = "created"
+		item.Shards = map[string]interface{}{"total": 1, "successful": 1, "failed": 0}
+		item.SeqNo = msg.ID
+		item.PrimaryTerm = 1
+		item.Status = http.StatusCreated
+		if item.ID == "" {
+			item.ID = strconv.FormatInt(msg.ID, 10)
+		}
+	}
+
+	r.acceptedCounter.CountN(int64(len(msgs)))
+	log.Logger.Debug("receive es bulk msgs",
+		zap.String("name", r.Name),
+		zap.Int("items", len(resp.Items)),
+		zap.Int("accepted", len(msgs)))
+	resp.Took = utils.Clock.GetUTCNow().Sub(startAt).Milliseconds()
+	r.setHeaders(ctx)
+	ctx.JSON(http.StatusOK, resp)
+	for _, msg := range msgs {
+		r.asyncOutChan <- msg
+	}
+}
+
+// parseESBulkSource convert source into msg, set error into item if failed
+func (r *ESBulkRecv) parseESBulkSource(action string, item *esBulkItemResult, source []byte) (msg *library.FluentMsg, err error) {
+	switch action {
+	case "index", "create":
+	default:
+		item.Status = http.StatusBadRequest
+		item.Error = &esBulkItemError{Type: "illegal_argument_exception", Reason: "unsupported action `" + action + "`"}
+		return nil, errors.New(item.Error.Reason)
+	}
+	if item.Index == "" {
+		item.Status = http.StatusBadRequest
+		item.Error = &esBulkItemError{Type: "action_request_validation_exception", Reason: "index is missing"}
+		return nil, errors.New(item.Error.Reason)
+	}
+	tag, ok := r.getTag(item.Index)
+	if !ok {
+		r.unmappedCounter.Count()
+		item.Status = http.StatusNotFound
+		item.Error = &esBulkItemError{Type: "index_not_found_exception", Reason: "no such index [" + item.Index + "]"}
+		return nil, errors.New(item.Error.Reason)
+	}
+
+	m := map[string]interface{}{}
+	if err = json.Unmarshal(source, &m); err != nil {
+		item.Status = http.StatusBadRequest
+		item.Error = &esBulkItemError{Type: "mapper_parsing_exception", Reason: "failed to parse: source should be JSON object"}
+		return nil, errors.New(item.Error.Reason)
+	}
+
+	var ts time.Time
+	if r.TimeKey != "" {
+		if v, ok := m[r.TimeKey].(string); ok {
+			if ts, err = time.Parse(r.TimeFormat, v); err != nil {
+				item.Status = http.StatusBadRequest
+				item.Error = &esBulkItemError{Type: "mapper_parsing_exception", Reason: fmt.Sprintf("cannot parse `%s` by format `%s`", r.TimeKey, r.TimeFormat)}
+				return nil, errors.New(item.Error.Reason)
+			}
+			ts = ts.UTC()
+		}
+	}
+
+	m[r.TagKey] = tag
+	if r.IndexKey != "" {
+		m[r.IndexKey] = item.Index
+	}
+	msg = r.msgPool.Get().(*library.FluentMsg)
+	msg.ID = r.counter.Count()
+	msg.Tag = tag
+	msg.Message = m
+	msg.Time = ts
+	return msg, nil
+}
+
+// putMsgs recycle msgs if the whole request is rejected
+func (r *ESBulkRecv) putMsgs(msgs []*library.FluentMsg) {
+	for _, msg := range msgs {
+		r.msgPool.Put(msg)
+	}
+}
+
+// esBulkMeta metadata of bulk action
+type esBulkMeta struct {
+	Index string `json:"_index"`
+	ID    string `json:"_id"`
+}
+
+// parseESBulkAction parse action line like `{"index": {"_index": "test"}}`
+func parseESBulkAction(line []byte) (action string, meta *esBulkMeta, err error) {
+	actions := map[string]*esBulkMeta{}
+	if err = json.Unmarshal(line, &actions); err != nil {
+		return "", nil, errors.New("malformed action/metadata line")
+	}
+	if len(actions) != 1 {
+		return "", nil, errors.New("malformed action/metadata line, expected only one action")
+	}
+	for action, meta = range actions {
+	}
+	if meta == nil {
+		meta = &esBulkMeta{}
+	}
+	return action, meta, nil
+}
+
+// splitESBulkLines split NDJSON body, empty lines are ignored
+func splitESBulkLines(body []byte) (lines [][]byte) {
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		if line = bytes.TrimSpace(line); len(line) != 0 {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
@@ -0,0 +1,152 @@
+package recvs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gofluentd/library"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestLoadESIndexTagMap(t *testing.T) {
+	m := LoadESIndexTagMap("sit", map[string]interface{}{
+		"filebeat-{env}-*": "filebeat.{env}",
+		"app":              "app.{env}",
+	})
+	if len(m) != 2 ||
+		m["filebeat-sit-*"] != "filebeat.sit" ||
+		m["app"] != "app.sit" {
+		t.Fatalf("got %+v", m)
+	}
+}
+
+func TestESBulkRecv(t *testing.T) {
+	var (
+		srv          = gin.New()
+		asyncOutChan = make(chan *library.FluentMsg, 1000)
+	)
+	srv.Any("/health", func(ctx *gin.Context) {})
+	recv := NewESBulkRecv(&ESBulkRecvCfg{
+		Name:    "test-es-bulk",
+		HTTPSrv: srv,
+		Path:    "/es/",
+		IndexTagMap: map[string]string{
+			"filebeat-*":     "filebeat.sit",
+			"filebeat-app-*": "app.sit",
+			"nginx":          "nginx.sit",
+		},
+		IndexKey: "index",
+		TimeKey:  "@timestamp",
+	})
+	recv.SetCounter(counter)
+	recv.SetMsgPool(msgPool)
+	recv.SetAsyncOutChan(asyncOutChan)
+
+	request := func(method, path string, body []byte, encoding string) (int, map[string]interface{}) {
+		req := httptest.NewRequest(method, path, bytes.NewReader(body))
+		if encoding != "" {
+			req.Header.Set("Content-Encoding", encoding)
+		}
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		if w.Header().Get("X-Elastic-Product") != "Elasticsearch" {
+			t.Fatalf("got headers %+v", w.Header())
+		}
+		resp := map[string]interface{}{}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("got error: %+v, %s", err, w.Body.String())
+		}
+		return w.Code, resp
+	}
+	itemStatus := func(resp map[string]interface{}, i int, action string) float64 {
+		return resp["items"].([]interface{})[i].(map[string]interface{})[action].(map[string]interface{})["status"].(float64)
+	}
+	loadMsg := func() *library.FluentMsg {
+		select {
+		case msg := <-asyncOutChan:
+			return msg
+		default:
+			t.Fatal("can not load msg")
+		}
+		return nil
+	}
+
+	// version check
+	code, resp := request(http.MethodGet, "/es/", nil, "")
+	if code != http.StatusOK || resp["version"].(map[string]interface{})["number"] != defaultESBulkVersion {
+		t.Fatalf("got %d, %+v", code, resp)
+	}
+	code, resp = request(http.MethodGet, "/es/_license", nil, "")
+	if code != http.StatusOK || resp["license"].(map[string]interface{})["status"] != "active" {
+		t.Fatalf("got %d, %+v", code, resp)
+	}
+
+	// bulk with mixed results
+	code, resp = request(http.MethodPost, "/es/_bulk", []byte(`{"index": {"_index": "filebeat-app-2020.01.02"}}
+{"log": "a", "@timestamp": "2020-01-02T03:04:05Z"}
+{"create": {"_index": "nginx", "_id": "abc"}}
+{"log": "b"}
+{"delete": {"_index": "nginx", "_id": "abc"}}
+{"update": {"_index": "nginx", "_id": "abc"}}
+{"doc": {"log": "c"}}
+{"index": {"_index": "unknown"}}
+{"log": "d"}
+{"index": {"_index": "filebeat-2020.01.02"}}
+"not object"
+`), "")
+	if code != http.StatusOK || resp["errors"] != true || len(resp["items"].([]interface{})) != 6 ||
+		itemStatus(resp, 0, "index") != http.StatusCreated ||
+		itemStatus(resp, 1, "create") != http.StatusCreated ||
+		itemStatus(resp, 2, "delete") != http.StatusBadRequest ||
+		itemStatus(resp, 3, "update") != http.StatusBadRequest ||
+		itemStatus(resp, 4, "index") != http.StatusNotFound ||
+		itemStatus(resp, 5, "index") != http.StatusBadRequest {
+		t.Fatalf("got %d, %+v", code, resp)
+	}
+	if id := resp["items"].([]interface{})[1].(map[string]interface{})["create"].(map[string]interface{})["_id"]; id != "abc" {
+		t.Fatalf("got %v", id)
+	}
+	msg := loadMsg()
+	if msg.Tag != "app.sit" ||
+		msg.Message["tag"] != "app.sit" ||
+		msg.Message["index"] != "filebeat-app-2020.01.02" ||
+		!msg.Time.Equal(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Fatalf("got %+v, %v", msg.Message, msg.Time)
+	}
+	if msg = loadMsg(); msg.Tag != "nginx.sit" || msg.Message["log"] != "b" {
+		t.Fatalf("got %+v", msg.Message)
+	}
+
+	// gzip with index in path
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	gz.Write([]byte("{\"index\": {}}\n{\"log\": \"e\"}\n"))
+	gz.Close()
+	code, resp = request(http.MethodPost, "/es/filebeat-2020.01.03/_bulk", buf.Bytes(), "gzip")
+	if code != http.StatusOK || resp["errors"] != false || itemStatus(resp, 0, "index") != http.StatusCreated {
+		t.Fatalf("got %d, %+v", code, resp)
+	}
+	if msg = loadMsg(); msg.Tag != "filebeat.sit" || msg.Message["log"] != "e" {
+		t.Fatalf("got %+v", msg.Message)
+	}
+
+	// malformed
+	code, _ = request(http.MethodPost, "/es/_bulk", []byte("{\"index\": {}}\n"), "")
+	if code != http.StatusBadRequest {
+		t.Fatalf("got %d", code)
+	}
+	code, _ = request(http.MethodPost, "/es/_search", nil, "")
+	if code != http.StatusNotFound {
+		t.Fatalf("got %d", code)
+	}
+	select {
+	case msg := <-asyncOutChan:
+		t.Fatalf("should not got msg: %+v", msg.Message)
+	default:
+	}
+}
@@ -2,32 +2,40 @@ package recvs
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
+	"os"
 	"regexp"
 	"sync"
 	"time"
 
+	"gofluentd/internal/monitor"
 	"gofluentd/library"
 	"gofluentd/library/log"
 
 	utils "github.com/Laisky/go-utils"
 	"github.com/Laisky/zap"
 	"github.com/cespare/xxhash"
+	"github.com/pkg/errors"
 	"github.com/tinylib/msgp/msgp"
 )
 
 const (
 	defaultConcatorWait          = 3 * time.Second
 	defaultConcatorCleanInterval = 1 * time.Minute
+	defaultFluentdAckTimeout     = 30 * time.Second
+	defaultFluentdMaxChunkSize   = 64 * 1024 * 1024
+	fluentdHandshakeTimeout      = 10 * time.Second
 )
 
 // FluentdRecvCfg configuration of FluentdRecv
 type FluentdRecvCfg struct {
 	Name,
-	// Addr: like `127.0.0.1:24225;`
+	// Addr: like `127.0.0.1:24225`, will be appended to Addrs if not empty
 	Addr,
 	// TagKey: set `msg.Message[TagKey] = tag`
 	TagKey,
@@ -45,6 +53,30 @@ type FluentdRecvCfg struct {
 
 	ConcatMaxLen int
 	ConcatCfg    map[string]interface{}
+
+	// AckTimeout: if client require ack by option `chunk`,
+	// wait at most AckTimeout for msgs to be persisted by journal,
+	// will not reply ack if timeout, client should resend the chunk.
+	AckTimeout time.Duration
+	// MaxChunkSize: max size of CompressedPackedForward chunk after decompression
+	MaxChunkSize int64
+
+	// Security enable forward protocol handshake if SharedKey is set
+	Security *library.ForwardSecurityCfg
+	// TLS enable tls on tcp listeners if Enable is set
+	TLS *library.TLSCfg
+
+	// Addrs: listen addresses like `0.0.0.0:24225`, `tcp://0.0.0.0:24225`
+	// or `unix:///var/run/gofluentd/fluentd.sock`
+	Addrs []string
+	// UnixSocketMode: file mode of unix sockets, default to 0660
+	UnixSocketMode os.FileMode
+	// UnixSocketOwner & UnixSocketGroup: optional, name or id of the owner of unix sockets
+	UnixSocketOwner, UnixSocketGroup string
+	// IsReusePort set SO_REUSEPORT on tcp listeners,
+	// NAcceptors listeners with their own accept loop will share each tcp addr.
+	IsReusePort bool
+	NAcceptors  int
 }
 
 type concatCfg struct {
@@ -62,6 +94,20 @@ type FluentdRecv struct {
 	concatTagCfg   map[string]*concatCfg
 	pendingMsgPool *sync.Pool
 	concators      []chan *library.FluentMsg
+
+	// compressedBytesCounter & decompressedBytesCounter count the size of
+	// CompressedPackedForward chunks before & after decompression,
+	// rawBytesCounter count the size of uncompressed PackedForward chunks.
+	compressedBytesCounter,
+	decompressedBytesCounter,
+	rawBytesCounter *utils.Counter
+	// authFailedCounter count connections failed in handshake
+	authFailedCounter *utils.Counter
+
+	tlsConfig *tls.Config
+
+	listeners        []*fluentdListener
+	unixUID, unixGID int
 }
 
 // PendingMsg is the message wait tobe concatenate
@@ -81,11 +127,22 @@ func NewFluentdRecv(cfg *FluentdRecvCfg) (r *FluentdRecv) {
 				return &PendingMsg{}
 			},
 		},
-		concatTagCfg: map[string]*concatCfg{},
+		concatTagCfg:             map[string]*concatCfg{},
+		compressedBytesCounter:   utils.NewCounter(),
+		decompressedBytesCounter: utils.NewCounter(),
+		rawBytesCounter:          utils.NewCounter(),
+		authFailedCounter:        utils.NewCounter(),
 	}
 	if err := r.valid(); err != nil {
 		log.Logger.Panic("config invalid", zap.Error(err))
 	}
+	if r.TLS != nil && r.TLS.Enable {
+		var err error
+		if r.tlsConfig, err = library.NewServerTLSConfig(r.TLS); err != nil {
+			log.Logger.Panic("load tls config", zap.Error(err))
+		}
+	}
+	r.registerMonitor()
 
 	tags := []string{}
 	for tag, cfgi := range cfg.ConcatCfg {
@@ -101,11 +158,16 @@ func NewFluentdRecv(cfg *FluentdRecvCfg) (r *FluentdRecv) {
 	r.logger.Info("create fluentd recv",
 		zap.String("lb_key", r.LBKey),
 		zap.String("tag_key", r.TagKey),
-		zap.String("addr", r.Addr),
+		zap.Strings("addrs", r.Addrs),
+		zap.Bool("is_reuse_port", r.IsReusePort),
+		zap.Int("n_acceptors", r.NAcceptors),
 		zap.Strings("tags", tags),
 		zap.Int("n_fork", r.NFork),
 		zap.Bool("is_rewrite_tag_from_tag_key", r.IsRewriteTagFromTagKey),
 		zap.String("origin_rewrite_tag_key", r.OriginRewriteTagKey),
+		zap.Duration("ack_timeout", r.AckTimeout),
+		zap.Bool("is_secure", r.Security.IsEnabled()),
+		zap.Bool("is_tls", r.tlsConfig != nil),
 	)
 	return r
 }
@@ -150,60 +212,92 @@ func (r *FluentdRecv) valid() error {
 		log.Logger.Info("reset lb_key", zap.String("lb_key", r.LBKey))
 	}
 
-	if r.Addr == "" {
+	if r.Addr != "" {
+		r.Addrs = append(r.Addrs, r.Addr)
+	} else if len(r.Addrs) == 0 {
 		r.Addr = "0.0.0.0:24225"
+		r.Addrs = []string{r.Addr}
 		log.Logger.Info("reset addr", zap.String("addr", r.Addr))
 	}
+	if r.IsReusePort && !isReusePortSupported {
+		return errors.New("SO_REUSEPORT is not supported on this platform")
+	}
+	if r.NAcceptors <= 0 {
+		r.NAcceptors = 1
+		log.Logger.Info("reset n_acceptors", zap.Int("n_acceptors", r.NAcceptors))
+	} else if r.NAcceptors > 1 && !r.IsReusePort {
+		return errors.New("is_reuse_port should be enabled if n_acceptors > 1")
+	}
+	if r.UnixSocketMode == 0 {
+		r.UnixSocketMode = defaultFluentdUnixSocketMode
+		log.Logger.Info("reset unix_socket_mode", zap.String("unix_socket_mode", r.UnixSocketMode.String()))
+	}
+	var err error
+	if r.unixUID, err = lookupUnixSocketUID(r.UnixSocketOwner); err != nil {
+		return errors.Wrap(err, "load unix_socket_owner")
+	}
+	if r.unixGID, err = lookupUnixSocketGID(r.UnixSocketGroup); err != nil {
+		return errors.Wrap(err, "load unix_socket_group")
+	}
+	if r.listeners, err = newFluentdListeners(r.Addrs, r.NAcceptors); err != nil {
+		return errors.Wrap(err, "load addrs")
+	}
+
+	if r.AckTimeout <= 0 {
+		r.AckTimeout = defaultFluentdAckTimeout
+		log.Logger.Info("reset ack_timeout_sec", zap.Duration("ack_timeout_sec", r.AckTimeout))
+	}
+
+	if r.MaxChunkSize <= 0 {
+		r.MaxChunkSize = defaultFluentdMaxChunkSize
+		log.Logger.Info("reset max_chunk_byte", zap.Int64("max_chunk_byte", r.MaxChunkSize))
+	}
+
+	if r.Security.IsEnabled() && r.Security.SelfHostname == "" {
+		if r.Security.SelfHostname, err = os.Hostname(); err != nil {
+			return errors.Wrap(err, "load hostname")
+		}
+		log.Logger.Info("reset self_hostname", zap.String("self_hostname", r.Security.SelfHostname))
+	}
 
 	return nil
 }
 
+func (r *FluentdRecv) registerMonitor() {
+	monitor.AddMetric("fluentdrecv."+r.Name, func() map[string]interface{} {
+		return map[string]interface{}{
+			"compressedBytesTotal":    r.compressedBytesCounter.Get(),
+			"compressedBytesPerSec":   r.compressedBytesCounter.GetSpeed(),
+			"decompressedBytesTotal":  r.decompressedBytesCounter.Get(),
+			"decompressedBytesPerSec": r.decompressedBytesCounter.GetSpeed(),
+			"rawBytesTotal":           r.rawBytesCounter.Get(),
+			"rawBytesPerSec":          r.rawBytesCounter.GetSpeed(),
+			"authFailedTotal":         r.authFailedCounter.Get(),
+			"listeners":               r.listenerMetrics(),
+		}
+	})
+}
+
 // GetName return the name of this recv
 func (r *FluentdRecv) GetName() string {
 	return r.Name
 }
 
-// Run starting this recv
+// Run starting this recv, block until ctx done
 func (r *FluentdRecv) Run(ctx context.Context) {
 	r.logger.Info("run FluentdRecv")
 	defer r.logger.Info("fluentd recv exist")
 	r.concators = r.startConcators(ctx)
-	var conn net.Conn
-LISTENER_LOOP:
-	for {
-		select {
-		case <-ctx.Done():
-			break LISTENER_LOOP
-		default:
-		}
-
-		r.logger.Info("listening on tcp...", zap.String("addr", r.Addr))
-		ln, err := net.Listen("tcp", r.Addr)
-		if err != nil {
-			r.logger.Error("try to bind addr got error", zap.Error(err))
-		}
 
-	ACCEPT_LOOP:
-		for {
-			select {
-			case <-ctx.Done():
-				break ACCEPT_LOOP
-			default:
-			}
-
-			conn, err = ln.Accept()
-			if err != nil {
-				r.logger.Error("try to accept connection got error", zap.Error(err))
-				break ACCEPT_LOOP
-			}
-
-			r.logger.Info("accept new connection", zap.String("remote", conn.RemoteAddr().String()))
-			go r.decodeMsg(ctx, conn)
-		}
-
-		r.logger.Info("close listener", zap.String("addr", r.Addr))
-		ln.Close()
+	var wg sync.WaitGroup
+	for _, l := range r.listeners {
+		wg.Add(1)
+		go func(l *fluentdListener) {
+			defer wg.Done()
+			r.runListener(ctx, l)
+		}(l)
 	}
+	wg.Wait()
 }
 
 func (r *FluentdRecv) decodeMsg(ctx context.Context, conn net.Conn) {
@@ -220,15 +314,33 @@ func (r *FluentdRecv) decodeMsg(ctx context.Context, conn net.Conn) {
 		tag     string
 		ok      bool
 		entryI  interface{}
+		entry   []interface{}
 		eof     = msgp.WrapError(io.EOF)
+		acker   *fluentdChunkAcker
+		// connLock protect conn from concurrent ack writing
+		connLock = &sync.Mutex{}
+		// gzReader & gzBuf for CompressedPackedForward
+		gzReader *gzip.Reader
+		gzBuf    = &bytes.Buffer{}
 
 		msgCnt, totalMsgCnt int
 	)
 	defer r.logger.Info("close connection",
 		zap.String("remote", conn.RemoteAddr().String()))
 
+	if r.Security.IsEnabled() {
+		if err = r.handshake(conn, reader); err != nil {
+			r.authFailedCounter.Count()
+			r.logger.Warn("close connection since handshake failed",
+				zap.Error(err),
+				zap.String("remote", conn.RemoteAddr().String()))
+			return
+		}
+	}
+
 	for {
 		msgCnt = 0
+		acker = nil
 		select {
 		case <-ctx.Done():
 			return
@@ -263,22 +375,51 @@ func (r *FluentdRecv) decodeMsg(ctx context.Context, conn net.Conn) {
 
 		switch msgBody := v[1].(type) {
 		case []interface{}:
+			if len(v) > 2 {
+				acker = newFluentdChunkAcker(v[2])
+			}
+
 			for _, entryI = range msgBody {
+				if entry, ok = entryI.([]interface{}); !ok || len(entry) < 2 {
+					r.logger.Warn("discard msg since unknown message format, entry should be [time, record]",
+						zap.String("tag", tag))
+					continue
+				}
+
 				msg = r.msgPool.Get().(*library.FluentMsg)
-				if msg.Message, ok = entryI.([]interface{})[1].(map[string]interface{}); !ok {
+				if msg.Message, ok = entry[1].(map[string]interface{}); !ok {
 					r.logger.Warn("discard msg since unknown message format, cannot decode",
 						zap.String("tag", tag))
 					r.msgPool.Put(msg)
 					continue
 				}
-				// []interface{})[0] is
-				// "laisky.cloud.kube.sit.aitimer-7b6b654d8-7hpsw_ai_aitimer-f25c8bfea7b30ed7ba7c600cdb75e6aa7326ba4b67139e3338bf873bd5036921"
+				msg.Time = r.parseTime(entry[0])
 				msg.Tag = tag
+				acker.attach(msg)
 				msgCnt++
 				r.ProcessMsg(msg)
 			}
 			r.logger.Debug("got message in format: `[]interface{}`", zap.Int("n", msgCnt))
 		case []byte: // embedded format
+			if len(v) > 2 {
+				acker = newFluentdChunkAcker(v[2])
+				if isFluentdChunkGzipped(v[2]) {
+					r.compressedBytesCounter.CountN(int64(len(msgBody)))
+					if gzReader, err = gunzipFluentdChunk(gzReader, gzBuf, msgBody, r.MaxChunkSize); err != nil {
+						r.logger.Warn("discard msg since cannot decompress chunk",
+							zap.Error(err),
+							zap.String("tag", tag))
+						continue
+					}
+					msgBody = gzBuf.Bytes()
+					r.decompressedBytesCounter.CountN(int64(len(msgBody)))
+				} else {
+					r.rawBytesCounter.CountN(int64(len(msgBody)))
+				}
+			} else {
+				r.rawBytesCounter.CountN(int64(len(msgBody)))
+			}
+
 			if buf2 == nil {
 				buf2 = bytes.NewReader(msgBody)
 			} else {
@@ -295,8 +436,9 @@ func (r *FluentdRecv) decodeMsg(ctx context.Context, conn net.Conn) {
 				if err = v2.DecodeMsg(reader2); err == eof {
 					break
 				} else if err != nil {
-					r.logger.Warn("discard msg since unknown message format, cannot decode")
-					continue
+					// the rest of entries cannot be located
+					r.logger.Warn("discard msg since unknown message format, cannot decode", zap.Error(err))
+					break
 				} else if len(v2) < 2 {
 					r.logger.Warn("discard msg since unknown message format, length should be 2",
 						zap.String("msg", fmt.Sprint(v2)))
@@ -309,7 +451,9 @@ func (r *FluentdRecv) decodeMsg(ctx context.Context, conn net.Conn) {
 						r.msgPool.Put(msg)
 						continue
 					}
+					msg.Time = r.parseTime(v2[0])
 					msg.Tag = tag
+					acker.attach(msg)
 					r.ProcessMsg(msg)
 					msgCnt++
 				}
@@ -330,17 +474,170 @@ func (r *FluentdRecv) decodeMsg(ctx context.Context, conn net.Conn) {
 				r.logger.Warn("discard msg since unknown msg format", zap.String("msg", fmt.Sprint(v)))
 				continue
 			}
+			if len(v) > 3 {
+				acker = newFluentdChunkAcker(v[3])
+			}
+
+			msg.Time = r.parseTime(v[1])
 			msg.Tag = tag
+			acker.attach(msg)
 			r.ProcessMsg(msg)
 			msgCnt++
 			r.logger.Debug("got message in format: default", zap.Int("n", msgCnt))
 		}
 
+		if acker != nil {
+			go r.replyAck(ctx, conn, connLock, acker)
+		}
+
 		totalMsgCnt += msgCnt
 		log.Logger.Debug("msg stats", zap.Int("total", totalMsgCnt))
 	}
 }
 
+// handshake authenticate client by shared_key and username/password
+func (r *FluentdRecv) handshake(conn net.Conn, reader *msgp.Reader) (err error) {
+	if err = conn.SetDeadline(time.Now().Add(fluentdHandshakeTimeout)); err != nil {
+		return errors.Wrap(err, "set deadline")
+	}
+	if err = library.ForwardServerHandshake(conn, reader, r.Security); err != nil {
+		return err
+	}
+
+	r.logger.Debug("handshake succeed", zap.String("remote", conn.RemoteAddr().String()))
+	return conn.SetDeadline(time.Time{})
+}
+
+// parseTime load event time from entry,
+// return zero time if ts is in unknown format.
+func (r *FluentdRecv) parseTime(ts interface{}) time.Time {
+	t, ok := library.ParseFluentTime(ts)
+	if !ok {
+		r.logger.Debug("unknown format of event time", zap.String("time", fmt.Sprint(ts)))
+	}
+
+	return t
+}
+
+// isFluentdChunkGzipped check whether option contains `compressed: "gzip"`
+func isFluentdChunkGzipped(optI interface{}) bool {
+	opt, ok := optI.(map[string]interface{})
+	if !ok {
+		return false
+	}
+
+	switch compressed := opt["compressed"].(type) {
+	case string:
+		return compressed == "gzip"
+	case []byte:
+		return string(compressed) == "gzip"
+	}
+
+	return false
+}
+
+// gunzipFluentdChunk decompress CompressedPackedForward entries into buf,
+// entries may consist of concatenated gzip members.
+// gzReader can be nil, will return the reader can be reused.
+// return error if the decompressed entries is larger than maxSize.
+func gunzipFluentdChunk(gzReader *gzip.Reader, buf *bytes.Buffer, data []byte, maxSize int64) (*gzip.Reader, error) {
+	var err error
+	buf.Reset()
+	if gzReader == nil {
+		if gzReader, err = gzip.NewReader(bytes.NewReader(data)); err != nil {
+			return nil, errors.Wrap(err, "new gzip reader")
+		}
+	} else if err = gzReader.Reset(bytes.NewReader(data)); err != nil {
+		return gzReader, errors.Wrap(err, "reset gzip reader")
+	}
+
+	// multistream mode is enabled by default
+	if _, err = buf.ReadFrom(io.LimitReader(gzReader, maxSize+1)); err != nil {
+		return gzReader, errors.Wrap(err, "decompress")
+	}
+	if int64(buf.Len()) > maxSize {
+		return gzReader, errors.Errorf("decompressed chunk size must less than %d bytes", maxSize)
+	}
+
+	return gzReader, gzReader.Close()
+}
+
+// fluentdChunkAcker counts the msgs in one forward chunk,
+// `{"ack": <chunk>}` will be replied after all msgs have been acked.
+type fluentdChunkAcker struct {
+	*library.CountAcker
+	chunk string
+}
+
+// newFluentdChunkAcker load `chunk` from forward protocol option,
+// return nil if client do not require ack
+func newFluentdChunkAcker(optI interface{}) *fluentdChunkAcker {
+	opt, ok := optI.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	a := &fluentdChunkAcker{}
+	switch chunk := opt["chunk"].(type) {
+	case string:
+		a.chunk = chunk
+	case []byte:
+		a.chunk = string(chunk)
+	default:
+		return nil
+	}
+
+	if a.chunk == "" {
+		return nil
+	}
+
+	// hold by decoder until all msgs in chunk attached
+	a.CountAcker = library.NewCountAcker()
+	return a
+}
+
+// attach bind acker to msg, clean ackers of msg if client do not require ack
+func (a *fluentdChunkAcker) attach(msg *library.FluentMsg) {
+	if a == nil {
+		msg.Ackers = nil
+		return
+	}
+
+	a.Attach(msg)
+}
+
+// replyAck write `{"ack": <chunk>}` back to client after all msgs in chunk persisted
+func (r *FluentdRecv) replyAck(ctx context.Context, conn net.Conn, connLock *sync.Mutex, acker *fluentdChunkAcker) {
+	acker.Ack() // release the hold by decoder
+	logger := r.logger.With(
+		zap.String("chunk", acker.chunk),
+		zap.String("remote", conn.RemoteAddr().String()),
+	)
+
+	timer := time.NewTimer(r.AckTimeout)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return
+	case <-timer.C:
+		logger.Warn("do not ack chunk since of timeout", zap.Duration("timeout", r.AckTimeout))
+		return
+	case <-acker.Done():
+	}
+
+	resp := msgp.AppendMapHeader(nil, 1)
+	resp = msgp.AppendString(resp, "ack")
+	resp = msgp.AppendString(resp, acker.chunk)
+
+	connLock.Lock()
+	defer connLock.Unlock()
+	if _, err := conn.Write(resp); err != nil {
+		logger.Error("reply ack", zap.Error(err))
+		return
+	}
+	logger.Debug("reply ack")
+}
+
 // ProcessMsg process msg
 func (r *FluentdRecv) ProcessMsg(msg *library.FluentMsg) {
 	if r.IsRewriteTagFromTagKey { // rewrite msg.Tag by msg.Message[OriginRewriteTagKey]
@@ -353,6 +650,7 @@ func (r *FluentdRecv) ProcessMsg(msg *library.FluentMsg) {
 			r.logger.Warn("discard msg since unknown type of tag key",
 				zap.String("tag", fmt.Sprint(tag)),
 				zap.String("tag_key", r.OriginRewriteTagKey))
+			msg.Ack() // resend will not help
 			r.msgPool.Put(msg)
 			return
 		}
@@ -523,6 +821,9 @@ NEW_MSG_LOOP:
 		pmsg.msg.Message[cfg.msgKey] =
 			append(pmsg.msg.Message[cfg.msgKey].([]byte), msg.Message[cfg.msgKey].([]byte)...)
 		pmsg.lastT = utils.Clock.GetUTCNow()
+		// concated msg will be acked with the head msg
+		pmsg.msg.Ackers = append(pmsg.msg.Ackers, msg.Ackers...)
+		msg.Ackers = nil
 		r.msgPool.Put(msg) // discard concated msg
 
 		// too long to send
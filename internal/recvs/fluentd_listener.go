@@ -0,0 +1,237 @@
+package recvs
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	utils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultFluentdUnixSocketMode os.FileMode = 0660
+	fluentdMinBindBackoff                    = 1 * time.Second
+	fluentdMaxBindBackoff                    = 1 * time.Minute
+)
+
+// fluentdListener one accept loop of FluentdRecv
+type fluentdListener struct {
+	// name: listen address, with `#<i>` suffix if multiple accept loops share the addr
+	name, network, addr string
+
+	isListening int32
+	activeConns int64
+	acceptedCnt,
+	acceptErrCnt,
+	bindErrCnt *utils.Counter
+}
+
+// parseFluentdListenAddr parse `host:port`, `tcp://host:port` or `unix:///path`
+func parseFluentdListenAddr(addr string) (network, address string, err error) {
+	switch {
+	case strings.HasPrefix(addr, "unix://"):
+		network, address = "unix", strings.TrimPrefix(addr, "unix://")
+	case strings.HasPrefix(addr, "tcp://"):
+		network, address = "tcp", strings.TrimPrefix(addr, "tcp://")
+	case strings.Contains(addr, "://"):
+		return "", "", errors.Errorf("unknown network of addr `%s`", addr)
+	default:
+		network, address = "tcp", addr
+	}
+
+	if address == "" {
+		return "", "", errors.Errorf("invalid addr `%s`", addr)
+	}
+	return network, address, nil
+}
+
+// newFluentdListeners create nAcceptors listeners for each tcp addr, one listener for each unix addr
+func newFluentdListeners(addrs []string, nAcceptors int) (listeners []*fluentdListener, err error) {
+	names := map[string]bool{}
+	for _, addr := range addrs {
+		network, address, err := parseFluentdListenAddr(addr)
+		if err != nil {
+			return nil, err
+		}
+		if names[addr] {
+			return nil, errors.Errorf("duplicated addr `%s`", addr)
+		}
+		names[addr] = true
+
+		n := 1
+		if network == "tcp" {
+			n = nAcceptors
+		}
+		for i := 0; i < n; i++ {
+			l := &fluentdListener{
+				name:         addr,
+				network:      network,
+				addr:         address,
+				acceptedCnt:  utils.NewCounter(),
+				acceptErrCnt: utils.NewCounter(),
+				bindErrCnt:   utils.NewCounter(),
+			}
+			if n > 1 {
+				l.name += "#" + strconv.Itoa(i)
+			}
+			listeners = append(listeners, l)
+		}
+	}
+
+	return listeners, nil
+}
+
+// lookupUnixSocketUID load uid by user name or id, return -1 if name is empty
+func lookupUnixSocketUID(name string) (int, error) {
+	if name == "" {
+		return -1, nil
+	}
+	if uid, err := strconv.Atoi(name); err == nil {
+		return uid, nil
+	}
+
+	u, err := user.Lookup(name)
+	if err != nil {
+		return -1, errors.Wrapf(err, "lookup user `%s`", name)
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+// lookupUnixSocketGID load gid by group name or id, return -1 if name is empty
+func lookupUnixSocketGID(name string) (int, error) {
+	if name == "" {
+		return -1, nil
+	}
+	if gid, err := strconv.Atoi(name); err == nil {
+		return gid, nil
+	}
+
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return -1, errors.Wrapf(err, "lookup group `%s`", name)
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// listenerMetrics return metrics of each listener
+func (r *FluentdRecv) listenerMetrics() map[string]interface{} {
+	metrics := make(map[string]interface{}, len(r.listeners))
+	for _, l := range r.listeners {
+		metrics[l.name] = map[string]interface{}{
+			"isListening":    atomic.LoadInt32(&l.isListening) == 1,
+			"activeConns":    atomic.LoadInt64(&l.activeConns),
+			"acceptedTotal":  l.acceptedCnt.Get(),
+			"acceptErrTotal": l.acceptErrCnt.Get(),
+			"bindErrTotal":   l.bindErrCnt.Get(),
+		}
+	}
+	return metrics
+}
+
+// listen bind addr of listener, set mode & ownership if it's unix socket
+func (r *FluentdRecv) listen(ctx context.Context, l *fluentdListener) (ln net.Listener, err error) {
+	lc := &net.ListenConfig{}
+	switch l.network {
+	case "tcp":
+		if r.IsReusePort {
+			lc.Control = reusePortControl
+		}
+	case "unix":
+		// remove socket file left by last run
+		if fi, err := os.Lstat(l.addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			if err = os.Remove(l.addr); err != nil {
+				return nil, errors.Wrap(err, "remove stale socket file")
+			}
+		}
+	}
+
+	if ln, err = lc.Listen(ctx, l.network, l.addr); err != nil {
+		return nil, err
+	}
+
+	if l.network == "unix" {
+		if err = os.Chmod(l.addr, r.UnixSocketMode); err != nil {
+			ln.Close()
+			return nil, errors.Wrap(err, "chmod socket file")
+		}
+		if r.unixUID != -1 || r.unixGID != -1 {
+			if err = os.Chown(l.addr, r.unixUID, r.unixGID); err != nil {
+				ln.Close()
+				return nil, errors.Wrap(err, "chown socket file")
+			}
+		}
+	} else if r.tlsConfig != nil {
+		ln = tls.NewListener(ln, r.tlsConfig)
+	}
+
+	return ln, nil
+}
+
+// runListener bind & accept connections until ctx done,
+// retry with exponential backoff if bind failed.
+func (r *FluentdRecv) runListener(ctx context.Context, l *fluentdListener) {
+	logger := r.logger.With(zap.String("listener", l.name))
+	defer logger.Info("listener exit")
+	backoff := fluentdMinBindBackoff
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		ln, err := r.listen(ctx, l)
+		if err != nil {
+			l.bindErrCnt.Count()
+			logger.Error("try to bind addr got error", zap.Error(err), zap.Duration("backoff", backoff))
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > fluentdMaxBindBackoff {
+				backoff = fluentdMaxBindBackoff
+			}
+			continue
+		}
+		backoff = fluentdMinBindBackoff
+		atomic.StoreInt32(&l.isListening, 1)
+		logger.Info("listening...", zap.String("network", l.network), zap.String("addr", l.addr))
+
+		ctx2Ln, cancel := context.WithCancel(ctx)
+		go func() {
+			<-ctx2Ln.Done()
+			ln.Close()
+		}()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if ctx.Err() == nil {
+					l.acceptErrCnt.Count()
+					logger.Error("try to accept connection got error", zap.Error(err))
+				}
+				break
+			}
+
+			l.acceptedCnt.Count()
+			logger.Info("accept new connection", zap.String("remote", conn.RemoteAddr().String()))
+			go func(conn net.Conn) {
+				atomic.AddInt64(&l.activeConns, 1)
+				defer atomic.AddInt64(&l.activeConns, -1)
+				r.decodeMsg(ctx, conn)
+			}(conn)
+		}
+
+		atomic.StoreInt32(&l.isListening, 0)
+		cancel()
+		logger.Info("close listener")
+	}
+}
@@ -0,0 +1,24 @@
+//go:build !windows
+// +build !windows
+
+package recvs
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const isReusePortSupported = true
+
+// reusePortControl set SO_REUSEPORT before bind
+func reusePortControl(network, address string, c syscall.RawConn) (err error) {
+	if ctrlErr := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	}); ctrlErr != nil {
+		return ctrlErr
+	}
+
+	return errors.Wrap(err, "set SO_REUSEPORT")
+}
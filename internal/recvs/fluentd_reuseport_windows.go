@@ -0,0 +1,14 @@
+package recvs
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+const isReusePortSupported = false
+
+// reusePortControl SO_REUSEPORT is not supported on windows
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return errors.New("SO_REUSEPORT is not supported on windows")
+}
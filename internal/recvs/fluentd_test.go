@@ -1,9 +1,13 @@
 package recvs
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"math/rand"
 	"net"
+	"os"
+	"path/filepath"
 	"runtime"
 	"testing"
 	"time"
@@ -12,6 +16,7 @@ import (
 
 	"github.com/Laisky/go-utils"
 	"github.com/cespare/xxhash"
+	"github.com/tinylib/msgp/msgp"
 )
 
 func TestFluentdRecv(t *testing.T) {
@@ -120,6 +125,395 @@ func TestFluentdRecv(t *testing.T) {
 
 }
 
+func TestFluentdRecvAck(t *testing.T) {
+	var (
+		ctx, cancel  = context.WithCancel(context.Background())
+		err          error
+		syncOutChan  = make(chan *library.FluentMsg, 1000)
+		asyncOutChan = make(chan *library.FluentMsg, 1000)
+		tag          = "test.sit"
+		chunk        = "p8n9gmxTQVC8/nh2wlKKeQ=="
+		eventTime    = time.Date(2020, 1, 2, 3, 4, 5, 123456789, time.UTC)
+	)
+	defer cancel()
+
+	cfg := &FluentdRecvCfg{
+		Name:       "fluentd-ack-test",
+		Addr:       "127.0.0.1:24229",
+		TagKey:     "tag",
+		AckTimeout: 3 * time.Second,
+	}
+	recv := NewFluentdRecv(cfg)
+	recv.SetCounter(counter)
+	recv.SetMsgPool(msgPool)
+	recv.SetAsyncOutChan(asyncOutChan)
+	recv.SetSyncOutChan(syncOutChan)
+	go recv.Run(ctx)
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.DialTimeout("tcp", cfg.Addr, 1*time.Second)
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	defer conn.Close()
+
+	// forward mode: [tag, [[time, record], ...], {"chunk": chunk}]
+	w := msgp.NewWriter(conn)
+	if err = w.WriteIntf([]interface{}{
+		tag,
+		[]interface{}{
+			[]interface{}{0, map[string]interface{}{"a": "b", "container_id": "lbkey"}},
+			[]interface{}{&library.EventTime{Time: eventTime}, map[string]interface{}{"a": "c", "container_id": "lbkey"}},
+		},
+		map[string]interface{}{"chunk": chunk},
+	}); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	if err = w.Flush(); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+
+	var msgs []*library.FluentMsg
+	for len(msgs) < 2 {
+		select {
+		case msg := <-asyncOutChan:
+			msgs = append(msgs, msg)
+		case <-time.After(time.Second):
+			t.Fatalf("can not load msg")
+		}
+	}
+
+	for _, msg := range msgs {
+		switch msg.Message["a"] {
+		case "b":
+			if !msg.Time.IsZero() {
+				t.Fatalf("time should be unknown, got %v", msg.Time)
+			}
+		case "c":
+			if !msg.Time.Equal(eventTime) {
+				t.Fatalf("expect event time %v, got %v", eventTime, msg.Time)
+			}
+		}
+	}
+
+	// should not ack before all msgs persisted
+	msgs[0].Ack()
+	if err = conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond)); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	r := msgp.NewReader(conn)
+	if err = r.ReadMapStrIntf(map[string]interface{}{}); err == nil {
+		t.Fatal("should not ack before all msgs persisted")
+	}
+
+	msgs[1].Ack()
+	if err = conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	r = msgp.NewReader(conn)
+	resp := map[string]interface{}{}
+	if err = r.ReadMapStrIntf(resp); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	if resp["ack"] != chunk {
+		t.Fatalf("ack not correct, got %v", resp)
+	}
+}
+
+func TestFluentdRecvCompressedPackedForward(t *testing.T) {
+	var (
+		ctx, cancel  = context.WithCancel(context.Background())
+		err          error
+		syncOutChan  = make(chan *library.FluentMsg, 1000)
+		asyncOutChan = make(chan *library.FluentMsg, 1000)
+		tag          = "test.sit"
+	)
+	defer cancel()
+
+	cfg := &FluentdRecvCfg{
+		Name:   "fluentd-gzip-test",
+		Addr:   "127.0.0.1:24230",
+		TagKey: "tag",
+	}
+	recv := NewFluentdRecv(cfg)
+	recv.SetCounter(counter)
+	recv.SetMsgPool(msgPool)
+	recv.SetAsyncOutChan(asyncOutChan)
+	recv.SetSyncOutChan(syncOutChan)
+	go recv.Run(ctx)
+	time.Sleep(100 * time.Millisecond)
+
+	// entries compressed into two concatenated gzip members
+	entries := &bytes.Buffer{}
+	for _, val := range []string{"b", "c"} {
+		entry, err := msgp.AppendIntf(nil, []interface{}{0, map[string]interface{}{"a": val}})
+		if err != nil {
+			t.Fatalf("got error: %+v", err)
+		}
+
+		gz := gzip.NewWriter(entries)
+		if _, err = gz.Write(entry); err != nil {
+			t.Fatalf("got error: %+v", err)
+		}
+		if err = gz.Close(); err != nil {
+			t.Fatalf("got error: %+v", err)
+		}
+	}
+
+	conn, err := net.DialTimeout("tcp", cfg.Addr, 1*time.Second)
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	defer conn.Close()
+
+	w := msgp.NewWriter(conn)
+	if err = w.WriteIntf([]interface{}{
+		tag,
+		entries.Bytes(),
+		map[string]interface{}{"compressed": "gzip"},
+	}); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	if err = w.Flush(); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+
+	for _, expect := range []string{"b", "c"} {
+		select {
+		case msg := <-asyncOutChan:
+			if msg.Tag != tag {
+				t.Fatalf("tag not correct, got %v", msg.Tag)
+			}
+			if msg.Message["a"] != expect {
+				t.Fatalf("msg not correct, got %v", msg.Message)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("can not load msg")
+		}
+	}
+
+	if recv.compressedBytesCounter.Get() != int64(entries.Len()) {
+		t.Fatalf("compressed bytes not correct, got %v", recv.compressedBytesCounter.Get())
+	}
+	if recv.decompressedBytesCounter.Get() == 0 {
+		t.Fatal("decompressed bytes should not be 0")
+	}
+}
+
+func TestGunzipFluentdChunkLimit(t *testing.T) {
+	data := &bytes.Buffer{}
+	gz := gzip.NewWriter(data)
+	if _, err := gz.Write(bytes.Repeat([]byte("a"), 1000)); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+
+	buf := &bytes.Buffer{}
+	gzReader, err := gunzipFluentdChunk(nil, buf, data.Bytes(), 1000)
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	if buf.Len() != 1000 {
+		t.Fatalf("got %d", buf.Len())
+	}
+	if _, err = gunzipFluentdChunk(gzReader, buf, data.Bytes(), 999); err == nil {
+		t.Fatal("should got error")
+	}
+}
+
+func TestFluentdRecvSecureForward(t *testing.T) {
+	var (
+		ctx, cancel  = context.WithCancel(context.Background())
+		err          error
+		syncOutChan  = make(chan *library.FluentMsg, 1000)
+		asyncOutChan = make(chan *library.FluentMsg, 1000)
+	)
+	defer cancel()
+
+	cfg := &FluentdRecvCfg{
+		Name:   "fluentd-secure-test",
+		Addr:   "127.0.0.1:24231",
+		TagKey: "tag",
+		Security: &library.ForwardSecurityCfg{
+			SharedKey: "secret",
+			Users:     map[string]string{"user": "pwd"},
+		},
+	}
+	recv := NewFluentdRecv(cfg)
+	recv.SetCounter(counter)
+	recv.SetMsgPool(msgPool)
+	recv.SetAsyncOutChan(asyncOutChan)
+	recv.SetSyncOutChan(syncOutChan)
+	go recv.Run(ctx)
+	time.Sleep(100 * time.Millisecond)
+
+	// wrong password
+	conn, err := net.DialTimeout("tcp", cfg.Addr, 1*time.Second)
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	if err = library.ForwardClientHandshake(conn, msgp.NewReader(conn), &library.ForwardSecurityCfg{
+		SharedKey:    "secret",
+		SelfHostname: "test",
+		Username:     "user",
+		Password:     "wrong",
+	}); err == nil {
+		t.Fatal("should reject wrong password")
+	}
+	conn.Close()
+	time.Sleep(50 * time.Millisecond)
+	if recv.authFailedCounter.Get() != 1 {
+		t.Fatalf("expect 1 auth failed, got %d", recv.authFailedCounter.Get())
+	}
+
+	conn, err = net.DialTimeout("tcp", cfg.Addr, 1*time.Second)
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	defer conn.Close()
+	if err = library.ForwardClientHandshake(conn, msgp.NewReader(conn), &library.ForwardSecurityCfg{
+		SharedKey:    "secret",
+		SelfHostname: "test",
+		Username:     "user",
+		Password:     "pwd",
+	}); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+
+	encoder := library.NewFluentEncoder(conn)
+	if err = encoder.Encode(&library.FluentMsg{
+		Tag:     "test.sit",
+		Message: map[string]interface{}{"a": "b", "container_id": "lbkey"},
+	}); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	if err = encoder.Flush(); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+
+	select {
+	case msg := <-asyncOutChan:
+		if msg.Message["a"] != "b" {
+			t.Fatalf("got %+v", msg.Message)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("can not load msg")
+	}
+}
+
+func TestParseFluentdListenAddr(t *testing.T) {
+	for addr, expect := range map[string][2]string{
+		"127.0.0.1:24225":              {"tcp", "127.0.0.1:24225"},
+		"tcp://127.0.0.1:24225":        {"tcp", "127.0.0.1:24225"},
+		"unix:///var/run/fluentd.sock": {"unix", "/var/run/fluentd.sock"},
+	} {
+		network, address, err := parseFluentdListenAddr(addr)
+		if err != nil {
+			t.Fatalf("got error: %+v", err)
+		}
+		if network != expect[0] || address != expect[1] {
+			t.Fatalf("got %s, %s", network, address)
+		}
+	}
+	for _, addr := range []string{"udp://127.0.0.1:24225", "unix://"} {
+		if _, _, err := parseFluentdListenAddr(addr); err == nil {
+			t.Fatalf("should got error for %s", addr)
+		}
+	}
+}
+
+func TestFluentdRecvListeners(t *testing.T) {
+	var (
+		ctx, cancel  = context.WithCancel(context.Background())
+		asyncOutChan = make(chan *library.FluentMsg, 1000)
+		sock         = filepath.Join(t.TempDir(), "fluentd.sock")
+		tag          = "test.sit"
+	)
+	defer cancel()
+
+	// addr in use, recv should bind it after released
+	occupied, err := net.Listen("tcp", "127.0.0.1:24246")
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+
+	recv := NewFluentdRecv(&FluentdRecvCfg{
+		Name:           "fluentd-listeners-test",
+		Addrs:          []string{"tcp://127.0.0.1:24245", "127.0.0.1:24246", "unix://" + sock},
+		UnixSocketMode: 0600,
+		IsReusePort:    true,
+		NAcceptors:     2,
+	})
+	recv.SetCounter(counter)
+	recv.SetMsgPool(msgPool)
+	recv.SetAsyncOutChan(asyncOutChan)
+	go recv.Run(ctx)
+	time.Sleep(100 * time.Millisecond)
+
+	if fi, err := os.Stat(sock); err != nil {
+		t.Fatalf("got error: %+v", err)
+	} else if fi.Mode().Perm() != 0600 {
+		t.Fatalf("got %v", fi.Mode())
+	}
+	metrics := recv.listenerMetrics()
+	if len(metrics) != 5 {
+		t.Fatalf("got %+v", metrics)
+	}
+	if m := metrics["127.0.0.1:24246#0"].(map[string]interface{}); m["isListening"] != false || m["bindErrTotal"].(int64) == 0 {
+		t.Fatalf("got %+v", m)
+	}
+	occupied.Close()
+
+	send := func(network, addr string) {
+		var (
+			conn net.Conn
+			err  error
+		)
+		for i := 0; ; i++ {
+			if conn, err = net.DialTimeout(network, addr, time.Second); err == nil {
+				break
+			} else if i > 50 {
+				t.Fatalf("got error: %+v", err)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		defer conn.Close()
+		encoder := library.NewFluentEncoder(conn)
+		if err = encoder.Encode(&library.FluentMsg{Tag: tag, Message: map[string]interface{}{"addr": addr}}); err != nil {
+			t.Fatalf("got error: %+v", err)
+		}
+		if err = encoder.Flush(); err != nil {
+			t.Fatalf("got error: %+v", err)
+		}
+
+		select {
+		case msg := <-asyncOutChan:
+			if msg.Tag != tag || msg.Message["addr"] != addr {
+				t.Fatalf("got %+v", msg.Message)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("can not load msg")
+		}
+	}
+	for _, addr := range []string{"127.0.0.1:24245", "127.0.0.1:24245", "127.0.0.1:24246"} {
+		send("tcp", addr)
+	}
+	send("unix", sock)
+
+	var accepted int64
+	for _, name := range []string{"tcp://127.0.0.1:24245#0", "tcp://127.0.0.1:24245#1"} {
+		accepted += recv.listenerMetrics()[name].(map[string]interface{})["acceptedTotal"].(int64)
+	}
+	if accepted != 2 {
+		t.Fatalf("got %d", accepted)
+	}
+	if m := recv.listenerMetrics()["unix://"+sock].(map[string]interface{}); m["acceptedTotal"].(int64) != 1 {
+		t.Fatalf("got %+v", m)
+	}
+}
+
 func choice(s []string) string {
 	return s[rand.Intn(len(s))]
 }
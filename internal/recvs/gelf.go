@@ -0,0 +1,406 @@
+package recvs
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"strings"
+	"time"
+
+	"gofluentd/internal/monitor"
+	"gofluentd/library"
+	"gofluentd/library/log"
+
+	utils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultGELFMaxMessageSize = 1024 * 1024
+	gelfMaxUDPPacketSize      = 65536
+)
+
+/*GELFRecvCfg is the configuration for GELFRecv
+
+Args:
+	Addr: listen GELF over UDP, chunked & compressed payloads are supported
+	TCPAddr: listen GELF over TCP, each message ends with null byte
+	Tag: tag template like `gelf.%{app}.sit`, additional fields without `_` prefix can be used
+	FallbackTag: used if tag is invalid or too many tags
+	MaxTags: max number of distinct tags
+	TagKey: set tag into `msg.Message[TagKey]`
+	MsgKey: put `short_message` into `msg.Message[MsgKey]`
+	TimeKey: optional, set `timestamp` in RFC3339Nano into `msg.Message[TimeKey]`
+	ChunkTimeout: drop incomplete chunked message after timeout
+	MaxChunks: max number of chunks of one message
+	MaxPendingMsgs: max number of incomplete chunked messages, chunks of new messages will be dropped if exceeded
+	MaxMessageSize: max size of one message after decompression
+*/
+type GELFRecvCfg struct {
+	Name,
+	Addr, TCPAddr string
+	Tag, FallbackTag string
+	MaxTags          int
+	TagKey, MsgKey,
+	TimeKey string
+	ChunkTimeout   time.Duration
+	MaxChunks      int
+	MaxPendingMsgs int
+	MaxMessageSize int
+}
+
+// GELFRecv recv for Graylog Extended Log Format
+type GELFRecv struct {
+	*BaseRecv
+	*GELFRecvCfg
+
+	tagDeriver   *tagDeriver
+	assembler    *gelfChunkAssembler
+	invalidCnt   *utils.Counter
+	expiredCnt   *utils.Counter
+	overflowCnt  *utils.Counter
+	fallbackCnt  *utils.Counter
+	isDynamicTag bool
+}
+
+// NewGELFRecv create new GELFRecv
+func NewGELFRecv(cfg *GELFRecvCfg) *GELFRecv {
+	r := &GELFRecv{
+		BaseRecv:    &BaseRecv{},
+		GELFRecvCfg: cfg,
+		invalidCnt:  utils.NewCounter(),
+		expiredCnt:  utils.NewCounter(),
+		overflowCnt: utils.NewCounter(),
+		fallbackCnt: utils.NewCounter(),
+	}
+	if err := r.valid(); err != nil {
+		log.Logger.Panic("config invalid", zap.Error(err))
+	}
+
+	log.Logger.Info("create GELFRecv",
+		zap.String("name", r.Name),
+		zap.String("addr", r.Addr),
+		zap.String("tcp_addr", r.TCPAddr),
+		zap.String("tag", r.Tag))
+	return r
+}
+
+func (r *GELFRecv) valid() (err error) {
+	if r.Addr == "" && r.TCPAddr == "" {
+		return errors.New("one of addr and tcp_addr should be set")
+	}
+	if r.Tag == "" {
+		return errors.New("tag should not be empty")
+	}
+
+	if r.MsgKey == "" {
+		r.MsgKey = "message"
+		log.Logger.Info("reset msg_key", zap.String("msg_key", r.MsgKey))
+	}
+	if r.TagKey == "" {
+		r.TagKey = "tag"
+		log.Logger.Info("reset tag_key", zap.String("tag_key", r.TagKey))
+	}
+	if r.ChunkTimeout <= 0 {
+		r.ChunkTimeout = defaultGELFChunkTimeout
+		log.Logger.Info("reset chunk_timeout_sec", zap.Duration("chunk_timeout", r.ChunkTimeout))
+	}
+	if r.MaxChunks <= 0 {
+		r.MaxChunks = defaultGELFMaxChunks
+		log.Logger.Info("reset max_chunks", zap.Int("max_chunks", r.MaxChunks))
+	} else if r.MaxChunks > 255 { // sequence count is one byte
+		return errors.New("max_chunks should not greater than 255")
+	}
+	if r.MaxPendingMsgs <= 0 {
+		r.MaxPendingMsgs = defaultGELFMaxPending
+		log.Logger.Info("reset max_pending_msgs", zap.Int("max_pending_msgs", r.MaxPendingMsgs))
+	}
+	if r.MaxMessageSize <= 0 {
+		r.MaxMessageSize = defaultGELFMaxMessageSize
+		log.Logger.Info("reset max_message_byte", zap.Int("max_message_byte", r.MaxMessageSize))
+	}
+
+	if r.tagDeriver, err = newTagDeriver(r.Name, r.Tag, r.FallbackTag, r.MaxTags, nil); err != nil {
+		return errors.Wrap(err, "new tag deriver")
+	}
+	r.isDynamicTag = r.tagDeriver.isDynamic()
+	r.assembler = newGELFChunkAssembler(r.ChunkTimeout, r.MaxChunks, r.MaxMessageSize, r.MaxPendingMsgs)
+	return nil
+}
+
+// GetName get the name of recv
+func (r *GELFRecv) GetName() string {
+	return r.Name
+}
+
+// Run start udp & tcp listeners
+func (r *GELFRecv) Run(ctx context.Context) {
+	log.Logger.Info("run GELFRecv", zap.String("name", r.Name))
+	monitor.AddMetric("gelfrecv."+r.Name, func() map[string]interface{} {
+		return map[string]interface{}{
+			"invalidTotal":       r.invalidCnt.Get(),
+			"chunkExpiredTotal":  r.expiredCnt.Get(),
+			"chunkOverflowTotal": r.overflowCnt.Get(),
+			"fallbackTotal":      r.fallbackCnt.Get(),
+			"pendingChunkedMsgs": r.assembler.len(),
+			"derivedTagsTotal":   r.tagDeriver.nTags(),
+		}
+	})
+
+	if r.Addr != "" {
+		go r.runUDP(ctx)
+		go r.runChunkGC(ctx)
+	}
+	if r.TCPAddr != "" {
+		go r.runTCP(ctx)
+	}
+}
+
+// runChunkGC drop expired chunks periodically
+func (r *GELFRecv) runChunkGC(ctx context.Context) {
+	ticker := time.NewTicker(r.ChunkTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if n := r.assembler.gc(); n != 0 {
+			r.expiredCnt.CountN(int64(n))
+			log.Logger.Warn("drop incomplete chunked gelf messages", zap.String("name", r.Name), zap.Int("n", n))
+		}
+	}
+}
+
+func (r *GELFRecv) runUDP(ctx context.Context) {
+	defer log.Logger.Info("gelf udp server exit", zap.String("name", r.Name))
+	buf := make([]byte, gelfMaxUDPPacketSize)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		conn, err := net.ListenPacket("udp", r.Addr)
+		if err != nil {
+			log.Logger.Error("try to bind addr got error", zap.String("addr", r.Addr), zap.Error(err))
+			time.Sleep(defaultRetryWait)
+			continue
+		}
+		log.Logger.Info("listening gelf udp", zap.String("name", r.Name), zap.String("addr", r.Addr))
+
+		ctx2Conn, cancel := context.WithCancel(ctx)
+		go func() {
+			<-ctx2Conn.Done()
+			conn.Close()
+		}()
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Logger.Error("read gelf udp got error", zap.String("addr", r.Addr), zap.Error(err))
+				}
+				break
+			}
+
+			payload := buf[:n]
+			if isGELFChunk(payload) {
+				if payload, err = r.assembler.add(payload); err == errGELFTooManyPending {
+					r.overflowCnt.Count()
+					log.Logger.Debug("drop gelf chunk", zap.String("name", r.Name), zap.Error(err))
+					continue
+				} else if err != nil {
+					r.invalidCnt.Count()
+					log.Logger.Warn("invalid gelf chunk", zap.String("name", r.Name), zap.Error(err))
+					continue
+				}
+				if payload == nil { // waiting for other chunks
+					continue
+				}
+			}
+			r.processPayload(payload)
+		}
+		cancel()
+	}
+}
+
+func (r *GELFRecv) runTCP(ctx context.Context) {
+	defer log.Logger.Info("gelf tcp server exit", zap.String("name", r.Name))
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		ln, err := net.Listen("tcp", r.TCPAddr)
+		if err != nil {
+			log.Logger.Error("try to bind addr got error", zap.String("addr", r.TCPAddr), zap.Error(err))
+			time.Sleep(defaultRetryWait)
+			continue
+		}
+		log.Logger.Info("listening gelf tcp", zap.String("name", r.Name), zap.String("addr", r.TCPAddr))
+
+		ctx2Ln, cancel := context.WithCancel(ctx)
+		go func() {
+			<-ctx2Ln.Done()
+			ln.Close()
+		}()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Logger.Error("accept gelf tcp got error", zap.String("addr", r.TCPAddr), zap.Error(err))
+				}
+				break
+			}
+			go r.handleTCPConn(ctx2Ln, conn)
+		}
+		cancel()
+	}
+}
+
+// handleTCPConn read null byte delimited messages
+func (r *GELFRecv) handleTCPConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 4096), r.MaxMessageSize+1)
+	scanner.Split(splitGELFNullByte)
+	for scanner.Scan() {
+		if payload := bytes.TrimSpace(scanner.Bytes()); len(payload) != 0 {
+			r.processPayload(payload)
+		}
+	}
+	if err := scanner.Err(); err != nil && ctx.Err() == nil {
+		log.Logger.Warn("read gelf tcp connection", zap.String("name", r.Name), zap.String("remote", conn.RemoteAddr().String()), zap.Error(err))
+	}
+}
+
+// splitGELFNullByte implement bufio.SplitFunc, split data by `\x00`
+func splitGELFNullByte(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) != 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// processPayload decompress & parse payload, then put msg into outchan
+func (r *GELFRecv) processPayload(payload []byte) {
+	msg, err := r.parsePayload(payload)
+	if err != nil {
+		r.invalidCnt.Count()
+		log.Logger.Warn("invalid gelf message", zap.String("name", r.Name), zap.Error(err))
+		return
+	}
+
+	log.Logger.Debug("receive new msg", zap.String("tag", msg.Tag), zap.Int64("id", msg.ID))
+	r.asyncOutChan <- msg
+}
+
+func (r *GELFRecv) parsePayload(payload []byte) (msg *library.FluentMsg, err error) {
+	if payload, err = decompressGELF(payload, r.MaxMessageSize); err != nil {
+		return nil, err
+	}
+
+	data := map[string]interface{}{}
+	if err = json.Unmarshal(payload, &data); err != nil {
+		return nil, errors.Wrap(err, "unmarshal gelf json")
+	}
+	if _, ok := data["short_message"]; !ok {
+		return nil, errors.New("short_message should not be empty")
+	}
+
+	msg = r.msgPool.Get().(*library.FluentMsg)
+	msg.ID = r.counter.Count()
+	msg.Message = r.convertFields(data)
+	msg.Time = parseGELFTimestamp(data["timestamp"])
+	if r.TimeKey != "" {
+		msg.Message[r.TimeKey] = msg.Time.Format(time.RFC3339Nano)
+	}
+
+	msg.Tag = r.Tag
+	if r.isDynamicTag {
+		var isFallback bool
+		if msg.Tag, isFallback = r.tagDeriver.derive(msg); isFallback {
+			r.fallbackCnt.Count()
+		}
+	}
+	msg.Message[r.TagKey] = msg.Tag
+	return msg, nil
+}
+
+// convertFields map gelf fields into msg.Message:
+// `short_message` -> MsgKey, `_<key>` -> `<key>`,
+// `version` & `timestamp` are removed, others are kept.
+func (r *GELFRecv) convertFields(data map[string]interface{}) map[string]interface{} {
+	m := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		switch {
+		case k == "version" || k == "timestamp":
+		case k == "short_message":
+			m[r.MsgKey] = v
+		case strings.HasPrefix(k, "_") && len(k) > 1:
+			m[k[1:]] = v
+		default:
+			m[k] = v
+		}
+	}
+	return m
+}
+
+// parseGELFTimestamp parse seconds since epoch with optional decimal places,
+// return now if timestamp is missing.
+func parseGELFTimestamp(v interface{}) time.Time {
+	if ts, ok := v.(float64); ok && ts > 0 {
+		sec, frac := math.Modf(ts)
+		return time.Unix(int64(sec), int64(math.Round(frac*1e6))*int64(time.Microsecond)).UTC()
+	}
+	return utils.Clock.GetUTCNow()
+}
+
+// decompressGELF decompress zlib or gzip payload, uncompressed payload is returned directly
+func decompressGELF(payload []byte, maxSize int) (body []byte, err error) {
+	var reader io.ReadCloser
+	switch {
+	case len(payload) >= 2 && payload[0] == 0x1f && payload[1] == 0x8b:
+		if reader, err = gzip.NewReader(bytes.NewReader(payload)); err != nil {
+			return nil, errors.Wrap(err, "new gzip reader")
+		}
+	case len(payload) >= 1 && payload[0] == 0x78:
+		if reader, err = zlib.NewReader(bytes.NewReader(payload)); err != nil {
+			return nil, errors.Wrap(err, "new zlib reader")
+		}
+	default:
+		if len(payload) > maxSize {
+			return nil, errors.Errorf("message size must less than %d bytes", maxSize)
+		}
+		return payload, nil
+	}
+	defer reader.Close()
+
+	if body, err = ioutil.ReadAll(io.LimitReader(reader, int64(maxSize)+1)); err != nil {
+		return nil, errors.Wrap(err, "decompress payload")
+	}
+	if len(body) > maxSize {
+		return nil, errors.Errorf("message size must less than %d bytes", maxSize)
+	}
+	return body, nil
+}
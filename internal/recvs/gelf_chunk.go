@@ -0,0 +1,139 @@
+package recvs
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	gelfChunkHeaderLen = 12
+
+	defaultGELFChunkTimeout = 5 * time.Second
+	defaultGELFMaxChunks    = 128
+	defaultGELFMaxPending   = 1000
+)
+
+var (
+	// gelfChunkMagic the first 2 bytes of chunked GELF message
+	gelfChunkMagic = []byte{0x1e, 0x0f}
+	// errGELFTooManyPending chunk of new message is dropped since too many incomplete messages
+	errGELFTooManyPending = errors.New("too many incomplete chunked messages")
+)
+
+// gelfChunks chunks of one message
+type gelfChunks struct {
+	parts    [][]byte
+	nArrived int
+	size     int
+	firstAt  time.Time
+}
+
+// gelfChunkAssembler reassemble chunked GELF messages by message id,
+// incomplete messages will be dropped after timeout.
+type gelfChunkAssembler struct {
+	sync.Mutex
+	timeout time.Duration
+	maxChunks, maxSize,
+	// maxPending max number of incomplete messages
+	maxPending int
+	pending map[[8]byte]*gelfChunks
+}
+
+func newGELFChunkAssembler(timeout time.Duration, maxChunks, maxSize, maxPending int) *gelfChunkAssembler {
+	return &gelfChunkAssembler{
+		timeout:    timeout,
+		maxChunks:  maxChunks,
+		maxSize:    maxSize,
+		maxPending: maxPending,
+		pending:    map[[8]byte]*gelfChunks{},
+	}
+}
+
+// isGELFChunk whether packet is one chunk of GELF message
+func isGELFChunk(packet []byte) bool {
+	return bytes.HasPrefix(packet, gelfChunkMagic)
+}
+
+// add put chunk into assembler,
+// return the whole payload if all chunks of message arrived, otherwise return nil.
+// return errGELFTooManyPending if chunk belongs to new message and there are too many incomplete messages.
+func (a *gelfChunkAssembler) add(packet []byte) (payload []byte, err error) {
+	if len(packet) <= gelfChunkHeaderLen {
+		return nil, errors.New("chunk too short")
+	}
+	var (
+		id    [8]byte
+		seq   = int(packet[10])
+		count = int(packet[11])
+	)
+	copy(id[:], packet[2:10])
+	if count == 0 || count > a.maxChunks {
+		return nil, errors.Errorf("sequence count %d exceeds max chunks %d", count, a.maxChunks)
+	}
+	if seq >= count {
+		return nil, errors.Errorf("sequence number %d should less than sequence count %d", seq, count)
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	cs, ok := a.pending[id]
+	if !ok {
+		if len(a.pending) >= a.maxPending {
+			return nil, errGELFTooManyPending
+		}
+		cs = &gelfChunks{
+			parts:   make([][]byte, count),
+			firstAt: time.Now(),
+		}
+		a.pending[id] = cs
+	}
+	if len(cs.parts) != count {
+		delete(a.pending, id)
+		return nil, errors.New("sequence count changed")
+	}
+	if cs.parts[seq] != nil { // duplicated
+		return nil, nil
+	}
+
+	// packet buffer will be reused by caller
+	cs.parts[seq] = append([]byte(nil), packet[gelfChunkHeaderLen:]...)
+	cs.nArrived++
+	cs.size += len(cs.parts[seq])
+	if cs.size > a.maxSize {
+		delete(a.pending, id)
+		return nil, errors.Errorf("message size exceeds %d bytes", a.maxSize)
+	}
+	if cs.nArrived != count {
+		return nil, nil
+	}
+
+	delete(a.pending, id)
+	payload = make([]byte, 0, cs.size)
+	for _, p := range cs.parts {
+		payload = append(payload, p...)
+	}
+	return payload, nil
+}
+
+// gc drop expired incomplete messages, return the number of dropped messages
+func (a *gelfChunkAssembler) gc() (n int) {
+	a.Lock()
+	defer a.Unlock()
+	for id, cs := range a.pending {
+		if time.Since(cs.firstAt) > a.timeout {
+			delete(a.pending, id)
+			n++
+		}
+	}
+	return n
+}
+
+// len return the number of incomplete messages
+func (a *gelfChunkAssembler) len() int {
+	a.Lock()
+	defer a.Unlock()
+	return len(a.pending)
+}
@@ -0,0 +1,177 @@
+package recvs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"gofluentd/library"
+)
+
+func splitGELFChunks(id byte, payload []byte, size int) (chunks [][]byte) {
+	n := (len(payload) + size - 1) / size
+	for i := 0; i < n; i++ {
+		end := (i + 1) * size
+		if end > len(payload) {
+			end = len(payload)
+		}
+		chunk := append([]byte{0x1e, 0x0f, id, 0, 0, 0, 0, 0, 0, 0, byte(i), byte(n)}, payload[i*size:end]...)
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+func TestGELFChunkAssembler(t *testing.T) {
+	a := newGELFChunkAssembler(50*time.Millisecond, 3, 10, 2)
+	chunks := splitGELFChunks(1, []byte("abcdefg"), 3)
+	for _, c := range [][]byte{chunks[2], chunks[0], chunks[0]} {
+		if payload, err := a.add(c); err != nil || payload != nil {
+			t.Fatalf("got %s, %+v", payload, err)
+		}
+	}
+	if payload, err := a.add(chunks[1]); err != nil || string(payload) != "abcdefg" {
+		t.Fatalf("got %s, %+v", payload, err)
+	}
+
+	// too many chunks
+	if _, err := a.add(splitGELFChunks(2, []byte("abcdefgh"), 2)[0]); err == nil {
+		t.Fatal("should got error")
+	}
+	// too large
+	chunks = splitGELFChunks(3, []byte("abcdefghijk"), 4)
+	a.add(chunks[0])
+	a.add(chunks[1])
+	if _, err := a.add(chunks[2]); err == nil {
+		t.Fatal("should got error")
+	}
+
+	// expired
+	a.add(splitGELFChunks(4, []byte("abcd"), 2)[0])
+	if n := a.gc(); n != 0 {
+		t.Fatalf("got %d", n)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if n := a.gc(); n != 1 || a.len() != 0 {
+		t.Fatalf("got %d", n)
+	}
+
+	// too many incomplete messages
+	a.add(splitGELFChunks(5, []byte("abcd"), 2)[0])
+	a.add(splitGELFChunks(6, []byte("abcd"), 2)[0])
+	if _, err := a.add(splitGELFChunks(7, []byte("abcd"), 2)[0]); err != errGELFTooManyPending {
+		t.Fatalf("got %+v", err)
+	}
+	// chunks of pending messages are still accepted
+	if payload, err := a.add(splitGELFChunks(5, []byte("abcd"), 2)[1]); err != nil || string(payload) != "abcd" {
+		t.Fatalf("got %s, %+v", payload, err)
+	}
+}
+
+func TestGELFRecv(t *testing.T) {
+	var (
+		outChan = make(chan *library.FluentMsg, 1000)
+		addr    = "127.0.0.1:24236"
+	)
+	recv := NewGELFRecv(&GELFRecvCfg{
+		Name:      "gelf-test",
+		Addr:      addr,
+		TCPAddr:   addr,
+		Tag:       "gelf.%{app}.sit",
+		TimeKey:   "@timestamp",
+		MaxChunks: 10,
+	})
+	recv.SetCounter(counter)
+	recv.SetMsgPool(msgPool)
+	recv.SetAsyncOutChan(outChan)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	recv.Run(ctx)
+	time.Sleep(100 * time.Millisecond)
+
+	loadMsg := func() *library.FluentMsg {
+		select {
+		case msg := <-outChan:
+			return msg
+		case <-time.After(2 * time.Second):
+			t.Fatal("can not load msg")
+		}
+		return nil
+	}
+	checkMsg := func(msg *library.FluentMsg, app string) {
+		if msg.Tag != "gelf."+app+".sit" ||
+			msg.Message["tag"] != msg.Tag ||
+			msg.Message["message"] != "hello" ||
+			msg.Message["full_message"] != "hello\nworld" ||
+			msg.Message["host"] != "app-1" ||
+			msg.Message["app"] != app ||
+			msg.Message["level"] != float64(3) ||
+			msg.Message["@timestamp"] != "2020-01-02T03:04:05.123Z" ||
+			msg.Message["version"] != nil ||
+			msg.Message["_app"] != nil {
+			t.Fatalf("got %+v, %+v", msg.Tag, msg.Message)
+		}
+	}
+	payload := func(app string) []byte {
+		return []byte(`{"version":"1.1","host":"app-1","short_message":"hello","full_message":"hello\nworld","timestamp":1577934245.123,"level":3,"_app":"` + app + `"}`)
+	}
+
+	udpConn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	defer udpConn.Close()
+
+	// uncompressed
+	if _, err = udpConn.Write(payload("plain")); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	checkMsg(loadMsg(), "plain")
+
+	// zlib
+	buf := &bytes.Buffer{}
+	zw := zlib.NewWriter(buf)
+	zw.Write(payload("zlib"))
+	zw.Close()
+	if _, err = udpConn.Write(buf.Bytes()); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	checkMsg(loadMsg(), "zlib")
+
+	// chunked gzip
+	buf.Reset()
+	gw := gzip.NewWriter(buf)
+	gw.Write(payload("chunked"))
+	gw.Close()
+	chunks := splitGELFChunks(5, buf.Bytes(), 20)
+	for i := len(chunks) - 1; i >= 0; i-- {
+		if _, err = udpConn.Write(chunks[i]); err != nil {
+			t.Fatalf("got error: %+v", err)
+		}
+	}
+	checkMsg(loadMsg(), "chunked")
+
+	// tcp with null byte delimiter
+	tcpConn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	defer tcpConn.Close()
+	data := append(payload("tcp1"), 0)
+	data = append(data, []byte(`{"short_message": 1`)...) // invalid
+	data = append(data, 0)
+	data = append(data, payload("tcp2")...)
+	data = append(data, 0)
+	if _, err = tcpConn.Write(data); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	checkMsg(loadMsg(), "tcp1")
+	checkMsg(loadMsg(), "tcp2")
+
+	if n := recv.invalidCnt.Get(); n != 1 {
+		t.Fatalf("got %d", n)
+	}
+}
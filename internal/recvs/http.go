@@ -10,6 +10,7 @@ import (
 	"regexp"
 	"time"
 
+	"gofluentd/internal/monitor"
 	"gofluentd/library"
 	"gofluentd/library/log"
 
@@ -20,7 +21,9 @@ import (
 
 // HTTPRecvCfg is the configuration for HTTPRecv
 type HTTPRecvCfg struct {
-	HTTPSrv     *gin.Engine
+	HTTPSrv *gin.Engine
+	// Mode: legacy/bulk
+	Mode        string
 	MaxBodySize int64
 	// Name: recv name
 	// Path: url endpoint
@@ -42,17 +45,32 @@ type HTTPRecvCfg struct {
 	SigSalt []byte
 
 	MaxAllowedDelaySec, MaxAllowedAheadSec time.Duration
+
+	// TagField: bulk mode only, load tag from `msg.Message[TagField]`,
+	// or from path param `:tag`, or use Tag
+	TagField string
+	// MaxRecordSize: bulk mode only, max size of each record
+	MaxRecordSize int
+
+	// Auth: authenticate requests by api key or hmac,
+	// legacy signature `SigKey` will not be checked if enabled
+	Auth *HTTPAuthCfg
 }
 
 // HTTPRecv recv for HTTP
 type HTTPRecv struct {
 	*BaseRecv
 	*HTTPRecvCfg
+
+	authenticator httpAuthenticator
+	// authRejectCounters count rejected requests by reason
+	authRejectCounters map[string]*utils.Counter
 }
 
 // NewHTTPRecv return new HTTPRecv
 func NewHTTPRecv(cfg *HTTPRecvCfg) *HTTPRecv {
 	log.Logger.Info("create HTTPRecv",
+		zap.String("mode", cfg.Mode),
 		zap.String("tag", cfg.Tag),
 		zap.String("path", cfg.Path),
 		zap.Duration("MaxAllowedAheadSec", cfg.MaxAllowedAheadSec),
@@ -64,10 +82,29 @@ func NewHTTPRecv(cfg *HTTPRecvCfg) *HTTPRecv {
 	}
 
 	r := &HTTPRecv{
-		BaseRecv:    &BaseRecv{},
-		HTTPRecvCfg: cfg,
+		BaseRecv:           &BaseRecv{},
+		HTTPRecvCfg:        cfg,
+		authRejectCounters: map[string]*utils.Counter{},
+	}
+	for _, reason := range httpAuthRejectReasons {
+		r.authRejectCounters[reason] = utils.NewCounter()
+	}
+	if r.Auth != nil && r.Auth.Type != "" {
+		var err error
+		if r.authenticator, err = newHTTPAuthenticator(r.Auth); err != nil {
+			log.Logger.Panic("config invalid", zap.Error(err))
+		}
+	}
+
+	switch r.Mode {
+	case "", HTTPRecvModeLegacy:
+		r.HTTPSrv.POST(r.Path, r.HTTPLogHandler)
+	case HTTPRecvModeBulk:
+		r.validBulk()
+		r.HTTPSrv.POST(r.Path, r.HTTPBulkHandler)
+	default:
+		log.Logger.Panic("unknown mode", zap.String("mode", r.Mode))
 	}
-	r.HTTPSrv.POST(r.Path, r.HTTPLogHandler)
 	r.HTTPSrv.GET(r.Path, func(ctx *gin.Context) {
 		ctx.String(200, "HTTPrecv")
 	})
@@ -82,6 +119,13 @@ func (r *HTTPRecv) GetName() string {
 // Run useless, just capatable for RecvItf
 func (r *HTTPRecv) Run(ctx context.Context) {
 	log.Logger.Info("run HTTPRecv")
+	monitor.AddMetric("httprecv."+r.Name, func() map[string]interface{} {
+		metric := map[string]interface{}{}
+		for reason, c := range r.authRejectCounters {
+			metric["authRejected."+reason] = c.Get()
+		}
+		return metric
+	})
 }
 
 func (r *HTTPRecv) validate(ctx *gin.Context, msg *library.FluentMsg) bool {
@@ -105,7 +149,38 @@ func (r *HTTPRecv) validate(ctx *gin.Context, msg *library.FluentMsg) bool {
 		return false
 	}
 
-	// signature
+	// signature, replaced by authenticator if enabled
+	if r.authenticator == nil && !r.validateSig(ctx, msg) {
+		return false
+	}
+
+	// check whether @timestamp is expires
+	now := utils.Clock.GetUTCNow()
+	ts, err := time.Parse(r.TimeFormat, string(msg.Message[r.TimeKey].([]byte)))
+	if err != nil {
+		log.Logger.Error("parse ts got error",
+			zap.Error(err),
+			zap.ByteString(r.TimeKey, msg.Message[r.TimeKey].([]byte)))
+		r.BadRequest(ctx, "signature error")
+		return false
+	} else if now.Sub(ts) > r.MaxAllowedDelaySec {
+		log.Logger.Warn("timekey expires", zap.Time("ts", ts))
+		r.BadRequest(ctx, "expires")
+		return false
+	} else if ts.Sub(now) > r.MaxAllowedAheadSec {
+		log.Logger.Warn("timekey ahead of now",
+			zap.Time("ts", ts),
+			zap.Time("now", now))
+		r.BadRequest(ctx, "come from future?")
+		return false
+	}
+	msg.Time = ts.UTC()
+
+	return true
+}
+
+// validateSig check signature `md5(ts + SigSalt)`
+func (r *HTTPRecv) validateSig(ctx *gin.Context, msg *library.FluentMsg) bool {
 	switch msg.Message[r.SigKey].(type) {
 	case nil:
 		log.Logger.Warn("`sig` not exists")
@@ -129,26 +204,6 @@ func (r *HTTPRecv) validate(ctx *gin.Context, msg *library.FluentMsg) bool {
 		return false
 	}
 
-	// check whether @timestamp is expires
-	now := utils.Clock.GetUTCNow()
-	if ts, err := time.Parse(r.TimeFormat, string(msg.Message[r.TimeKey].([]byte))); err != nil {
-		log.Logger.Error("parse ts got error",
-			zap.Error(err),
-			zap.ByteString(r.TimeKey, msg.Message[r.TimeKey].([]byte)))
-		r.BadRequest(ctx, "signature error")
-		return false
-	} else if now.Sub(ts) > r.MaxAllowedDelaySec {
-		log.Logger.Warn("timekey expires", zap.Time("ts", ts))
-		r.BadRequest(ctx, "expires")
-		return false
-	} else if ts.Sub(now) > r.MaxAllowedAheadSec {
-		log.Logger.Warn("timekey ahead of now",
-			zap.Time("ts", ts),
-			zap.Time("now", now))
-		r.BadRequest(ctx, "come from future?")
-		return false
-	}
-
 	return true
 }
 
@@ -189,6 +244,20 @@ func (r *HTTPRecv) HTTPLogHandler(ctx *gin.Context) {
 		return
 	}
 
+	if r.authenticator != nil {
+		key, err := r.authenticate(ctx.Request, msgData)
+		if err == nil {
+			err = r.checkTag(key, r.OrigTag)
+		}
+		if err != nil {
+			r.msgPool.Put(msg)
+			if err = ctx.AbortWithError(http.StatusUnauthorized, err); err != nil {
+				log.Logger.Error("abort http", zap.Error(err))
+			}
+			return
+		}
+	}
+
 	msg.Tag = r.Tag + "." + r.Env // forward-xxx.sit
 	msg.Message = map[string]interface{}{}
 	if err = json.Unmarshal(msgData, &msg.Message); err != nil {
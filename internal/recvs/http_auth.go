@@ -0,0 +1,372 @@
+package recvs
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gofluentd/library/log"
+
+	utils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/pkg/errors"
+)
+
+const (
+	// HTTPAuthTypeAPIKey authenticate by `Authorization: Bearer <key>`
+	HTTPAuthTypeAPIKey = "apikey"
+	// HTTPAuthTypeHMAC authenticate by HMAC-SHA256 signature of timestamp, nonce & body
+	HTTPAuthTypeHMAC = "hmac"
+
+	// HTTPAuthHeaderKeyID id of key used by HMAC
+	HTTPAuthHeaderKeyID = "X-Auth-Key-Id"
+	// HTTPAuthHeaderTimestamp unix timestamp in seconds
+	HTTPAuthHeaderTimestamp = "X-Auth-Timestamp"
+	// HTTPAuthHeaderNonce random string, should not be reused in replay window
+	HTTPAuthHeaderNonce = "X-Auth-Nonce"
+	// HTTPAuthHeaderSignature hex(hmac-sha256(key, `<timestamp>\n<nonce>\n<body>`))
+	HTTPAuthHeaderSignature = "X-Auth-Signature"
+
+	defaultHTTPAuthReloadInterval = 30 * time.Second
+	defaultHTTPAuthReplayWindow   = 5 * time.Minute
+)
+
+// reasons of rejected requests
+const (
+	httpAuthRejectMissingCredential = "missing_credential"
+	httpAuthRejectUnknownKey        = "unknown_key"
+	httpAuthRejectBadSignature      = "bad_signature"
+	httpAuthRejectExpired           = "expired"
+	httpAuthRejectReplayed          = "replayed"
+	httpAuthRejectForbiddenTag      = "forbidden_tag"
+)
+
+var httpAuthRejectReasons = []string{
+	httpAuthRejectMissingCredential,
+	httpAuthRejectUnknownKey,
+	httpAuthRejectBadSignature,
+	httpAuthRejectExpired,
+	httpAuthRejectReplayed,
+	httpAuthRejectForbiddenTag,
+}
+
+// HTTPAuthCfg configuration of HTTPRecv authentication
+type HTTPAuthCfg struct {
+	// Type: apikey/hmac
+	Type string
+	// KeyFile JSON file contains keys:
+	//   [{"id": "app1", "key": "xxx", "tags": ["app1", "app2"]}]
+	// empty `tags` means all tags are allowed.
+	// file will be reloaded if modified.
+	KeyFile string
+	// ReloadInterval check whether KeyFile modified in every interval,
+	// disable reload if < 0
+	ReloadInterval time.Duration
+	// ReplayWindow hmac only, max difference between timestamp and now,
+	// nonce will be cached in this window
+	ReplayWindow time.Duration
+}
+
+// httpAuthKey key loaded from key file
+type httpAuthKey struct {
+	ID   string   `json:"id"`
+	Key  string   `json:"key"`
+	Tags []string `json:"tags"`
+}
+
+// isTagAllowed check whether the key can write logs with tag
+func (k *httpAuthKey) isTagAllowed(tag string) bool {
+	if len(k.Tags) == 0 {
+		return true
+	}
+	for _, t := range k.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// httpAuthError error with the reason of rejection
+type httpAuthError struct {
+	reason string
+	err    error
+}
+
+func (e *httpAuthError) Error() string {
+	return e.reason + ": " + e.err.Error()
+}
+
+func newHTTPAuthError(reason, msg string) *httpAuthError {
+	return &httpAuthError{reason: reason, err: errors.New(msg)}
+}
+
+// httpAuthenticator authenticate HTTP request
+type httpAuthenticator interface {
+	// Authenticate return the key if request is valid,
+	// body is the raw request body.
+	Authenticate(req *http.Request, body []byte) (*httpAuthKey, error)
+}
+
+// httpKeyStore load keys from file, and reload it if modified
+type httpKeyStore struct {
+	sync.RWMutex
+	fpath    string
+	interval time.Duration
+
+	// keys id -> key for hmac, or key -> key for apikey
+	keys      map[string]*httpAuthKey
+	isByKey   bool
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+func newHTTPKeyStore(fpath string, interval time.Duration, isByKey bool) (s *httpKeyStore, err error) {
+	s = &httpKeyStore{
+		fpath:    fpath,
+		interval: interval,
+		isByKey:  isByKey,
+	}
+	if err = s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *httpKeyStore) load() error {
+	fi, err := os.Stat(s.fpath)
+	if err != nil {
+		return errors.Wrapf(err, "stat `%s`", s.fpath)
+	}
+	cnt, err := ioutil.ReadFile(s.fpath)
+	if err != nil {
+		return errors.Wrapf(err, "read `%s`", s.fpath)
+	}
+	ks := []*httpAuthKey{}
+	if err = json.Unmarshal(cnt, &ks); err != nil {
+		return errors.Wrapf(err, "unmarshal `%s`", s.fpath)
+	}
+
+	keys := map[string]*httpAuthKey{}
+	for _, k := range ks {
+		if k.ID == "" || k.Key == "" {
+			return errors.Errorf("id and key should not be empty in `%s`", s.fpath)
+		}
+		if s.isByKey {
+			keys[k.Key] = k
+		} else {
+			keys[k.ID] = k
+		}
+	}
+
+	s.Lock()
+	s.keys = keys
+	s.modTime = fi.ModTime()
+	s.lastCheck = utils.Clock.GetUTCNow()
+	s.Unlock()
+	log.Logger.Info("load http auth keys", zap.String("file", s.fpath), zap.Int("n", len(keys)))
+	return nil
+}
+
+// reloadIfModified reload keys if file modified,
+// keep old keys if got error.
+func (s *httpKeyStore) reloadIfModified() {
+	now := utils.Clock.GetUTCNow()
+	s.RLock()
+	isExpired := s.interval >= 0 && now.Sub(s.lastCheck) > s.interval
+	modTime := s.modTime
+	s.RUnlock()
+	if !isExpired {
+		return
+	}
+
+	s.Lock()
+	s.lastCheck = now
+	s.Unlock()
+	fi, err := os.Stat(s.fpath)
+	if err != nil {
+		log.Logger.Error("check http auth key file", zap.Error(err))
+		return
+	}
+	if fi.ModTime().Equal(modTime) {
+		return
+	}
+
+	if err = s.load(); err != nil {
+		log.Logger.Error("reload http auth key file", zap.Error(err))
+	}
+}
+
+// get load key by id or key
+func (s *httpKeyStore) get(k string) *httpAuthKey {
+	s.reloadIfModified()
+	s.RLock()
+	defer s.RUnlock()
+	return s.keys[k]
+}
+
+// httpAPIKeyAuthenticator authenticate by static bearer key
+type httpAPIKeyAuthenticator struct {
+	store *httpKeyStore
+}
+
+// Authenticate check `Authorization: Bearer <key>`
+func (a *httpAPIKeyAuthenticator) Authenticate(req *http.Request, body []byte) (*httpAuthKey, error) {
+	token := req.Header.Get("Authorization")
+	if !strings.HasPrefix(token, "Bearer ") {
+		return nil, newHTTPAuthError(httpAuthRejectMissingCredential, "bearer token missing")
+	}
+
+	key := a.store.get(strings.TrimSpace(strings.TrimPrefix(token, "Bearer ")))
+	if key == nil {
+		return nil, newHTTPAuthError(httpAuthRejectUnknownKey, "unknown api key")
+	}
+	return key, nil
+}
+
+// httpHMACAuthenticator authenticate by HMAC-SHA256 signature,
+// reject request with the same nonce in replay window.
+type httpHMACAuthenticator struct {
+	store  *httpKeyStore
+	window time.Duration
+
+	sync.Mutex
+	// nonces `<key id>/<nonce>` -> expire time
+	nonces    map[string]time.Time
+	lastPurge time.Time
+}
+
+// Authenticate check signature of `<timestamp>\n<nonce>\n<body>`
+func (a *httpHMACAuthenticator) Authenticate(req *http.Request, body []byte) (*httpAuthKey, error) {
+	var (
+		keyID = req.Header.Get(HTTPAuthHeaderKeyID)
+		tsStr = req.Header.Get(HTTPAuthHeaderTimestamp)
+		nonce = req.Header.Get(HTTPAuthHeaderNonce)
+		sig   = req.Header.Get(HTTPAuthHeaderSignature)
+	)
+	if keyID == "" || tsStr == "" || nonce == "" || sig == "" {
+		return nil, newHTTPAuthError(httpAuthRejectMissingCredential, "auth headers missing")
+	}
+
+	key := a.store.get(keyID)
+	if key == nil {
+		return nil, newHTTPAuthError(httpAuthRejectUnknownKey, "unknown key id")
+	}
+
+	expect, err := hex.DecodeString(sig)
+	if err != nil || !hmac.Equal(expect, httpHMACSign([]byte(key.Key), tsStr, nonce, body)) {
+		return nil, newHTTPAuthError(httpAuthRejectBadSignature, "signature mismatch")
+	}
+
+	ts, err := strconv.ParseInt(tsStr, 10, 64)
+	if err != nil {
+		return nil, newHTTPAuthError(httpAuthRejectBadSignature, "timestamp should be unix seconds")
+	}
+	now := utils.Clock.GetUTCNow()
+	if d := now.Sub(time.Unix(ts, 0)); d > a.window || d < -a.window {
+		return nil, newHTTPAuthError(httpAuthRejectExpired, "timestamp out of replay window")
+	}
+
+	if !a.checkNonce(keyID+"/"+nonce, now) {
+		return nil, newHTTPAuthError(httpAuthRejectReplayed, "nonce already used")
+	}
+	return key, nil
+}
+
+// checkNonce return false if nonce already used
+func (a *httpHMACAuthenticator) checkNonce(nonce string, now time.Time) bool {
+	a.Lock()
+	defer a.Unlock()
+	if now.Sub(a.lastPurge) > a.window {
+		for n, expireAt := range a.nonces {
+			if now.After(expireAt) {
+				delete(a.nonces, n)
+			}
+		}
+		a.lastPurge = now
+	}
+
+	if expireAt, ok := a.nonces[nonce]; ok && !now.After(expireAt) {
+		return false
+	}
+	// timestamp can be ahead or behind now in window
+	a.nonces[nonce] = now.Add(2 * a.window)
+	return true
+}
+
+// httpHMACSign calculate hmac-sha256 of `<timestamp>\n<nonce>\n<body>`
+func httpHMACSign(key []byte, ts, nonce string, body []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(ts + "\n" + nonce + "\n"))
+	h.Write(body)
+	return h.Sum(nil)
+}
+
+// newHTTPAuthenticator return authenticator by cfg.Type
+func newHTTPAuthenticator(cfg *HTTPAuthCfg) (httpAuthenticator, error) {
+	if cfg.KeyFile == "" {
+		return nil, errors.New("auth.key_file should not be empty")
+	}
+	if cfg.ReloadInterval == 0 {
+		cfg.ReloadInterval = defaultHTTPAuthReloadInterval
+		log.Logger.Info("reset auth.reload_interval_sec", zap.Duration("reload_interval_sec", cfg.ReloadInterval))
+	}
+
+	switch cfg.Type {
+	case HTTPAuthTypeAPIKey:
+		store, err := newHTTPKeyStore(cfg.KeyFile, cfg.ReloadInterval, true)
+		if err != nil {
+			return nil, err
+		}
+		return &httpAPIKeyAuthenticator{store: store}, nil
+	case HTTPAuthTypeHMAC:
+		if cfg.ReplayWindow <= 0 {
+			cfg.ReplayWindow = defaultHTTPAuthReplayWindow
+			log.Logger.Info("reset auth.replay_window_sec", zap.Duration("replay_window_sec", cfg.ReplayWindow))
+		}
+		store, err := newHTTPKeyStore(cfg.KeyFile, cfg.ReloadInterval, false)
+		if err != nil {
+			return nil, err
+		}
+		return &httpHMACAuthenticator{
+			store:  store,
+			window: cfg.ReplayWindow,
+			nonces: map[string]time.Time{},
+		}, nil
+	default:
+		return nil, errors.Errorf("unknown auth type `%s`", cfg.Type)
+	}
+}
+
+// authenticate check request by authenticator,
+// count rejected request by reason.
+func (r *HTTPRecv) authenticate(req *http.Request, body []byte) (*httpAuthKey, error) {
+	key, err := r.authenticator.Authenticate(req, body)
+	if err != nil {
+		if authErr, ok := err.(*httpAuthError); ok {
+			r.authRejectCounters[authErr.reason].Count()
+		}
+		log.Logger.Warn("reject unauthorized request",
+			zap.String("name", r.Name),
+			zap.String("remote", req.RemoteAddr),
+			zap.Error(err))
+		return nil, err
+	}
+	return key, nil
+}
+
+// checkTag check whether key can write logs with tag
+func (r *HTTPRecv) checkTag(key *httpAuthKey, tag string) error {
+	if key == nil || key.isTagAllowed(tag) {
+		return nil
+	}
+	r.authRejectCounters[httpAuthRejectForbiddenTag].Count()
+	return newHTTPAuthError(httpAuthRejectForbiddenTag, "tag `"+tag+"` not allowed for key `"+key.ID+"`")
+}
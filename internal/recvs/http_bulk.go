@@ -0,0 +1,282 @@
+package recvs
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	stdjson "encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"gofluentd/library"
+	"gofluentd/library/log"
+
+	"github.com/Laisky/zap"
+	"github.com/gin-gonic/gin"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+const (
+	// HTTPRecvModeLegacy accept one signed JSON object per request
+	HTTPRecvModeLegacy = "legacy"
+	// HTTPRecvModeBulk accept JSON object, JSON array or NDJSON per request
+	HTTPRecvModeBulk = "bulk"
+
+	defaultHTTPBulkMaxBodySize   = 10 * 1024 * 1024
+	defaultHTTPBulkMaxRecordSize = 1024 * 1024
+)
+
+// httpBulkResult is the result of each record in bulk request
+type httpBulkResult struct {
+	MsgID int64  `json:"msgid,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// httpBulkResp is the response of bulk request
+type httpBulkResp struct {
+	Accepted int               `json:"accepted"`
+	Rejected int               `json:"rejected"`
+	Results  []*httpBulkResult `json:"results"`
+	Error    string            `json:"error,omitempty"`
+}
+
+func (r *HTTPRecv) validBulk() {
+	if r.MaxBodySize <= 0 {
+		r.MaxBodySize = defaultHTTPBulkMaxBodySize
+		log.Logger.Info("reset max_body_byte", zap.Int64("max_body_byte", r.MaxBodySize))
+	}
+
+	if r.MaxRecordSize <= 0 {
+		r.MaxRecordSize = defaultHTTPBulkMaxRecordSize
+		log.Logger.Info("reset max_record_byte", zap.Int("max_record_byte", r.MaxRecordSize))
+	}
+
+	if r.TimeKey != "" && r.TimeFormat == "" {
+		r.TimeFormat = time.RFC3339Nano
+		log.Logger.Info("reset time_format", zap.String("time_format", r.TimeFormat))
+	}
+
+	if r.TagKey == "" {
+		r.TagKey = "tag"
+		log.Logger.Info("reset tag_key", zap.String("tag_key", r.TagKey))
+	}
+
+	if r.Tag == "" && r.TagField == "" && !strings.Contains(r.Path, ":tag") {
+		log.Logger.Panic("one of tag, tag_field or `:tag` in path should be set")
+	}
+}
+
+// abortBulk reply error for the whole request
+func (r *HTTPRecv) abortBulk(ctx *gin.Context, status int, msg string) {
+	log.Logger.Warn("reject bulk request",
+		zap.String("name", r.Name),
+		zap.String("remote", ctx.ClientIP()),
+		zap.String("error", msg))
+	ctx.AbortWithStatusJSON(status, &httpBulkResp{Error: msg})
+}
+
+// readRawBody read request body without decompression,
+// return error if the body is larger than MaxBodySize.
+func (r *HTTPRecv) readRawBody(req *http.Request) (body []byte, err error) {
+	if body, err = ioutil.ReadAll(io.LimitReader(req.Body, r.MaxBodySize+1)); err != nil {
+		return nil, errors.Wrap(err, "read body")
+	}
+	if int64(len(body)) > r.MaxBodySize {
+		return nil, errors.Errorf("body size must less than %d bytes", r.MaxBodySize)
+	}
+
+	return body, nil
+}
+
+// decompressBulkBody decompress raw body by `Content-Encoding`,
+// return error if the decompressed body is larger than MaxBodySize.
+func (r *HTTPRecv) decompressBulkBody(req *http.Request, raw []byte) (body []byte, err error) {
+	return decompressHTTPBody(req, raw, r.MaxBodySize)
+}
+
+// decompressHTTPBody decompress raw body by `Content-Encoding`,
+// return error if the decompressed body is larger than maxSize.
+func decompressHTTPBody(req *http.Request, raw []byte, maxSize int64) (body []byte, err error) {
+	var reader io.Reader
+	switch strings.ToLower(strings.TrimSpace(req.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+		return raw, nil
+	case "gzip":
+		gz, err := gzip.NewReader(bytes.NewReader(raw))
+		if err != nil {
+			return nil, errors.Wrap(err, "new gzip reader")
+		}
+		defer gz.Close()
+		reader = gz
+	case "deflate":
+		fr := flate.NewReader(bytes.NewReader(raw))
+		defer fr.Close()
+		reader = fr
+	case "zstd":
+		zr, err := zstd.NewReader(bytes.NewReader(raw))
+		if err != nil {
+			return nil, errors.Wrap(err, "new zstd reader")
+		}
+		defer zr.Close()
+		reader = zr
+	default:
+		return nil, errors.Errorf("unsupported Content-Encoding `%s`", req.Header.Get("Content-Encoding"))
+	}
+
+	if body, err = ioutil.ReadAll(io.LimitReader(reader, maxSize+1)); err != nil {
+		return nil, errors.Wrap(err, "decompress body")
+	}
+	if int64(len(body)) > maxSize {
+		return nil, errors.Errorf("body size must less than %d bytes", maxSize)
+	}
+
+	return body, nil
+}
+
+// splitBulkRecords split body into records,
+// body can be a JSON object, JSON array or NDJSON.
+func splitBulkRecords(body []byte) (records [][]byte, err error) {
+	body = bytes.TrimSpace(body)
+	switch {
+	case len(body) == 0:
+		return nil, errors.New("empty body")
+	case body[0] == '[':
+		var arr []jsoniter.RawMessage
+		if err = json.Unmarshal(body, &arr); err != nil {
+			return nil, errors.Wrap(err, "unmarshal json array")
+		}
+		for _, rec := range arr {
+			records = append(records, rec)
+		}
+	// single object, maybe in multiple lines.
+	// do not use jsoniter, it ignores the data after the first value.
+	case stdjson.Valid(body):
+		records = append(records, body)
+	default: // NDJSON
+		for _, line := range bytes.Split(body, []byte{'\n'}) {
+			if line = bytes.TrimSpace(line); len(line) != 0 {
+				records = append(records, line)
+			}
+		}
+	}
+
+	return records, nil
+}
+
+// HTTPBulkHandler process logs in JSON object, JSON array or NDJSON
+func (r *HTTPRecv) HTTPBulkHandler(ctx *gin.Context) {
+	if ctx.Request.ContentLength > r.MaxBodySize {
+		r.abortBulk(ctx, http.StatusRequestEntityTooLarge, fmt.Sprintf("content size must less than %d bytes", r.MaxBodySize))
+		return
+	}
+
+	body, err := r.readRawBody(ctx.Request)
+	if err != nil {
+		r.abortBulk(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// signature is calculated by the raw body before decompression
+	var key *httpAuthKey
+	if r.authenticator != nil {
+		if key, err = r.authenticate(ctx.Request, body); err != nil {
+			r.abortBulk(ctx, http.StatusUnauthorized, err.Error())
+			return
+		}
+	}
+
+	if body, err = r.decompressBulkBody(ctx.Request, body); err != nil {
+		r.abortBulk(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+	records, err := splitBulkRecords(body)
+	if err != nil {
+		r.abortBulk(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var (
+		resp = &httpBulkResp{Results: make([]*httpBulkResult, len(records))}
+		msgs = make([]*library.FluentMsg, 0, len(records))
+		msg  *library.FluentMsg
+	)
+	for i, rec := range records {
+		if msg, err = r.parseBulkRecord(ctx, key, rec); err != nil {
+			resp.Rejected++
+			resp.Results[i] = &httpBulkResult{Error: err.Error()}
+			continue
+		}
+
+		msg.ID = r.counter.Count()
+		resp.Accepted++
+		resp.Results[i] = &httpBulkResult{MsgID: msg.ID}
+		msgs = append(msgs, msg)
+	}
+
+	log.Logger.Debug("receive bulk msgs",
+		zap.String("name", r.Name),
+		zap.Int("accepted", resp.Accepted),
+		zap.Int("rejected", resp.Rejected))
+	if resp.Accepted == 0 {
+		ctx.JSON(http.StatusBadRequest, resp)
+	} else {
+		ctx.JSON(http.StatusOK, resp)
+	}
+	for _, msg = range msgs {
+		r.asyncOutChan <- msg
+	}
+}
+
+// parseBulkRecord decode record into msg,
+// key is nil if authentication disabled.
+func (r *HTTPRecv) parseBulkRecord(ctx *gin.Context, key *httpAuthKey, rec []byte) (msg *library.FluentMsg, err error) {
+	if len(rec) > r.MaxRecordSize {
+		return nil, errors.Errorf("record size must less than %d bytes", r.MaxRecordSize)
+	}
+
+	m := map[string]interface{}{}
+	if err = json.Unmarshal(rec, &m); err != nil {
+		return nil, errors.New("record should be JSON object")
+	}
+
+	// tag priority: field > path > config
+	tag := r.Tag
+	if pathTag := ctx.Param("tag"); pathTag != "" {
+		tag = pathTag
+	}
+	if r.TagField != "" {
+		if fieldTag, ok := m[r.TagField].(string); ok && fieldTag != "" {
+			tag = fieldTag
+		}
+	}
+	if tag == "" {
+		return nil, errors.New("tag missing")
+	}
+	if err = r.checkTag(key, tag); err != nil {
+		return nil, err
+	}
+	tag += "." + r.Env
+
+	var ts time.Time
+	if r.TimeKey != "" {
+		if v, ok := m[r.TimeKey].(string); ok {
+			if ts, err = time.Parse(r.TimeFormat, v); err != nil {
+				return nil, errors.Errorf("cannot parse `%s` by format `%s`", r.TimeKey, r.TimeFormat)
+			}
+			ts = ts.UTC()
+		}
+	}
+
+	m[r.TagKey] = tag
+	msg = r.msgPool.Get().(*library.FluentMsg)
+	msg.Tag = tag
+	msg.Message = m
+	msg.Time = ts
+	return msg, nil
+}
@@ -1,10 +1,18 @@
 package recvs
 
 import (
+	"bytes"
+	"compress/gzip"
 	"crypto/md5"
 	"encoding/hex"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"regexp"
+	"strings"
 	"testing"
 	"time"
 
@@ -14,6 +22,7 @@ import (
 	"github.com/Laisky/go-utils"
 	"github.com/Laisky/zap"
 	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/zstd"
 )
 
 var (
@@ -118,3 +127,267 @@ func fakeReq() map[string]string {
 	}
 
 }
+
+func TestHTTPRecvBulk(t *testing.T) {
+	var (
+		srv          = gin.New()
+		asyncOutChan = make(chan *library.FluentMsg, 1000)
+	)
+	httprecv := NewHTTPRecv(&HTTPRecvCfg{
+		Name:          "test-http-bulk",
+		HTTPSrv:       srv,
+		Mode:          HTTPRecvModeBulk,
+		Env:           "sit",
+		Path:          "/api/v1/bulk/:tag",
+		TagField:      "app",
+		TimeKey:       "ts",
+		MaxBodySize:   1000,
+		MaxRecordSize: 100,
+	})
+	httprecv.SetCounter(counter)
+	httprecv.SetMsgPool(msgPool)
+	httprecv.SetAsyncOutChan(asyncOutChan)
+
+	post := func(body []byte, encoding string) (int, *httpBulkResp) {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/bulk/test", bytes.NewReader(body))
+		if encoding != "" {
+			req.Header.Set("Content-Encoding", encoding)
+		}
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		resp := &httpBulkResp{}
+		if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil {
+			t.Fatalf("got error: %+v, %s", err, w.Body.String())
+		}
+		return w.Code, resp
+	}
+	loadMsgs := func(n int) (msgs []*library.FluentMsg) {
+		for i := 0; i < n; i++ {
+			select {
+			case msg := <-asyncOutChan:
+				msgs = append(msgs, msg)
+			default:
+				t.Fatalf("expect %d msgs, got %d", n, len(msgs))
+			}
+		}
+		return msgs
+	}
+
+	// json array, per-record results
+	code, resp := post([]byte(`[
+		{"log": "a", "ts": "2020-01-02T03:04:05Z"},
+		"not object",
+		{"log": "b", "app": "other"},
+		{"log": "`+strings.Repeat("x", 100)+`"}
+	]`), "")
+	if code != http.StatusOK || resp.Accepted != 2 || resp.Rejected != 2 ||
+		resp.Results[0].MsgID == 0 || resp.Results[1].Error == "" ||
+		resp.Results[2].MsgID == 0 || resp.Results[3].Error == "" {
+		t.Fatalf("got %d, %+v", code, resp)
+	}
+	msgs := loadMsgs(2)
+	if msgs[0].Tag != "test.sit" ||
+		msgs[0].Message["tag"] != "test.sit" ||
+		!msgs[0].Time.Equal(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Fatalf("got %+v, %v", msgs[0].Message, msgs[0].Time)
+	}
+	if msgs[1].Tag != "other.sit" {
+		t.Fatalf("got %v", msgs[1].Tag)
+	}
+
+	// gzip ndjson
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	if _, err := gz.Write([]byte("{\"log\": \"a\"}\n{\"log\": \"b\"}\n\n{\"log\": \"c\"}")); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	gz.Close()
+	if code, resp = post(buf.Bytes(), "gzip"); code != http.StatusOK || resp.Accepted != 3 {
+		t.Fatalf("got %d, %+v", code, resp)
+	}
+	loadMsgs(3)
+
+	// zstd single object
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	if code, resp = post(enc.EncodeAll([]byte("{\n\"log\": \"a\"\n}"), nil), "zstd"); code != http.StatusOK || resp.Accepted != 1 {
+		t.Fatalf("got %d, %+v", code, resp)
+	}
+	loadMsgs(1)
+
+	// body too large after decompression
+	buf.Reset()
+	gz.Reset(buf)
+	if _, err := gz.Write(bytes.Repeat([]byte("{\"log\": \"a\"}\n"), 100)); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	gz.Close()
+	if code, resp = post(buf.Bytes(), "gzip"); code != http.StatusBadRequest || resp.Error == "" {
+		t.Fatalf("got %d, %+v", code, resp)
+	}
+
+	// all rejected
+	if code, _ = post([]byte("abc"), ""); code != http.StatusBadRequest {
+		t.Fatalf("got %d", code)
+	}
+}
+
+func writeHTTPAuthKeys(t *testing.T, fpath string, keys []*httpAuthKey, mtime time.Time) {
+	cnt, err := json.Marshal(keys)
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	if err = ioutil.WriteFile(fpath, cnt, 0600); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	// make sure modtime changed
+	if err = os.Chtimes(fpath, mtime, mtime); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+}
+
+func TestHTTPRecvAuth(t *testing.T) {
+	var (
+		keyFile      = filepath.Join(t.TempDir(), "keys.json")
+		asyncOutChan = make(chan *library.FluentMsg, 1000)
+		now          = time.Now()
+	)
+	writeHTTPAuthKeys(t, keyFile, []*httpAuthKey{
+		{ID: "app1", Key: "key1", Tags: []string{"app1"}},
+		{ID: "all", Key: "key2"},
+	}, now.Add(-time.Hour))
+
+	newRecv := func(typ string) *gin.Engine {
+		srv := gin.New()
+		r := NewHTTPRecv(&HTTPRecvCfg{
+			Name:          "test-http-auth-" + typ,
+			HTTPSrv:       srv,
+			Mode:          HTTPRecvModeBulk,
+			Env:           "sit",
+			Path:          "/api/v1/bulk/:tag",
+			MaxBodySize:   1000,
+			MaxRecordSize: 100,
+			Auth: &HTTPAuthCfg{
+				Type:           typ,
+				KeyFile:        keyFile,
+				ReloadInterval: time.Millisecond,
+			},
+		})
+		r.SetCounter(counter)
+		r.SetMsgPool(msgPool)
+		r.SetAsyncOutChan(asyncOutChan)
+		return srv
+	}
+	post := func(srv *gin.Engine, tag string, header map[string]string, body string) (int, *httpBulkResp) {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/bulk/"+tag, strings.NewReader(body))
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		resp := &httpBulkResp{}
+		if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil {
+			t.Fatalf("got error: %+v, %s", err, w.Body.String())
+		}
+		for i := 0; i < resp.Accepted; i++ {
+			<-asyncOutChan
+		}
+		return w.Code, resp
+	}
+
+	// api key
+	srv := newRecv(HTTPAuthTypeAPIKey)
+	if code, _ := post(srv, "app1", nil, `{"log": "a"}`); code != http.StatusUnauthorized {
+		t.Fatalf("got %d", code)
+	}
+	if code, _ := post(srv, "app1", map[string]string{"Authorization": "Bearer wrong"}, `{"log": "a"}`); code != http.StatusUnauthorized {
+		t.Fatalf("got %d", code)
+	}
+	if code, resp := post(srv, "app1", map[string]string{"Authorization": "Bearer key1"}, `{"log": "a"}`); code != http.StatusOK || resp.Accepted != 1 {
+		t.Fatalf("got %d, %+v", code, resp)
+	}
+	// tag not allowed
+	if code, resp := post(srv, "app2", map[string]string{"Authorization": "Bearer key1"}, `{"log": "a"}`); code != http.StatusBadRequest || resp.Rejected != 1 {
+		t.Fatalf("got %d, %+v", code, resp)
+	}
+	if code, _ := post(srv, "app2", map[string]string{"Authorization": "Bearer key2"}, `{"log": "a"}`); code != http.StatusOK {
+		t.Fatalf("got %d", code)
+	}
+
+	// rotate keys without restart
+	writeHTTPAuthKeys(t, keyFile, []*httpAuthKey{
+		{ID: "app1", Key: "key1-new", Tags: []string{"app1"}},
+	}, now)
+	time.Sleep(10 * time.Millisecond)
+	if code, _ := post(srv, "app1", map[string]string{"Authorization": "Bearer key1"}, `{"log": "a"}`); code != http.StatusUnauthorized {
+		t.Fatalf("got %d", code)
+	}
+	if code, _ := post(srv, "app1", map[string]string{"Authorization": "Bearer key1-new"}, `{"log": "a"}`); code != http.StatusOK {
+		t.Fatalf("got %d", code)
+	}
+
+	// hmac
+	srv = newRecv(HTTPAuthTypeHMAC)
+	sign := func(id, key string, ts time.Time, nonce, body string) map[string]string {
+		tsStr := fmt.Sprint(ts.Unix())
+		return map[string]string{
+			HTTPAuthHeaderKeyID:     id,
+			HTTPAuthHeaderTimestamp: tsStr,
+			HTTPAuthHeaderNonce:     nonce,
+			HTTPAuthHeaderSignature: hex.EncodeToString(httpHMACSign([]byte(key), tsStr, nonce, []byte(body))),
+		}
+	}
+	body := `{"log": "a"}`
+	if code, resp := post(srv, "app1", sign("app1", "key1-new", time.Now(), "n1", body), body); code != http.StatusOK || resp.Accepted != 1 {
+		t.Fatalf("got %d, %+v", code, resp)
+	}
+	// replayed
+	if code, _ := post(srv, "app1", sign("app1", "key1-new", time.Now(), "n1", body), body); code != http.StatusUnauthorized {
+		t.Fatalf("got %d", code)
+	}
+	// expired
+	if code, _ := post(srv, "app1", sign("app1", "key1-new", time.Now().Add(-time.Hour), "n2", body), body); code != http.StatusUnauthorized {
+		t.Fatalf("got %d", code)
+	}
+	// body modified
+	if code, _ := post(srv, "app1", sign("app1", "key1-new", time.Now(), "n3", body), `{"log": "b"}`); code != http.StatusUnauthorized {
+		t.Fatalf("got %d", code)
+	}
+	// old key
+	if code, _ := post(srv, "app1", sign("app1", "key1", time.Now(), "n4", body), body); code != http.StatusUnauthorized {
+		t.Fatalf("got %d", code)
+	}
+}
+
+func TestHTTPAuthRejectMetrics(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "keys.json")
+	writeHTTPAuthKeys(t, keyFile, []*httpAuthKey{{ID: "app1", Key: "key1", Tags: []string{"app1"}}}, time.Now())
+	r := NewHTTPRecv(&HTTPRecvCfg{
+		Name:    "test-http-auth-metric",
+		HTTPSrv: gin.New(),
+		Mode:    HTTPRecvModeBulk,
+		Path:    "/api/v1/bulk/:tag",
+		Auth:    &HTTPAuthCfg{Type: HTTPAuthTypeAPIKey, KeyFile: keyFile},
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	if _, err := r.authenticate(req, nil); err == nil {
+		t.Fatal("should got error")
+	}
+	req.Header.Set("Authorization", "Bearer key1")
+	key, err := r.authenticate(req, nil)
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	if err = r.checkTag(key, "app2"); err == nil {
+		t.Fatal("should got error")
+	}
+
+	if r.authRejectCounters[httpAuthRejectMissingCredential].Get() != 1 ||
+		r.authRejectCounters[httpAuthRejectForbiddenTag].Get() != 1 ||
+		r.authRejectCounters[httpAuthRejectUnknownKey].Get() != 0 {
+		t.Fatalf("got %+v", r.authRejectCounters)
+	}
+}
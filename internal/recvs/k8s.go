@@ -0,0 +1,277 @@
+package recvs
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"gofluentd/library"
+	"gofluentd/library/log"
+
+	utils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultK8sTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	defaultK8sCAFile    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+	defaultK8sCacheTTL  = 5 * time.Minute
+	defaultK8sTimeout   = 5 * time.Second
+)
+
+// k8sLogFileRegexp parse the name of files in `/var/log/containers/`
+var k8sLogFileRegexp = regexp.MustCompile(`^(?P<pod_name>[^_]+)_(?P<namespace>[^_]+)_(?P<container_name>.+)-(?P<container_id>[a-z0-9]{64})\.log$`)
+
+// K8sMetaCfg configuration of kubernetes metadata enrichment
+type K8sMetaCfg struct {
+	Enable bool
+	// APIServer like `https://kubernetes.default.svc:443`,
+	// load from env `KUBERNETES_SERVICE_HOST` & `KUBERNETES_SERVICE_PORT` if empty
+	APIServer,
+	// TokenFile bearer token of service account, will be reloaded for each request
+	TokenFile,
+	// CAFile CA of api server
+	CAFile string
+	InsecureSkipVerify bool
+
+	// CacheTTL expiration of pod metadata in cache
+	CacheTTL time.Duration
+	// Timeout of each request to api server
+	Timeout time.Duration
+}
+
+// k8sPodMeta metadata loaded from kubernetes api
+type k8sPodMeta struct {
+	uid, nodeName string
+	labels        map[string]string
+	expireAt      time.Time
+	// isMissing pod not found or api server unavailable
+	isMissing bool
+}
+
+// k8sMetaClient load pod metadata from kubernetes api with cache
+type k8sMetaClient struct {
+	*K8sMetaCfg
+	httpClient *http.Client
+
+	sync.Mutex
+	// cache `<namespace>/<pod_name>` -> metadata
+	cache map[string]*k8sPodMeta
+	// loading `<namespace>/<pod_name>` being requested from api server
+	loading map[string]bool
+}
+
+func newK8sMetaClient(cfg *K8sMetaCfg) (c *k8sMetaClient, err error) {
+	c = &k8sMetaClient{
+		K8sMetaCfg: cfg,
+		cache:      map[string]*k8sPodMeta{},
+		loading:    map[string]bool{},
+	}
+	if err = c.valid(); err != nil {
+		return nil, err
+	}
+
+	tlsCfg, err := library.NewClientTLSConfig(&library.TLSCfg{
+		CAFile:             c.CAFile,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "load tls config")
+	}
+	c.httpClient = &http.Client{
+		Timeout: c.Timeout,
+		Transport: &http.Transport{
+			TLSClientConfig: tlsCfg,
+		},
+	}
+
+	return c, nil
+}
+
+func (c *k8sMetaClient) valid() error {
+	if c.APIServer == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return errors.New("api_server should not be empty if not running in kubernetes")
+		}
+		c.APIServer = "https://" + net.JoinHostPort(host, port)
+		log.Logger.Info("reset k8s.api_server", zap.String("api_server", c.APIServer))
+	}
+	c.APIServer = strings.TrimRight(c.APIServer, "/")
+
+	if c.TokenFile == "" {
+		if _, err := os.Stat(defaultK8sTokenFile); err == nil {
+			c.TokenFile = defaultK8sTokenFile
+			log.Logger.Info("reset k8s.token_file", zap.String("token_file", c.TokenFile))
+		}
+	}
+
+	if c.CAFile == "" && strings.HasPrefix(c.APIServer, "https://") {
+		if _, err := os.Stat(defaultK8sCAFile); err == nil {
+			c.CAFile = defaultK8sCAFile
+			log.Logger.Info("reset k8s.ca_file", zap.String("ca_file", c.CAFile))
+		}
+	}
+
+	if c.CacheTTL <= 0 {
+		c.CacheTTL = defaultK8sCacheTTL
+		log.Logger.Info("reset k8s.cache_ttl_sec", zap.Duration("cache_ttl_sec", c.CacheTTL))
+	}
+
+	if c.Timeout <= 0 {
+		c.Timeout = defaultK8sTimeout
+		log.Logger.Info("reset k8s.timeout_sec", zap.Duration("timeout_sec", c.Timeout))
+	}
+
+	return nil
+}
+
+// getPod load pod metadata from cache without blocking,
+// request api server in background if not cached or expired.
+// isReady is false if metadata is still loading,
+// pod is nil if pod not found or api server unavailable.
+func (c *k8sMetaClient) getPod(namespace, name string) (pod *k8sPodMeta, isReady bool) {
+	key := namespace + "/" + name
+	c.Lock()
+	defer c.Unlock()
+	meta, ok := c.cache[key]
+	if (!ok || utils.Clock.GetUTCNow().After(meta.expireAt)) && !c.loading[key] {
+		c.loading[key] = true
+		go c.loadPod(key, namespace, name)
+	}
+
+	switch {
+	case !ok:
+		return nil, false
+	case meta.isMissing:
+		return nil, true
+	default:
+		return meta, true
+	}
+}
+
+// loadPod request pod metadata from api server and save into cache
+func (c *k8sMetaClient) loadPod(key, namespace, name string) {
+	meta, err := c.requestPod(namespace, name)
+	if err != nil {
+		log.Logger.Warn("load pod metadata from kubernetes",
+			zap.Error(err),
+			zap.String("namespace", namespace),
+			zap.String("pod", name))
+		// do not query missing pod again until expired
+		meta = &k8sPodMeta{isMissing: true}
+	}
+	meta.expireAt = utils.Clock.GetUTCNow().Add(c.CacheTTL)
+
+	c.Lock()
+	c.cache[key] = meta
+	delete(c.loading, key)
+	c.Unlock()
+}
+
+func (c *k8sMetaClient) requestPod(namespace, name string) (*k8sPodMeta, error) {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/api/v1/namespaces/%s/pods/%s", c.APIServer, namespace, name), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "new request")
+	}
+	if c.TokenFile != "" {
+		token, err := ioutil.ReadFile(c.TokenFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read token file `%s`", c.TokenFile)
+		}
+		req.Header.Set("Authorization", "Bearer "+string(bytes.TrimSpace(token)))
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "request")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("api server return status %d", resp.StatusCode)
+	}
+
+	pod := &struct {
+		Metadata struct {
+			UID    string            `json:"uid"`
+			Labels map[string]string `json:"labels"`
+		} `json:"metadata"`
+		Spec struct {
+			NodeName string `json:"nodeName"`
+		} `json:"spec"`
+	}{}
+	if err = json.NewDecoder(resp.Body).Decode(pod); err != nil {
+		return nil, errors.Wrap(err, "decode pod")
+	}
+
+	return &k8sPodMeta{
+		uid:      pod.Metadata.UID,
+		nodeName: pod.Spec.NodeName,
+		labels:   pod.Metadata.Labels,
+	}, nil
+}
+
+// parseK8sLogFileName load pod_name, namespace, container_name & container_id
+// from file name like `<pod_name>_<namespace>_<container_name>-<container_id>.log`,
+// return nil if not match.
+func parseK8sLogFileName(fpath string) map[string]interface{} {
+	m := map[string]interface{}{}
+	if err := library.RegexNamedSubMatch(k8sLogFileRegexp, []byte(filepath.Base(fpath)), m); err != nil {
+		return nil
+	}
+	for k, v := range m { // RegexNamedSubMatch set []byte
+		if b, ok := v.([]byte); ok {
+			m[k] = string(b)
+		}
+	}
+	return m
+}
+
+// parseCRILog parse line in CRI format: `<time> <stream> <tag> <log>`,
+// tag `P` means partial line.
+func parseCRILog(line []byte) (ts time.Time, stream string, isPartial bool, content []byte, err error) {
+	fields := bytes.SplitN(line, []byte{' '}, 4)
+	if len(fields) < 3 {
+		return ts, "", false, nil, errors.New("fields not enough")
+	}
+	if ts, err = time.Parse(time.RFC3339Nano, string(fields[0])); err != nil {
+		return ts, "", false, nil, errors.Wrap(err, "parse time")
+	}
+	// tags are separated by `:`, the first one is `P` or `F`
+	isPartial = bytes.HasPrefix(fields[2], []byte("P"))
+	if len(fields) == 4 {
+		content = fields[3]
+	}
+	return ts.UTC(), string(fields[1]), isPartial, content, nil
+}
+
+// parseDockerJSONLog parse line in docker json-file format:
+// `{"log": "...\n", "stream": "stdout", "time": "..."}`,
+// log without newline means partial line.
+func parseDockerJSONLog(line []byte) (ts time.Time, stream string, isPartial bool, content []byte, err error) {
+	entry := &struct {
+		Log    string    `json:"log"`
+		Stream string    `json:"stream"`
+		Time   time.Time `json:"time"`
+	}{}
+	if err = json.Unmarshal(line, entry); err != nil {
+		return ts, "", false, nil, errors.Wrap(err, "unmarshal")
+	}
+
+	content = []byte(entry.Log)
+	if bytes.HasSuffix(content, []byte{'\n'}) {
+		content = bytes.TrimRight(content, "\r\n")
+	} else {
+		isPartial = true
+	}
+	return entry.Time.UTC(), entry.Stream, isPartial, content, nil
+}
@@ -0,0 +1,225 @@
+package recvs
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeK8sPod pod returned by fake kubernetes api server
+type fakeK8sPod struct {
+	Namespace, Name, UID, NodeName string
+	Labels                         map[string]string
+}
+
+// newFakeK8sAPIServer run a fake kubernetes api server that only serves
+// `GET /api/v1/namespaces/<namespace>/pods/<name>`,
+// nRequests counts the requests it received.
+func newFakeK8sAPIServer(token string, pods ...*fakeK8sPod) (srv *httptest.Server, nRequests *int64) {
+	nRequests = new(int64)
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(nRequests, 1)
+		if token != "" && req.Header.Get("Authorization") != "Bearer "+token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		for _, pod := range pods {
+			if req.URL.Path != fmt.Sprintf("/api/v1/namespaces/%s/pods/%s", pod.Namespace, pod.Name) {
+				continue
+			}
+
+			if err := json.NewEncoder(w).Encode(map[string]interface{}{
+				"kind": "Pod",
+				"metadata": map[string]interface{}{
+					"name":      pod.Name,
+					"namespace": pod.Namespace,
+					"uid":       pod.UID,
+					"labels":    pod.Labels,
+				},
+				"spec": map[string]interface{}{
+					"nodeName": pod.NodeName,
+				},
+			}); err != nil {
+				panic(err)
+			}
+			return
+		}
+
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	return srv, nRequests
+}
+
+func TestParseCRILog(t *testing.T) {
+	ts, stream, isPartial, content, err := parseCRILog([]byte("2020-01-02T03:04:05.123456789Z stderr P hello world"))
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	if !ts.Equal(time.Date(2020, 1, 2, 3, 4, 5, 123456789, time.UTC)) ||
+		stream != "stderr" ||
+		!isPartial ||
+		string(content) != "hello world" {
+		t.Fatalf("got %v, %v, %v, %s", ts, stream, isPartial, content)
+	}
+
+	if _, _, isPartial, content, err = parseCRILog([]byte("2020-01-02T03:04:05Z stdout F")); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	if isPartial || len(content) != 0 {
+		t.Fatalf("got %v, %s", isPartial, content)
+	}
+
+	if _, _, _, _, err = parseCRILog([]byte("hello world")); err == nil {
+		t.Fatal("should got error")
+	}
+}
+
+func TestParseDockerJSONLog(t *testing.T) {
+	ts, stream, isPartial, content, err := parseDockerJSONLog([]byte(`{"log":"hello\n","stream":"stdout","time":"2020-01-02T03:04:05.1Z"}`))
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	if !ts.Equal(time.Date(2020, 1, 2, 3, 4, 5, 100000000, time.UTC)) ||
+		stream != "stdout" ||
+		isPartial ||
+		string(content) != "hello" {
+		t.Fatalf("got %v, %v, %v, %s", ts, stream, isPartial, content)
+	}
+
+	if _, _, isPartial, _, err = parseDockerJSONLog([]byte(`{"log":"hel","stream":"stdout","time":"2020-01-02T03:04:05.1Z"}`)); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	if !isPartial {
+		t.Fatal("should be partial")
+	}
+}
+
+func TestTailRecvK8s(t *testing.T) {
+	var (
+		dir         = t.TempDir()
+		containerID = strings.Repeat("a", 64)
+		fpath       = filepath.Join(dir, "web-0_default_nginx-"+containerID+".log")
+	)
+	srv, nRequests := newFakeK8sAPIServer("", &fakeK8sPod{
+		Namespace: "default",
+		Name:      "web-0",
+		UID:       "uid-1",
+		NodeName:  "node-1",
+		Labels:    map[string]string{"app": "web"},
+	})
+	defer srv.Close()
+
+	appendFile(t, fpath, strings.Join([]string{
+		"2020-01-02T03:04:05Z stdout P hello ",
+		"2020-01-02T03:04:05Z stderr F error",
+		"2020-01-02T03:04:06Z stdout F world",
+		"",
+	}, "\n"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	outChan, done := runTailRecv(ctx, &TailRecvCfg{
+		Name:           "tail-k8s-test",
+		Paths:          []string{filepath.Join(dir, "*.log")},
+		Tag:            "k8s.${namespace}.${container_name}",
+		PollInterval:   20 * time.Millisecond,
+		IsReadFromHead: true,
+		Format:         TailFormatCRI,
+		K8s: &K8sMetaCfg{
+			Enable:    true,
+			APIServer: srv.URL,
+		},
+	})
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	expects := []struct {
+		log, stream string
+		ts          time.Time
+	}{
+		{"error", "stderr", time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{"hello world", "stdout", time.Date(2020, 1, 2, 3, 4, 6, 0, time.UTC)},
+	}
+	for _, expect := range expects {
+		select {
+		case msg := <-outChan:
+			if msg.Message["log"] != expect.log ||
+				msg.Message["stream"] != expect.stream ||
+				!msg.Time.Equal(expect.ts) {
+				t.Fatalf("expect %+v, got %+v, %v", expect, msg.Message, msg.Time)
+			}
+			if msg.Tag != "k8s.default.nginx" ||
+				msg.Message["pod_name"] != "web-0" ||
+				msg.Message["namespace"] != "default" ||
+				msg.Message["container_name"] != "nginx" ||
+				msg.Message["container_id"] != containerID ||
+				msg.Message["pod_id"] != "uid-1" ||
+				msg.Message["node_name"] != "node-1" ||
+				msg.Message["labels"].(map[string]interface{})["app"] != "web" {
+				t.Fatalf("got %+v", msg.Message)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("can not load msg")
+		}
+	}
+
+	// metadata should be cached
+	if n := atomic.LoadInt64(nRequests); n != 1 {
+		t.Fatalf("expect 1 request, got %d", n)
+	}
+}
+
+func TestK8sMetaClientAsync(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	var (
+		dir       = t.TempDir()
+		podFpath  = filepath.Join(dir, "web-0_default_nginx-"+strings.Repeat("a", 64)+".log")
+		hostFpath = filepath.Join(dir, "host.log")
+	)
+	appendFile(t, podFpath, "2020-01-02T03:04:05Z stdout F pod\n")
+	appendFile(t, hostFpath, "2020-01-02T03:04:05Z stdout F host\n")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	outChan, done := runTailRecv(ctx, &TailRecvCfg{
+		Name:           "tail-k8s-async-test",
+		Paths:          []string{filepath.Join(dir, "*.log")},
+		Tag:            "k8s",
+		PollInterval:   20 * time.Millisecond,
+		IsReadFromHead: true,
+		Format:         TailFormatCRI,
+		K8s: &K8sMetaCfg{
+			Enable:    true,
+			APIServer: srv.URL,
+		},
+	})
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// file without pod metadata should not be blocked by api server
+	if lines := loadTailLines(t, outChan, 1); lines[0] != "host" {
+		t.Fatalf("got %v", lines)
+	}
+
+	// lines of pod are read after metadata loaded
+	release <- struct{}{}
+	if lines := loadTailLines(t, outChan, 1); lines[0] != "pod" {
+		t.Fatalf("got %v", lines)
+	}
+}
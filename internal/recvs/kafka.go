@@ -2,19 +2,37 @@ package recvs
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
+	"gofluentd/internal/monitor"
 	"gofluentd/library"
 	"gofluentd/library/log"
 
-	"github.com/Laisky/go-kafka"
 	"github.com/Laisky/zap"
+	"github.com/Shopify/sarama"
+	"github.com/gin-gonic/gin"
 	"github.com/pkg/errors"
+	"github.com/xdg/scram"
 )
 
 const (
-	defaultKafkaReconnectInterval = 1 * time.Hour
+	defaultKafkaReconnectInterval    = 1 * time.Hour
+	defaultKafkaTopicRefreshInterval = 1 * time.Minute
+	defaultKafkaVersion              = "1.0.0"
+
+	// KafkaSASLPlain SASL/PLAIN
+	KafkaSASLPlain = sarama.SASLTypePlaintext
+	// KafkaSASLSCRAMSHA256 SASL/SCRAM-SHA-256
+	KafkaSASLSCRAMSHA256 = sarama.SASLTypeSCRAMSHA256
+	// KafkaSASLSCRAMSHA512 SASL/SCRAM-SHA-512
+	KafkaSASLSCRAMSHA512 = sarama.SASLTypeSCRAMSHA512
 )
 
 func GetKafkaRewriteTag(rewriteTag, env string) string {
@@ -31,6 +49,59 @@ type KafkaCommitCfg struct {
 	IntervalDuration time.Duration
 }
 
+/*KafkaTopicCfg how to process messages of topic
+
+Args:
+	Topic: subscribe topic, one of Topic and TopicRegexp should be set
+	TopicRegexp: subscribe all topics match this regexp
+	IsJSONFormat: unmarshal json into `msg.Message`
+	MsgKey: put kafka msg body into `msg.Message[MsgKey]`
+	Tag: set `msg.Tag`
+	JSONTagKey: load tag from kafka message(only work when IsJSONFormat is true)
+	RewriteTag: rewrite `msg.Tag`, `msg.Message["tag"]` will keep origin value
+	AddCfg: add new field and value into `msg.Message`
+*/
+type KafkaTopicCfg struct {
+	Topic       string
+	TopicRegexp *regexp.Regexp
+	Tag, MsgKey,
+	JSONTagKey, RewriteTag string
+	IsJSONFormat bool
+	AddCfg       library.AddCfg
+}
+
+// match check whether topic is subscribed by this cfg
+func (c *KafkaTopicCfg) match(topic string) bool {
+	if c.TopicRegexp != nil {
+		return c.TopicRegexp.MatchString(topic)
+	}
+	return c.Topic == topic
+}
+
+// KafkaSASLCfg SASL authentication
+type KafkaSASLCfg struct {
+	// Mechanism: PLAIN/SCRAM-SHA-256/SCRAM-SHA-512
+	Mechanism,
+	Username, Password string
+}
+
+/*KafkaMetadataCfg put metadata of kafka message into `msg.Message`,
+field will not be set if its key is empty
+
+Args:
+	KeyField: message key in string, can be used as `lb_key` in tag filters
+	HeadersField: headers in `map[string]interface{}`, requires kafka >= 0.11
+	TopicField, PartitionField, OffsetField: where message come from
+	TimestampField: broker timestamp in RFC3339Nano, requires kafka >= 0.10
+	IsEventTime: use broker timestamp as `msg.Time`
+*/
+type KafkaMetadataCfg struct {
+	KeyField, HeadersField,
+	TopicField, PartitionField, OffsetField,
+	TimestampField string
+	IsEventTime bool
+}
+
 /*KafkaCfg kafka client configuration
 
 Args:
@@ -38,32 +109,70 @@ Args:
 	MsgKey: put kafka msg body into `msg.Message[MsgKey]`
 	TagKey: set tag into `msg.Message[TagKey]`
 	Name: name of this recv plugin
-	KMsgPool: sync.Pool for `*utils.kafka.KafkaMsg`
 	Meta: add new field and value into `msg.Message`
 	JSONTagKey: load tag from kafka message(only work when IsJSONFormat is true)
 	RewriteTag: rewrite `msg.Tag`, `msg.Message["tag"]` will keep origin value
 	ReconnectInterval: restart consumer periodically
+	TopicCfgs: process each topic in different way,
+		will be generated by Topics, Tag, MsgKey... if empty
+	Version: kafka version like `1.0.0`
+	SASL: SASL authentication, disabled if nil
+	TLS: TLS connection, disabled if nil
+	AckMode: when to commit offset, consume/journal/sender
+	MaxPending: max unacked messages of each partition, stop consuming if exceeded
+	AckTimeout: consume again from the oldest unacked message if it waits too long
+	HTTPSrv: register admin endpoints for backfill
+	IsEnableBackfill: admin endpoints of backfill are only registered if enabled
+	BackfillAuth: authenticate requests to admin endpoints, required if backfill enabled
+	BackfillTag: default `msg.Tag` of backfill messages
+	Metadata: put metadata of kafka message into `msg.Message`, disabled if nil
 */
 type KafkaCfg struct {
 	KafkaCommitCfg
 	Topics, Brokers                  []string
 	Group, Tag, MsgKey, TagKey, Name string
 	NConsumer                        int
-	KMsgPool                         *sync.Pool
 	IsJSONFormat                     bool
 	JSONTagKey                       string
 	RewriteTag                       string
 	ReconnectInterval                time.Duration
+
+	TopicCfgs []*KafkaTopicCfg
+	Version   string
+	SASL      *KafkaSASLCfg
+	TLS       *library.TLSCfg
+
+	AckMode    string
+	MaxPending int
+	AckTimeout time.Duration
+
+	HTTPSrv          *gin.Engine
+	IsEnableBackfill bool
+	BackfillAuth     *HTTPAuthCfg
+	BackfillTag      string
+
+	Metadata *KafkaMetadataCfg
 }
 
 type KafkaRecv struct {
 	BaseRecv
 	*KafkaCfg
+
+	saramaCfg *sarama.Config
+	// trackers map["topic/partition"]*kafkaOffsetTracker
+	trackers *sync.Map
+
+	backfillLock sync.Mutex
+	// runCtx backfill will stop when recv exit
+	runCtx       context.Context
+	backfill     *kafkaBackfill
+	backfillAuth httpAuthenticator
 }
 
 func NewKafkaRecv(cfg *KafkaCfg) *KafkaRecv {
 	k := &KafkaRecv{
 		KafkaCfg: cfg,
+		trackers: &sync.Map{},
 	}
 	if err := k.valid(); err != nil {
 		log.Logger.Panic("new kafka recv", zap.Error(err))
@@ -71,6 +180,7 @@ func NewKafkaRecv(cfg *KafkaCfg) *KafkaRecv {
 
 	log.Logger.Info("new kafka recv",
 		zap.Strings("topics", cfg.Topics),
+		zap.Int("n_topic_cfgs", len(cfg.TopicCfgs)),
 		zap.Strings("brokers", cfg.Brokers),
 		zap.Bool("is_json_format", cfg.IsJSONFormat),
 		zap.String("tag_key", cfg.TagKey),
@@ -81,11 +191,15 @@ func NewKafkaRecv(cfg *KafkaCfg) *KafkaRecv {
 		zap.String("msg_key", cfg.MsgKey),
 		zap.Duration("reconnect_sec", cfg.ReconnectInterval),
 		zap.String("json_tag_key", cfg.JSONTagKey),
+		zap.String("ack_mode", cfg.AckMode),
 	)
+	if k.HTTPSrv != nil && k.IsEnableBackfill {
+		k.bindBackfillHTTP()
+	}
 	return k
 }
 
-func (r *KafkaRecv) valid() error {
+func (r *KafkaRecv) valid() (err error) {
 	if !r.IsJSONFormat {
 		if r.MsgKey == "" {
 			r.MsgKey = "log"
@@ -113,140 +227,607 @@ func (r *KafkaRecv) valid() error {
 		log.Logger.Info("reset interval_sec", zap.Duration("interval_sec", r.IntervalDuration))
 	}
 
+	// compatible with single topic configuration
+	if len(r.TopicCfgs) == 0 {
+		for _, topic := range r.Topics {
+			if topic == "" {
+				continue
+			}
+			r.TopicCfgs = append(r.TopicCfgs, &KafkaTopicCfg{
+				Topic:        topic,
+				Tag:          r.Tag,
+				MsgKey:       r.MsgKey,
+				JSONTagKey:   r.JSONTagKey,
+				RewriteTag:   r.RewriteTag,
+				IsJSONFormat: r.IsJSONFormat,
+				AddCfg:       r.AddCfg,
+			})
+		}
+	}
+	if len(r.TopicCfgs) == 0 {
+		return errors.New("topics should not be empty")
+	}
+	for _, c := range r.TopicCfgs {
+		if c.Topic == "" && c.TopicRegexp == nil {
+			return errors.New("one of topic and topic_regexp should be set")
+		}
+		if !c.IsJSONFormat && c.MsgKey == "" {
+			c.MsgKey = r.MsgKey
+		}
+		if c.MsgKey == "" {
+			c.MsgKey = "log"
+		}
+		if c.Tag == "" && c.JSONTagKey == "" {
+			return errors.Errorf("tag of topic `%s` should not be empty", c.Topic)
+		}
+	}
+
+	switch r.AckMode {
+	case "":
+		r.AckMode = KafkaAckModeConsume
+		log.Logger.Info("reset ack_mode", zap.String("ack_mode", r.AckMode))
+	case KafkaAckModeConsume, KafkaAckModeJournal, KafkaAckModeSender:
+	default:
+		return errors.Errorf("unknown ack_mode `%s`", r.AckMode)
+	}
+	if r.MaxPending <= 0 {
+		r.MaxPending = defaultKafkaMaxPending
+		log.Logger.Info("reset max_pending", zap.Int("max_pending", r.MaxPending))
+	}
+	if r.AckTimeout <= 0 {
+		r.AckTimeout = defaultKafkaAckTimeout
+		log.Logger.Info("reset ack_timeout_sec", zap.Duration("ack_timeout_sec", r.AckTimeout))
+	}
+
+	if r.Version == "" {
+		r.Version = defaultKafkaVersion
+		log.Logger.Info("reset version", zap.String("version", r.Version))
+	}
+	if r.saramaCfg, err = r.newSaramaCfg(); err != nil {
+		return errors.Wrap(err, "new sarama config")
+	}
+
+	if r.IsEnableBackfill {
+		if r.BackfillAuth == nil || r.BackfillAuth.Type == "" {
+			return errors.New("backfill_auth should be set if backfill enabled")
+		}
+		if r.backfillAuth, err = newHTTPAuthenticator(r.BackfillAuth); err != nil {
+			return errors.Wrap(err, "new backfill authenticator")
+		}
+	}
+
 	return nil
 }
 
+// newSaramaCfg generate consumer config
+func (r *KafkaRecv) newSaramaCfg() (c *sarama.Config, err error) {
+	c = sarama.NewConfig()
+	if c.Version, err = sarama.ParseKafkaVersion(r.Version); err != nil {
+		return nil, errors.Wrapf(err, "parse version `%s`", r.Version)
+	}
+	c.ClientID = "go-fluentd"
+	c.Net.KeepAlive = 30 * time.Second
+	// do not return errors by channel, `consumerGroup.Close` of sarama
+	// races with sending errors. errors of `Consume` are still returned.
+	c.Consumer.Return.Errors = false
+	c.Consumer.Offsets.AutoCommit.Interval = r.IntervalDuration
+
+	if r.SASL != nil && r.SASL.Mechanism != "" {
+		c.Net.SASL.Enable = true
+		c.Net.SASL.Handshake = true
+		c.Net.SASL.User = r.SASL.Username
+		c.Net.SASL.Password = r.SASL.Password
+		switch strings.ToUpper(r.SASL.Mechanism) {
+		case KafkaSASLPlain:
+			c.Net.SASL.Mechanism = KafkaSASLPlain
+		case KafkaSASLSCRAMSHA256:
+			c.Net.SASL.Mechanism = KafkaSASLSCRAMSHA256
+			c.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+				return &kafkaSCRAMClient{HashGeneratorFcn: sha256.New}
+			}
+		case KafkaSASLSCRAMSHA512:
+			c.Net.SASL.Mechanism = KafkaSASLSCRAMSHA512
+			c.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+				return &kafkaSCRAMClient{HashGeneratorFcn: sha512.New}
+			}
+		default:
+			return nil, errors.Errorf("unknown sasl mechanism `%s`", r.SASL.Mechanism)
+		}
+	}
+
+	if r.TLS != nil && r.TLS.Enable {
+		c.Net.TLS.Enable = true
+		if c.Net.TLS.Config, err = library.NewClientTLSConfig(r.TLS); err != nil {
+			return nil, errors.Wrap(err, "load tls config")
+		}
+	}
+
+	return c, c.Validate()
+}
+
 func (r *KafkaRecv) GetName() string {
 	return r.Name
 }
 
+// Run block until all consumers exit
 func (r *KafkaRecv) Run(ctx context.Context) {
 	log.Logger.Info("run KafkaRecv")
+	r.backfillLock.Lock()
+	r.runCtx = ctx
+	r.backfillLock.Unlock()
+	monitor.AddMetric("kafkarecv."+r.Name, func() map[string]interface{} {
+		metric := map[string]interface{}{
+			"ackMode": r.AckMode,
+		}
+		r.trackers.Range(func(k, v interface{}) bool {
+			metric[k.(string)] = v.(*kafkaOffsetTracker).getMetric()
+			return true
+		})
+		return metric
+	})
+	wg := &sync.WaitGroup{}
 	for i := 0; i < r.NConsumer; i++ {
+		wg.Add(1)
 		go func(i int) {
+			defer wg.Done()
 			defer log.Logger.Info("kafka reciver exit", zap.Int("n", i))
-			var (
-				ok           bool
-				kmsg         *kafka.KafkaMsg
-				msg          *library.FluentMsg
-				ctx2Consumer context.Context
-				cancel       func()
-			)
-
 			for {
 				select {
 				case <-ctx.Done():
-					if cancel != nil {
-						cancel()
-					}
 					return
 				default:
 				}
 
-				ctx2Consumer, cancel = context.WithTimeout(ctx, r.ReconnectInterval)
-				cli, err := kafka.NewKafkaCliWithGroupID(
-					ctx2Consumer,
-					&kafka.KafkaCliCfg{
-						Brokers:  r.Brokers,
-						Topics:   r.Topics,
-						Groupid:  r.Group,
-						KMsgPool: r.KMsgPool,
-					},
-					kafka.WithCommitFilterCheckInterval(r.IntervalDuration),
-					kafka.WithCommitFilterCheckNum(r.IntervalNum),
-				)
+				// restart consumer periodically
+				ctx2Consumer, cancel := context.WithTimeout(ctx, r.ReconnectInterval)
+				err := r.runConsumer(ctx2Consumer, i)
+				cancel()
 				if err != nil {
-					log.Logger.Error("try to connect to kafka got error", zap.Error(err))
-					cancel()
-					continue
-				}
-				log.Logger.Info("connect to kafka brokers",
-					zap.Strings("brokers", r.Brokers),
-					zap.Strings("topics", r.Topics),
-					zap.Int("intervalnum", r.IntervalNum),
-					zap.Int("nconsumer", r.NConsumer),
-					zap.Duration("intervalduration", r.IntervalDuration),
-					zap.String("group", r.Group))
-
-				msgChan := cli.Messages(ctx)
-			CONSUMER_LOOP:
-				for { // receive new kmsg, and convert to fluent msg
+					log.Logger.Error("try to consume kafka got error",
+						zap.String("name", r.GetName()),
+						zap.Error(err))
 					select {
-					case <-ctx2Consumer.Done():
-						break CONSUMER_LOOP
-					case kmsg, ok = <-msgChan:
-						if !ok {
-							log.Logger.Info("consumer break")
-							cancel()
-							break CONSUMER_LOOP
-						}
+					case <-ctx.Done():
+					case <-time.After(defaultRetryWait):
 					}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
 
-					log.Logger.Debug("got new message from kafka",
-						zap.Int("n", i),
-						zap.Int32("partition", kmsg.Partition),
-						zap.ByteString("msg", kmsg.Message),
-						zap.String("name", r.GetName()))
-					if msg, err = r.parse2Msg(kmsg); err != nil {
-						log.Logger.Error("try to parse kafka message got error",
-							zap.String("name", r.GetName()),
-							zap.Error(err),
-							zap.ByteString("log", kmsg.Message))
-						cli.CommitWithMsg(kmsg)
-						continue
-					}
+// runConsumer consume topics until ctx done,
+// will resubscribe if matched topics changed.
+func (r *KafkaRecv) runConsumer(ctx context.Context, i int) error {
+	cli, err := sarama.NewClient(r.Brokers, r.saramaCfg)
+	if err != nil {
+		return errors.Wrap(err, "connect to kafka")
+	}
+	defer cli.Close()
+	group, err := sarama.NewConsumerGroupFromClient(r.Group, cli)
+	if err != nil {
+		return errors.Wrap(err, "new consumer group")
+	}
+	defer group.Close()
 
-					r.syncOutChan <- msg // blockable
-					cli.CommitWithMsg(kmsg)
+	for {
+		topics, err := r.resolveTopics(cli)
+		if err != nil {
+			return err
+		}
+		if len(topics) == 0 {
+			log.Logger.Warn("no topic matched", zap.String("name", r.GetName()))
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(defaultKafkaTopicRefreshInterval):
+				continue
+			}
+		}
+		log.Logger.Info("consume kafka topics",
+			zap.String("name", r.GetName()),
+			zap.Int("n", i),
+			zap.Strings("brokers", r.Brokers),
+			zap.Strings("topics", topics),
+			zap.String("group", r.Group))
+
+		ctx2Session, cancel := context.WithCancel(ctx)
+		go r.watchTopics(ctx2Session, cancel, cli, topics)
+		err = group.Consume(ctx2Session, topics, &kafkaConsumerGroupHandler{
+			recv:   r,
+			n:      i,
+			cancel: cancel,
+		})
+		cancel()
+		if err != nil {
+			return errors.Wrap(err, "consume")
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+// resolveTopics load all topics match TopicCfgs
+func (r *KafkaRecv) resolveTopics(cli sarama.Client) (topics []string, err error) {
+	set := map[string]struct{}{}
+	for _, c := range r.TopicCfgs {
+		if c.TopicRegexp == nil {
+			set[c.Topic] = struct{}{}
+		}
+	}
+
+	if r.hasTopicRegexp() {
+		if err = cli.RefreshMetadata(); err != nil {
+			return nil, errors.Wrap(err, "refresh metadata")
+		}
+		all, err := cli.Topics()
+		if err != nil {
+			return nil, errors.Wrap(err, "load topics")
+		}
+		for _, topic := range all {
+			if strings.HasPrefix(topic, "__") { // internal topics
+				continue
+			}
+			for _, c := range r.TopicCfgs {
+				if c.TopicRegexp != nil && c.match(topic) {
+					set[topic] = struct{}{}
 				}
-				cli.Close()
 			}
-		}(i)
+		}
+	}
+
+	for topic := range set {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics, nil
+}
+
+// hasTopicRegexp whether topics may be changed
+func (r *KafkaRecv) hasTopicRegexp() bool {
+	for _, c := range r.TopicCfgs {
+		if c.TopicRegexp != nil {
+			return true
+		}
 	}
+	return false
+}
+
+// watchTopics cancel session if matched topics changed
+func (r *KafkaRecv) watchTopics(ctx context.Context, cancel func(), cli sarama.Client, topics []string) {
+	if !r.hasTopicRegexp() {
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(defaultKafkaTopicRefreshInterval):
+		}
+
+		newTopics, err := r.resolveTopics(cli)
+		if err != nil {
+			log.Logger.Warn("refresh kafka topics", zap.Error(err))
+			continue
+		}
+		if strings.Join(newTopics, ",") != strings.Join(topics, ",") {
+			log.Logger.Info("kafka topics changed, resubscribe",
+				zap.Strings("old", topics),
+				zap.Strings("new", newTopics))
+			cancel()
+			return
+		}
+	}
+}
+
+// getTopicCfg return the first cfg match topic
+func (r *KafkaRecv) getTopicCfg(topic string) *KafkaTopicCfg {
+	for _, c := range r.TopicCfgs {
+		if c.match(topic) {
+			return c
+		}
+	}
+	return nil
+}
+
+// kafkaConsumerGroupHandler convert kafka messages to fluent msgs
+type kafkaConsumerGroupHandler struct {
+	recv *KafkaRecv
+	n    int
+	// cancel restart session
+	cancel func()
+}
+
+func (h *kafkaConsumerGroupHandler) Setup(sess sarama.ConsumerGroupSession) error {
+	log.Logger.Info("kafka consumer group rebalanced",
+		zap.String("name", h.recv.GetName()),
+		zap.Int("n", h.n),
+		zap.Int32("generation", sess.GenerationID()),
+		zap.Any("claims", sess.Claims()))
+	return nil
+}
+
+func (h *kafkaConsumerGroupHandler) Cleanup(sess sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+func (h *kafkaConsumerGroupHandler) ConsumeClaim(sess sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	r := h.recv
+	topicCfg := r.getTopicCfg(claim.Topic())
+	if topicCfg == nil {
+		return errors.Errorf("unknown topic `%s`", claim.Topic())
+	}
+	if r.AckMode == KafkaAckModeConsume {
+		return h.consumeAndCommit(sess, claim, topicCfg)
+	}
+
+	return h.consumeAndTrack(sess, claim, topicCfg)
+}
+
+// consumeAndCommit mark offset once msg is put into acceptor
+func (h *kafkaConsumerGroupHandler) consumeAndCommit(sess sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim, topicCfg *KafkaTopicCfg) error {
+	var (
+		r            = h.recv
+		msg          *library.FluentMsg
+		err          error
+		nUncommitted int
+	)
+	for kmsg := range claim.Messages() {
+		if msg, err = r.parseKafkaMsg(h.n, topicCfg, kmsg); err == nil {
+			select {
+			case r.syncOutChan <- msg: // blockable
+			case <-sess.Context().Done():
+				r.msgPool.Put(msg)
+				return nil
+			}
+		}
+
+		sess.MarkMessage(kmsg, "")
+		if nUncommitted++; nUncommitted >= r.IntervalNum {
+			sess.Commit()
+			nUncommitted = 0
+		}
+	}
+
+	return nil
+}
+
+// consumeAndTrack mark offset after msg acked by journal or senders,
+// will restart session if any msg is not acked in time.
+func (h *kafkaConsumerGroupHandler) consumeAndTrack(sess sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim, topicCfg *KafkaTopicCfg) error {
+	var (
+		r       = h.recv
+		msg     *library.FluentMsg
+		err     error
+		kmsg    *sarama.ConsumerMessage
+		ok      bool
+		key     = fmt.Sprintf("%s/%d", claim.Topic(), claim.Partition())
+		tracker = newKafkaOffsetTracker(sess, claim.Topic(), claim.Partition(), r.MaxPending, r.AckTimeout)
+		ticker  = time.NewTicker(r.AckTimeout / 10)
+	)
+	r.trackers.Store(key, tracker)
+	defer func() {
+		ticker.Stop()
+		tracker.close()
+		r.trackers.Delete(key)
+	}()
+
+	for {
+		// stop consuming until downstream catch up
+		for tracker.isFull() {
+			select {
+			case <-sess.Context().Done():
+				return nil
+			case <-tracker.notifyAckedChan:
+			case <-ticker.C:
+				if h.restartIfStalled(tracker) {
+					return nil
+				}
+			}
+		}
+
+		select {
+		case <-sess.Context().Done():
+			return nil
+		case <-ticker.C:
+			if h.restartIfStalled(tracker) {
+				return nil
+			}
+			continue
+		case kmsg, ok = <-claim.Messages():
+			if !ok {
+				return nil
+			}
+		}
+
+		acker := tracker.track(kmsg.Offset)
+		if msg, err = r.parseKafkaMsg(h.n, topicCfg, kmsg); err != nil {
+			acker.Ack() // never retry invalid message
+			continue
+		}
+
+		attachKafkaAcker(r.AckMode, msg, acker)
+		select {
+		case r.syncOutChan <- msg: // blockable
+		case <-sess.Context().Done():
+			msg.Ackers = nil
+			msg.CommitAckers = nil
+			r.msgPool.Put(msg)
+			return nil
+		}
+	}
+}
+
+// restartIfStalled restart session to consume from the oldest unacked message
+func (h *kafkaConsumerGroupHandler) restartIfStalled(tracker *kafkaOffsetTracker) bool {
+	if !tracker.isStalled() {
+		return false
+	}
+
+	log.Logger.Warn("kafka message not acked in time, restart consumer",
+		zap.String("name", h.recv.GetName()),
+		zap.String("topic", tracker.topic),
+		zap.Int32("partition", tracker.partition),
+		zap.Duration("ack_timeout", h.recv.AckTimeout))
+	h.cancel()
+	return true
+}
+
+// parseKafkaMsg parse kafkamsg and log error
+func (r *KafkaRecv) parseKafkaMsg(n int, topicCfg *KafkaTopicCfg, kmsg *sarama.ConsumerMessage) (msg *library.FluentMsg, err error) {
+	log.Logger.Debug("got new message from kafka",
+		zap.Int("n", n),
+		zap.String("topic", kmsg.Topic),
+		zap.Int32("partition", kmsg.Partition),
+		zap.Int64("offset", kmsg.Offset),
+		zap.ByteString("msg", kmsg.Value),
+		zap.String("name", r.GetName()))
+	if msg, err = r.parse2Msg(topicCfg, kmsg); err != nil {
+		log.Logger.Error("try to parse kafka message got error",
+			zap.String("name", r.GetName()),
+			zap.Error(err),
+			zap.ByteString("log", kmsg.Value))
+	}
+
+	return msg, err
 }
 
 // parse2Msg parse kafkamsg to fluentdmsg
-func (r *KafkaRecv) parse2Msg(kmsg *kafka.KafkaMsg) (msg *library.FluentMsg, err error) {
+func (r *KafkaRecv) parse2Msg(c *KafkaTopicCfg, kmsg *sarama.ConsumerMessage) (msg *library.FluentMsg, err error) {
 	msg = r.msgPool.Get().(*library.FluentMsg)
 	msg.ID = r.counter.Count()
-	msg.Tag = r.Tag
+	msg.Tag = c.Tag
+	msg.Time = time.Time{}
 
 	// remove old messages log
 	msg.Message = map[string]interface{}{}
 
-	if r.IsJSONFormat {
-		if err = json.Unmarshal(kmsg.Message, &msg.Message); err != nil {
+	if c.IsJSONFormat {
+		if err = json.Unmarshal(kmsg.Value, &msg.Message); err != nil {
 			r.msgPool.Put(msg)
 			return nil, errors.Wrap(err, "try to unmarshal kmsg got error")
 		}
 
-		if r.JSONTagKey != "" { // load msg.Tag from json
-			switch msg.Message[r.JSONTagKey].(type) {
+		if c.JSONTagKey != "" { // load msg.Tag from json
+			switch msg.Message[c.JSONTagKey].(type) {
 			case []byte:
-				msg.Tag = string(msg.Message[r.JSONTagKey].([]byte))
+				msg.Tag = string(msg.Message[c.JSONTagKey].([]byte))
 			case string:
-				msg.Tag = msg.Message[r.JSONTagKey].(string)
+				msg.Tag = msg.Message[c.JSONTagKey].(string)
 			default:
-				log.Logger.Error("discard log since unknown JSONTagKey format", zap.String("tagkey", r.JSONTagKey))
+				log.Logger.Error("discard log since unknown JSONTagKey format", zap.String("tagkey", c.JSONTagKey))
 				r.msgPool.Put(msg)
 				return nil, errors.New("unknown JSONTagKey format")
 			}
 		}
 	} else {
-		msg.Message[r.MsgKey] = kmsg.Message
+		msg.Message[c.MsgKey] = kmsg.Value
 	}
 
+	if r.Metadata != nil {
+		r.setMetadata(msg, kmsg)
+	}
 	if r.TagKey != "" {
 		msg.Message[r.TagKey] = msg.Tag
 	}
-	// log.Logger.Debug("parse2Msg got new msg",
-	// 	zap.String("tag", msg.Tag),
-	// 	zap.String("rewrite_tag", r.RewriteTag),
-	// 	zap.ByteString("msg", kmsg.Message))
-	if r.RewriteTag != "" {
-		msg.Tag = r.RewriteTag
+	if c.RewriteTag != "" {
+		msg.Tag = c.RewriteTag
 	}
 
-	library.ProcessAdd(r.AddCfg, msg)
+	library.ProcessAdd(c.AddCfg, msg)
 	return msg, nil
 }
+
+// setMetadata put metadata of kafka message into msg
+func (r *KafkaRecv) setMetadata(msg *library.FluentMsg, kmsg *sarama.ConsumerMessage) {
+	c := r.Metadata
+	if c.KeyField != "" && kmsg.Key != nil {
+		msg.Message[c.KeyField] = string(kmsg.Key)
+	}
+	if c.HeadersField != "" && len(kmsg.Headers) != 0 {
+		headers := make(map[string]interface{}, len(kmsg.Headers))
+		for _, h := range kmsg.Headers {
+			headers[string(h.Key)] = string(h.Value)
+		}
+		msg.Message[c.HeadersField] = headers
+	}
+	if c.TopicField != "" {
+		msg.Message[c.TopicField] = kmsg.Topic
+	}
+	if c.PartitionField != "" {
+		msg.Message[c.PartitionField] = kmsg.Partition
+	}
+	if c.OffsetField != "" {
+		msg.Message[c.OffsetField] = kmsg.Offset
+	}
+
+	if kmsg.Timestamp.Unix() <= 0 { // message format v0 has no timestamp
+		return
+	}
+	if c.TimestampField != "" {
+		msg.Message[c.TimestampField] = kmsg.Timestamp.UTC().Format(time.RFC3339Nano)
+	}
+	if c.IsEventTime {
+		msg.Time = kmsg.Timestamp.UTC()
+	}
+}
+
+// kafkaSCRAMClient implement sarama.SCRAMClient
+type kafkaSCRAMClient struct {
+	*scram.Client
+	*scram.ClientConversation
+	scram.HashGeneratorFcn
+}
+
+func (c *kafkaSCRAMClient) Begin(userName, password, authzID string) (err error) {
+	if c.Client, err = c.HashGeneratorFcn.NewClient(userName, password, authzID); err != nil {
+		return errors.Wrap(err, "new scram client")
+	}
+	c.ClientConversation = c.Client.NewConversation()
+	return nil
+}
+
+func (c *kafkaSCRAMClient) Step(challenge string) (string, error) {
+	return c.ClientConversation.Step(challenge)
+}
+
+func (c *kafkaSCRAMClient) Done() bool {
+	return c.ClientConversation.Done()
+}
+
+// ParseKafkaTopicCfgs parse settings to topic configs
+func ParseKafkaTopicCfgs(env string, cfg interface{}) []*KafkaTopicCfg {
+	items, ok := normalizeSettingVal(cfg).([]interface{})
+	if !ok {
+		return nil
+	}
+
+	cfgs := []*KafkaTopicCfg{}
+	for _, itemI := range items {
+		item, ok := itemI.(map[string]interface{})
+		if !ok {
+			log.Logger.Panic("kafka topic config should be map", zap.String("cfg", fmt.Sprint(itemI)))
+		}
+		c := &KafkaTopicCfg{}
+		c.Topic, _ = item["topic"].(string)
+		if v, ok := item["topic_regexp"].(string); ok && v != "" {
+			c.TopicRegexp = regexp.MustCompile(v)
+		}
+		if v, ok := item["tag"].(string); ok {
+			c.Tag = library.LoadTagReplaceEnv(env, v)
+		}
+		c.MsgKey, _ = item["msg_key"].(string)
+		c.JSONTagKey, _ = item["json_tag_key"].(string)
+		if v, ok := item["rewrite_tag"].(string); ok {
+			c.RewriteTag = GetKafkaRewriteTag(v, env)
+		}
+		c.IsJSONFormat, _ = item["is_json_format"].(bool)
+		c.AddCfg = library.ParseAddCfg(env, item["add"])
+		cfgs = append(cfgs, c)
+	}
+
+	return cfgs
+}
@@ -0,0 +1,145 @@
+package recvs
+
+import (
+	"sync"
+	"time"
+
+	"gofluentd/library"
+
+	"github.com/Shopify/sarama"
+)
+
+const (
+	// KafkaAckModeConsume commit offset once msg is put into acceptor
+	KafkaAckModeConsume = "consume"
+	// KafkaAckModeJournal commit offset after msg persisted into journal
+	KafkaAckModeJournal = "journal"
+	// KafkaAckModeSender commit offset after msg sent by all senders or discarded by filters
+	KafkaAckModeSender = "sender"
+
+	defaultKafkaMaxPending = 10000
+	defaultKafkaAckTimeout = 5 * time.Minute
+)
+
+// kafkaOffsetAcker ack one kafka message
+type kafkaOffsetAcker struct {
+	tracker *kafkaOffsetTracker
+	offset  int64
+	ts      time.Time
+	isAcked bool
+}
+
+// Ack implement library.AckerItf
+func (a *kafkaOffsetAcker) Ack() {
+	a.tracker.ack(a)
+}
+
+// kafkaOffsetTracker track the offsets of one partition,
+// only mark the contiguous acked offsets,
+// so out-of-order acks never mark offset past an unacked message.
+type kafkaOffsetTracker struct {
+	sync.Mutex
+	sess             sarama.ConsumerGroupSession
+	topic            string
+	partition        int32
+	isClosed         bool
+	markedOffset     int64
+	pending          []*kafkaOffsetAcker
+	notifyAckedChan  chan struct{}
+	ackTimeout       time.Duration
+	maxPendingLength int
+}
+
+func newKafkaOffsetTracker(sess sarama.ConsumerGroupSession, topic string, partition int32, maxPending int, ackTimeout time.Duration) *kafkaOffsetTracker {
+	return &kafkaOffsetTracker{
+		sess:             sess,
+		topic:            topic,
+		partition:        partition,
+		markedOffset:     -1,
+		notifyAckedChan:  make(chan struct{}, 1),
+		ackTimeout:       ackTimeout,
+		maxPendingLength: maxPending,
+	}
+}
+
+// track return acker of kafka message, offset should be increasing
+func (t *kafkaOffsetTracker) track(offset int64) *kafkaOffsetAcker {
+	a := &kafkaOffsetAcker{
+		tracker: t,
+		offset:  offset,
+		ts:      time.Now(),
+	}
+	t.Lock()
+	t.pending = append(t.pending, a)
+	t.Unlock()
+	return a
+}
+
+// ack mark acker as acked, then mark the contiguous acked offsets
+func (t *kafkaOffsetTracker) ack(a *kafkaOffsetAcker) {
+	t.Lock()
+	defer t.Unlock()
+	if t.isClosed || a.isAcked {
+		return
+	}
+	a.isAcked = true
+
+	n := 0
+	for n < len(t.pending) && t.pending[n].isAcked {
+		n++
+	}
+	if n == 0 {
+		return
+	}
+
+	t.markedOffset = t.pending[n-1].offset
+	t.sess.MarkOffset(t.topic, t.partition, t.markedOffset+1, "")
+	t.pending = t.pending[n:]
+	select {
+	case t.notifyAckedChan <- struct{}{}:
+	default:
+	}
+}
+
+// isFull whether there are too many unacked messages
+func (t *kafkaOffsetTracker) isFull() bool {
+	t.Lock()
+	defer t.Unlock()
+	return len(t.pending) >= t.maxPendingLength
+}
+
+// isStalled whether the oldest unacked message waits too long,
+// it may be discarded by downstream, should be consumed again.
+func (t *kafkaOffsetTracker) isStalled() bool {
+	t.Lock()
+	defer t.Unlock()
+	return len(t.pending) != 0 && time.Since(t.pending[0].ts) > t.ackTimeout
+}
+
+// close ignore all acks after session end
+func (t *kafkaOffsetTracker) close() {
+	t.Lock()
+	t.isClosed = true
+	t.pending = nil
+	t.Unlock()
+}
+
+// getMetric return the status of tracker
+func (t *kafkaOffsetTracker) getMetric() map[string]interface{} {
+	t.Lock()
+	defer t.Unlock()
+	return map[string]interface{}{
+		"markedOffset": t.markedOffset,
+		"pending":      len(t.pending),
+	}
+}
+
+// attachKafkaAcker attach acker to msg by ack mode
+func attachKafkaAcker(mode string, msg *library.FluentMsg, a *kafkaOffsetAcker) {
+	switch mode {
+	case KafkaAckModeJournal:
+		msg.Ackers = []library.AckerItf{a}
+	case KafkaAckModeSender:
+		msg.CommitAckers = []library.AckerItf{a}
+	}
+}
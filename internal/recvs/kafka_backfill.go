@@ -0,0 +1,333 @@
+package recvs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"gofluentd/library/log"
+
+	"github.com/Laisky/zap"
+	"github.com/Shopify/sarama"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// kafkaBackfillMaxBodySize max size of request body to admin endpoints
+const kafkaBackfillMaxBodySize = 1024 * 1024
+
+// KafkaBackfillReq is the request to replay kafka messages.
+// start from StartTime or Offsets, end at EndTime or the newest offset when requested.
+type KafkaBackfillReq struct {
+	// Topics: default to all subscribed topics
+	Topics    []string  `json:"topics"`
+	StartTime time.Time `json:"start_time"`
+	EndTime   time.Time `json:"end_time"`
+	// Offsets: map[topic]map[partition]offset, overwrite StartTime
+	Offsets map[string]map[int32]int64 `json:"offsets"`
+	// Tag: set `msg.Tag`, default to KafkaCfg.BackfillTag
+	Tag string `json:"tag"`
+}
+
+// kafkaBackfillPartition progress of one partition
+type kafkaBackfillPartition struct {
+	Topic       string `json:"topic"`
+	Partition   int32  `json:"partition"`
+	StartOffset int64  `json:"start_offset"`
+	// EndOffset: exclusive
+	EndOffset int64 `json:"end_offset"`
+	// Offset: next offset to consume
+	Offset    int64  `json:"offset"`
+	NConsumed int64  `json:"n_consumed"`
+	IsDone    bool   `json:"is_done"`
+	Error     string `json:"error,omitempty"`
+}
+
+// kafkaBackfill is a temporary consumer without consumer group
+type kafkaBackfill struct {
+	sync.Mutex
+	req        *KafkaBackfillReq
+	cancel     func()
+	startAt    time.Time
+	partitions []*kafkaBackfillPartition
+}
+
+// kafkaBackfillStatus is the response of backfill progress
+type kafkaBackfillStatus struct {
+	Tag        string                    `json:"tag"`
+	StartAt    time.Time                 `json:"start_at"`
+	IsRunning  bool                      `json:"is_running"`
+	Partitions []*kafkaBackfillPartition `json:"partitions"`
+}
+
+func (b *kafkaBackfill) isRunning() bool {
+	for _, p := range b.partitions {
+		if !p.IsDone {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *kafkaBackfill) status() *kafkaBackfillStatus {
+	b.Lock()
+	defer b.Unlock()
+	s := &kafkaBackfillStatus{
+		Tag:       b.req.Tag,
+		StartAt:   b.startAt,
+		IsRunning: b.isRunning(),
+	}
+	for _, p := range b.partitions {
+		cp := *p
+		s.Partitions = append(s.Partitions, &cp)
+	}
+	return s
+}
+
+// authBackfill reject requests to admin endpoints without valid credential
+func (r *KafkaRecv) authBackfill(ctx *gin.Context) {
+	body, err := ioutil.ReadAll(io.LimitReader(ctx.Request.Body, kafkaBackfillMaxBodySize))
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	ctx.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	if _, err = r.backfillAuth.Authenticate(ctx.Request, body); err != nil {
+		log.Logger.Warn("reject unauthorized backfill request",
+			zap.String("name", r.Name),
+			zap.String("remote", ctx.Request.RemoteAddr),
+			zap.Error(err))
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, map[string]string{"error": err.Error()})
+	}
+}
+
+// bindBackfillHTTP register admin endpoints to start/stop/query backfill
+func (r *KafkaRecv) bindBackfillHTTP() {
+	path := "/admin/kafka/" + r.Name + "/backfill"
+	r.HTTPSrv.POST(path, r.authBackfill, func(ctx *gin.Context) {
+		req := &KafkaBackfillReq{}
+		if err := ctx.BindJSON(req); err != nil {
+			return
+		}
+		if err := r.StartBackfill(req); err != nil {
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, r.getBackfillStatus())
+	})
+	r.HTTPSrv.GET(path, r.authBackfill, func(ctx *gin.Context) {
+		if s := r.getBackfillStatus(); s != nil {
+			ctx.JSON(http.StatusOK, s)
+			return
+		}
+		ctx.AbortWithStatusJSON(http.StatusNotFound, map[string]string{"error": "no backfill"})
+	})
+	r.HTTPSrv.DELETE(path, r.authBackfill, func(ctx *gin.Context) {
+		r.backfillLock.Lock()
+		defer r.backfillLock.Unlock()
+		if r.backfill != nil {
+			r.backfill.cancel()
+		}
+		ctx.JSON(http.StatusOK, map[string]string{"msg": "ok"})
+	})
+}
+
+func (r *KafkaRecv) getBackfillStatus() *kafkaBackfillStatus {
+	r.backfillLock.Lock()
+	defer r.backfillLock.Unlock()
+	if r.backfill == nil {
+		return nil
+	}
+	return r.backfill.status()
+}
+
+// StartBackfill replay kafka messages in background,
+// only one backfill can be running at the same time.
+func (r *KafkaRecv) StartBackfill(req *KafkaBackfillReq) (err error) {
+	if req.Tag == "" {
+		req.Tag = r.BackfillTag
+	}
+	if req.Tag == "" {
+		return errors.New("tag should not be empty")
+	}
+	if req.StartTime.IsZero() && len(req.Offsets) == 0 {
+		return errors.New("one of start_time and offsets should be set")
+	}
+	if !req.EndTime.IsZero() && req.EndTime.Before(req.StartTime) {
+		return errors.New("end_time should after start_time")
+	}
+
+	r.backfillLock.Lock()
+	defer r.backfillLock.Unlock()
+	if r.runCtx == nil {
+		return errors.New("recv is not running")
+	}
+	if r.backfill != nil && r.backfill.status().IsRunning {
+		return errors.New("another backfill is running")
+	}
+
+	cli, err := sarama.NewClient(r.Brokers, r.saramaCfg)
+	if err != nil {
+		return errors.Wrap(err, "connect to kafka")
+	}
+	b := &kafkaBackfill{
+		req:     req,
+		startAt: time.Now(),
+	}
+	if err = r.prepareBackfill(cli, b); err != nil {
+		cli.Close()
+		return err
+	}
+	consumer, err := sarama.NewConsumerFromClient(cli)
+	if err != nil {
+		cli.Close()
+		return errors.Wrap(err, "new consumer")
+	}
+
+	ctx, cancel := context.WithCancel(r.runCtx)
+	b.cancel = cancel
+	r.backfill = b
+	log.Logger.Info("start kafka backfill",
+		zap.String("name", r.GetName()),
+		zap.String("tag", req.Tag),
+		zap.Time("start_time", req.StartTime),
+		zap.Time("end_time", req.EndTime),
+		zap.Int("n_partitions", len(b.partitions)))
+
+	wg := &sync.WaitGroup{}
+	for _, p := range b.partitions {
+		if p.IsDone {
+			continue
+		}
+		wg.Add(1)
+		go func(p *kafkaBackfillPartition) {
+			defer wg.Done()
+			err := r.runBackfillPartition(ctx, consumer, b, p)
+			b.Lock()
+			p.IsDone = true
+			if err != nil {
+				p.Error = err.Error()
+			}
+			b.Unlock()
+		}(p)
+	}
+	go func() {
+		wg.Wait()
+		cancel()
+		consumer.Close()
+		cli.Close()
+		log.Logger.Info("kafka backfill done", zap.String("name", r.GetName()), zap.String("tag", req.Tag))
+	}()
+
+	return nil
+}
+
+// prepareBackfill load offset range of every partition
+func (r *KafkaRecv) prepareBackfill(cli sarama.Client, b *kafkaBackfill) (err error) {
+	req := b.req
+	topics := req.Topics
+	if len(topics) == 0 {
+		if topics, err = r.resolveTopics(cli); err != nil {
+			return err
+		}
+	}
+
+	for _, topic := range topics {
+		if r.getTopicCfg(topic) == nil {
+			return errors.Errorf("topic `%s` is not subscribed", topic)
+		}
+		partitions, err := cli.Partitions(topic)
+		if err != nil {
+			return errors.Wrapf(err, "load partitions of `%s`", topic)
+		}
+
+		for _, partition := range partitions {
+			p := &kafkaBackfillPartition{
+				Topic:     topic,
+				Partition: partition,
+			}
+			if p.EndOffset, err = cli.GetOffset(topic, partition, sarama.OffsetNewest); err != nil {
+				return errors.Wrapf(err, "load newest offset of `%s/%d`", topic, partition)
+			}
+			if !req.EndTime.IsZero() {
+				endOffset, err := cli.GetOffset(topic, partition, kafkaTimeToMillis(req.EndTime))
+				if err != nil {
+					return errors.Wrapf(err, "load offset by end_time of `%s/%d`", topic, partition)
+				}
+				if endOffset >= 0 && endOffset < p.EndOffset {
+					p.EndOffset = endOffset
+				}
+			}
+
+			if offset, ok := req.Offsets[topic][partition]; ok {
+				p.StartOffset = offset
+			} else if !req.StartTime.IsZero() {
+				if p.StartOffset, err = cli.GetOffset(topic, partition, kafkaTimeToMillis(req.StartTime)); err != nil {
+					return errors.Wrapf(err, "load offset by start_time of `%s/%d`", topic, partition)
+				}
+			} else { // only replay partitions in offsets
+				continue
+			}
+
+			// no message after start_time
+			if p.StartOffset < 0 || p.StartOffset >= p.EndOffset {
+				p.StartOffset = p.EndOffset
+				p.IsDone = true
+			}
+			p.Offset = p.StartOffset
+			b.partitions = append(b.partitions, p)
+		}
+	}
+
+	return nil
+}
+
+// runBackfillPartition consume partition from StartOffset to EndOffset
+func (r *KafkaRecv) runBackfillPartition(ctx context.Context, consumer sarama.Consumer, b *kafkaBackfill, p *kafkaBackfillPartition) error {
+	pc, err := consumer.ConsumePartition(p.Topic, p.Partition, p.StartOffset)
+	if err != nil {
+		return errors.Wrapf(err, "consume `%s/%d`", p.Topic, p.Partition)
+	}
+	defer pc.Close()
+
+	topicCfg := r.getTopicCfg(p.Topic)
+	for {
+		select {
+		case <-ctx.Done():
+			return errors.New("canceled")
+		case err := <-pc.Errors():
+			return err
+		case kmsg := <-pc.Messages():
+			if kmsg.Offset >= p.EndOffset {
+				return nil
+			}
+			if msg, err := r.parseKafkaMsg(-1, topicCfg, kmsg); err == nil {
+				msg.Tag = b.req.Tag
+				select {
+				case r.syncOutChan <- msg:
+				case <-ctx.Done():
+					r.msgPool.Put(msg)
+					return errors.New("canceled")
+				}
+			}
+
+			b.Lock()
+			p.Offset = kmsg.Offset + 1
+			p.NConsumed++
+			b.Unlock()
+			if p.Offset >= p.EndOffset {
+				return nil
+			}
+		}
+	}
+}
+
+// kafkaTimeToMillis convert time to kafka timestamp
+func kafkaTimeToMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
@@ -0,0 +1,512 @@
+package recvs
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"gofluentd/library"
+
+	"github.com/Shopify/sarama"
+	"github.com/gin-gonic/gin"
+)
+
+// newKafkaMockBroker mock a broker that contains topics with one partition,
+// and assign partitions of subscribed topics to consumer.
+func newKafkaMockBroker(t *testing.T, group string, topics map[string][]string, subscribed []string) (*sarama.MockBroker, *sarama.MockOffsetResponse) {
+	broker := sarama.NewMockBroker(t, 0)
+	metadata := sarama.NewMockMetadataResponse(t).SetBroker(broker.Addr(), broker.BrokerID())
+	offset := sarama.NewMockOffsetResponse(t).SetVersion(1)
+	fetch := sarama.NewMockFetchResponse(t, 10).SetVersion(3)
+	offsetFetch := sarama.NewMockOffsetFetchResponse(t)
+	assignment := &sarama.ConsumerGroupMemberAssignment{Topics: map[string][]int32{}}
+	for topic, msgs := range topics {
+		metadata.SetLeader(topic, 0, broker.BrokerID())
+		offset.SetOffset(topic, 0, sarama.OffsetOldest, 0).
+			SetOffset(topic, 0, sarama.OffsetNewest, int64(len(msgs)))
+		for i, m := range msgs {
+			fetch.SetMessage(topic, 0, int64(i), sarama.StringEncoder(m))
+		}
+		fetch.SetHighWaterMark(topic, 0, int64(len(msgs)))
+		offsetFetch.SetOffset(group, topic, 0, 0, "", sarama.ErrNoError)
+	}
+	for _, topic := range subscribed {
+		assignment.Topics[topic] = []int32{0}
+	}
+
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": metadata,
+		"OffsetRequest":   offset,
+		"FetchRequest":    fetch,
+		"FindCoordinatorRequest": sarama.NewMockFindCoordinatorResponse(t).
+			SetCoordinator(sarama.CoordinatorGroup, group, broker),
+		// follower will not balance partitions
+		"JoinGroupRequest": sarama.NewMockJoinGroupResponse(t).
+			SetGroupProtocol(sarama.BalanceStrategyRange.Name()).
+			SetMemberId("m1").
+			SetLeaderId("m0").
+			SetGenerationId(1),
+		"SyncGroupRequest":    sarama.NewMockSyncGroupResponse(t).SetMemberAssignment(assignment),
+		"HeartbeatRequest":    sarama.NewMockHeartbeatResponse(t),
+		"OffsetFetchRequest":  offsetFetch,
+		"OffsetCommitRequest": sarama.NewMockOffsetCommitResponse(t),
+		"LeaveGroupRequest":   sarama.NewMockLeaveGroupResponse(t),
+	})
+	return broker, offset
+}
+
+func TestKafkaRecv(t *testing.T) {
+	group := "test-group"
+	broker, _ := newKafkaMockBroker(t, group, map[string][]string{
+		"json-topic":  {`{"app": "a", "v": 1}`, `{"app": "b", "v": 2}`},
+		"app_1_log":   {"hello"},
+		"other-topic": {"should not be consumed"},
+	}, []string{"json-topic", "app_1_log"})
+	defer broker.Close()
+
+	recv := NewKafkaRecv(&KafkaCfg{
+		Name:    "kafka-test",
+		Brokers: []string{broker.Addr()},
+		Group:   group,
+		TagKey:  "tag",
+		Version: "0.10.2.0",
+		TopicCfgs: []*KafkaTopicCfg{
+			{
+				Topic:        "json-topic",
+				IsJSONFormat: true,
+				JSONTagKey:   "app",
+			},
+			{
+				TopicRegexp: regexp.MustCompile(`^app_\d+_log$`),
+				Tag:         "kafka-app.sit",
+				MsgKey:      "raw",
+				AddCfg: library.AddCfg{
+					"kafka-app.sit": {{"source": "kafka"}},
+				},
+			},
+		},
+	})
+	outChan := make(chan *library.FluentMsg, 10)
+	recv.SetCounter(counter)
+	recv.SetMsgPool(msgPool)
+	recv.SetSyncOutChan(outChan)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		recv.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	got := map[string]*library.FluentMsg{}
+	for len(got) < 3 {
+		select {
+		case msg := <-outChan:
+			got[msg.Tag] = msg
+		case <-time.After(10 * time.Second):
+			t.Fatalf("only got %d msgs", len(got))
+		}
+	}
+
+	if msg := got["a"]; msg == nil || msg.Message["v"] != float64(1) || msg.Message["tag"] != "a" {
+		t.Fatalf("got %+v", msg)
+	}
+	if got["b"] == nil {
+		t.Fatal("msg from json-topic missing")
+	}
+	msg := got["kafka-app.sit"]
+	if msg == nil {
+		t.Fatal("msg from regexp topic missing")
+	}
+	if string(msg.Message["raw"].([]byte)) != "hello" {
+		t.Fatalf("got %+v", msg.Message)
+	}
+	if msg.Message["source"] != "kafka" {
+		t.Fatalf("add not applied: %+v", msg.Message)
+	}
+
+	select {
+	case msg := <-outChan:
+		t.Fatalf("unexpected msg %+v", msg)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestKafkaRecvValid(t *testing.T) {
+	// compatible with single topic configuration
+	r := &KafkaRecv{KafkaCfg: &KafkaCfg{
+		Topics: []string{"t1"},
+		Tag:    "t1.sit",
+	}}
+	if err := r.valid(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(r.TopicCfgs) != 1 || r.TopicCfgs[0].Topic != "t1" || r.TopicCfgs[0].MsgKey != "log" {
+		t.Fatalf("got %+v", r.TopicCfgs)
+	}
+
+	for _, mechanism := range []string{"plain", "SCRAM-SHA-256", "SCRAM-SHA-512"} {
+		r = &KafkaRecv{KafkaCfg: &KafkaCfg{
+			Topics: []string{"t1"},
+			Tag:    "t1.sit",
+			SASL:   &KafkaSASLCfg{Mechanism: mechanism, Username: "u", Password: "p"},
+		}}
+		if err := r.valid(); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if !r.saramaCfg.Net.SASL.Enable {
+			t.Fatal("sasl should be enabled")
+		}
+	}
+
+	for _, cfg := range []*KafkaCfg{
+		{Topics: []string{""}, Tag: "t"},
+		{TopicCfgs: []*KafkaTopicCfg{{Tag: "t"}}},
+		{Topics: []string{"t1"}},
+		{Topics: []string{"t1"}, Tag: "t", SASL: &KafkaSASLCfg{Mechanism: "GSSAPI"}},
+		{Topics: []string{"t1"}, Tag: "t", Version: "abc"},
+		{Topics: []string{"t1"}, Tag: "t", IsEnableBackfill: true},
+	} {
+		r = &KafkaRecv{KafkaCfg: cfg}
+		if err := r.valid(); err == nil {
+			t.Fatalf("should be invalid: %+v", cfg)
+		}
+	}
+}
+
+func TestParseKafkaTopicCfgs(t *testing.T) {
+	cfgs := ParseKafkaTopicCfgs("sit", []interface{}{
+		map[interface{}]interface{}{
+			"topic":          "t1",
+			"tag":            "t1.{env}",
+			"is_json_format": true,
+			"json_tag_key":   "app",
+		},
+		map[interface{}]interface{}{
+			"topic_regexp": "^app_.*$",
+			"tag":          "app.{env}",
+			"rewrite_tag":  "kafkabuf",
+			"add": map[interface{}]interface{}{
+				"app.{env}": []interface{}{
+					map[interface{}]interface{}{"source": "kafka"},
+				},
+			},
+		},
+	})
+	if len(cfgs) != 2 {
+		t.Fatalf("got %d", len(cfgs))
+	}
+	if cfgs[0].Topic != "t1" || cfgs[0].Tag != "t1.sit" || !cfgs[0].IsJSONFormat || cfgs[0].JSONTagKey != "app" {
+		t.Fatalf("got %+v", cfgs[0])
+	}
+	if !cfgs[1].match("app_1") || cfgs[1].match("t1") {
+		t.Fatal("topic regexp not work")
+	}
+	if cfgs[1].RewriteTag != "kafkabuf.sit" {
+		t.Fatalf("got %+v", cfgs[1])
+	}
+	if cfgs[1].AddCfg["app.sit"][0]["source"] != "kafka" {
+		t.Fatalf("got %+v", cfgs[1].AddCfg)
+	}
+}
+
+// fakeKafkaSession record marked offsets
+type fakeKafkaSession struct {
+	sarama.ConsumerGroupSession
+	marked []int64
+}
+
+func (s *fakeKafkaSession) MarkOffset(topic string, partition int32, offset int64, metadata string) {
+	s.marked = append(s.marked, offset)
+}
+
+func TestKafkaOffsetTracker(t *testing.T) {
+	sess := &fakeKafkaSession{}
+	tracker := newKafkaOffsetTracker(sess, "t", 0, 3, 100*time.Millisecond)
+	a0 := tracker.track(10)
+	a1 := tracker.track(11)
+	a2 := tracker.track(13) // offsets may be non-contiguous
+	if !tracker.isFull() {
+		t.Fatal("should be full")
+	}
+
+	// out-of-order ack should not mark
+	a2.Ack()
+	a1.Ack()
+	if len(sess.marked) != 0 {
+		t.Fatalf("got %v", sess.marked)
+	}
+	if tracker.isStalled() {
+		t.Fatal("should not be stalled")
+	}
+	time.Sleep(150 * time.Millisecond)
+	if !tracker.isStalled() {
+		t.Fatal("should be stalled")
+	}
+
+	a0.Ack()
+	if len(sess.marked) != 1 || sess.marked[0] != 14 {
+		t.Fatalf("got %v", sess.marked)
+	}
+	if tracker.isFull() || tracker.isStalled() {
+		t.Fatal("all acked")
+	}
+	select {
+	case <-tracker.notifyAckedChan:
+	default:
+		t.Fatal("should notify")
+	}
+
+	// ignore acks after session end
+	a3 := tracker.track(14)
+	tracker.close()
+	a3.Ack()
+	if len(sess.marked) != 1 {
+		t.Fatalf("got %v", sess.marked)
+	}
+}
+
+func TestKafkaRecvAckMode(t *testing.T) {
+	group := "test-group"
+	broker, _ := newKafkaMockBroker(t, group, map[string][]string{
+		"json-topic": {`{"app": "a"}`, `{"app": "b"}`},
+	}, []string{"json-topic"})
+	defer broker.Close()
+
+	recv := NewKafkaRecv(&KafkaCfg{
+		Name:    "kafka-test",
+		Brokers: []string{broker.Addr()},
+		Group:   group,
+		Version: "0.10.2.0",
+		AckMode: KafkaAckModeSender,
+		Topics:  []string{"json-topic"},
+		Tag:     "json.sit",
+		KafkaCommitCfg: KafkaCommitCfg{
+			IntervalDuration: 50 * time.Millisecond,
+		},
+	})
+	outChan := make(chan *library.FluentMsg, 10)
+	recv.SetCounter(counter)
+	recv.SetMsgPool(msgPool)
+	recv.SetSyncOutChan(outChan)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		recv.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	msgs := []*library.FluentMsg{}
+	for len(msgs) < 2 {
+		select {
+		case msg := <-outChan:
+			if len(msg.Ackers) != 0 || len(msg.CommitAckers) != 1 {
+				t.Fatalf("got %+v", msg)
+			}
+			msgs = append(msgs, msg)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("only got %d msgs", len(msgs))
+		}
+	}
+
+	committedOffset := func() (offset int64) {
+		offset = -1
+		for _, rr := range broker.History() {
+			if req, ok := rr.Request.(*sarama.OffsetCommitRequest); ok {
+				if o, _, err := req.Offset("json-topic", 0); err == nil && o > offset {
+					offset = o
+				}
+			}
+		}
+		return offset
+	}
+
+	// the second msg acked, but the first msg is pending
+	msgs[1].AckCommit()
+	time.Sleep(200 * time.Millisecond)
+	if o := committedOffset(); o > 0 {
+		t.Fatalf("should not commit past pending msg, got %d", o)
+	}
+
+	msgs[0].AckCommit()
+	time.Sleep(200 * time.Millisecond)
+	if o := committedOffset(); o != 2 {
+		t.Fatalf("expect 2, got %d", o)
+	}
+}
+
+func TestKafkaRecvBackfill(t *testing.T) {
+	group := "test-group"
+	broker, offset := newKafkaMockBroker(t, group, map[string][]string{
+		"json-topic": {`{"app": "a"}`, `{"app": "b"}`, `{"app": "c"}`, `{"app": "d"}`},
+	}, []string{"json-topic"})
+	defer broker.Close()
+	startTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	endTime := startTime.Add(time.Hour)
+	offset.SetOffset("json-topic", 0, kafkaTimeToMillis(startTime), 1).
+		SetOffset("json-topic", 0, kafkaTimeToMillis(endTime), 3)
+
+	keyFile := filepath.Join(t.TempDir(), "keys.json")
+	writeHTTPAuthKeys(t, keyFile, []*httpAuthKey{{ID: "admin", Key: "admin-key"}}, time.Now())
+	srv := gin.New()
+	recv := NewKafkaRecv(&KafkaCfg{
+		Name:        "kafka-test",
+		Brokers:     []string{broker.Addr()},
+		Group:       group,
+		Version:     "0.10.2.0",
+		TagKey:      "tag",
+		TopicCfgs:   []*KafkaTopicCfg{{Topic: "json-topic", IsJSONFormat: true, JSONTagKey: "app"}},
+		HTTPSrv:     srv,
+		BackfillTag: "backfill.sit",
+
+		IsEnableBackfill: true,
+		BackfillAuth:     &HTTPAuthCfg{Type: HTTPAuthTypeAPIKey, KeyFile: keyFile},
+	})
+	outChan := make(chan *library.FluentMsg, 10)
+	recv.SetCounter(counter)
+	recv.SetMsgPool(msgPool)
+	recv.SetSyncOutChan(outChan)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	recv.runCtx = ctx
+
+	requestWithKey := func(method, body, key string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, "/admin/kafka/kafka-test/backfill", bytes.NewBufferString(body))
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		srv.ServeHTTP(w, req)
+		return w
+	}
+	request := func(method, body string) *httptest.ResponseRecorder {
+		return requestWithKey(method, body, "admin-key")
+	}
+
+	// unauthorized
+	for _, key := range []string{"", "wrong-key"} {
+		if w := requestWithKey(http.MethodPost, `{"start_time": "2020-01-01T00:00:00Z"}`, key); w.Code != http.StatusUnauthorized {
+			t.Fatalf("got %d", w.Code)
+		}
+		if w := requestWithKey(http.MethodDelete, "", key); w.Code != http.StatusUnauthorized {
+			t.Fatalf("got %d", w.Code)
+		}
+	}
+
+	if w := request(http.MethodGet, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("got %d", w.Code)
+	}
+	if w := request(http.MethodPost, `{"topics": ["other-topic"], "start_time": "2020-01-01T00:00:00Z"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	if w := request(http.MethodPost, `{"start_time": "2020-01-01T00:00:00Z", "end_time": "2020-01-01T01:00:00Z"}`); w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+
+	for _, app := range []string{"b", "c"} {
+		select {
+		case msg := <-outChan:
+			if msg.Tag != "backfill.sit" || msg.Message["tag"] != app {
+				t.Fatalf("got %+v", msg)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+
+	var status *kafkaBackfillStatus
+	for i := 0; i < 50; i++ {
+		if status = recv.getBackfillStatus(); !status.IsRunning {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if status.IsRunning || len(status.Partitions) != 1 {
+		t.Fatalf("got %+v", status)
+	}
+	if p := status.Partitions[0]; p.StartOffset != 1 || p.EndOffset != 3 || p.NConsumed != 2 || p.Error != "" {
+		t.Fatalf("got %+v", p)
+	}
+	if w := request(http.MethodGet, ""); w.Code != http.StatusOK {
+		t.Fatalf("got %d", w.Code)
+	}
+	select {
+	case msg := <-outChan:
+		t.Fatalf("unexpected msg %+v", msg)
+	default:
+	}
+}
+
+func TestKafkaRecvMetadata(t *testing.T) {
+	recv := NewKafkaRecv(&KafkaCfg{
+		Topics: []string{"t1"},
+		Tag:    "t1.sit",
+		TagKey: "tag",
+		Metadata: &KafkaMetadataCfg{
+			KeyField:       "kafka_key",
+			HeadersField:   "kafka_headers",
+			TopicField:     "kafka_topic",
+			PartitionField: "kafka_partition",
+			OffsetField:    "kafka_offset",
+			TimestampField: "kafka_ts",
+			IsEventTime:    true,
+		},
+	})
+	recv.SetCounter(counter)
+	recv.SetMsgPool(msgPool)
+
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 6000000, time.UTC)
+	msg, err := recv.parse2Msg(recv.TopicCfgs[0], &sarama.ConsumerMessage{
+		Topic:     "t1",
+		Partition: 3,
+		Offset:    123,
+		Key:       []byte("user-1"),
+		Value:     []byte("hello"),
+		Timestamp: ts,
+		Headers: []*sarama.RecordHeader{
+			{Key: []byte("trace-id"), Value: []byte("abc")},
+		},
+	})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if msg.Message["kafka_key"] != "user-1" ||
+		msg.Message["kafka_topic"] != "t1" ||
+		msg.Message["kafka_partition"] != int32(3) ||
+		msg.Message["kafka_offset"] != int64(123) ||
+		msg.Message["kafka_ts"] != "2020-01-02T03:04:05.006Z" ||
+		msg.Message["kafka_headers"].(map[string]interface{})["trace-id"] != "abc" {
+		t.Fatalf("got %+v", msg.Message)
+	}
+	if !msg.Time.Equal(ts) {
+		t.Fatalf("got %v", msg.Time)
+	}
+
+	// message without key, headers and timestamp
+	msg, err = recv.parse2Msg(recv.TopicCfgs[0], &sarama.ConsumerMessage{Topic: "t1", Value: []byte("hello")})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for _, k := range []string{"kafka_key", "kafka_headers", "kafka_ts"} {
+		if _, ok := msg.Message[k]; ok {
+			t.Fatalf("%s should not be set: %+v", k, msg.Message)
+		}
+	}
+	if !msg.Time.IsZero() {
+		t.Fatalf("got %v", msg.Time)
+	}
+}
@@ -0,0 +1,481 @@
+package recvs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"gofluentd/internal/monitor"
+	"gofluentd/library"
+	"gofluentd/library/log"
+
+	utils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/pkg/errors"
+)
+
+const (
+	// LinesNetworkTCP listen on tcp
+	LinesNetworkTCP = "tcp"
+	// LinesNetworkUDP listen on udp, one datagram can contain multiple frames
+	LinesNetworkUDP = "udp"
+	// LinesNetworkUnix listen on unix domain socket (stream)
+	LinesNetworkUnix = "unix"
+
+	// LinesFramingDelimiter frames end with delimiter
+	LinesFramingDelimiter = "delimiter"
+	// LinesFramingOctetCounting frames like `<len> <payload>` (RFC6587)
+	LinesFramingOctetCounting = "octet_counting"
+
+	// LinesFormatJSON parse line as JSON object, store it raw if failed
+	LinesFormatJSON = "json"
+	// LinesFormatRaw store line into `msg.Message[MsgKey]`
+	LinesFormatRaw = "raw"
+
+	defaultLinesMaxLineLen = 64 * 1024
+	linesMaxUDPPacketSize  = 65536
+	// linesMaxOctetCountDigits max digits of frame length in octet counting
+	linesMaxOctetCountDigits = 10
+)
+
+/*LinesRecvCfg is the configuration for LinesRecv
+
+Args:
+	Network: `tcp`, `udp` or `unix`
+	Addr: like `0.0.0.0:24300`, or path of socket file if network is `unix`
+	Framing: `delimiter` or `octet_counting`
+	Delimiter: frame delimiter, default to `\n`, trailing `\r` will be trimmed if delimiter is `\n`
+	Format: `json` or `raw`
+	MsgKey: put raw line into `msg.Message[MsgKey]`
+	MaxLineLen: longer lines will be discarded
+	Tag: static tag of msgs
+	TagKey: set tag into `msg.Message[TagKey]`
+	IsRewriteTagFromTagKey: set `msg.Tag = msg.Message[OriginRewriteTagKey]`,
+		msg will be discarded if the field is not string, just like FluentdRecv.
+	SourceKey: optional, set remote address (or socket path for unix) into `msg.Message[SourceKey]`
+*/
+type LinesRecvCfg struct {
+	Name,
+	Network, Addr,
+	Framing, Delimiter,
+	Format, MsgKey string
+	MaxLineLen  int
+	Tag, TagKey string
+
+	IsRewriteTagFromTagKey bool
+	OriginRewriteTagKey    string
+
+	SourceKey string
+}
+
+// LinesRecv recv newline-delimited JSON or raw lines
+type LinesRecv struct {
+	*BaseRecv
+	*LinesRecvCfg
+
+	delimiter      []byte
+	isTrimCR       bool
+	activeConns    int64
+	tooLongCnt     *utils.Counter
+	decodeErrCnt   *utils.Counter
+	invalidCnt     *utils.Counter
+	discardedCnt   *utils.Counter
+	receivedLenCnt *utils.Counter
+}
+
+// NewLinesRecv create new LinesRecv
+func NewLinesRecv(cfg *LinesRecvCfg) *LinesRecv {
+	r := &LinesRecv{
+		BaseRecv:       &BaseRecv{},
+		LinesRecvCfg:   cfg,
+		tooLongCnt:     utils.NewCounter(),
+		decodeErrCnt:   utils.NewCounter(),
+		invalidCnt:     utils.NewCounter(),
+		discardedCnt:   utils.NewCounter(),
+		receivedLenCnt: utils.NewCounter(),
+	}
+	if err := r.valid(); err != nil {
+		log.Logger.Panic("config invalid", zap.Error(err))
+	}
+
+	log.Logger.Info("create LinesRecv",
+		zap.String("name", r.Name),
+		zap.String("network", r.Network),
+		zap.String("addr", r.Addr),
+		zap.String("framing", r.Framing),
+		zap.String("format", r.Format),
+		zap.String("tag", r.Tag),
+		zap.Bool("is_rewrite_tag_from_tag_key", r.IsRewriteTagFromTagKey),
+		zap.String("origin_rewrite_tag_key", r.OriginRewriteTagKey))
+	return r
+}
+
+func (r *LinesRecv) valid() error {
+	switch r.Network {
+	case "":
+		r.Network = LinesNetworkTCP
+		log.Logger.Info("reset network", zap.String("network", r.Network))
+	case LinesNetworkTCP, LinesNetworkUDP, LinesNetworkUnix:
+	default:
+		return errors.Errorf("unknown network `%s`", r.Network)
+	}
+	if r.Addr == "" {
+		return errors.New("addr should not be empty")
+	}
+
+	switch r.Framing {
+	case "":
+		r.Framing = LinesFramingDelimiter
+		log.Logger.Info("reset framing", zap.String("framing", r.Framing))
+	case LinesFramingDelimiter, LinesFramingOctetCounting:
+	default:
+		return errors.Errorf("unknown framing `%s`", r.Framing)
+	}
+	if r.Delimiter == "" {
+		r.Delimiter = "\n"
+		log.Logger.Info("reset delimiter", zap.String("delimiter", r.Delimiter))
+	}
+	r.delimiter = []byte(r.Delimiter)
+	r.isTrimCR = r.Delimiter == "\n"
+
+	switch r.Format {
+	case "":
+		r.Format = LinesFormatJSON
+		log.Logger.Info("reset format", zap.String("format", r.Format))
+	case LinesFormatJSON, LinesFormatRaw:
+	default:
+		return errors.Errorf("unknown format `%s`", r.Format)
+	}
+	if r.MsgKey == "" {
+		r.MsgKey = "log"
+		log.Logger.Info("reset msg_key", zap.String("msg_key", r.MsgKey))
+	}
+	if r.MaxLineLen <= 0 {
+		r.MaxLineLen = defaultLinesMaxLineLen
+		log.Logger.Info("reset max_line_len", zap.Int("max_line_len", r.MaxLineLen))
+	}
+	if r.TagKey == "" {
+		r.TagKey = "tag"
+		log.Logger.Info("reset tag_key", zap.String("tag_key", r.TagKey))
+	}
+
+	if r.IsRewriteTagFromTagKey {
+		if r.OriginRewriteTagKey == "" {
+			return errors.New("if IsRewriteTagFromTagKey is setted, OriginRewriteTagKey should not empty")
+		}
+	} else if r.Tag == "" {
+		return errors.New("tag should not be empty")
+	}
+
+	return nil
+}
+
+// GetName get the name of recv
+func (r *LinesRecv) GetName() string {
+	return r.Name
+}
+
+// Run start listener
+func (r *LinesRecv) Run(ctx context.Context) {
+	log.Logger.Info("run LinesRecv", zap.String("name", r.Name))
+	monitor.AddMetric("linesrecv."+r.Name, func() map[string]interface{} {
+		return map[string]interface{}{
+			"activeConns":      atomic.LoadInt64(&r.activeConns),
+			"receivedBytes":    r.receivedLenCnt.Get(),
+			"receivedBytesSec": r.receivedLenCnt.GetSpeed(),
+			"tooLongTotal":     r.tooLongCnt.Get(),
+			"decodeErrTotal":   r.decodeErrCnt.Get(),
+			"invalidTotal":     r.invalidCnt.Get(),
+			"discardedTotal":   r.discardedCnt.Get(),
+		}
+	})
+
+	if r.Network == LinesNetworkUDP {
+		go r.runUDP(ctx)
+	} else {
+		go r.runStream(ctx)
+	}
+}
+
+func (r *LinesRecv) runUDP(ctx context.Context) {
+	defer log.Logger.Info("lines udp server exit", zap.String("name", r.Name))
+	buf := make([]byte, linesMaxUDPPacketSize)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		conn, err := net.ListenPacket("udp", r.Addr)
+		if err != nil {
+			log.Logger.Error("try to bind addr got error", zap.String("addr", r.Addr), zap.Error(err))
+			time.Sleep(defaultRetryWait)
+			continue
+		}
+		log.Logger.Info("listening lines udp", zap.String("name", r.Name), zap.String("addr", r.Addr))
+
+		ctx2Conn, cancel := context.WithCancel(ctx)
+		go func() {
+			<-ctx2Conn.Done()
+			conn.Close()
+		}()
+		for {
+			n, remote, err := conn.ReadFrom(buf)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Logger.Error("read lines udp got error", zap.String("addr", r.Addr), zap.Error(err))
+				}
+				break
+			}
+
+			if err = r.scan(bytes.NewReader(buf[:n]), remote.String()); err != nil {
+				r.invalidCnt.Count()
+				log.Logger.Warn("invalid lines udp packet", zap.String("name", r.Name), zap.Error(err))
+			}
+		}
+		cancel()
+	}
+}
+
+// runStream listen on tcp or unix socket
+func (r *LinesRecv) runStream(ctx context.Context) {
+	defer log.Logger.Info("lines server exit", zap.String("name", r.Name), zap.String("network", r.Network))
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		if r.Network == LinesNetworkUnix {
+			// remove socket file left by last run, never remove other kinds of file
+			if fi, err := os.Lstat(r.Addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+				if err = os.Remove(r.Addr); err != nil {
+					log.Logger.Warn("try to remove socket file got error", zap.String("addr", r.Addr), zap.Error(err))
+				}
+			}
+		}
+		ln, err := net.Listen(r.Network, r.Addr)
+		if err != nil {
+			log.Logger.Error("try to bind addr got error", zap.String("addr", r.Addr), zap.Error(err))
+			time.Sleep(defaultRetryWait)
+			continue
+		}
+		log.Logger.Info("listening lines", zap.String("name", r.Name), zap.String("network", r.Network), zap.String("addr", r.Addr))
+
+		ctx2Ln, cancel := context.WithCancel(ctx)
+		go func() {
+			<-ctx2Ln.Done()
+			ln.Close()
+		}()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Logger.Error("accept lines connection got error", zap.String("addr", r.Addr), zap.Error(err))
+				}
+				break
+			}
+			go r.handleConn(ctx2Ln, conn)
+		}
+		cancel()
+	}
+}
+
+func (r *LinesRecv) handleConn(ctx context.Context, conn net.Conn) {
+	atomic.AddInt64(&r.activeConns, 1)
+	defer atomic.AddInt64(&r.activeConns, -1)
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	remote := conn.RemoteAddr().String()
+	if r.Network == LinesNetworkUnix {
+		// clients of unix socket are usually unnamed
+		remote = r.Addr
+	}
+	if err := r.scan(conn, remote); err != nil && ctx.Err() == nil {
+		r.invalidCnt.Count()
+		log.Logger.Warn("close lines connection", zap.String("name", r.Name), zap.String("remote", remote), zap.Error(err))
+	}
+}
+
+// scan split frames from reader and process each line
+func (r *LinesRecv) scan(reader io.Reader, remote string) error {
+	f := &linesFramer{
+		delimiter:  r.delimiter,
+		maxLineLen: r.MaxLineLen,
+		tooLongCnt: r.tooLongCnt,
+	}
+	scanner := bufio.NewScanner(reader)
+	if r.Framing == LinesFramingOctetCounting {
+		scanner.Buffer(make([]byte, 0, 4096), r.MaxLineLen+linesMaxOctetCountDigits+1)
+		scanner.Split(f.splitOctetCounting)
+	} else {
+		scanner.Buffer(make([]byte, 0, 4096), r.MaxLineLen+len(r.delimiter))
+		scanner.Split(f.splitDelimiter)
+	}
+
+	for scanner.Scan() {
+		r.receivedLenCnt.CountN(int64(len(scanner.Bytes())))
+		r.processLine(scanner.Bytes(), remote)
+	}
+	return scanner.Err()
+}
+
+// processLine parse line then put msg into outchan
+func (r *LinesRecv) processLine(line []byte, remote string) {
+	if r.isTrimCR {
+		line = bytes.TrimSuffix(line, []byte{'\r'})
+	}
+	if len(bytes.TrimSpace(line)) == 0 {
+		return
+	}
+
+	msg := r.msgPool.Get().(*library.FluentMsg)
+	msg.Message = nil
+	if r.Format == LinesFormatJSON {
+		data := map[string]interface{}{}
+		if err := json.Unmarshal(line, &data); err == nil {
+			msg.Message = data
+		} else {
+			r.decodeErrCnt.Count()
+		}
+	}
+	if msg.Message == nil {
+		msg.Message = map[string]interface{}{r.MsgKey: string(line)}
+	}
+	if r.SourceKey != "" {
+		msg.Message[r.SourceKey] = remote
+	}
+
+	msg.Tag = r.Tag
+	if r.IsRewriteTagFromTagKey { // rewrite msg.Tag by msg.Message[OriginRewriteTagKey]
+		tag, ok := msg.Message[r.OriginRewriteTagKey].(string)
+		if !ok {
+			r.discardedCnt.Count()
+			log.Logger.Warn("discard msg since unknown type of tag key",
+				zap.String("tag", fmt.Sprint(msg.Message[r.OriginRewriteTagKey])),
+				zap.String("tag_key", r.OriginRewriteTagKey))
+			r.msgPool.Put(msg)
+			return
+		}
+		msg.Tag = tag
+	}
+	msg.Message[r.TagKey] = msg.Tag
+	msg.ID = r.counter.Count()
+	msg.Time = time.Time{}
+	msg.Ackers = nil
+	msg.CommitAckers = nil
+
+	log.Logger.Debug("receive new msg", zap.String("tag", msg.Tag), zap.Int64("id", msg.ID))
+	r.asyncOutChan <- msg
+}
+
+// linesFramer split frames for one connection or datagram,
+// frames longer than maxLineLen are discarded.
+type linesFramer struct {
+	delimiter  []byte
+	maxLineLen int
+	tooLongCnt *utils.Counter
+
+	// isDiscarding discard data until next delimiter
+	isDiscarding bool
+	// nSkip bytes of too long octet counting frame to skip
+	nSkip int
+}
+
+// splitDelimiter implement bufio.SplitFunc, split data by delimiter
+func (f *linesFramer) splitDelimiter(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if i := bytes.Index(data, f.delimiter); i >= 0 {
+		if f.isDiscarding {
+			f.isDiscarding = false
+			return i + len(f.delimiter), nil, nil
+		}
+		if i > f.maxLineLen {
+			f.tooLongCnt.Count()
+			return i + len(f.delimiter), nil, nil
+		}
+		return i + len(f.delimiter), data[:i], nil
+	}
+
+	if atEOF {
+		if len(data) == 0 || f.isDiscarding {
+			return len(data), nil, nil
+		}
+		if len(data) > f.maxLineLen {
+			f.tooLongCnt.Count()
+			return len(data), nil, nil
+		}
+		return len(data), data, nil
+	}
+
+	if len(data) >= f.maxLineLen+len(f.delimiter) {
+		// keep the tail which may be the beginning of delimiter
+		if !f.isDiscarding {
+			f.isDiscarding = true
+			f.tooLongCnt.Count()
+		}
+		return len(data) - len(f.delimiter) + 1, nil, nil
+	}
+
+	return 0, nil, nil
+}
+
+// splitOctetCounting implement bufio.SplitFunc, split frames like `<len> <payload>`
+func (f *linesFramer) splitOctetCounting(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if f.nSkip > 0 {
+		if advance = f.nSkip; advance > len(data) {
+			advance = len(data)
+		}
+		f.nSkip -= advance
+		return advance, nil, nil
+	}
+
+	// skip trailers between frames
+	for advance < len(data) && (data[advance] == '\n' || data[advance] == '\r' || data[advance] == ' ') {
+		advance++
+	}
+	if advance != 0 || len(data) == 0 {
+		return advance, nil, nil
+	}
+
+	i := bytes.IndexByte(data, ' ')
+	if i < 0 {
+		if len(data) > linesMaxOctetCountDigits {
+			return 0, nil, errors.New("invalid octet count")
+		}
+		if atEOF {
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+		return 0, nil, nil
+	}
+
+	n, err := strconv.Atoi(string(data[:i]))
+	if err != nil || n < 0 {
+		return 0, nil, errors.Errorf("invalid octet count `%s`", data[:i])
+	}
+	if n > f.maxLineLen {
+		f.tooLongCnt.Count()
+		f.nSkip = n
+		return i + 1, nil, nil
+	}
+	if len(data) < i+1+n {
+		if atEOF {
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+		return 0, nil, nil
+	}
+
+	return i + 1 + n, data[i+1 : i+1+n], nil
+}
@@ -0,0 +1,167 @@
+package recvs
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gofluentd/library"
+
+	utils "github.com/Laisky/go-utils"
+)
+
+func TestLinesFramer(t *testing.T) {
+	scan := func(f *linesFramer, split bufio.SplitFunc, data string) (tokens []string, err error) {
+		scanner := bufio.NewScanner(strings.NewReader(data))
+		scanner.Buffer(make([]byte, 0, 2), f.maxLineLen+len(f.delimiter)+linesMaxOctetCountDigits)
+		scanner.Split(split)
+		for scanner.Scan() {
+			tokens = append(tokens, scanner.Text())
+		}
+		return tokens, scanner.Err()
+	}
+
+	f := &linesFramer{delimiter: []byte("||"), maxLineLen: 5, tooLongCnt: utils.NewCounter()}
+	tokens, err := scan(f, f.splitDelimiter, "a||bcdef||0123456789abc||d||toolong")
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	if strings.Join(tokens, ",") != "a,bcdef,d" || f.tooLongCnt.Get() != 2 {
+		t.Fatalf("got %+v, %d", tokens, f.tooLongCnt.Get())
+	}
+
+	f = &linesFramer{maxLineLen: 5, tooLongCnt: utils.NewCounter()}
+	tokens, err = scan(f, f.splitOctetCounting, "1 a5 b\ncde\n6 123456 2 fg")
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	if strings.Join(tokens, ",") != "a,b\ncde,fg" || f.tooLongCnt.Get() != 1 {
+		t.Fatalf("got %+v, %d", tokens, f.tooLongCnt.Get())
+	}
+	if _, err = scan(f, f.splitOctetCounting, "abc def"); err == nil {
+		t.Fatal("should got error")
+	}
+	if _, err = scan(f, f.splitOctetCounting, "3 ab"); err == nil {
+		t.Fatal("should got error")
+	}
+}
+
+func TestLinesRecv(t *testing.T) {
+	outChan := make(chan *library.FluentMsg, 1000)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sock := filepath.Join(t.TempDir(), "lines.sock")
+	for _, cfg := range []*LinesRecvCfg{
+		{
+			Name:       "lines-tcp-test",
+			Addr:       "127.0.0.1:24242",
+			Tag:        "lines.sit",
+			MaxLineLen: 100,
+			SourceKey:  "remote",
+		},
+		{
+			Name:    "lines-udp-test",
+			Network: LinesNetworkUDP,
+			Addr:    "127.0.0.1:24243",
+			Format:  LinesFormatRaw,
+			Tag:     "lines.udp.sit",
+		},
+		{
+			Name:                   "lines-unix-test",
+			Network:                LinesNetworkUnix,
+			Addr:                   sock,
+			Framing:                LinesFramingOctetCounting,
+			IsRewriteTagFromTagKey: true,
+			OriginRewriteTagKey:    "app",
+		},
+	} {
+		recv := NewLinesRecv(cfg)
+		recv.SetCounter(counter)
+		recv.SetMsgPool(msgPool)
+		recv.SetAsyncOutChan(outChan)
+		recv.Run(ctx)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	loadMsg := func() *library.FluentMsg {
+		select {
+		case msg := <-outChan:
+			return msg
+		case <-time.After(5 * time.Second):
+			t.Fatal("can not load msg")
+		}
+		return nil
+	}
+	send := func(network, addr, data string) {
+		conn, err := net.Dial(network, addr)
+		if err != nil {
+			t.Fatalf("got error: %+v", err)
+		}
+		defer conn.Close()
+		if _, err = conn.Write([]byte(data)); err != nil {
+			t.Fatalf("got error: %+v", err)
+		}
+	}
+
+	// tcp, json with raw fallback, too long line is discarded
+	send("tcp", "127.0.0.1:24242", `{"log": "hello"}`+"\r\n\n"+strings.Repeat("x", 200)+"\nnot json")
+	msg := loadMsg()
+	if msg.Tag != "lines.sit" || msg.Message["tag"] != "lines.sit" || msg.Message["log"] != "hello" || !strings.HasPrefix(msg.Message["remote"].(string), "127.0.0.1:") {
+		t.Fatalf("got %+v, %+v", msg.Tag, msg.Message)
+	}
+	if msg = loadMsg(); msg.Message["log"] != "not json" {
+		t.Fatalf("got %+v", msg.Message)
+	}
+
+	// udp, multiple lines in one datagram
+	send("udp", "127.0.0.1:24243", "a\n{\"log\": \"b\"}\n")
+	if msg = loadMsg(); msg.Tag != "lines.udp.sit" || msg.Message["log"] != "a" {
+		t.Fatalf("got %+v, %+v", msg.Tag, msg.Message)
+	}
+	if msg = loadMsg(); msg.Message["log"] != `{"log": "b"}` {
+		t.Fatalf("got %+v", msg.Message)
+	}
+
+	// unix, octet counting, tag rewritten from field, msg without tag is discarded
+	line1 := `{"log": "x"}`
+	line2 := `{"app": "order", "log": "y"}`
+	send("unix", sock, "12 "+line1+"28 "+line2)
+	if msg = loadMsg(); msg.Tag != "order" || msg.Message["tag"] != "order" || msg.Message["log"] != "y" {
+		t.Fatalf("got %+v, %+v", msg.Tag, msg.Message)
+	}
+	select {
+	case msg = <-outChan:
+		t.Fatalf("got %+v", msg.Message)
+	default:
+	}
+}
+
+func TestLinesRecvNotRemoveRegularFile(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fpath := filepath.Join(t.TempDir(), "lines.sock")
+	if err := ioutil.WriteFile(fpath, []byte("data"), 0644); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+
+	recv := NewLinesRecv(&LinesRecvCfg{
+		Name:    "lines-unix-test",
+		Network: LinesNetworkUnix,
+		Addr:    fpath,
+		Tag:     "lines.sit",
+	})
+	recv.SetCounter(counter)
+	recv.SetMsgPool(msgPool)
+	recv.SetAsyncOutChan(make(chan *library.FluentMsg, 10))
+	recv.Run(ctx)
+	time.Sleep(200 * time.Millisecond)
+
+	if data, err := ioutil.ReadFile(fpath); err != nil || string(data) != "data" {
+		t.Fatalf("got %s, %+v", data, err)
+	}
+}
@@ -0,0 +1,470 @@
+package recvs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gofluentd/internal/monitor"
+	"gofluentd/library"
+	"gofluentd/library/log"
+
+	utils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/snappy"
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	defaultLokiPath        = "/loki/api/v1/push"
+	defaultLokiMaxBodySize = 10 * 1024 * 1024
+
+	lokiTenantHeader = "X-Scope-OrgID"
+)
+
+// LokiRecvCfg is the configuration for LokiRecv
+type LokiRecvCfg struct {
+	HTTPSrv *gin.Engine
+	Name    string
+	// Path: push endpoint, default to `/loki/api/v1/push`
+	Path string
+	// Tag: tag template like `loki.%{app}.sit`, labels can be used as variables
+	// FallbackTag: used if tag is invalid or too many tags
+	Tag, FallbackTag string
+	MaxTags          int
+	// TagKey: set `msg.Message[TagKey] = msg.Tag`
+	// MsgKey: put line into `msg.Message[MsgKey]`
+	TagKey, MsgKey string
+	// LabelPrefix: labels & structured metadata are set as `msg.Message[LabelPrefix+<label>]`
+	LabelPrefix string
+	// TenantKey: set `X-Scope-OrgID` into `msg.Message[TenantKey]`, disabled if empty
+	TenantKey string
+	// TimeKey: optional, set entry time in RFC3339Nano into `msg.Message[TimeKey]`
+	TimeKey     string
+	MaxBodySize int64
+}
+
+// LokiRecv recv compatible with loki push API
+type LokiRecv struct {
+	*BaseRecv
+	*LokiRecvCfg
+
+	tagDeriver      *tagDeriver
+	requestCounter  *utils.Counter
+	fallbackCounter *utils.Counter
+}
+
+// lokiEntry one log line
+type lokiEntry struct {
+	ts       time.Time
+	line     string
+	metadata map[string]string
+}
+
+// lokiStream entries with the same labels
+type lokiStream struct {
+	labels  map[string]string
+	entries []*lokiEntry
+}
+
+// NewLokiRecv create new LokiRecv and register push endpoint on HTTPSrv
+func NewLokiRecv(cfg *LokiRecvCfg) *LokiRecv {
+	r := &LokiRecv{
+		BaseRecv:        &BaseRecv{},
+		LokiRecvCfg:     cfg,
+		requestCounter:  utils.NewCounter(),
+		fallbackCounter: utils.NewCounter(),
+	}
+	if err := r.valid(); err != nil {
+		log.Logger.Panic("config invalid", zap.Error(err))
+	}
+
+	log.Logger.Info("create LokiRecv",
+		zap.String("name", r.Name),
+		zap.String("path", r.Path),
+		zap.String("tag", r.Tag))
+	r.HTTPSrv.POST(r.Path, r.PushHandler)
+	return r
+}
+
+func (r *LokiRecv) valid() (err error) {
+	if r.HTTPSrv == nil {
+		return errors.New("http server should not be nil")
+	}
+	if r.Tag == "" {
+		return errors.New("tag should not be empty")
+	}
+
+	if r.Path == "" {
+		r.Path = defaultLokiPath
+		log.Logger.Info("reset path", zap.String("path", r.Path))
+	}
+	if r.TagKey == "" {
+		r.TagKey = "tag"
+		log.Logger.Info("reset tag_key", zap.String("tag_key", r.TagKey))
+	}
+	if r.MsgKey == "" {
+		r.MsgKey = "log"
+		log.Logger.Info("reset msg_key", zap.String("msg_key", r.MsgKey))
+	}
+	if r.MaxBodySize <= 0 {
+		r.MaxBodySize = defaultLokiMaxBodySize
+		log.Logger.Info("reset max_body_byte", zap.Int64("max_body_byte", r.MaxBodySize))
+	}
+
+	if r.tagDeriver, err = newTagDeriver(r.Name, r.Tag, r.FallbackTag, r.MaxTags, nil); err != nil {
+		return errors.Wrap(err, "new tag deriver")
+	}
+	return nil
+}
+
+// GetName get the name of recv
+func (r *LokiRecv) GetName() string {
+	return r.Name
+}
+
+// Run only register metrics, requests are handled by HTTPSrv
+func (r *LokiRecv) Run(ctx context.Context) {
+	log.Logger.Info("run LokiRecv", zap.String("name", r.Name))
+	monitor.AddMetric("lokirecv."+r.Name, func() map[string]interface{} {
+		return map[string]interface{}{
+			"requestTotal":     r.requestCounter.Get(),
+			"fallbackTotal":    r.fallbackCounter.Get(),
+			"derivedTagsTotal": r.tagDeriver.nTags(),
+		}
+	})
+}
+
+// PushHandler process loki push request in JSON or snappy compressed protobuf
+func (r *LokiRecv) PushHandler(ctx *gin.Context) {
+	r.requestCounter.Count()
+	if ctx.Request.ContentLength > r.MaxBodySize {
+		r.abort(ctx, http.StatusRequestEntityTooLarge, fmt.Sprintf("content size must less than %d bytes", r.MaxBodySize))
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(ctx.Request.Body, r.MaxBodySize+1))
+	if err != nil {
+		r.abort(ctx, http.StatusBadRequest, "read body: "+err.Error())
+		return
+	}
+	if int64(len(body)) > r.MaxBodySize {
+		r.abort(ctx, http.StatusRequestEntityTooLarge, fmt.Sprintf("body size must less than %d bytes", r.MaxBodySize))
+		return
+	}
+
+	var streams []*lokiStream
+	switch contentType := strings.TrimSpace(strings.Split(ctx.GetHeader("Content-Type"), ";")[0]); contentType {
+	case "application/json":
+		if body, err = decompressHTTPBody(ctx.Request, body, r.MaxBodySize); err == nil {
+			streams, err = parseLokiJSON(body)
+		}
+	case "", "application/x-protobuf":
+		if body, err = decodeLokiSnappy(body, r.MaxBodySize); err == nil {
+			streams, err = parseLokiProtobuf(body)
+		}
+	default:
+		r.abort(ctx, http.StatusUnsupportedMediaType, fmt.Sprintf("unsupported Content-Type `%s`", contentType))
+		return
+	}
+	if err != nil {
+		r.abort(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	tenant := ctx.GetHeader(lokiTenantHeader)
+	for _, stream := range streams {
+		for _, entry := range stream.entries {
+			r.asyncOutChan <- r.convertEntry(tenant, stream, entry)
+		}
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+// abort reply error in plain text like loki
+func (r *LokiRecv) abort(ctx *gin.Context, status int, msg string) {
+	log.Logger.Warn("reject loki push request",
+		zap.String("name", r.Name),
+		zap.String("remote", ctx.ClientIP()),
+		zap.String("error", msg))
+	ctx.String(status, msg)
+	ctx.Abort()
+}
+
+// convertEntry convert entry into msg
+func (r *LokiRecv) convertEntry(tenant string, stream *lokiStream, entry *lokiEntry) *library.FluentMsg {
+	msg := r.msgPool.Get().(*library.FluentMsg)
+	msg.ID = r.counter.Count()
+	msg.Message = make(map[string]interface{}, len(stream.labels)+len(entry.metadata)+4)
+	for k, v := range stream.labels {
+		msg.Message[r.LabelPrefix+k] = v
+	}
+	for k, v := range entry.metadata {
+		msg.Message[r.LabelPrefix+k] = v
+	}
+	msg.Message[r.MsgKey] = entry.line
+	if r.TenantKey != "" && tenant != "" {
+		msg.Message[r.TenantKey] = tenant
+	}
+	msg.Time = entry.ts
+	if r.TimeKey != "" {
+		msg.Message[r.TimeKey] = msg.Time.Format(time.RFC3339Nano)
+	}
+
+	var isFallback bool
+	if msg.Tag, isFallback = r.tagDeriver.derive(msg); isFallback {
+		r.fallbackCounter.Count()
+	}
+	msg.Message[r.TagKey] = msg.Tag
+	return msg
+}
+
+// lokiJSONReq push request in JSON, support both
+// `{"streams": [{"stream": {"app": "x"}, "values": [["<unix ns>", "<line>"]]}]}` and
+// the legacy `{"streams": [{"labels": "{app=\"x\"}", "entries": [{"ts": "<RFC3339>", "line": "<line>"}]}]}`
+type lokiJSONReq struct {
+	Streams []struct {
+		Stream  map[string]string `json:"stream"`
+		Values  [][]interface{}   `json:"values"`
+		Labels  string            `json:"labels"`
+		Entries []struct {
+			Ts   time.Time `json:"ts"`
+			Line string    `json:"line"`
+		} `json:"entries"`
+	} `json:"streams"`
+}
+
+// parseLokiJSON parse push request in JSON
+func parseLokiJSON(body []byte) (streams []*lokiStream, err error) {
+	req := &lokiJSONReq{}
+	if err = json.Unmarshal(body, req); err != nil {
+		return nil, errors.Wrap(err, "unmarshal json")
+	}
+
+	for _, s := range req.Streams {
+		stream := &lokiStream{labels: s.Stream}
+		if stream.labels == nil {
+			if stream.labels, err = parseLokiLabels(s.Labels); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, v := range s.Values {
+			if len(v) < 2 {
+				return nil, errors.New("value should be [<timestamp>, <line>]")
+			}
+			tsStr, ok := v[0].(string)
+			if !ok {
+				return nil, errors.New("timestamp should be string")
+			}
+			ts, err := strconv.ParseInt(tsStr, 10, 64)
+			if err != nil {
+				return nil, errors.Wrapf(err, "parse timestamp `%s`", tsStr)
+			}
+			entry := &lokiEntry{ts: time.Unix(0, ts).UTC()}
+			if entry.line, ok = v[1].(string); !ok {
+				return nil, errors.New("line should be string")
+			}
+			if len(v) > 2 { // structured metadata
+				if m, ok := v[2].(map[string]interface{}); ok {
+					entry.metadata = make(map[string]string, len(m))
+					for k, mv := range m {
+						entry.metadata[k] = fmt.Sprint(mv)
+					}
+				}
+			}
+			stream.entries = append(stream.entries, entry)
+		}
+		for _, e := range s.Entries {
+			stream.entries = append(stream.entries, &lokiEntry{ts: e.Ts.UTC(), line: e.Line})
+		}
+		streams = append(streams, stream)
+	}
+
+	return streams, nil
+}
+
+// decodeLokiSnappy decompress snappy block
+func decodeLokiSnappy(body []byte, maxSize int64) ([]byte, error) {
+	n, err := snappy.DecodedLen(body)
+	if err != nil {
+		return nil, errors.Wrap(err, "decode snappy")
+	}
+	if int64(n) > maxSize {
+		return nil, errors.Errorf("body size must less than %d bytes", maxSize)
+	}
+	if body, err = snappy.Decode(nil, body); err != nil {
+		return nil, errors.Wrap(err, "decode snappy")
+	}
+	return body, nil
+}
+
+// parseLokiProtobuf parse `logproto.PushRequest`:
+//
+//	PushRequest { repeated Stream streams = 1; }
+//	Stream { string labels = 1; repeated Entry entries = 2; uint64 hash = 3; }
+//	Entry { Timestamp timestamp = 1; string line = 2; repeated LabelPair structuredMetadata = 3; }
+func parseLokiProtobuf(body []byte) (streams []*lokiStream, err error) {
+	err = walkProtobuf(body, func(num protowire.Number, v []byte) error {
+		if num != 1 {
+			return nil
+		}
+		stream := &lokiStream{}
+		if err := walkProtobuf(v, func(num protowire.Number, v []byte) (err error) {
+			switch num {
+			case 1:
+				stream.labels, err = parseLokiLabels(string(v))
+			case 2:
+				var entry *lokiEntry
+				if entry, err = parseLokiProtobufEntry(v); err == nil {
+					stream.entries = append(stream.entries, entry)
+				}
+			}
+			return err
+		}); err != nil {
+			return errors.Wrap(err, "parse stream")
+		}
+		streams = append(streams, stream)
+		return nil
+	})
+	return streams, err
+}
+
+func parseLokiProtobufEntry(body []byte) (entry *lokiEntry, err error) {
+	entry = &lokiEntry{}
+	var sec, nsec int64
+	err = walkProtobuf(body, func(num protowire.Number, v []byte) error {
+		switch num {
+		case 1:
+			return walkProtobufVarint(v, func(num protowire.Number, n uint64) {
+				switch num {
+				case 1:
+					sec = int64(n)
+				case 2:
+					nsec = int64(int32(n))
+				}
+			})
+		case 2:
+			entry.line = string(v)
+		case 3:
+			var name, value string
+			if err := walkProtobuf(v, func(num protowire.Number, v []byte) error {
+				switch num {
+				case 1:
+					name = string(v)
+				case 2:
+					value = string(v)
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			if entry.metadata == nil {
+				entry.metadata = map[string]string{}
+			}
+			entry.metadata[name] = value
+		}
+		return nil
+	})
+	entry.ts = time.Unix(sec, nsec).UTC()
+	return entry, err
+}
+
+// walkProtobuf call f with every length-delimited field, other fields are skipped
+func walkProtobuf(b []byte, f func(num protowire.Number, v []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if typ == protowire.BytesType {
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			if err := f(num, v); err != nil {
+				return err
+			}
+			b = b[n:]
+			continue
+		}
+		if n = protowire.ConsumeFieldValue(num, typ, b); n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// walkProtobufVarint call f with every varint field, other fields are skipped
+func walkProtobufVarint(b []byte, f func(num protowire.Number, v uint64)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if typ == protowire.VarintType {
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			f(num, v)
+			b = b[n:]
+			continue
+		}
+		if n = protowire.ConsumeFieldValue(num, typ, b); n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// parseLokiLabels parse labels like `{app="x", env="sit"}`
+func parseLokiLabels(s string) (labels map[string]string, err error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "{") || !strings.HasSuffix(s, "}") {
+		return nil, errors.Errorf("labels `%s` should be enclosed in braces", s)
+	}
+	s = s[1 : len(s)-1]
+	labels = map[string]string{}
+	for {
+		s = strings.TrimLeft(s, " ,")
+		if s == "" {
+			return labels, nil
+		}
+
+		i := strings.IndexByte(s, '=')
+		if i <= 0 {
+			return nil, errors.Errorf("invalid label at `%s`", s)
+		}
+		name := strings.TrimSpace(s[:i])
+		s = strings.TrimSpace(s[i+1:])
+		if !strings.HasPrefix(s, `"`) {
+			return nil, errors.Errorf("label value of `%s` should be quoted", name)
+		}
+
+		// find the closing quote
+		j := 1
+		for ; j < len(s) && s[j] != '"'; j++ {
+			if s[j] == '\\' {
+				j++
+			}
+		}
+		if j >= len(s) {
+			return nil, errors.Errorf("unclosed label value of `%s`", name)
+		}
+		if labels[name], err = strconv.Unquote(s[:j+1]); err != nil {
+			return nil, errors.Wrapf(err, "unquote label value of `%s`", name)
+		}
+		s = s[j+1:]
+	}
+}
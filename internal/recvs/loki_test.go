@@ -0,0 +1,157 @@
+package recvs
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"gofluentd/library"
+
+	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestParseLokiLabels(t *testing.T) {
+	labels, err := parseLokiLabels(`{app="order", msg="a \"quoted\", value", env="sit"}`)
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	if !reflect.DeepEqual(labels, map[string]string{
+		"app": "order",
+		"msg": `a "quoted", value`,
+		"env": "sit",
+	}) {
+		t.Fatalf("got %+v", labels)
+	}
+
+	for _, s := range []string{`app="order"`, `{app=order}`, `{app="order}`} {
+		if _, err = parseLokiLabels(s); err == nil {
+			t.Fatalf("should got error for %s", s)
+		}
+	}
+}
+
+// encodeLokiPushRequest encode `logproto.PushRequest` with one stream
+func encodeLokiPushRequest(labels string, ts time.Time, lines ...string) []byte {
+	var stream []byte
+	stream = protowire.AppendTag(stream, 1, protowire.BytesType)
+	stream = protowire.AppendString(stream, labels)
+	for _, line := range lines {
+		var tsb, entry, md []byte
+		tsb = protowire.AppendTag(tsb, 1, protowire.VarintType)
+		tsb = protowire.AppendVarint(tsb, uint64(ts.Unix()))
+		tsb = protowire.AppendTag(tsb, 2, protowire.VarintType)
+		tsb = protowire.AppendVarint(tsb, uint64(ts.Nanosecond()))
+		entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+		entry = protowire.AppendBytes(entry, tsb)
+		entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+		entry = protowire.AppendString(entry, line)
+		md = protowire.AppendTag(md, 1, protowire.BytesType)
+		md = protowire.AppendString(md, "trace_id")
+		md = protowire.AppendTag(md, 2, protowire.BytesType)
+		md = protowire.AppendString(md, "abc")
+		entry = protowire.AppendTag(entry, 3, protowire.BytesType)
+		entry = protowire.AppendBytes(entry, md)
+
+		stream = protowire.AppendTag(stream, 2, protowire.BytesType)
+		stream = protowire.AppendBytes(stream, entry)
+	}
+	stream = protowire.AppendTag(stream, 3, protowire.VarintType)
+	stream = protowire.AppendVarint(stream, 12345)
+
+	var req []byte
+	req = protowire.AppendTag(req, 1, protowire.BytesType)
+	return protowire.AppendBytes(req, stream)
+}
+
+func TestLokiRecv(t *testing.T) {
+	var (
+		srv          = gin.New()
+		asyncOutChan = make(chan *library.FluentMsg, 1000)
+		ts           = time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	)
+	recv := NewLokiRecv(&LokiRecvCfg{
+		Name:        "test-loki",
+		HTTPSrv:     srv,
+		Tag:         "loki.%{label.app}.sit",
+		LabelPrefix: "label.",
+		TenantKey:   "tenant",
+		TimeKey:     "@timestamp",
+	})
+	recv.SetCounter(counter)
+	recv.SetMsgPool(msgPool)
+	recv.SetAsyncOutChan(asyncOutChan)
+
+	push := func(contentType string, body []byte) int {
+		req := httptest.NewRequest(http.MethodPost, defaultLokiPath, bytes.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set(lokiTenantHeader, "team-a")
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		return w.Code
+	}
+	loadMsg := func() *library.FluentMsg {
+		select {
+		case msg := <-asyncOutChan:
+			return msg
+		default:
+			t.Fatal("can not load msg")
+		}
+		return nil
+	}
+	checkMsg := func(msg *library.FluentMsg, line string) {
+		if msg.Tag != "loki.order.sit" ||
+			msg.Message["tag"] != "loki.order.sit" ||
+			msg.Message["log"] != line ||
+			msg.Message["label.app"] != "order" ||
+			msg.Message["label.env"] != "sit" ||
+			msg.Message["tenant"] != "team-a" ||
+			msg.Message["@timestamp"] != "2020-01-02T03:04:05.000000006Z" ||
+			!msg.Time.Equal(ts) {
+			t.Fatalf("got %+v, %+v, %v", msg.Tag, msg.Message, msg.Time)
+		}
+	}
+
+	// snappy protobuf
+	body := snappy.Encode(nil, encodeLokiPushRequest(`{app="order", env="sit"}`, ts, "line-1", "line-2"))
+	if code := push("application/x-protobuf", body); code != http.StatusNoContent {
+		t.Fatalf("got %d", code)
+	}
+	for _, line := range []string{"line-1", "line-2"} {
+		msg := loadMsg()
+		checkMsg(msg, line)
+		if msg.Message["label.trace_id"] != "abc" {
+			t.Fatalf("got %+v", msg.Message)
+		}
+	}
+
+	// json
+	if code := push("application/json", []byte(`{"streams": [
+		{"stream": {"app": "order", "env": "sit"}, "values": [["1577934245000000006", "line-3"]]},
+		{"labels": "{app=\"order\", env=\"sit\"}", "entries": [{"ts": "2020-01-02T03:04:05.000000006Z", "line": "line-4"}]}
+	]}`)); code != http.StatusNoContent {
+		t.Fatalf("got %d", code)
+	}
+	checkMsg(loadMsg(), "line-3")
+	checkMsg(loadMsg(), "line-4")
+
+	// invalid
+	if code := push("application/x-protobuf", []byte("not snappy")); code != http.StatusBadRequest {
+		t.Fatalf("got %d", code)
+	}
+	if code := push("application/json", []byte(`{"streams": [{"stream": {}, "values": [[1, "x"]]}]}`)); code != http.StatusBadRequest {
+		t.Fatalf("got %d", code)
+	}
+	if code := push("text/plain", []byte("x")); code != http.StatusUnsupportedMediaType {
+		t.Fatalf("got %d", code)
+	}
+	select {
+	case msg := <-asyncOutChan:
+		t.Fatalf("should not got msg: %+v", msg.Message)
+	default:
+	}
+}
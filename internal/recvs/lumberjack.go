@@ -0,0 +1,425 @@
+package recvs
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"gofluentd/internal/monitor"
+	"gofluentd/library"
+	"gofluentd/library/log"
+
+	utils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/pkg/errors"
+)
+
+const (
+	lumberjackVersion = '2'
+
+	lumberjackFrameWindow     = 'W'
+	lumberjackFrameCompressed = 'C'
+	lumberjackFrameJSON       = 'J'
+	lumberjackFrameData       = 'D'
+	lumberjackFrameACK        = 'A'
+
+	defaultLumberjackAckTimeout        = 30 * time.Second
+	defaultLumberjackKeepaliveInterval = 5 * time.Second
+	defaultLumberjackMaxFrameSize      = 10 * 1024 * 1024
+
+	lumberjackMetadataKey = "@metadata"
+	lumberjackTimeKey     = "@timestamp"
+)
+
+/*LumberjackRecvCfg is the configuration for LumberjackRecv
+
+Args:
+	Addr: listen lumberjack v2 over TCP, like `0.0.0.0:5044`
+	Tag: tag template like `%{fields.app}.sit`, nested fields are supported
+	FallbackTag: used if tag is invalid or too many tags
+	MaxTags: max number of distinct tags
+	TagKey: set tag into `msg.Message[TagKey]`
+	MetadataKey: rename `@metadata` to MetadataKey, `@metadata` will be removed if empty
+	AckTimeout: wait at most AckTimeout for msgs in window to be persisted by journal,
+		connection will be closed if timeout, client should resend the window.
+	KeepaliveInterval: send empty ACK to prevent client timeout while waiting
+	MaxFrameSize: max size of one data frame or decompressed frame
+	TLS: enable tls if Enable is set
+*/
+type LumberjackRecvCfg struct {
+	Name, Addr       string
+	Tag, FallbackTag string
+	MaxTags          int
+	TagKey,
+	MetadataKey string
+	AckTimeout,
+	KeepaliveInterval time.Duration
+	MaxFrameSize int
+	TLS          *library.TLSCfg
+}
+
+// LumberjackRecv recv for beats lumberjack v2 protocol
+type LumberjackRecv struct {
+	*BaseRecv
+	*LumberjackRecvCfg
+
+	tlsConfig       *tls.Config
+	tagDeriver      *tagDeriver
+	connCounter     *utils.Counter
+	invalidCounter  *utils.Counter
+	timeoutCounter  *utils.Counter
+	fallbackCounter *utils.Counter
+}
+
+// NewLumberjackRecv create new LumberjackRecv
+func NewLumberjackRecv(cfg *LumberjackRecvCfg) *LumberjackRecv {
+	r := &LumberjackRecv{
+		BaseRecv:          &BaseRecv{},
+		LumberjackRecvCfg: cfg,
+		connCounter:       utils.NewCounter(),
+		invalidCounter:    utils.NewCounter(),
+		timeoutCounter:    utils.NewCounter(),
+		fallbackCounter:   utils.NewCounter(),
+	}
+	if err := r.valid(); err != nil {
+		log.Logger.Panic("config invalid", zap.Error(err))
+	}
+
+	log.Logger.Info("create LumberjackRecv",
+		zap.String("name", r.Name),
+		zap.String("addr", r.Addr),
+		zap.String("tag", r.Tag),
+		zap.Bool("tls", r.tlsConfig != nil),
+		zap.Duration("ack_timeout", r.AckTimeout))
+	return r
+}
+
+func (r *LumberjackRecv) valid() (err error) {
+	if r.Addr == "" {
+		return errors.New("addr should not be empty")
+	}
+	if r.Tag == "" {
+		return errors.New("tag should not be empty")
+	}
+
+	if r.TagKey == "" {
+		r.TagKey = "tag"
+		log.Logger.Info("reset tag_key", zap.String("tag_key", r.TagKey))
+	}
+	if r.AckTimeout <= 0 {
+		r.AckTimeout = defaultLumberjackAckTimeout
+		log.Logger.Info("reset ack_timeout_sec", zap.Duration("ack_timeout", r.AckTimeout))
+	}
+	if r.KeepaliveInterval <= 0 {
+		r.KeepaliveInterval = defaultLumberjackKeepaliveInterval
+		log.Logger.Info("reset keepalive_interval_sec", zap.Duration("keepalive_interval", r.KeepaliveInterval))
+	}
+	if r.MaxFrameSize <= 0 {
+		r.MaxFrameSize = defaultLumberjackMaxFrameSize
+		log.Logger.Info("reset max_frame_byte", zap.Int("max_frame_byte", r.MaxFrameSize))
+	}
+
+	if r.TLS != nil && r.TLS.Enable {
+		if r.tlsConfig, err = library.NewServerTLSConfig(r.TLS); err != nil {
+			return errors.Wrap(err, "load tls config")
+		}
+	}
+	if r.tagDeriver, err = newTagDeriver(r.Name, r.Tag, r.FallbackTag, r.MaxTags, nil); err != nil {
+		return errors.Wrap(err, "new tag deriver")
+	}
+	return nil
+}
+
+// GetName get the name of recv
+func (r *LumberjackRecv) GetName() string {
+	return r.Name
+}
+
+// Run start tcp listener
+func (r *LumberjackRecv) Run(ctx context.Context) {
+	log.Logger.Info("run LumberjackRecv", zap.String("name", r.Name))
+	monitor.AddMetric("lumberjackrecv."+r.Name, func() map[string]interface{} {
+		return map[string]interface{}{
+			"connectionTotal":  r.connCounter.Get(),
+			"invalidTotal":     r.invalidCounter.Get(),
+			"ackTimeoutTotal":  r.timeoutCounter.Get(),
+			"fallbackTotal":    r.fallbackCounter.Get(),
+			"derivedTagsTotal": r.tagDeriver.nTags(),
+		}
+	})
+
+	go func() {
+		defer log.Logger.Info("lumberjack server exit", zap.String("name", r.Name))
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+
+			ln, err := net.Listen("tcp", r.Addr)
+			if err != nil {
+				log.Logger.Error("try to bind addr got error", zap.String("addr", r.Addr), zap.Error(err))
+				time.Sleep(defaultRetryWait)
+				continue
+			}
+			if r.tlsConfig != nil {
+				ln = tls.NewListener(ln, r.tlsConfig)
+			}
+			log.Logger.Info("listening lumberjack", zap.String("name", r.Name), zap.String("addr", r.Addr))
+
+			ctx2Ln, cancel := context.WithCancel(ctx)
+			go func() {
+				<-ctx2Ln.Done()
+				ln.Close()
+			}()
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					if ctx.Err() == nil {
+						log.Logger.Error("accept lumberjack connection got error", zap.String("addr", r.Addr), zap.Error(err))
+					}
+					break
+				}
+				r.connCounter.Count()
+				go r.handleConn(ctx2Ln, conn)
+			}
+			cancel()
+		}
+	}()
+}
+
+// lumberjackConn state of one connection
+type lumberjackConn struct {
+	conn net.Conn
+	// window: number of data frames in current batch
+	window, nFrames uint32
+	lastSeq         uint32
+	// acker: released after all msgs in window persisted
+	acker *library.CountAcker
+	// writeLock protect conn from concurrent ack writing
+	writeLock sync.Mutex
+}
+
+func (c *lumberjackConn) resetBatch() {
+	c.nFrames = 0
+	c.acker = library.NewCountAcker() // hold by decoder until all frames in window read
+}
+
+// writeACK reply `2A<seq>`
+func (c *lumberjackConn) writeACK(seq uint32) error {
+	buf := make([]byte, 6)
+	buf[0] = lumberjackVersion
+	buf[1] = lumberjackFrameACK
+	binary.BigEndian.PutUint32(buf[2:], seq)
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+func (r *LumberjackRecv) handleConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	logger := log.Logger.With(zap.String("name", r.Name), zap.String("remote", conn.RemoteAddr().String()))
+	logger.Debug("accept lumberjack connection")
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	var (
+		reader = bufio.NewReader(conn)
+		c      = &lumberjackConn{conn: conn}
+		err    error
+	)
+	c.resetBatch()
+	for {
+		if err = r.readFrame(reader, c); err != nil {
+			if err != io.EOF && ctx.Err() == nil {
+				r.invalidCounter.Count()
+				logger.Warn("read lumberjack frame", zap.Error(err))
+			}
+			return
+		}
+
+		if c.window == 0 || c.nFrames < c.window {
+			continue
+		}
+		if err = r.waitAndACK(ctx, c); err != nil {
+			logger.Warn("close connection since ack failed", zap.Error(err))
+			return
+		}
+		c.resetBatch()
+	}
+}
+
+// waitAndACK wait all msgs in window persisted, then reply ack with the last sequence,
+// send keepalive while waiting.
+func (r *LumberjackRecv) waitAndACK(ctx context.Context, c *lumberjackConn) error {
+	c.acker.Ack() // release the hold by decoder
+	timeout := time.NewTimer(r.AckTimeout)
+	defer timeout.Stop()
+	keepalive := time.NewTicker(r.KeepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timeout.C:
+			r.timeoutCounter.Count()
+			return errors.Errorf("msgs not persisted in %v", r.AckTimeout)
+		case <-keepalive.C:
+			if err := c.writeACK(0); err != nil {
+				return errors.Wrap(err, "send keepalive")
+			}
+		case <-c.acker.Done():
+			return errors.Wrap(c.writeACK(c.lastSeq), "send ack")
+		}
+	}
+}
+
+// readFrame read one frame, compressed frame will be read recursively
+func (r *LumberjackRecv) readFrame(reader io.Reader, c *lumberjackConn) (err error) {
+	header := make([]byte, 2)
+	if _, err = io.ReadFull(reader, header); err != nil {
+		return err
+	}
+	if header[0] != lumberjackVersion {
+		return errors.Errorf("unsupported protocol version `%c`", header[0])
+	}
+
+	switch header[1] {
+	case lumberjackFrameWindow:
+		if c.window, err = readLumberjackUint32(reader); err != nil {
+			return errors.Wrap(err, "read window size")
+		}
+	case lumberjackFrameCompressed:
+		payload, err := r.readLumberjackBytes(reader)
+		if err != nil {
+			return errors.Wrap(err, "read compressed frame")
+		}
+		zr, err := zlib.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return errors.Wrap(err, "new zlib reader")
+		}
+		defer zr.Close()
+		if payload, err = ioutil.ReadAll(io.LimitReader(zr, int64(r.MaxFrameSize)+1)); err != nil {
+			return errors.Wrap(err, "decompress frame")
+		}
+		if len(payload) > r.MaxFrameSize {
+			return errors.Errorf("decompressed frame size must less than %d bytes", r.MaxFrameSize)
+		}
+
+		inner := bytes.NewReader(payload)
+		for inner.Len() != 0 {
+			if err = r.readFrame(inner, c); err != nil {
+				return err
+			}
+		}
+	case lumberjackFrameJSON:
+		seq, err := readLumberjackUint32(reader)
+		if err != nil {
+			return errors.Wrap(err, "read sequence")
+		}
+		payload, err := r.readLumberjackBytes(reader)
+		if err != nil {
+			return errors.Wrap(err, "read json frame")
+		}
+		data := map[string]interface{}{}
+		if err = json.Unmarshal(payload, &data); err != nil {
+			return errors.Wrap(err, "unmarshal json frame")
+		}
+		r.acceptEvent(c, seq, data)
+	case lumberjackFrameData:
+		seq, err := readLumberjackUint32(reader)
+		if err != nil {
+			return errors.Wrap(err, "read sequence")
+		}
+		n, err := readLumberjackUint32(reader)
+		if err != nil {
+			return errors.Wrap(err, "read pair count")
+		}
+		data := map[string]interface{}{}
+		for i := uint32(0); i < n; i++ {
+			k, err := r.readLumberjackBytes(reader)
+			if err != nil {
+				return errors.Wrap(err, "read key")
+			}
+			v, err := r.readLumberjackBytes(reader)
+			if err != nil {
+				return errors.Wrap(err, "read value")
+			}
+			data[string(k)] = string(v)
+		}
+		r.acceptEvent(c, seq, data)
+	default:
+		return errors.Errorf("unknown frame type `%c`", header[1])
+	}
+
+	return nil
+}
+
+// acceptEvent convert event to msg and put it into pipeline
+func (r *LumberjackRecv) acceptEvent(c *lumberjackConn, seq uint32, data map[string]interface{}) {
+	c.nFrames++
+	c.lastSeq = seq
+
+	msg := r.msgPool.Get().(*library.FluentMsg)
+	msg.ID = r.counter.Count()
+	msg.Message = data
+	if meta, ok := data[lumberjackMetadataKey]; ok {
+		delete(data, lumberjackMetadataKey)
+		if r.MetadataKey != "" {
+			data[r.MetadataKey] = meta
+		}
+	}
+	msg.Time = time.Time{}
+	if v, ok := data[lumberjackTimeKey].(string); ok {
+		if ts, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			msg.Time = ts.UTC()
+		}
+	}
+
+	var isFallback bool
+	if msg.Tag, isFallback = r.tagDeriver.derive(msg); isFallback {
+		r.fallbackCounter.Count()
+	}
+	msg.Message[r.TagKey] = msg.Tag
+	c.acker.Attach(msg)
+
+	log.Logger.Debug("receive new msg", zap.String("tag", msg.Tag), zap.Int64("id", msg.ID))
+	r.asyncOutChan <- msg
+}
+
+// readLumberjackBytes read `<uint32 length><payload>`
+func (r *LumberjackRecv) readLumberjackBytes(reader io.Reader) ([]byte, error) {
+	n, err := readLumberjackUint32(reader)
+	if err != nil {
+		return nil, err
+	}
+	if int(n) > r.MaxFrameSize {
+		return nil, errors.Errorf("frame size must less than %d bytes", r.MaxFrameSize)
+	}
+	buf := make([]byte, n)
+	if _, err = io.ReadFull(reader, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func readLumberjackUint32(reader io.Reader) (uint32, error) {
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(buf), nil
+}
@@ -0,0 +1,156 @@
+package recvs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"gofluentd/library"
+)
+
+func appendLumberjackUint32(buf []byte, n uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, n)
+	return append(buf, b...)
+}
+
+func appendLumberjackJSONFrame(buf []byte, seq uint32, payload string) []byte {
+	buf = append(buf, lumberjackVersion, lumberjackFrameJSON)
+	buf = appendLumberjackUint32(buf, seq)
+	buf = appendLumberjackUint32(buf, uint32(len(payload)))
+	return append(buf, payload...)
+}
+
+func readLumberjackACK(t *testing.T, conn net.Conn) uint32 {
+	buf := make([]byte, 6)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	if buf[0] != lumberjackVersion || buf[1] != lumberjackFrameACK {
+		t.Fatalf("got %v", buf)
+	}
+	return binary.BigEndian.Uint32(buf[2:])
+}
+
+func TestLumberjackRecv(t *testing.T) {
+	var (
+		outChan = make(chan *library.FluentMsg, 1000)
+		addr    = "127.0.0.1:24237"
+	)
+	recv := NewLumberjackRecv(&LumberjackRecvCfg{
+		Name:              "lumberjack-test",
+		Addr:              addr,
+		Tag:               "beats.%{fields.app}.sit",
+		MetadataKey:       "metadata",
+		AckTimeout:        300 * time.Millisecond,
+		KeepaliveInterval: 100 * time.Millisecond,
+	})
+	recv.SetCounter(counter)
+	recv.SetMsgPool(msgPool)
+	recv.SetAsyncOutChan(outChan)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	recv.Run(ctx)
+	time.Sleep(100 * time.Millisecond)
+
+	loadMsg := func() *library.FluentMsg {
+		select {
+		case msg := <-outChan:
+			return msg
+		case <-time.After(2 * time.Second):
+			t.Fatal("can not load msg")
+		}
+		return nil
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	defer conn.Close()
+
+	// window of 3: one compressed frame with 2 json frames, then one data frame
+	var inner []byte
+	inner = appendLumberjackJSONFrame(inner, 1, `{"@timestamp":"2020-01-02T03:04:05.123Z","@metadata":{"beat":"filebeat"},"message":"a","fields":{"app":"order"}}`)
+	inner = appendLumberjackJSONFrame(inner, 2, `{"message":"b","fields":{"app":"pay"}}`)
+	zbuf := &bytes.Buffer{}
+	zw := zlib.NewWriter(zbuf)
+	zw.Write(inner)
+	zw.Close()
+
+	var data []byte
+	data = append(data, lumberjackVersion, lumberjackFrameWindow)
+	data = appendLumberjackUint32(data, 3)
+	data = append(data, lumberjackVersion, lumberjackFrameCompressed)
+	data = appendLumberjackUint32(data, uint32(zbuf.Len()))
+	data = append(data, zbuf.Bytes()...)
+	data = append(data, lumberjackVersion, lumberjackFrameData)
+	data = appendLumberjackUint32(data, 3)
+	data = appendLumberjackUint32(data, 1)
+	data = appendLumberjackUint32(data, 7)
+	data = append(data, "message"...)
+	data = appendLumberjackUint32(data, 1)
+	data = append(data, 'c')
+	if _, err = conn.Write(data); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+
+	msg := loadMsg()
+	if msg.Tag != "beats.order.sit" ||
+		msg.Message["tag"] != "beats.order.sit" ||
+		msg.Message["message"] != "a" ||
+		msg.Message["@metadata"] != nil ||
+		msg.Message["metadata"].(map[string]interface{})["beat"] != "filebeat" ||
+		!msg.Time.Equal(time.Date(2020, 1, 2, 3, 4, 5, 123000000, time.UTC)) {
+		t.Fatalf("got %+v, %+v, %v", msg.Tag, msg.Message, msg.Time)
+	}
+	msgs := []*library.FluentMsg{msg, loadMsg(), loadMsg()}
+	if msgs[1].Tag != "beats.pay.sit" || msgs[2].Message["message"] != "c" || msgs[2].Tag != "beats.unknown.sit" {
+		t.Fatalf("got %+v, %+v", msgs[1].Message, msgs[2].Message)
+	}
+
+	// ack after all msgs persisted, keepalive while waiting
+	msgs[0].Ack()
+	msgs[1].Ack()
+	if seq := readLumberjackACK(t, conn); seq != 0 {
+		t.Fatalf("got %d", seq)
+	}
+	msgs[2].Ack()
+	for {
+		if seq := readLumberjackACK(t, conn); seq != 0 {
+			if seq != 3 {
+				t.Fatalf("got %d", seq)
+			}
+			break
+		}
+	}
+
+	// connection closed if msgs not persisted in time
+	data = data[:0]
+	data = append(data, lumberjackVersion, lumberjackFrameWindow)
+	data = appendLumberjackUint32(data, 1)
+	data = appendLumberjackJSONFrame(data, 1, `{"message":"d"}`)
+	if _, err = conn.Write(data); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	loadMsg()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 6)
+	for {
+		if _, err = io.ReadFull(conn, buf); err != nil {
+			break
+		}
+		if seq := binary.BigEndian.Uint32(buf[2:]); seq != 0 {
+			t.Fatalf("should not ack, got %d", seq)
+		}
+	}
+	if err != io.EOF || recv.timeoutCounter.Get() != 1 {
+		t.Fatalf("got %+v", err)
+	}
+}
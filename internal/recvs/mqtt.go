@@ -0,0 +1,724 @@
+package recvs
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"gofluentd/internal/monitor"
+	"gofluentd/library"
+	"gofluentd/library/log"
+
+	utils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/eclipse/paho.golang/packets"
+	mqttv5 "github.com/eclipse/paho.golang/paho"
+	mqttv3 "github.com/eclipse/paho.mqtt.golang"
+	"github.com/pkg/errors"
+)
+
+// MQTT protocol levels
+const (
+	MQTTProtocolV311 = 4
+	MQTTProtocolV5   = 5
+)
+
+const (
+	defaultMQTTKeepAlive      = 30 * time.Second
+	defaultMQTTConnectTimeout = 10 * time.Second
+	defaultMQTTAckTimeout     = 30 * time.Second
+	defaultMQTTSessionExpiry  = 24 * time.Hour
+	defaultMQTTMaxInflight    = 100
+	defaultMQTTMaxPacketSize  = 10 * 1024 * 1024
+
+	// MQTTFormatJSON decode payload as JSON object
+	MQTTFormatJSON = "json"
+	// MQTTFormatRaw put payload into `msg.Message[MsgKey]`
+	MQTTFormatRaw = "raw"
+
+	mqttSharePrefix = "$share/"
+)
+
+// MQTTSubscription subscribe topics by template
+type MQTTSubscription struct {
+	// Topic: topic filter, wildcard level can be named like `vehicle/+vin/log` or `vehicle/#path`,
+	// named levels will be set into msg with the name as key.
+	// shared subscription like `$share/gofluentd/vehicle/+vin/log` is supported by v5.
+	Topic string
+	// QoS: max qos, 0 or 1
+	QoS int
+	// Tag: tag template like `vehicle.%{vin}.sit`
+	Tag, FallbackTag string
+	// Format: `json` or `raw`, invalid JSON payload will be treated as raw
+	Format string
+}
+
+// ParseMQTTSubscriptions parse settings to subscriptions
+func ParseMQTTSubscriptions(env string, cfg interface{}) []*MQTTSubscription {
+	items, ok := normalizeSettingVal(cfg).([]interface{})
+	if !ok {
+		return nil
+	}
+
+	subs := []*MQTTSubscription{}
+	for _, itemI := range items {
+		item, ok := itemI.(map[string]interface{})
+		if !ok {
+			log.Logger.Panic("mqtt subscription should be map", zap.String("cfg", fmt.Sprint(itemI)))
+		}
+		s := &MQTTSubscription{}
+		s.Topic, _ = item["topic"].(string)
+		s.QoS, _ = item["qos"].(int)
+		if v, ok := item["tag"].(string); ok {
+			s.Tag = library.LoadTagReplaceEnv(env, v)
+		}
+		if v, ok := item["fallback_tag"].(string); ok {
+			s.FallbackTag = library.LoadTagReplaceEnv(env, v)
+		}
+		s.Format, _ = item["format"].(string)
+		subs = append(subs, s)
+	}
+
+	return subs
+}
+
+// mqttTopic parsed topic template
+type mqttTopic struct {
+	// filter: topic filter sent to server
+	filter string
+	// levels: levels of filter without shared prefix
+	levels []string
+	// names: name of each wildcard level, empty if not named
+	names []string
+}
+
+func parseMQTTTopicTemplate(tpl string) (*mqttTopic, error) {
+	var share string
+	if strings.HasPrefix(tpl, mqttSharePrefix) {
+		parts := strings.SplitN(strings.TrimPrefix(tpl, mqttSharePrefix), "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.Errorf("invalid shared subscription `%s`", tpl)
+		}
+		share = mqttSharePrefix + parts[0] + "/"
+		tpl = parts[1]
+	}
+	if tpl == "" {
+		return nil, errors.New("topic should not be empty")
+	}
+
+	t := &mqttTopic{}
+	for i, lv := range strings.Split(tpl, "/") {
+		var name string
+		switch {
+		case strings.HasPrefix(lv, "+"):
+			name, lv = lv[1:], "+"
+		case strings.HasPrefix(lv, "#"):
+			name, lv = lv[1:], "#"
+			if i != strings.Count(tpl, "/") {
+				return nil, errors.Errorf("`#` should be the last level in `%s`", tpl)
+			}
+		case strings.ContainsAny(lv, "+#"):
+			return nil, errors.Errorf("wildcard should occupy entire level in `%s`", tpl)
+		}
+		t.levels = append(t.levels, lv)
+		t.names = append(t.names, name)
+	}
+	t.filter = share + strings.Join(t.levels, "/")
+	return t, nil
+}
+
+// match return values of named levels if topic matches filter
+func (t *mqttTopic) match(topic string) (fields map[string]string, ok bool) {
+	topicLevels := strings.Split(topic, "/")
+	// topics start with `$` should not be matched by wildcard at first level
+	if strings.HasPrefix(topic, "$") && (t.levels[0] == "+" || t.levels[0] == "#") {
+		return nil, false
+	}
+
+	fields = map[string]string{}
+	for i, lv := range t.levels {
+		switch {
+		case lv == "#":
+			if t.names[i] != "" {
+				if i < len(topicLevels) {
+					fields[t.names[i]] = strings.Join(topicLevels[i:], "/")
+				} else {
+					fields[t.names[i]] = ""
+				}
+			}
+			return fields, true
+		case i >= len(topicLevels):
+			return nil, false
+		case lv == "+":
+			if t.names[i] != "" {
+				fields[t.names[i]] = topicLevels[i]
+			}
+		case lv != topicLevels[i]:
+			return nil, false
+		}
+	}
+
+	return fields, len(topicLevels) == len(t.levels)
+}
+
+// mqttSubscription subscription with parsed topic & tag deriver
+type mqttSubscription struct {
+	*MQTTSubscription
+	topic      *mqttTopic
+	tagDeriver *tagDeriver
+}
+
+/*MQTTRecvCfg is the configuration for MQTTRecv
+
+Args:
+	Addr: server address like `127.0.0.1:1883`
+	ClientID: required by persistent session
+	ProtocolVersion: 4 for MQTT 3.1.1, 5 for MQTT 5.0, default to 4
+	IsCleanSession: discard session on server after disconnected,
+		otherwise qos 1 msgs published while disconnected will be redelivered.
+	SessionExpiry: v5 only, how long will server keep the persistent session
+	KeepAlive: interval of PINGREQ
+	ConnectTimeout: timeout of dial & CONNECT
+	AckTimeout: PUBACK is sent after msg persisted by journal,
+		connection will be closed if msg not persisted in AckTimeout.
+	MaxInflight: max unacked qos 1 msgs, also sent as receive maximum by v5
+	MaxPacketSize: v5 only, max size of one packet
+	TagKey: set tag into `msg.Message[TagKey]`
+	MsgKey: put raw payload into `msg.Message[MsgKey]`
+	TopicKey: optional, set topic into `msg.Message[TopicKey]`
+	MaxTags: max number of distinct tags per subscription
+	TLS: enable tls if Enable is set
+*/
+type MQTTRecvCfg struct {
+	Name, Addr string
+	ClientID, Username,
+	Password string
+	ProtocolVersion int
+	IsCleanSession  bool
+	SessionExpiry, KeepAlive,
+	ConnectTimeout, AckTimeout time.Duration
+	MaxInflight, MaxPacketSize int
+	TagKey, MsgKey,
+	TopicKey string
+	MaxTags       int
+	Subscriptions []*MQTTSubscription
+	TLS           *library.TLSCfg
+}
+
+// MQTTRecv subscribe msgs from MQTT server
+type MQTTRecv struct {
+	*BaseRecv
+	*MQTTRecvCfg
+
+	tlsConfig        *tls.Config
+	subs             []*mqttSubscription
+	connCounter      *utils.Counter
+	decodeErrCounter *utils.Counter
+	unmatchedCounter *utils.Counter
+	timeoutCounter   *utils.Counter
+	fallbackCounter  *utils.Counter
+}
+
+// NewMQTTRecv create new MQTTRecv
+func NewMQTTRecv(cfg *MQTTRecvCfg) *MQTTRecv {
+	r := &MQTTRecv{
+		BaseRecv:         &BaseRecv{},
+		MQTTRecvCfg:      cfg,
+		connCounter:      utils.NewCounter(),
+		decodeErrCounter: utils.NewCounter(),
+		unmatchedCounter: utils.NewCounter(),
+		timeoutCounter:   utils.NewCounter(),
+		fallbackCounter:  utils.NewCounter(),
+	}
+	if err := r.valid(); err != nil {
+		log.Logger.Panic("config invalid", zap.Error(err))
+	}
+
+	log.Logger.Info("create MQTTRecv",
+		zap.String("name", r.Name),
+		zap.String("addr", r.Addr),
+		zap.String("client_id", r.ClientID),
+		zap.Int("protocol_version", r.ProtocolVersion),
+		zap.Bool("clean_session", r.IsCleanSession),
+		zap.Bool("tls", r.tlsConfig != nil),
+		zap.Int("n_subscriptions", len(r.subs)))
+	return r
+}
+
+func (r *MQTTRecv) valid() (err error) {
+	if r.Addr == "" {
+		return errors.New("addr should not be empty")
+	}
+	if len(r.Subscriptions) == 0 {
+		return errors.New("subscriptions should not be empty")
+	}
+
+	switch r.ProtocolVersion {
+	case 0:
+		r.ProtocolVersion = MQTTProtocolV311
+		log.Logger.Info("reset protocol_version", zap.Int("protocol_version", r.ProtocolVersion))
+	case MQTTProtocolV311, MQTTProtocolV5:
+	default:
+		return errors.Errorf("unsupported protocol_version %d", r.ProtocolVersion)
+	}
+	if r.ClientID == "" {
+		if !r.IsCleanSession {
+			return errors.New("client_id should not be empty for persistent session")
+		}
+		r.ClientID = "gofluentd-" + r.Name + "-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+		log.Logger.Info("reset client_id", zap.String("client_id", r.ClientID))
+	}
+	if r.SessionExpiry <= 0 && !r.IsCleanSession && r.ProtocolVersion == MQTTProtocolV5 {
+		r.SessionExpiry = defaultMQTTSessionExpiry
+		log.Logger.Info("reset session_expiry_sec", zap.Duration("session_expiry", r.SessionExpiry))
+	}
+	if r.KeepAlive <= 0 {
+		r.KeepAlive = defaultMQTTKeepAlive
+		log.Logger.Info("reset keepalive_sec", zap.Duration("keepalive", r.KeepAlive))
+	}
+	if r.KeepAlive > 0xffff*time.Second {
+		return errors.New("keepalive_sec should less than 65536")
+	}
+	if r.ConnectTimeout <= 0 {
+		r.ConnectTimeout = defaultMQTTConnectTimeout
+		log.Logger.Info("reset connect_timeout_sec", zap.Duration("connect_timeout", r.ConnectTimeout))
+	}
+	if r.AckTimeout <= 0 {
+		r.AckTimeout = defaultMQTTAckTimeout
+		log.Logger.Info("reset ack_timeout_sec", zap.Duration("ack_timeout", r.AckTimeout))
+	}
+	if r.MaxInflight <= 0 {
+		r.MaxInflight = defaultMQTTMaxInflight
+		log.Logger.Info("reset max_inflight", zap.Int("max_inflight", r.MaxInflight))
+	}
+	if r.MaxInflight > 0xffff {
+		return errors.New("max_inflight should less than 65536")
+	}
+	if r.MaxPacketSize <= 0 {
+		r.MaxPacketSize = defaultMQTTMaxPacketSize
+		log.Logger.Info("reset max_packet_byte", zap.Int("max_packet_byte", r.MaxPacketSize))
+	}
+	if r.TagKey == "" {
+		r.TagKey = "tag"
+		log.Logger.Info("reset tag_key", zap.String("tag_key", r.TagKey))
+	}
+	if r.MsgKey == "" {
+		r.MsgKey = "message"
+		log.Logger.Info("reset msg_key", zap.String("msg_key", r.MsgKey))
+	}
+
+	for _, s := range r.Subscriptions {
+		if s.Tag == "" {
+			return errors.Errorf("tag should not be empty for topic `%s`", s.Topic)
+		}
+		if s.QoS != 0 && s.QoS != 1 {
+			return errors.Errorf("qos should be 0 or 1 for topic `%s`", s.Topic)
+		}
+		switch s.Format {
+		case "":
+			s.Format = MQTTFormatJSON
+			log.Logger.Info("reset format", zap.String("topic", s.Topic), zap.String("format", s.Format))
+		case MQTTFormatJSON, MQTTFormatRaw:
+		default:
+			return errors.Errorf("unknown format `%s` for topic `%s`", s.Format, s.Topic)
+		}
+
+		sub := &mqttSubscription{MQTTSubscription: s}
+		if sub.topic, err = parseMQTTTopicTemplate(s.Topic); err != nil {
+			return errors.Wrap(err, "parse topic")
+		}
+		if strings.HasPrefix(sub.topic.filter, mqttSharePrefix) && r.ProtocolVersion != MQTTProtocolV5 {
+			return errors.Errorf("shared subscription `%s` requires protocol_version 5", s.Topic)
+		}
+		if sub.tagDeriver, err = newTagDeriver(r.Name, s.Tag, s.FallbackTag, r.MaxTags, nil); err != nil {
+			return errors.Wrap(err, "new tag deriver")
+		}
+		r.subs = append(r.subs, sub)
+	}
+
+	if r.TLS != nil && r.TLS.Enable {
+		if r.tlsConfig, err = library.NewClientTLSConfig(r.TLS); err != nil {
+			return errors.Wrap(err, "load tls config")
+		}
+	}
+	return nil
+}
+
+// GetName get the name of recv
+func (r *MQTTRecv) GetName() string {
+	return r.Name
+}
+
+// Run connect to server, reconnect if disconnected
+func (r *MQTTRecv) Run(ctx context.Context) {
+	log.Logger.Info("run MQTTRecv", zap.String("name", r.Name))
+	monitor.AddMetric("mqttrecv."+r.Name, func() map[string]interface{} {
+		nTags := 0
+		for _, s := range r.subs {
+			nTags += s.tagDeriver.nTags()
+		}
+		return map[string]interface{}{
+			"connectionTotal":  r.connCounter.Get(),
+			"decodeErrTotal":   r.decodeErrCounter.Get(),
+			"unmatchedTotal":   r.unmatchedCounter.Get(),
+			"ackTimeoutTotal":  r.timeoutCounter.Get(),
+			"fallbackTotal":    r.fallbackCounter.Get(),
+			"derivedTagsTotal": nTags,
+		}
+	})
+
+	go func() {
+		defer log.Logger.Info("mqtt client exit", zap.String("name", r.Name))
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+
+			if err := r.runSession(ctx); err != nil && ctx.Err() == nil {
+				log.Logger.Error("mqtt session got error", zap.String("name", r.Name), zap.String("addr", r.Addr), zap.Error(err))
+				time.Sleep(defaultRetryWait)
+			}
+		}
+	}()
+}
+
+// mqttMsg msg received by mqtt client
+type mqttMsg struct {
+	topic   string
+	qos     byte
+	payload []byte
+	// ack send PUBACK, should be called in the order of receiving
+	ack func()
+}
+
+// mqttPendingAck qos 1 msg waiting to be persisted,
+// acker is nil if msg is discarded.
+type mqttPendingAck struct {
+	msg   *mqttMsg
+	acker *library.CountAcker
+}
+
+// notifyMQTTLost put err into lost without blocking, only the first error matters
+func notifyMQTTLost(lost chan<- error, err error) {
+	select {
+	case lost <- err:
+	default:
+	}
+}
+
+// runSession connect & subscribe, then block until disconnected
+func (r *MQTTRecv) runSession(ctx context.Context) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		lost       = make(chan error, 1)
+		pending    = make(chan *mqttPendingAck, r.MaxInflight)
+		disconnect func()
+		handler    = func(m *mqttMsg) {
+			r.acceptPublish(ctx, pending, m)
+		}
+	)
+	if r.ProtocolVersion == MQTTProtocolV5 {
+		disconnect, err = r.connectV5(ctx, handler, lost)
+	} else {
+		disconnect, err = r.connectV311(handler, lost)
+	}
+	if err != nil {
+		return err
+	}
+	r.connCounter.Count()
+
+	go func() {
+		if err := r.runAcker(ctx, pending); err != nil {
+			notifyMQTTLost(lost, err)
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+	case err = <-lost:
+	}
+	// unblock handler & acker before disconnecting,
+	// client waits for handler to return
+	cancel()
+	disconnect()
+	return err
+}
+
+// connectV311 connect to server by MQTT 3.1.1
+func (r *MQTTRecv) connectV311(handler func(*mqttMsg), lost chan<- error) (disconnect func(), err error) {
+	opts := mqttv3.NewClientOptions().
+		SetClientID(r.ClientID).
+		SetUsername(r.Username).
+		SetPassword(r.Password).
+		SetProtocolVersion(MQTTProtocolV311).
+		SetCleanSession(r.IsCleanSession).
+		SetKeepAlive(r.KeepAlive).
+		SetConnectTimeout(r.ConnectTimeout).
+		SetAutoReconnect(false).
+		SetAutoAckDisabled(true).
+		SetOrderMatters(true).
+		SetDefaultPublishHandler(func(_ mqttv3.Client, m mqttv3.Message) {
+			handler(&mqttMsg{
+				topic:   m.Topic(),
+				qos:     m.Qos(),
+				payload: m.Payload(),
+				ack: func() {
+					// paho panics if msg is acked after connection closed,
+					// server will redeliver the msg anyway
+					defer func() { _ = recover() }()
+					m.Ack()
+				},
+			})
+		}).
+		SetConnectionLostHandler(func(_ mqttv3.Client, err error) {
+			notifyMQTTLost(lost, errors.Wrap(err, "connection lost"))
+		})
+	if r.tlsConfig != nil {
+		opts.AddBroker("ssl://" + r.Addr).SetTLSConfig(r.tlsConfig)
+	} else {
+		opts.AddBroker("tcp://" + r.Addr)
+	}
+
+	c := mqttv3.NewClient(opts)
+	ct := c.Connect()
+	ct.Wait()
+	if err = ct.Error(); err != nil {
+		return nil, errors.Wrapf(err, "connect `%s`", r.Addr)
+	}
+	disconnect = func() { c.Disconnect(0) }
+	log.Logger.Info("connected to mqtt server",
+		zap.String("name", r.Name),
+		zap.String("addr", r.Addr),
+		zap.Bool("session_present", ct.(*mqttv3.ConnectToken).SessionPresent()))
+
+	// subscribe on every connection, it's harmless if session present
+	filters := map[string]byte{}
+	for _, sub := range r.subs {
+		filters[sub.topic.filter] = byte(sub.QoS)
+	}
+	st := c.SubscribeMultiple(filters, nil)
+	if !st.WaitTimeout(r.ConnectTimeout) {
+		disconnect()
+		return nil, errors.New("subscribe timeout")
+	}
+	if err = st.Error(); err != nil {
+		disconnect()
+		return nil, errors.Wrap(err, "subscribe")
+	}
+	for filter, code := range st.(*mqttv3.SubscribeToken).Result() {
+		if code >= 0x80 {
+			disconnect()
+			return nil, errors.Errorf("subscribe `%s` refused with code %d", filter, code)
+		}
+	}
+
+	log.Logger.Info("subscribed mqtt topics", zap.String("name", r.Name), zap.Int("n", len(filters)))
+	return disconnect, nil
+}
+
+// connectV5 connect to server by MQTT 5.0
+func (r *MQTTRecv) connectV5(ctx context.Context, handler func(*mqttMsg), lost chan<- error) (disconnect func(), err error) {
+	dialer := &net.Dialer{Timeout: r.ConnectTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", r.Addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "dial `%s`", r.Addr)
+	}
+	if r.tlsConfig != nil {
+		tlsCfg := r.tlsConfig.Clone()
+		if tlsCfg.ServerName == "" {
+			tlsCfg.ServerName, _, _ = net.SplitHostPort(r.Addr)
+		}
+		conn = tls.Client(conn, tlsCfg)
+	}
+
+	var c *mqttv5.Client
+	c = mqttv5.NewClient(mqttv5.ClientConfig{
+		// paho writes acks & pings concurrently
+		Conn:          packets.NewThreadSafeConn(conn),
+		PacketTimeout: r.ConnectTimeout,
+		Router: mqttv5.NewSingleHandlerRouter(func(p *mqttv5.Publish) {
+			handler(&mqttMsg{
+				topic:   p.Topic,
+				qos:     p.QoS,
+				payload: p.Payload,
+				ack: func() {
+					if err := c.Ack(p); err != nil {
+						log.Logger.Debug("ack msg", zap.String("name", r.Name), zap.Error(err))
+					}
+				},
+			})
+		}),
+		EnableManualAcknowledgment: true,
+		OnClientError: func(err error) {
+			notifyMQTTLost(lost, errors.Wrap(err, "connection lost"))
+		},
+		OnServerDisconnect: func(d *mqttv5.Disconnect) {
+			notifyMQTTLost(lost, errors.Errorf("disconnected by server with code %d", d.ReasonCode))
+		},
+	})
+
+	var (
+		receiveMaximum = uint16(r.MaxInflight)
+		maxPacketSize  = uint32(r.MaxPacketSize)
+		sessionExpiry  = uint32(r.SessionExpiry / time.Second)
+	)
+	ca, err := c.Connect(ctx, &mqttv5.Connect{
+		ClientID:     r.ClientID,
+		Username:     r.Username,
+		UsernameFlag: r.Username != "",
+		Password:     []byte(r.Password),
+		PasswordFlag: r.Password != "",
+		CleanStart:   r.IsCleanSession,
+		KeepAlive:    uint16(r.KeepAlive / time.Second),
+		Properties: &mqttv5.ConnectProperties{
+			SessionExpiryInterval: &sessionExpiry,
+			ReceiveMaximum:        &receiveMaximum,
+			MaximumPacketSize:     &maxPacketSize,
+		},
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "connect `%s`", r.Addr)
+	}
+	disconnect = func() {
+		_ = c.Disconnect(&mqttv5.Disconnect{ReasonCode: 0})
+	}
+	log.Logger.Info("connected to mqtt server",
+		zap.String("name", r.Name),
+		zap.String("addr", r.Addr),
+		zap.Bool("session_present", ca.SessionPresent))
+
+	// subscribe on every connection, it's harmless if session present
+	s := &mqttv5.Subscribe{Subscriptions: map[string]mqttv5.SubscribeOptions{}}
+	for _, sub := range r.subs {
+		s.Subscriptions[sub.topic.filter] = mqttv5.SubscribeOptions{QoS: byte(sub.QoS)}
+	}
+	subCtx, cancel := context.WithTimeout(ctx, r.ConnectTimeout)
+	defer cancel()
+	sa, err := c.Subscribe(subCtx, s)
+	if err != nil {
+		disconnect()
+		return nil, errors.Wrap(err, "subscribe")
+	}
+	for _, code := range sa.Reasons {
+		if code >= 0x80 {
+			disconnect()
+			return nil, errors.Errorf("subscribe refused with code %d", code)
+		}
+	}
+
+	log.Logger.Info("subscribed mqtt topics", zap.String("name", r.Name), zap.Int("n", len(sa.Reasons)))
+	return disconnect, nil
+}
+
+// runAcker send PUBACK after msg persisted by journal,
+// return error if msg not persisted in time, server will redeliver it after reconnected.
+func (r *MQTTRecv) runAcker(ctx context.Context, pending <-chan *mqttPendingAck) error {
+	for {
+		var a *mqttPendingAck
+		select {
+		case <-ctx.Done():
+			return nil
+		case a = <-pending:
+		}
+
+		if a.acker != nil {
+			timer := time.NewTimer(r.AckTimeout)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return nil
+			case <-timer.C:
+				r.timeoutCounter.Count()
+				return errors.Errorf("msg not persisted in %s", r.AckTimeout)
+			case <-a.acker.Done():
+				timer.Stop()
+			}
+		}
+
+		a.msg.ack()
+	}
+}
+
+// match return the first subscription that matches topic
+func (r *MQTTRecv) match(topic string) (*mqttSubscription, map[string]string) {
+	for _, sub := range r.subs {
+		if fields, ok := sub.topic.match(topic); ok {
+			return sub, fields
+		}
+	}
+	return nil, nil
+}
+
+// acceptPublish convert mqtt msg to msg and put it into pipeline
+func (r *MQTTRecv) acceptPublish(ctx context.Context, pending chan<- *mqttPendingAck, m *mqttMsg) {
+	a := &mqttPendingAck{msg: m}
+	sub, fields := r.match(m.topic)
+	if sub == nil {
+		r.unmatchedCounter.Count()
+		log.Logger.Debug("discard msg since topic not matched", zap.String("name", r.Name), zap.String("topic", m.topic))
+		if m.qos > 0 {
+			putMQTTPendingAck(ctx, pending, a)
+		}
+		return
+	}
+
+	msg := r.msgPool.Get().(*library.FluentMsg)
+	msg.ID = r.counter.Count()
+	msg.Message = r.decodePayload(sub, m.payload)
+	for k, v := range fields {
+		msg.Message[k] = v
+	}
+	if r.TopicKey != "" {
+		msg.Message[r.TopicKey] = m.topic
+	}
+	msg.Time = time.Time{}
+
+	var isFallback bool
+	if msg.Tag, isFallback = sub.tagDeriver.derive(msg); isFallback {
+		r.fallbackCounter.Count()
+	}
+	msg.Message[r.TagKey] = msg.Tag
+	msg.Ackers = nil
+	if m.qos > 0 {
+		a.acker = library.NewCountAcker()
+		a.acker.Attach(msg)
+		a.acker.Ack() // release the hold by receiver
+		putMQTTPendingAck(ctx, pending, a)
+	}
+
+	log.Logger.Debug("receive new msg", zap.String("tag", msg.Tag), zap.Int64("id", msg.ID))
+	select {
+	case <-ctx.Done():
+		// disconnected, qos 1 msg will be redelivered
+	case r.asyncOutChan <- msg:
+	}
+}
+
+// putMQTTPendingAck block if too many inflight msgs
+func putMQTTPendingAck(ctx context.Context, pending chan<- *mqttPendingAck, a *mqttPendingAck) {
+	select {
+	case <-ctx.Done():
+	case pending <- a:
+	}
+}
+
+// decodePayload decode payload by format of subscription
+func (r *MQTTRecv) decodePayload(sub *mqttSubscription, payload []byte) map[string]interface{} {
+	if sub.Format == MQTTFormatJSON {
+		data := map[string]interface{}{}
+		if err := json.Unmarshal(payload, &data); err == nil && data != nil {
+			return data
+		}
+		r.decodeErrCounter.Count()
+	}
+
+	return map[string]interface{}{r.MsgKey: string(payload)}
+}
@@ -0,0 +1,184 @@
+package recvs
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"gofluentd/library"
+
+	"github.com/DrmagicE/gmqtt"
+	_ "github.com/DrmagicE/gmqtt/persistence"
+	"github.com/DrmagicE/gmqtt/server"
+	_ "github.com/DrmagicE/gmqtt/topicalias/fifo"
+)
+
+func TestMQTTTopicTemplate(t *testing.T) {
+	for _, c := range []struct {
+		tpl, filter, topic string
+		ok                 bool
+		fields             map[string]string
+	}{
+		{"vehicle/+vin/log", "vehicle/+/log", "vehicle/abc/log", true, map[string]string{"vin": "abc"}},
+		{"vehicle/+vin/log", "vehicle/+/log", "vehicle/abc/log/x", false, nil},
+		{"vehicle/+/+kind/#path", "vehicle/+/+/#", "vehicle/abc/can/a/b", true, map[string]string{"kind": "can", "path": "a/b"}},
+		{"vehicle/#path", "vehicle/#", "vehicle", true, map[string]string{"path": ""}},
+		{"$share/g/vehicle/+vin", "$share/g/vehicle/+", "vehicle/abc", true, map[string]string{"vin": "abc"}},
+		{"+a/log", "+/log", "$SYS/log", false, nil},
+	} {
+		topic, err := parseMQTTTopicTemplate(c.tpl)
+		if err != nil {
+			t.Fatalf("got error: %+v", err)
+		}
+		if topic.filter != c.filter {
+			t.Fatalf("got %s", topic.filter)
+		}
+		fields, ok := topic.match(c.topic)
+		if ok != c.ok || (ok && !reflect.DeepEqual(fields, c.fields)) {
+			t.Fatalf("got %v, %+v for %+v", ok, fields, c)
+		}
+	}
+
+	for _, tpl := range []string{"", "a/#b/c", "a/b+/c", "$share/g"} {
+		if _, err := parseMQTTTopicTemplate(tpl); err == nil {
+			t.Fatalf("should got error for `%s`", tpl)
+		}
+	}
+}
+
+func TestMQTTRecv(t *testing.T) {
+	for _, version := range []int{MQTTProtocolV311, MQTTProtocolV5} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("got error: %+v", err)
+		}
+		resumed := make(chan bool, 10)
+		subscribed := make(chan string, 10)
+		broker := server.New(
+			server.WithTCPListener(ln),
+			server.WithHook(server.Hooks{
+				OnSessionCreated: func(context.Context, server.Client) { resumed <- false },
+				OnSessionResumed: func(context.Context, server.Client) { resumed <- true },
+				OnSubscribed: func(_ context.Context, _ server.Client, s *gmqtt.Subscription) {
+					subscribed <- s.TopicFilter
+				},
+			}),
+		)
+		go broker.Run()
+
+		outChan := make(chan *library.FluentMsg, 1000)
+		recv := NewMQTTRecv(&MQTTRecvCfg{
+			Name:            "mqtt-test",
+			Addr:            ln.Addr().String(),
+			ClientID:        "gofluentd-test",
+			ProtocolVersion: version,
+			TopicKey:        "topic",
+			AckTimeout:      500 * time.Millisecond,
+			Subscriptions: []*MQTTSubscription{
+				{Topic: "vehicle/+vin/log", QoS: 1, Tag: "bigdata.%{vin}.sit"},
+				{Topic: "vehicle/+vin/raw/#", Tag: "raw.sit", Format: MQTTFormatRaw},
+			},
+		})
+		recv.SetCounter(counter)
+		recv.SetMsgPool(msgPool)
+		recv.SetAsyncOutChan(outChan)
+		ctx, cancel := context.WithCancel(context.Background())
+		recv.Run(ctx)
+
+		loadMsg := func() *library.FluentMsg {
+			select {
+			case msg := <-outChan:
+				return msg
+			case <-time.After(5 * time.Second):
+				t.Fatal("can not load msg")
+			}
+			return nil
+		}
+		checkSession := func(expect bool) {
+			select {
+			case isResumed := <-resumed:
+				if isResumed != expect {
+					t.Fatalf("expect session resumed %v", expect)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("not connected")
+			}
+		}
+		publish := func(topic string, qos uint8, payload string) {
+			broker.Publisher().Publish(&gmqtt.Message{Topic: topic, QoS: qos, Payload: []byte(payload)})
+		}
+		inflight := func() uint64 {
+			stats, _ := broker.StatsManager().GetClientStats("gofluentd-test")
+			return stats.MessageStats.InflightCurrent
+		}
+		waitInflight := func(expect uint64) {
+			for i := 0; i < 100; i++ {
+				if inflight() == expect {
+					return
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+			t.Fatalf("expect %d inflight msgs, got %d", expect, inflight())
+		}
+
+		checkSession(false)
+		for i := 0; i < 2; i++ {
+			select {
+			case <-subscribed:
+			case <-time.After(5 * time.Second):
+				t.Fatal("not subscribed")
+			}
+		}
+		publish("vehicle/abc/log", 1, `{"vin": "should be overwritten", "speed": 10}`)
+		publish("vehicle/abc/raw/can", 0, "raw-payload")
+		publish("vehicle/def/log", 1, `{"speed": 20}`)
+
+		msg := loadMsg()
+		if msg.Tag != "bigdata.abc.sit" ||
+			msg.Message["tag"] != "bigdata.abc.sit" ||
+			msg.Message["vin"] != "abc" ||
+			msg.Message["speed"] != float64(10) ||
+			msg.Message["topic"] != "vehicle/abc/log" {
+			t.Fatalf("got %+v, %+v", msg.Tag, msg.Message)
+		}
+		rawMsg := loadMsg()
+		if rawMsg.Tag != "raw.sit" || rawMsg.Message["message"] != "raw-payload" || rawMsg.Message["vin"] != "abc" {
+			t.Fatalf("got %+v, %+v", rawMsg.Tag, rawMsg.Message)
+		}
+		msg2 := loadMsg()
+		if msg2.Tag != "bigdata.def.sit" || msg2.Message["speed"] != float64(20) {
+			t.Fatalf("got %+v, %+v", msg2.Tag, msg2.Message)
+		}
+
+		// puback in order and only after persisted
+		msg2.Ack()
+		time.Sleep(100 * time.Millisecond)
+		if n := inflight(); n != 2 {
+			t.Fatalf("should not ack before previous msg persisted, got %d inflight", n)
+		}
+		msg.Ack()
+		waitInflight(0)
+
+		// msg not persisted in time will be redelivered after reconnected
+		publish("vehicle/ghi/log", 1, `{"speed": 30}`)
+		if msg = loadMsg(); msg.Message["vin"] != "ghi" {
+			t.Fatalf("got %+v", msg.Message)
+		}
+		checkSession(true)
+		if msg = loadMsg(); msg.Message["vin"] != "ghi" {
+			t.Fatalf("got %+v", msg.Message)
+		}
+		msg.Ack()
+		waitInflight(0)
+		if recv.timeoutCounter.Get() != 1 {
+			t.Fatalf("got %d", recv.timeoutCounter.Get())
+		}
+
+		cancel()
+		if err = broker.Stop(context.Background()); err != nil {
+			t.Fatalf("got error: %+v", err)
+		}
+	}
+}
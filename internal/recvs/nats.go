@@ -0,0 +1,353 @@
+package recvs
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"gofluentd/internal/monitor"
+	"gofluentd/library"
+	"gofluentd/library/log"
+
+	utils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+const (
+	// NATSAckModeJournal ack JetStream msg after msg persisted into journal
+	NATSAckModeJournal = "journal"
+	// NATSAckModeSender ack JetStream msg after msg sent by all senders
+	NATSAckModeSender = "sender"
+
+	defaultNATSAckWait       = 5 * time.Minute
+	defaultNATSMaxAckPending = 10000
+	defaultNATSFetchBatch    = 100
+	defaultNATSFetchWait     = 3 * time.Second
+	defaultNATSPendingMsgs   = 100000
+)
+
+/*NATSRecvCfg is the configuration for NATSRecv
+
+Args:
+	Subjects: subjects to subscribe, wildcards `*` & `>` are supported
+	Queue: core only, queue group to load balance between instances
+	IsJetStream: consume by JetStream durable pull consumer,
+		each subject got its own consumer named by Durable (and the subject if more than one subjects).
+	Durable: JetStream durable consumer name, required if IsJetStream
+	AckMode: JetStream only, `journal` or `sender`
+	AckWait: JetStream only, msg will be redelivered if not acked in AckWait
+	MaxAckPending: JetStream only, max unacked msgs of each consumer
+	FetchBatch: JetStream only, max msgs of each fetch
+	Tag: tag template like `%{app}.sit`, fields of msg are available
+	FallbackTag: used if tag is invalid or too many tags
+	MaxTags: max number of distinct tags
+	TagKey: set tag into `msg.Message[TagKey]`
+	MsgKey: put raw payload into `msg.Message[MsgKey]`
+	SubjectKey: optional, set subject into `msg.Message[SubjectKey]`
+	IsJSONFormat: decode payload as JSON object, invalid JSON payload will be treated as raw
+*/
+type NATSRecvCfg struct {
+	*library.NATSConnCfg
+	Name     string
+	Subjects []string
+	Queue    string
+
+	IsJetStream      bool
+	Durable, AckMode string
+	AckWait          time.Duration
+	MaxAckPending,
+	FetchBatch int
+
+	Tag, FallbackTag string
+	MaxTags          int
+	TagKey, MsgKey,
+	SubjectKey string
+	IsJSONFormat bool
+}
+
+// NATSRecv subscribe msgs from NATS core or JetStream
+type NATSRecv struct {
+	*BaseRecv
+	*NATSRecvCfg
+
+	tagDeriver       *tagDeriver
+	decodeErrCounter *utils.Counter
+	fallbackCounter  *utils.Counter
+	ackErrCounter    *utils.Counter
+}
+
+// NewNATSRecv create new NATSRecv
+func NewNATSRecv(cfg *NATSRecvCfg) *NATSRecv {
+	r := &NATSRecv{
+		BaseRecv:         &BaseRecv{},
+		NATSRecvCfg:      cfg,
+		decodeErrCounter: utils.NewCounter(),
+		fallbackCounter:  utils.NewCounter(),
+		ackErrCounter:    utils.NewCounter(),
+	}
+	if err := r.valid(); err != nil {
+		log.Logger.Panic("config invalid", zap.Error(err))
+	}
+
+	log.Logger.Info("create NATSRecv",
+		zap.String("name", r.Name),
+		zap.Strings("servers", r.Servers),
+		zap.Strings("subjects", r.Subjects),
+		zap.Bool("jetstream", r.IsJetStream),
+		zap.String("tag", r.Tag))
+	return r
+}
+
+func (r *NATSRecv) valid() (err error) {
+	if r.NATSConnCfg == nil || len(r.Servers) == 0 {
+		return errors.New("servers should not be empty")
+	}
+	if len(r.Subjects) == 0 {
+		return errors.New("subjects should not be empty")
+	}
+	if r.Tag == "" {
+		return errors.New("tag should not be empty")
+	}
+
+	if r.IsJetStream {
+		if r.Durable == "" {
+			return errors.New("durable should not be empty for jetstream")
+		}
+		if r.Queue != "" {
+			return errors.New("queue is not supported by jetstream pull consumer")
+		}
+		switch r.AckMode {
+		case "":
+			r.AckMode = NATSAckModeJournal
+			log.Logger.Info("reset ack_mode", zap.String("ack_mode", r.AckMode))
+		case NATSAckModeJournal, NATSAckModeSender:
+		default:
+			return errors.Errorf("unknown ack_mode `%s`", r.AckMode)
+		}
+		if r.AckWait <= 0 {
+			r.AckWait = defaultNATSAckWait
+			log.Logger.Info("reset ack_wait_sec", zap.Duration("ack_wait", r.AckWait))
+		}
+		if r.MaxAckPending <= 0 {
+			r.MaxAckPending = defaultNATSMaxAckPending
+			log.Logger.Info("reset max_ack_pending", zap.Int("max_ack_pending", r.MaxAckPending))
+		}
+		if r.FetchBatch <= 0 {
+			r.FetchBatch = defaultNATSFetchBatch
+			log.Logger.Info("reset fetch_batch", zap.Int("fetch_batch", r.FetchBatch))
+		}
+	}
+
+	if r.TagKey == "" {
+		r.TagKey = "tag"
+		log.Logger.Info("reset tag_key", zap.String("tag_key", r.TagKey))
+	}
+	if r.MsgKey == "" {
+		r.MsgKey = "log"
+		log.Logger.Info("reset msg_key", zap.String("msg_key", r.MsgKey))
+	}
+	if r.tagDeriver, err = newTagDeriver(r.Name, r.Tag, r.FallbackTag, r.MaxTags, nil); err != nil {
+		return errors.Wrap(err, "new tag deriver")
+	}
+	return nil
+}
+
+// GetName get the name of recv
+func (r *NATSRecv) GetName() string {
+	return r.Name
+}
+
+// Run connect to NATS & subscribe subjects
+func (r *NATSRecv) Run(ctx context.Context) {
+	log.Logger.Info("run NATSRecv", zap.String("name", r.Name))
+	monitor.AddMetric("natsrecv."+r.Name, func() map[string]interface{} {
+		return map[string]interface{}{
+			"decodeErrTotal":   r.decodeErrCounter.Get(),
+			"fallbackTotal":    r.fallbackCounter.Get(),
+			"ackErrTotal":      r.ackErrCounter.Get(),
+			"derivedTagsTotal": r.tagDeriver.nTags(),
+		}
+	})
+
+	go func() {
+		defer log.Logger.Info("nats recv exit", zap.String("name", r.Name))
+		var (
+			nc  *nats.Conn
+			err error
+		)
+		for {
+			if nc, err = library.NewNATSConn(r.Name, r.NATSConnCfg); err == nil {
+				break
+			}
+			log.Logger.Error("try to connect nats got error", zap.String("name", r.Name), zap.Error(err))
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(defaultRetryWait):
+			}
+		}
+		go func() {
+			<-ctx.Done()
+			nc.Close()
+		}()
+
+		if r.IsJetStream {
+			r.runJetStream(ctx, nc)
+		} else {
+			r.runCore(ctx, nc)
+		}
+	}()
+}
+
+// runCore subscribe core subjects, msgs can not be acked
+func (r *NATSRecv) runCore(ctx context.Context, nc *nats.Conn) {
+	msgChan := make(chan *nats.Msg, defaultNATSPendingMsgs)
+	for _, subject := range r.Subjects {
+		var err error
+		for {
+			if _, err = nc.ChanQueueSubscribe(subject, r.Queue, msgChan); err == nil {
+				break
+			}
+			log.Logger.Error("try to subscribe got error", zap.String("subject", subject), zap.Error(err))
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(defaultRetryWait):
+			}
+		}
+		log.Logger.Info("subscribed nats subject",
+			zap.String("name", r.Name),
+			zap.String("subject", subject),
+			zap.String("queue", r.Queue))
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case m := <-msgChan:
+			r.acceptMsg(m, nil)
+		}
+	}
+}
+
+// durableName return durable name of the consumer for subject
+func (r *NATSRecv) durableName(subject string) string {
+	if len(r.Subjects) == 1 {
+		return r.Durable
+	}
+	return r.Durable + "_" + strings.NewReplacer(".", "_", "*", "STAR", ">", "GT").Replace(subject)
+}
+
+// runJetStream fetch msgs by durable pull consumer of each subject
+func (r *NATSRecv) runJetStream(ctx context.Context, nc *nats.Conn) {
+	js, err := nc.JetStream()
+	if err != nil {
+		log.Logger.Panic("create jetstream context", zap.Error(err))
+	}
+
+	for _, subject := range r.Subjects {
+		go func(subject string) {
+			durable := r.durableName(subject)
+			logger := log.Logger.With(zap.String("name", r.Name), zap.String("subject", subject), zap.String("durable", durable))
+			var (
+				sub *nats.Subscription
+				err error
+			)
+			for {
+				if sub, err = js.PullSubscribe(subject, durable,
+					nats.AckExplicit(),
+					nats.AckWait(r.AckWait),
+					nats.MaxAckPending(r.MaxAckPending),
+				); err == nil {
+					break
+				}
+				logger.Error("try to create pull consumer got error", zap.Error(err))
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(defaultRetryWait):
+				}
+			}
+			logger.Info("subscribed jetstream subject")
+
+			for {
+				fetchCtx, cancel := context.WithTimeout(ctx, defaultNATSFetchWait)
+				msgs, err := sub.Fetch(r.FetchBatch, nats.Context(fetchCtx))
+				cancel()
+				if ctx.Err() != nil {
+					return
+				}
+				if err != nil {
+					if err != context.DeadlineExceeded && err != nats.ErrTimeout {
+						logger.Warn("fetch jetstream msgs", zap.Error(err))
+						time.Sleep(defaultRetryWait)
+					}
+					continue
+				}
+
+				for _, m := range msgs {
+					r.acceptMsg(m, &natsMsgAcker{msg: m, counter: r.ackErrCounter})
+				}
+			}
+		}(subject)
+	}
+	<-ctx.Done()
+}
+
+// natsMsgAcker ack JetStream msg
+type natsMsgAcker struct {
+	msg     *nats.Msg
+	counter *utils.Counter
+}
+
+// Ack implement library.AckerItf
+func (a *natsMsgAcker) Ack() {
+	if err := a.msg.Ack(); err != nil {
+		a.counter.Count()
+		log.Logger.Warn("ack jetstream msg", zap.String("subject", a.msg.Subject), zap.Error(err))
+	}
+}
+
+// acceptMsg convert nats msg to msg and put it into pipeline,
+// acker is nil for core msg.
+func (r *NATSRecv) acceptMsg(m *nats.Msg, acker *natsMsgAcker) {
+	msg := r.msgPool.Get().(*library.FluentMsg)
+	msg.ID = r.counter.Count()
+	msg.Message = nil
+	if r.IsJSONFormat {
+		if err := json.Unmarshal(m.Data, &msg.Message); err != nil || msg.Message == nil {
+			r.decodeErrCounter.Count()
+			log.Logger.Debug("decode json payload", zap.String("subject", m.Subject), zap.Error(err))
+			msg.Message = nil
+		}
+	}
+	if msg.Message == nil {
+		msg.Message = map[string]interface{}{r.MsgKey: string(m.Data)}
+	}
+	if r.SubjectKey != "" {
+		msg.Message[r.SubjectKey] = m.Subject
+	}
+	msg.Time = time.Time{}
+
+	var isFallback bool
+	if msg.Tag, isFallback = r.tagDeriver.derive(msg); isFallback {
+		r.fallbackCounter.Count()
+	}
+	msg.Message[r.TagKey] = msg.Tag
+	msg.Ackers = nil
+	msg.CommitAckers = nil
+	if acker != nil {
+		switch r.AckMode {
+		case NATSAckModeJournal:
+			msg.Ackers = []library.AckerItf{acker}
+		case NATSAckModeSender:
+			msg.CommitAckers = []library.AckerItf{acker}
+		}
+	}
+
+	log.Logger.Debug("receive new msg", zap.String("tag", msg.Tag), zap.Int64("id", msg.ID), zap.String("subject", m.Subject))
+	r.asyncOutChan <- msg
+}
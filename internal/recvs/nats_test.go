@@ -0,0 +1,136 @@
+package recvs
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gofluentd/library"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+func runNATSTestServer(t *testing.T, port int) *server.Server {
+	srv, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      port,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	go srv.Start()
+	if !srv.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats server not ready")
+	}
+	return srv
+}
+
+func TestNATSRecv(t *testing.T) {
+	srv := runNATSTestServer(t, 24240)
+	defer srv.Shutdown()
+	connCfg := &library.NATSConnCfg{Servers: []string{srv.ClientURL()}}
+	nc, err := library.NewNATSConn("test", connCfg)
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	defer nc.Close()
+	js, err := nc.JetStream()
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	if _, err = js.AddStream(&nats.StreamConfig{Name: "LOGS", Subjects: []string{"logs.>"}}); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+
+	outChan := make(chan *library.FluentMsg, 1000)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, cfg := range []*NATSRecvCfg{
+		{
+			NATSConnCfg:  connCfg,
+			Name:         "nats-core-test",
+			Subjects:     []string{"core.>"},
+			Queue:        "gofluentd",
+			Tag:          "nats.%{app}.sit",
+			SubjectKey:   "subject",
+			IsJSONFormat: true,
+		},
+		{
+			NATSConnCfg: connCfg,
+			Name:        "nats-js-test",
+			Subjects:    []string{"logs.>"},
+			IsJetStream: true,
+			Durable:     "gofluentd",
+			Tag:         "js.sit",
+		},
+	} {
+		recv := NewNATSRecv(cfg)
+		recv.SetCounter(counter)
+		recv.SetMsgPool(msgPool)
+		recv.SetAsyncOutChan(outChan)
+		recv.Run(ctx)
+	}
+
+	loadMsg := func() *library.FluentMsg {
+		select {
+		case msg := <-outChan:
+			return msg
+		case <-time.After(5 * time.Second):
+			t.Fatal("can not load msg")
+		}
+		return nil
+	}
+
+	// core
+	time.Sleep(200 * time.Millisecond)
+	if err = nc.Publish("core.a", []byte(`{"app": "order", "log": "hello"}`)); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	if err = nc.Publish("core.b", []byte(`not json`)); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	msg := loadMsg()
+	if msg.Tag != "nats.order.sit" || msg.Message["tag"] != "nats.order.sit" || msg.Message["log"] != "hello" || msg.Message["subject"] != "core.a" || msg.Ackers != nil {
+		t.Fatalf("got %+v, %+v", msg.Tag, msg.Message)
+	}
+	if msg = loadMsg(); msg.Tag != "nats.unknown.sit" || msg.Message["log"] != "not json" {
+		t.Fatalf("got %+v, %+v", msg.Tag, msg.Message)
+	}
+
+	// jetstream, ack after persisted
+	for _, data := range []string{"a", "b"} {
+		if _, err = js.Publish("logs.app", []byte(data)); err != nil {
+			t.Fatalf("got error: %+v", err)
+		}
+	}
+	msgs := []*library.FluentMsg{loadMsg(), loadMsg()}
+	for i, data := range []string{"a", "b"} {
+		if msgs[i].Tag != "js.sit" || msgs[i].Message["log"] != data || len(msgs[i].Ackers) != 1 {
+			t.Fatalf("got %+v, %+v", msgs[i].Tag, msgs[i].Message)
+		}
+	}
+	numAckPending := func() int {
+		info, err := js.ConsumerInfo("LOGS", "gofluentd")
+		if err != nil {
+			t.Fatalf("got error: %+v", err)
+		}
+		return info.NumAckPending
+	}
+	if n := numAckPending(); n != 2 {
+		t.Fatalf("got %d", n)
+	}
+	for _, msg = range msgs {
+		msg.Ack()
+	}
+	for i := 0; numAckPending() != 0; i++ {
+		if i > 50 {
+			t.Fatalf("got %d", numAckPending())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
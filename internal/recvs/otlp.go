@@ -0,0 +1,448 @@
+package recvs
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	stdjson "encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"gofluentd/internal/monitor"
+	"gofluentd/library"
+	"gofluentd/library/log"
+
+	"github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/pkg/errors"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	"google.golang.org/grpc"
+	_ "google.golang.org/grpc/encoding/gzip" // accept gzip compressed requests
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// OTLPLogsPath is the endpoint of OTLP/HTTP logs
+	OTLPLogsPath = "/v1/logs"
+
+	otlpContentTypeProtobuf = "application/x-protobuf"
+	otlpContentTypeJSON     = "application/json"
+
+	otlpResourcePrefix   = "resource."
+	otlpScopePrefix      = "scope."
+	otlpAttributesPrefix = "attributes."
+
+	defaultOTLPMaxBodySize = 10 * 1024 * 1024
+)
+
+/*OTLPRecvCfg is the configuration for OTLPRecv
+
+Args:
+	HTTPAddr: listen OTLP/HTTP `POST /v1/logs`, disabled if empty
+	GRPCAddr: listen OTLP/gRPC `LogsService/Export`, disabled if empty
+	Tag: tag template like `%{resource.service.name}.sit`
+	FallbackTag: used if tag is invalid or too many tags
+	MaxTags: max number of distinct tags
+	TagKey: set tag into `msg.Message[TagKey]`
+	MsgKey: put body into `msg.Message[MsgKey]`
+	TimeKey: optional, set event time in RFC3339Nano into `msg.Message[TimeKey]`
+	MaxBodySize: max size of request after decompression
+	MinSeverity: reject records with lower severity number,
+		records with unspecified severity are always accepted.
+		only records rejected by MinSeverity are counted in partial success,
+		acceptor filters run asynchronously after response, their rejects are not reported.
+*/
+type OTLPRecvCfg struct {
+	Name,
+	HTTPAddr, GRPCAddr string
+	Tag, FallbackTag string
+	MaxTags          int
+	TagKey, MsgKey,
+	TimeKey string
+	MaxBodySize int64
+	MinSeverity int32
+}
+
+// OTLPRecv recv for OpenTelemetry logs
+type OTLPRecv struct {
+	*BaseRecv
+	*OTLPRecvCfg
+
+	tagDeriver     *tagDeriver
+	rejectCounter  *utils.Counter
+	requestCounter *utils.Counter
+}
+
+// NewOTLPRecv create new OTLPRecv
+func NewOTLPRecv(cfg *OTLPRecvCfg) *OTLPRecv {
+	r := &OTLPRecv{
+		BaseRecv:       &BaseRecv{},
+		OTLPRecvCfg:    cfg,
+		rejectCounter:  utils.NewCounter(),
+		requestCounter: utils.NewCounter(),
+	}
+	if err := r.valid(); err != nil {
+		log.Logger.Panic("config invalid", zap.Error(err))
+	}
+
+	log.Logger.Info("create OTLPRecv",
+		zap.String("name", r.Name),
+		zap.String("http_addr", r.HTTPAddr),
+		zap.String("grpc_addr", r.GRPCAddr),
+		zap.String("tag", r.Tag),
+		zap.Int32("min_severity", r.MinSeverity))
+	return r
+}
+
+func (r *OTLPRecv) valid() (err error) {
+	if r.HTTPAddr == "" && r.GRPCAddr == "" {
+		return errors.New("one of http_addr and grpc_addr should be set")
+	}
+	if r.Tag == "" {
+		return errors.New("tag should not be empty")
+	}
+
+	if r.MsgKey == "" {
+		r.MsgKey = "log"
+		log.Logger.Info("reset msg_key", zap.String("msg_key", r.MsgKey))
+	}
+	if r.TagKey == "" {
+		r.TagKey = "tag"
+		log.Logger.Info("reset tag_key", zap.String("tag_key", r.TagKey))
+	}
+	if r.MaxBodySize <= 0 {
+		r.MaxBodySize = defaultOTLPMaxBodySize
+		log.Logger.Info("reset max_body_byte", zap.Int64("max_body_byte", r.MaxBodySize))
+	}
+
+	if r.tagDeriver, err = newTagDeriver(r.Name, r.Tag, r.FallbackTag, r.MaxTags, nil); err != nil {
+		return errors.Wrap(err, "new tag deriver")
+	}
+	return nil
+}
+
+// GetName get the name of recv
+func (r *OTLPRecv) GetName() string {
+	return r.Name
+}
+
+// Run start http & grpc servers
+func (r *OTLPRecv) Run(ctx context.Context) {
+	log.Logger.Info("run OTLPRecv", zap.String("name", r.Name))
+	monitor.AddMetric("otlprecv."+r.Name, func() map[string]interface{} {
+		return map[string]interface{}{
+			"requestTotal":     r.requestCounter.Get(),
+			"rejectedTotal":    r.rejectCounter.Get(),
+			"derivedTagsTotal": r.tagDeriver.nTags(),
+		}
+	})
+
+	if r.HTTPAddr != "" {
+		go r.runServer(ctx, r.HTTPAddr, func(ln net.Listener) (serve func() error, stop func()) {
+			srv := &http.Server{Handler: r}
+			return func() error { return srv.Serve(ln) }, func() { srv.Close() }
+		})
+	}
+	if r.GRPCAddr != "" {
+		go r.runServer(ctx, r.GRPCAddr, func(ln net.Listener) (serve func() error, stop func()) {
+			srv := grpc.NewServer(grpc.MaxRecvMsgSize(int(r.MaxBodySize)))
+			collogspb.RegisterLogsServiceServer(srv, &otlpLogsService{recv: r})
+			return func() error { return srv.Serve(ln) }, srv.Stop
+		})
+	}
+}
+
+// runServer listen addr and serve until ctx done, retry if got error
+func (r *OTLPRecv) runServer(ctx context.Context, addr string, newServer func(net.Listener) (serve func() error, stop func())) {
+	defer log.Logger.Info("otlp server exit", zap.String("name", r.Name), zap.String("addr", addr))
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			log.Logger.Error("try to bind addr got error", zap.String("addr", addr), zap.Error(err))
+			time.Sleep(defaultRetryWait)
+			continue
+		}
+
+		log.Logger.Info("listening otlp", zap.String("name", r.Name), zap.String("addr", addr))
+		serve, stop := newServer(ln)
+		ctx2Srv, cancel := context.WithCancel(ctx)
+		go func() {
+			<-ctx2Srv.Done()
+			stop()
+		}()
+		if err = serve(); err != nil && ctx.Err() == nil {
+			log.Logger.Error("otlp server got error", zap.String("addr", addr), zap.Error(err))
+		}
+		cancel()
+	}
+}
+
+// ServeHTTP handle OTLP/HTTP request
+func (r *OTLPRecv) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != OTLPLogsPath {
+		http.NotFound(w, req)
+		return
+	}
+	if req.Method != http.MethodPost {
+		http.Error(w, "only accept POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	raw, err := ioutil.ReadAll(io.LimitReader(req.Body, r.MaxBodySize+1))
+	if err != nil {
+		http.Error(w, "can not load request body", http.StatusBadRequest)
+		return
+	}
+	if int64(len(raw)) > r.MaxBodySize {
+		http.Error(w, fmt.Sprintf("body size must less than %d bytes", r.MaxBodySize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	body, err := decompressHTTPBody(req, raw, r.MaxBodySize)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var (
+		exportReq   = &collogspb.ExportLogsServiceRequest{}
+		contentType = strings.TrimSpace(strings.Split(req.Header.Get("Content-Type"), ";")[0])
+		respBody    []byte
+	)
+	switch contentType {
+	case otlpContentTypeProtobuf:
+		err = proto.Unmarshal(body, exportReq)
+	case otlpContentTypeJSON:
+		if body, err = otlpJSONConvertIDs(body); err == nil {
+			err = protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(body, exportReq)
+		}
+	default:
+		http.Error(w, fmt.Sprintf("unsupported Content-Type `%s`", contentType), http.StatusUnsupportedMediaType)
+		return
+	}
+	if err != nil {
+		log.Logger.Warn("decode otlp request", zap.String("name", r.Name), zap.Error(err))
+		http.Error(w, "decode request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := r.export(exportReq)
+	if contentType == otlpContentTypeJSON {
+		respBody, err = protojson.Marshal(resp)
+	} else {
+		respBody, err = proto.Marshal(resp)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	if _, err = w.Write(respBody); err != nil {
+		log.Logger.Warn("write otlp response", zap.Error(err))
+	}
+}
+
+// otlpLogsService implement OTLP/gRPC LogsService
+type otlpLogsService struct {
+	collogspb.UnimplementedLogsServiceServer
+	recv *OTLPRecv
+}
+
+// Export implement LogsServiceServer
+func (s *otlpLogsService) Export(ctx context.Context, req *collogspb.ExportLogsServiceRequest) (*collogspb.ExportLogsServiceResponse, error) {
+	return s.recv.export(req), nil
+}
+
+// export convert all log records to msgs,
+// return partial success if any record is rejected by MinSeverity.
+func (r *OTLPRecv) export(req *collogspb.ExportLogsServiceRequest) *collogspb.ExportLogsServiceResponse {
+	r.requestCounter.Count()
+	var (
+		nRejected int64
+		errMsg    string
+	)
+	for _, rl := range req.GetResourceLogs() {
+		resourceAttrs := map[string]interface{}{}
+		flattenOTLPAttrs(resourceAttrs, otlpResourcePrefix, rl.GetResource().GetAttributes())
+		for _, sl := range rl.GetScopeLogs() {
+			scopeAttrs := map[string]interface{}{}
+			if scope := sl.GetScope(); scope != nil {
+				if scope.GetName() != "" {
+					scopeAttrs[otlpScopePrefix+"name"] = scope.GetName()
+				}
+				if scope.GetVersion() != "" {
+					scopeAttrs[otlpScopePrefix+"version"] = scope.GetVersion()
+				}
+				flattenOTLPAttrs(scopeAttrs, otlpScopePrefix, scope.GetAttributes())
+			}
+
+			for _, rec := range sl.GetLogRecords() {
+				if sev := int32(rec.GetSeverityNumber()); sev != 0 && sev < r.MinSeverity {
+					nRejected++
+					errMsg = fmt.Sprintf("severity number lower than %d", r.MinSeverity)
+					continue
+				}
+
+				r.asyncOutChan <- r.convertRecord(resourceAttrs, scopeAttrs, rec)
+			}
+		}
+	}
+
+	resp := &collogspb.ExportLogsServiceResponse{}
+	if nRejected != 0 {
+		r.rejectCounter.CountN(nRejected)
+		resp.PartialSuccess = &collogspb.ExportLogsPartialSuccess{
+			RejectedLogRecords: nRejected,
+			ErrorMessage:       errMsg,
+		}
+	}
+	return resp
+}
+
+// convertRecord convert log record to msg
+func (r *OTLPRecv) convertRecord(resourceAttrs, scopeAttrs map[string]interface{}, rec *logspb.LogRecord) *library.FluentMsg {
+	msg := r.msgPool.Get().(*library.FluentMsg)
+	msg.ID = r.counter.Count()
+	msg.Message = make(map[string]interface{}, len(resourceAttrs)+len(scopeAttrs)+len(rec.GetAttributes())+6)
+	for k, v := range resourceAttrs {
+		msg.Message[k] = v
+	}
+	for k, v := range scopeAttrs {
+		msg.Message[k] = v
+	}
+	flattenOTLPAttrs(msg.Message, otlpAttributesPrefix, rec.GetAttributes())
+
+	if rec.GetBody() != nil {
+		msg.Message[r.MsgKey] = convertOTLPValue(rec.GetBody())
+	}
+	if rec.GetSeverityText() != "" {
+		msg.Message["severity_text"] = rec.GetSeverityText()
+	}
+	if rec.GetSeverityNumber() != logspb.SeverityNumber_SEVERITY_NUMBER_UNSPECIFIED {
+		msg.Message["severity_number"] = int32(rec.GetSeverityNumber())
+	}
+	if len(rec.GetTraceId()) != 0 {
+		msg.Message["trace_id"] = hex.EncodeToString(rec.GetTraceId())
+	}
+	if len(rec.GetSpanId()) != 0 {
+		msg.Message["span_id"] = hex.EncodeToString(rec.GetSpanId())
+	}
+
+	switch {
+	case rec.GetTimeUnixNano() != 0:
+		msg.Time = time.Unix(0, int64(rec.GetTimeUnixNano())).UTC()
+	case rec.GetObservedTimeUnixNano() != 0:
+		msg.Time = time.Unix(0, int64(rec.GetObservedTimeUnixNano())).UTC()
+	default:
+		msg.Time = time.Time{}
+	}
+	if r.TimeKey != "" && !msg.Time.IsZero() {
+		msg.Message[r.TimeKey] = msg.Time.Format(time.RFC3339Nano)
+	}
+
+	msg.Tag, _ = r.tagDeriver.derive(msg)
+	msg.Message[r.TagKey] = msg.Tag
+	return msg
+}
+
+// flattenOTLPAttrs put attributes into m with prefix,
+// nested kvlist will be flattened by `.`
+func flattenOTLPAttrs(m map[string]interface{}, prefix string, attrs []*commonpb.KeyValue) {
+	for _, kv := range attrs {
+		if kvlist := kv.GetValue().GetKvlistValue(); kvlist != nil {
+			flattenOTLPAttrs(m, prefix+kv.GetKey()+".", kvlist.GetValues())
+			continue
+		}
+		m[prefix+kv.GetKey()] = convertOTLPValue(kv.GetValue())
+	}
+}
+
+// convertOTLPValue convert AnyValue to go value
+func convertOTLPValue(v *commonpb.AnyValue) interface{} {
+	switch v := v.GetValue().(type) {
+	case *commonpb.AnyValue_StringValue:
+		return v.StringValue
+	case *commonpb.AnyValue_BoolValue:
+		return v.BoolValue
+	case *commonpb.AnyValue_IntValue:
+		return v.IntValue
+	case *commonpb.AnyValue_DoubleValue:
+		return v.DoubleValue
+	case *commonpb.AnyValue_BytesValue:
+		return v.BytesValue
+	case *commonpb.AnyValue_ArrayValue:
+		arr := make([]interface{}, 0, len(v.ArrayValue.GetValues()))
+		for _, vi := range v.ArrayValue.GetValues() {
+			arr = append(arr, convertOTLPValue(vi))
+		}
+		return arr
+	case *commonpb.AnyValue_KvlistValue:
+		m := make(map[string]interface{}, len(v.KvlistValue.GetValues()))
+		for _, kv := range v.KvlistValue.GetValues() {
+			m[kv.GetKey()] = convertOTLPValue(kv.GetValue())
+		}
+		return m
+	default:
+		return nil
+	}
+}
+
+// otlpJSONConvertIDs convert hex encoded traceId & spanId to base64,
+// OTLP/JSON use hex but protojson expects base64.
+// numbers are kept as json.Number to avoid losing precision of int64.
+func otlpJSONConvertIDs(body []byte) ([]byte, error) {
+	data := map[string]interface{}{}
+	decoder := stdjson.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&data); err != nil {
+		return nil, errors.Wrap(err, "unmarshal json")
+	}
+
+	for _, rl := range otlpJSONList(data, "resourceLogs", "resource_logs") {
+		for _, sl := range otlpJSONList(rl, "scopeLogs", "scope_logs") {
+			for _, rec := range otlpJSONList(sl, "logRecords", "log_records") {
+				for _, key := range []string{"traceId", "trace_id", "spanId", "span_id"} {
+					if v, ok := rec[key].(string); ok && v != "" {
+						id, err := hex.DecodeString(v)
+						if err != nil {
+							return nil, errors.Wrapf(err, "decode `%s`", key)
+						}
+						rec[key] = base64.StdEncoding.EncodeToString(id)
+					}
+				}
+			}
+		}
+	}
+
+	return stdjson.Marshal(data)
+}
+
+// otlpJSONList load list of objects by camelCase or snake_case key
+func otlpJSONList(m map[string]interface{}, keys ...string) (items []map[string]interface{}) {
+	for _, key := range keys {
+		arr, ok := m[key].([]interface{})
+		if !ok {
+			continue
+		}
+		for _, vi := range arr {
+			if v, ok := vi.(map[string]interface{}); ok {
+				items = append(items, v)
+			}
+		}
+	}
+	return items
+}
@@ -0,0 +1,214 @@
+package recvs
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"gofluentd/library"
+
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+func newOTLPStrKV(k, v string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: k, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: v}}}
+}
+
+func TestOTLPRecv(t *testing.T) {
+	var (
+		outChan  = make(chan *library.FluentMsg, 1000)
+		httpAddr = "127.0.0.1:24234"
+		grpcAddr = "127.0.0.1:24235"
+	)
+	recv := NewOTLPRecv(&OTLPRecvCfg{
+		Name:        "otlp-test",
+		HTTPAddr:    httpAddr,
+		GRPCAddr:    grpcAddr,
+		Tag:         "%{resource.service.name}.sit",
+		TimeKey:     "@timestamp",
+		MinSeverity: int32(logspb.SeverityNumber_SEVERITY_NUMBER_INFO),
+	})
+	recv.SetCounter(counter)
+	recv.SetMsgPool(msgPool)
+	recv.SetAsyncOutChan(outChan)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	recv.Run(ctx)
+	time.Sleep(100 * time.Millisecond)
+
+	loadMsg := func() *library.FluentMsg {
+		select {
+		case msg := <-outChan:
+			return msg
+		case <-time.After(2 * time.Second):
+			t.Fatal("can not load msg")
+		}
+		return nil
+	}
+
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	exportReq := &collogspb.ExportLogsServiceRequest{
+		ResourceLogs: []*logspb.ResourceLogs{{
+			Resource: &resourcepb.Resource{Attributes: []*commonpb.KeyValue{
+				newOTLPStrKV("service.name", "order"),
+			}},
+			ScopeLogs: []*logspb.ScopeLogs{{
+				Scope: &commonpb.InstrumentationScope{Name: "logger", Version: "1.0"},
+				LogRecords: []*logspb.LogRecord{
+					{
+						TimeUnixNano:   uint64(ts.UnixNano()),
+						SeverityNumber: logspb.SeverityNumber_SEVERITY_NUMBER_WARN,
+						SeverityText:   "WARN",
+						Body:           &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "hello"}},
+						TraceId:        []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+						SpanId:         []byte{1, 2, 3, 4, 5, 6, 7, 8},
+						Attributes: []*commonpb.KeyValue{
+							newOTLPStrKV("user", "laisky"),
+							{Key: "http", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_KvlistValue{KvlistValue: &commonpb.KeyValueList{
+								Values: []*commonpb.KeyValue{{Key: "status", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: 200}}}},
+							}}}},
+						},
+					},
+					{ // rejected by min_severity
+						SeverityNumber: logspb.SeverityNumber_SEVERITY_NUMBER_DEBUG,
+						Body:           &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "debug"}},
+					},
+				},
+			}},
+		}},
+	}
+	checkMsg := func(msg *library.FluentMsg) {
+		if msg.Tag != "order.sit" ||
+			msg.Message["tag"] != "order.sit" ||
+			msg.Message["log"] != "hello" ||
+			msg.Message["resource.service.name"] != "order" ||
+			msg.Message["scope.name"] != "logger" ||
+			msg.Message["scope.version"] != "1.0" ||
+			msg.Message["attributes.user"] != "laisky" ||
+			msg.Message["attributes.http.status"] != int64(200) ||
+			msg.Message["severity_text"] != "WARN" ||
+			msg.Message["severity_number"] != int32(13) ||
+			msg.Message["trace_id"] != "0102030405060708090a0b0c0d0e0f10" ||
+			msg.Message["span_id"] != "0102030405060708" ||
+			msg.Message["@timestamp"] != "2020-01-02T03:04:05.000000006Z" ||
+			!msg.Time.Equal(ts) {
+			t.Fatalf("got %+v, %+v", msg.Tag, msg.Message)
+		}
+	}
+	checkResp := func(resp *collogspb.ExportLogsServiceResponse) {
+		if resp.GetPartialSuccess().GetRejectedLogRecords() != 1 {
+			t.Fatalf("got %+v", resp)
+		}
+	}
+
+	// OTLP/HTTP protobuf
+	body, err := proto.Marshal(exportReq)
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	httpResp, err := http.Post("http://"+httpAddr+OTLPLogsPath, "application/x-protobuf", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	respBody, _ := ioutil.ReadAll(httpResp.Body)
+	httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		t.Fatalf("got %d: %s", httpResp.StatusCode, respBody)
+	}
+	resp := &collogspb.ExportLogsServiceResponse{}
+	if err = proto.Unmarshal(respBody, resp); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	checkResp(resp)
+	checkMsg(loadMsg())
+
+	// OTLP/HTTP json with hex ids
+	body = []byte(`{"resourceLogs":[{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"order"}}]},
+		"scopeLogs":[{"scope":{"name":"logger","version":"1.0"},"logRecords":[
+			{"timeUnixNano":"1577934245000000006","severityNumber":13,"severityText":"WARN","body":{"stringValue":"hello"},
+			 "traceId":"0102030405060708090a0b0c0d0e0f10","spanId":"0102030405060708",
+			 "attributes":[{"key":"user","value":{"stringValue":"laisky"}},{"key":"http","value":{"kvlistValue":{"values":[{"key":"status","value":{"intValue":"200"}}]}}}]},
+			{"severityNumber":5,"body":{"stringValue":"debug"}}]}]}]}`)
+	httpResp, err = http.Post("http://"+httpAddr+OTLPLogsPath, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	respBody, _ = ioutil.ReadAll(httpResp.Body)
+	httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		t.Fatalf("got %d: %s", httpResp.StatusCode, respBody)
+	}
+	resp = &collogspb.ExportLogsServiceResponse{}
+	if err = protojson.Unmarshal(respBody, resp); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	checkResp(resp)
+	checkMsg(loadMsg())
+
+	// OTLP/gRPC
+	conn, err := grpc.Dial(grpcAddr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	defer conn.Close()
+	resp, err = collogspb.NewLogsServiceClient(conn).Export(ctx, exportReq)
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	checkResp(resp)
+	checkMsg(loadMsg())
+
+	// unsupported content type
+	httpResp, err = http.Post("http://"+httpAddr+OTLPLogsPath, "text/plain", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Fatalf("got %d", httpResp.StatusCode)
+	}
+
+	select {
+	case msg := <-outChan:
+		t.Fatalf("should not got msg: %+v", msg.Message)
+	default:
+	}
+}
+
+func TestOTLPJSONConvertIDs(t *testing.T) {
+	// numbers larger than 2^53 should not lose precision
+	body := []byte(`{"resourceLogs": [{"scopeLogs": [{"logRecords": [{
+		"timeUnixNano": 1609459200123456789,
+		"traceId": "0102030405060708090a0b0c0d0e0f10",
+		"spanId": "0102030405060708",
+		"attributes": [{"key": "n", "value": {"intValue": 9007199254740993}}]
+	}]}]}]}`)
+	converted, err := otlpJSONConvertIDs(body)
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+
+	req := &collogspb.ExportLogsServiceRequest{}
+	if err = protojson.Unmarshal(converted, req); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	rec := req.GetResourceLogs()[0].GetScopeLogs()[0].GetLogRecords()[0]
+	if rec.GetTimeUnixNano() != 1609459200123456789 {
+		t.Fatalf("got %d", rec.GetTimeUnixNano())
+	}
+	if v := rec.GetAttributes()[0].GetValue().GetIntValue(); v != 9007199254740993 {
+		t.Fatalf("got %d", v)
+	}
+	if rec.GetTraceId()[15] != 0x10 || rec.GetSpanId()[7] != 0x08 {
+		t.Fatalf("got %x, %x", rec.GetTraceId(), rec.GetSpanId())
+	}
+}
@@ -0,0 +1,588 @@
+package recvs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gofluentd/internal/monitor"
+	"gofluentd/library"
+	"gofluentd/library/log"
+
+	utils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+)
+
+const (
+	// RedisStreamAckModeJournal XACK after msg persisted into journal
+	RedisStreamAckModeJournal = "journal"
+	// RedisStreamAckModeSender XACK after msg sent by all senders
+	RedisStreamAckModeSender = "sender"
+
+	defaultRedisStreamBatchSize     = 500
+	defaultRedisStreamBlock         = 3 * time.Second
+	defaultRedisStreamClaimInterval = 30 * time.Second
+	defaultRedisStreamClaimMinIdle  = 5 * time.Minute
+	defaultRedisStreamAckInterval   = 200 * time.Millisecond
+	defaultRedisStreamAckTimeout    = 5 * time.Second
+)
+
+// RedisStreamCfg stream consumed by RedisStreamRecv
+type RedisStreamCfg struct {
+	Stream string
+	// Tag: tag template like `%{app}.sit`, fields of entry are available
+	Tag, FallbackTag string
+	// JSONKey: optional, decode JSON object in this field and merge it into msg
+	JSONKey string
+}
+
+// ParseRedisStreamCfgs parse settings to stream configs
+func ParseRedisStreamCfgs(env string, cfg interface{}) []*RedisStreamCfg {
+	items, ok := normalizeSettingVal(cfg).([]interface{})
+	if !ok {
+		return nil
+	}
+
+	cfgs := []*RedisStreamCfg{}
+	for _, itemI := range items {
+		item, ok := itemI.(map[string]interface{})
+		if !ok {
+			log.Logger.Panic("redis stream config should be map", zap.String("cfg", fmt.Sprint(itemI)))
+		}
+		c := &RedisStreamCfg{}
+		if v, ok := item["stream"].(string); ok {
+			c.Stream = library.LoadTagReplaceEnv(env, v)
+		}
+		if v, ok := item["tag"].(string); ok {
+			c.Tag = library.LoadTagReplaceEnv(env, v)
+		}
+		if v, ok := item["fallback_tag"].(string); ok {
+			c.FallbackTag = library.LoadTagReplaceEnv(env, v)
+		}
+		c.JSONKey, _ = item["json_key"].(string)
+		cfgs = append(cfgs, c)
+	}
+
+	return cfgs
+}
+
+/*RedisStreamRecvCfg is the configuration for RedisStreamRecv
+
+Args:
+	Streams: streams to consume, each stream has its own tag
+	Group: consumer group, will be created if not exists
+	Consumer: consumer name in group, should be unique & stable for each instance,
+		pending entries of this consumer will be reread after restart.
+	GroupStartID: start id of new group, `$` (default) or `0`
+	AckMode: `journal` or `sender`
+	BatchSize: COUNT of XREADGROUP & XPENDING
+	Block: BLOCK of XREADGROUP
+	ClaimInterval: interval to check pending entries of group
+	ClaimMinIdle: XCLAIM pending entries idle more than ClaimMinIdle,
+		include unacked entries of this consumer, they will be redelivered.
+	MaxTags: max number of distinct tags per stream
+	TagKey: set tag into `msg.Message[TagKey]`
+	IDKey: optional, set entry id into `msg.Message[IDKey]`
+	StreamKey: optional, set stream into `msg.Message[StreamKey]`
+*/
+type RedisStreamRecvCfg struct {
+	*library.RedisConnCfg
+	Name    string
+	Streams []*RedisStreamCfg
+	Group, Consumer,
+	GroupStartID, AckMode string
+	BatchSize int
+	Block, ClaimInterval,
+	ClaimMinIdle time.Duration
+	MaxTags int
+	TagKey, IDKey,
+	StreamKey string
+}
+
+// redisStream stream config with tag deriver
+type redisStream struct {
+	*RedisStreamCfg
+	tagDeriver *tagDeriver
+}
+
+// RedisStreamRecv consume redis streams by consumer group
+type RedisStreamRecv struct {
+	*BaseRecv
+	*RedisStreamRecvCfg
+
+	client           *redis.Client
+	streams          map[string]*redisStream
+	claimedCounter   *utils.Counter
+	ackedCounter     *utils.Counter
+	ackErrCounter    *utils.Counter
+	decodeErrCounter *utils.Counter
+	fallbackCounter  *utils.Counter
+
+	// ackLock protect acked entries waiting to be XACKed,
+	// Ack is called by journal synchronously, so it should never block.
+	ackLock sync.Mutex
+	ackIDs  map[string][]string
+	nAcks   int
+	// ackNotify notify acker if there are enough entries to XACK
+	ackNotify chan struct{}
+}
+
+// NewRedisStreamRecv create new RedisStreamRecv
+func NewRedisStreamRecv(cfg *RedisStreamRecvCfg) *RedisStreamRecv {
+	r := &RedisStreamRecv{
+		BaseRecv:           &BaseRecv{},
+		RedisStreamRecvCfg: cfg,
+		streams:            map[string]*redisStream{},
+		ackIDs:             map[string][]string{},
+		ackNotify:          make(chan struct{}, 1),
+		claimedCounter:     utils.NewCounter(),
+		ackedCounter:       utils.NewCounter(),
+		ackErrCounter:      utils.NewCounter(),
+		decodeErrCounter:   utils.NewCounter(),
+		fallbackCounter:    utils.NewCounter(),
+	}
+	if err := r.valid(); err != nil {
+		log.Logger.Panic("config invalid", zap.Error(err))
+	}
+
+	log.Logger.Info("create RedisStreamRecv",
+		zap.String("name", r.Name),
+		zap.String("addr", r.Addr),
+		zap.String("group", r.Group),
+		zap.String("consumer", r.Consumer),
+		zap.Int("n_streams", len(r.streams)))
+	return r
+}
+
+func (r *RedisStreamRecv) valid() (err error) {
+	if r.RedisConnCfg == nil {
+		return errors.New("addr should not be empty")
+	}
+	if r.client, err = library.NewRedisClient(r.RedisConnCfg); err != nil {
+		return errors.Wrap(err, "new redis client")
+	}
+	if len(r.Streams) == 0 {
+		return errors.New("streams should not be empty")
+	}
+	if r.Group == "" {
+		return errors.New("group should not be empty")
+	}
+
+	if r.Consumer == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return errors.Wrap(err, "load hostname")
+		}
+		r.Consumer = hostname + "-" + r.Name
+		log.Logger.Info("reset consumer", zap.String("consumer", r.Consumer))
+	}
+	if r.GroupStartID == "" {
+		r.GroupStartID = "$"
+		log.Logger.Info("reset group_start_id", zap.String("group_start_id", r.GroupStartID))
+	}
+	switch r.AckMode {
+	case "":
+		r.AckMode = RedisStreamAckModeJournal
+		log.Logger.Info("reset ack_mode", zap.String("ack_mode", r.AckMode))
+	case RedisStreamAckModeJournal, RedisStreamAckModeSender:
+	default:
+		return errors.Errorf("unknown ack_mode `%s`", r.AckMode)
+	}
+	if r.BatchSize <= 0 {
+		r.BatchSize = defaultRedisStreamBatchSize
+		log.Logger.Info("reset batch_size", zap.Int("batch_size", r.BatchSize))
+	}
+	if r.Block <= 0 {
+		r.Block = defaultRedisStreamBlock
+		log.Logger.Info("reset block_sec", zap.Duration("block", r.Block))
+	}
+	if r.ClaimInterval <= 0 {
+		r.ClaimInterval = defaultRedisStreamClaimInterval
+		log.Logger.Info("reset claim_interval_sec", zap.Duration("claim_interval", r.ClaimInterval))
+	}
+	if r.ClaimMinIdle <= 0 {
+		r.ClaimMinIdle = defaultRedisStreamClaimMinIdle
+		log.Logger.Info("reset claim_min_idle_sec", zap.Duration("claim_min_idle", r.ClaimMinIdle))
+	}
+	if r.TagKey == "" {
+		r.TagKey = "tag"
+		log.Logger.Info("reset tag_key", zap.String("tag_key", r.TagKey))
+	}
+
+	for _, c := range r.Streams {
+		if c.Stream == "" || c.Tag == "" {
+			return errors.New("stream & tag should not be empty")
+		}
+		if _, ok := r.streams[c.Stream]; ok {
+			return errors.Errorf("duplicated stream `%s`", c.Stream)
+		}
+		s := &redisStream{RedisStreamCfg: c}
+		if s.tagDeriver, err = newTagDeriver(r.Name, c.Tag, c.FallbackTag, r.MaxTags, nil); err != nil {
+			return errors.Wrap(err, "new tag deriver")
+		}
+		r.streams[c.Stream] = s
+	}
+	return nil
+}
+
+// GetName get the name of recv
+func (r *RedisStreamRecv) GetName() string {
+	return r.Name
+}
+
+// Run create groups, then consume, claim & ack entries
+func (r *RedisStreamRecv) Run(ctx context.Context) {
+	log.Logger.Info("run RedisStreamRecv", zap.String("name", r.Name))
+	monitor.AddMetric("redisstreamrecv."+r.Name, func() map[string]interface{} {
+		nTags := 0
+		for _, s := range r.streams {
+			nTags += s.tagDeriver.nTags()
+		}
+		return map[string]interface{}{
+			"claimedTotal":     r.claimedCounter.Get(),
+			"ackedTotal":       r.ackedCounter.Get(),
+			"ackErrTotal":      r.ackErrCounter.Get(),
+			"decodeErrTotal":   r.decodeErrCounter.Get(),
+			"fallbackTotal":    r.fallbackCounter.Get(),
+			"derivedTagsTotal": nTags,
+		}
+	})
+
+	go func() {
+		r.runAcker(ctx)
+		r.client.Close()
+	}()
+	go func() {
+		defer log.Logger.Info("redis stream recv exit", zap.String("name", r.Name))
+		for {
+			if err := r.createGroups(ctx); err == nil {
+				break
+			} else if ctx.Err() == nil {
+				log.Logger.Error("try to create consumer groups got error", zap.String("name", r.Name), zap.Error(err))
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(defaultRetryWait):
+			}
+		}
+
+		r.readPending(ctx)
+		go r.runClaimer(ctx)
+		r.runConsumer(ctx)
+	}()
+}
+
+// createGroups create group for each stream, ignore existing groups
+func (r *RedisStreamRecv) createGroups(ctx context.Context) error {
+	for stream := range r.streams {
+		if err := r.client.XGroupCreateMkStream(ctx, stream, r.Group, r.GroupStartID).Err(); err != nil &&
+			!strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return errors.Wrapf(err, "create group for stream `%s`", stream)
+		}
+	}
+	return nil
+}
+
+// readPending reread pending entries delivered to this consumer before restart
+func (r *RedisStreamRecv) readPending(ctx context.Context) {
+	lastIDs := map[string]string{}
+	for stream := range r.streams {
+		lastIDs[stream] = "0"
+	}
+
+	for len(lastIDs) != 0 {
+		args := &redis.XReadGroupArgs{
+			Group:    r.Group,
+			Consumer: r.Consumer,
+			Count:    int64(r.BatchSize),
+			Block:    -1,
+		}
+		for stream := range lastIDs {
+			args.Streams = append(args.Streams, stream)
+		}
+		for _, stream := range args.Streams {
+			args.Streams = append(args.Streams, lastIDs[stream])
+		}
+
+		results, err := r.client.XReadGroup(ctx, args).Result()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Logger.Error("try to read pending entries got error", zap.String("name", r.Name), zap.Error(err))
+			}
+			return
+		}
+		for _, res := range results {
+			if len(res.Messages) == 0 {
+				delete(lastIDs, res.Stream)
+				continue
+			}
+			for _, m := range res.Messages {
+				r.acceptEntry(res.Stream, m)
+			}
+			lastIDs[res.Stream] = res.Messages[len(res.Messages)-1].ID
+		}
+	}
+}
+
+// runConsumer read new entries by XREADGROUP
+func (r *RedisStreamRecv) runConsumer(ctx context.Context) {
+	args := &redis.XReadGroupArgs{
+		Group:    r.Group,
+		Consumer: r.Consumer,
+		Count:    int64(r.BatchSize),
+		Block:    r.Block,
+	}
+	for stream := range r.streams {
+		args.Streams = append(args.Streams, stream)
+	}
+	for range r.streams {
+		args.Streams = append(args.Streams, ">")
+	}
+
+	for {
+		results, err := r.client.XReadGroup(ctx, args).Result()
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			if err != redis.Nil {
+				log.Logger.Error("try to read entries got error", zap.String("name", r.Name), zap.Error(err))
+				time.Sleep(defaultRetryWait)
+			}
+			continue
+		}
+
+		for _, res := range results {
+			for _, m := range res.Messages {
+				r.acceptEntry(res.Stream, m)
+			}
+		}
+	}
+}
+
+// runClaimer XCLAIM entries pending too long,
+// include entries of other consumers & entries of this consumer that never acked.
+func (r *RedisStreamRecv) runClaimer(ctx context.Context) {
+	ticker := time.NewTicker(r.ClaimInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for stream := range r.streams {
+			if err := r.claim(ctx, stream); err != nil && ctx.Err() == nil {
+				log.Logger.Warn("try to claim pending entries got error",
+					zap.String("name", r.Name),
+					zap.String("stream", stream),
+					zap.Error(err))
+			}
+		}
+	}
+}
+
+// claim page through all pending entries of group, XCLAIM entries idle more than ClaimMinIdle
+func (r *RedisStreamRecv) claim(ctx context.Context, stream string) error {
+	start := "-"
+	for {
+		pendings, err := r.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+			Stream: stream,
+			Group:  r.Group,
+			Start:  start,
+			End:    "+",
+			Count:  int64(r.BatchSize),
+		}).Result()
+		if err != nil {
+			return errors.Wrap(err, "xpending")
+		}
+		if len(pendings) == 0 {
+			return nil
+		}
+
+		ids := []string{}
+		for _, p := range pendings {
+			if p.Idle >= r.ClaimMinIdle {
+				ids = append(ids, p.ID)
+			}
+		}
+		if len(ids) != 0 {
+			msgs, err := r.client.XClaim(ctx, &redis.XClaimArgs{
+				Stream:   stream,
+				Group:    r.Group,
+				Consumer: r.Consumer,
+				MinIdle:  r.ClaimMinIdle,
+				Messages: ids,
+			}).Result()
+			if err != nil {
+				return errors.Wrap(err, "xclaim")
+			}
+
+			log.Logger.Info("claimed pending entries",
+				zap.String("name", r.Name),
+				zap.String("stream", stream),
+				zap.Int("n", len(msgs)))
+			r.claimedCounter.CountN(int64(len(msgs)))
+			for _, m := range msgs {
+				r.acceptEntry(stream, m)
+			}
+		}
+
+		if len(pendings) < r.BatchSize {
+			return nil
+		}
+		if start, err = nextRedisStreamID(pendings[len(pendings)-1].ID); err != nil {
+			return err
+		}
+	}
+}
+
+// nextRedisStreamID return the smallest id greater than id,
+// used as inclusive start of XPENDING, since exclusive range requires redis 6.2.
+func nextRedisStreamID(id string) (string, error) {
+	parts := strings.SplitN(id, "-", 2)
+	if len(parts) != 2 {
+		return "", errors.Errorf("invalid stream id `%s`", id)
+	}
+	seq, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return "", errors.Wrapf(err, "parse stream id `%s`", id)
+	}
+	return parts[0] + "-" + strconv.FormatUint(seq+1, 10), nil
+}
+
+// redisStreamAcker XACK entry in batch
+type redisStreamAcker struct {
+	stream, id string
+	recv       *RedisStreamRecv
+}
+
+// Ack implement library.AckerItf
+func (a *redisStreamAcker) Ack() {
+	a.recv.putAck(a.stream, a.id)
+}
+
+// putAck save entry to be XACKed without blocking
+func (r *RedisStreamRecv) putAck(stream, id string) {
+	r.ackLock.Lock()
+	r.ackIDs[stream] = append(r.ackIDs[stream], id)
+	r.nAcks++
+	isFull := r.nAcks >= r.BatchSize
+	r.ackLock.Unlock()
+
+	if isFull {
+		select {
+		case r.ackNotify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// runAcker XACK entries every defaultRedisStreamAckInterval or BatchSize entries,
+// XACK remaining entries before exit.
+func (r *RedisStreamRecv) runAcker(ctx context.Context) {
+	ticker := time.NewTicker(defaultRedisStreamAckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			r.flushAcks()
+			return
+		case <-r.ackNotify:
+		case <-ticker.C:
+		}
+
+		r.flushAcks()
+	}
+}
+
+// flushAcks XACK all acked entries,
+// do not use ctx of Run, otherwise acks during shutdown will be lost.
+func (r *RedisStreamRecv) flushAcks() {
+	r.ackLock.Lock()
+	if r.nAcks == 0 {
+		r.ackLock.Unlock()
+		return
+	}
+	ids := r.ackIDs
+	r.ackIDs = map[string][]string{}
+	r.nAcks = 0
+	r.ackLock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultRedisStreamAckTimeout)
+	defer cancel()
+	for stream, streamIDs := range ids {
+		if err := r.client.XAck(ctx, stream, r.Group, streamIDs...).Err(); err != nil {
+			r.ackErrCounter.CountN(int64(len(streamIDs)))
+			log.Logger.Warn("try to ack entries got error",
+				zap.String("name", r.Name),
+				zap.String("stream", stream),
+				zap.Error(err))
+		} else {
+			r.ackedCounter.CountN(int64(len(streamIDs)))
+		}
+	}
+}
+
+// acceptEntry convert entry to msg and put it into pipeline
+func (r *RedisStreamRecv) acceptEntry(stream string, m redis.XMessage) {
+	s := r.streams[stream]
+	acker := &redisStreamAcker{stream: stream, id: m.ID, recv: r}
+	if m.Values == nil {
+		// entry has been deleted
+		acker.Ack()
+		return
+	}
+
+	msg := r.msgPool.Get().(*library.FluentMsg)
+	msg.ID = r.counter.Count()
+	msg.Message = make(map[string]interface{}, len(m.Values))
+	for k, v := range m.Values {
+		msg.Message[k] = v
+	}
+	if s.JSONKey != "" {
+		if v, ok := msg.Message[s.JSONKey].(string); ok {
+			data := map[string]interface{}{}
+			if err := json.UnmarshalFromString(v, &data); err == nil {
+				delete(msg.Message, s.JSONKey)
+				for k, v := range data {
+					msg.Message[k] = v
+				}
+			} else {
+				r.decodeErrCounter.Count()
+			}
+		}
+	}
+	if r.IDKey != "" {
+		msg.Message[r.IDKey] = m.ID
+	}
+	if r.StreamKey != "" {
+		msg.Message[r.StreamKey] = stream
+	}
+	msg.Time = time.Time{}
+
+	var isFallback bool
+	if msg.Tag, isFallback = s.tagDeriver.derive(msg); isFallback {
+		r.fallbackCounter.Count()
+	}
+	msg.Message[r.TagKey] = msg.Tag
+	msg.Ackers = nil
+	msg.CommitAckers = nil
+	switch r.AckMode {
+	case RedisStreamAckModeJournal:
+		msg.Ackers = []library.AckerItf{acker}
+	case RedisStreamAckModeSender:
+		msg.CommitAckers = []library.AckerItf{acker}
+	}
+
+	log.Logger.Debug("receive new msg", zap.String("tag", msg.Tag), zap.Int64("id", msg.ID), zap.String("entry", m.ID))
+	r.asyncOutChan <- msg
+}
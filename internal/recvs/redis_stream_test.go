@@ -0,0 +1,211 @@
+package recvs
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gofluentd/library"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+func TestRedisStreamRecv(t *testing.T) {
+	srv := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: srv.Addr()})
+	defer client.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// entry delivered to another consumer but never acked
+	if err := client.XAdd(ctx, &redis.XAddArgs{Stream: "logs", Values: map[string]interface{}{"app": "order", "log": "hello"}}).Err(); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	if err := client.XGroupCreate(ctx, "logs", "gofluentd", "0").Err(); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	if err := client.XReadGroup(ctx, &redis.XReadGroupArgs{Group: "gofluentd", Consumer: "other", Streams: []string{"logs", ">"}, Count: 1, Block: -1}).Err(); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	if err := client.XAdd(ctx, &redis.XAddArgs{Stream: "logs", Values: map[string]interface{}{"payload": `{"app": "pay", "log": "world"}`}}).Err(); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+
+	outChan := make(chan *library.FluentMsg, 1000)
+	recv := NewRedisStreamRecv(&RedisStreamRecvCfg{
+		RedisConnCfg:  &library.RedisConnCfg{Addr: srv.Addr()},
+		Name:          "redis-stream-test",
+		Streams:       []*RedisStreamCfg{{Stream: "logs", Tag: "redis.%{app}.sit", JSONKey: "payload"}},
+		Group:         "gofluentd",
+		Consumer:      "c1",
+		Block:         100 * time.Millisecond,
+		ClaimInterval: 100 * time.Millisecond,
+		ClaimMinIdle:  50 * time.Millisecond,
+		IDKey:         "_id",
+	})
+	recv.SetCounter(counter)
+	recv.SetMsgPool(msgPool)
+	recv.SetAsyncOutChan(outChan)
+	recv.Run(ctx)
+
+	msgs := map[string]*library.FluentMsg{}
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-outChan:
+			msgs[msg.Message["log"].(string)] = msg
+		case <-time.After(5 * time.Second):
+			t.Fatal("can not load msg")
+		}
+	}
+	if msg := msgs["world"]; msg == nil || msg.Tag != "redis.pay.sit" || msg.Message["tag"] != "redis.pay.sit" || msg.Message["payload"] != nil || msg.Message["_id"] == "" || len(msg.Ackers) != 1 {
+		t.Fatalf("got %+v", msg)
+	}
+	// claimed from other consumer
+	if msg := msgs["hello"]; msg == nil || msg.Tag != "redis.order.sit" || len(msg.Ackers) != 1 {
+		t.Fatalf("got %+v", msg)
+	}
+
+	numPending := func() int64 {
+		pending, err := client.XPending(ctx, "logs", "gofluentd").Result()
+		if err != nil {
+			t.Fatalf("got error: %+v", err)
+		}
+		return pending.Count
+	}
+	if n := numPending(); n != 2 {
+		t.Fatalf("got %d", n)
+	}
+	for _, msg := range msgs {
+		msg.Ack()
+	}
+	for i := 0; numPending() != 0; i++ {
+		if i > 50 {
+			t.Fatalf("got %d", numPending())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestRedisStreamRecvAckNotBlock(t *testing.T) {
+	srv := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: srv.Addr()})
+	defer client.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if err := client.XGroupCreateMkStream(ctx, "logs", "gofluentd", "0").Err(); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	ids := []string{}
+	for i := 0; i < 3; i++ {
+		id, err := client.XAdd(ctx, &redis.XAddArgs{Stream: "logs", Values: map[string]interface{}{"app": "order"}}).Result()
+		if err != nil {
+			t.Fatalf("got error: %+v", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := client.XReadGroup(ctx, &redis.XReadGroupArgs{Group: "gofluentd", Consumer: "c1", Streams: []string{"logs", ">"}, Count: 3, Block: -1}).Err(); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+
+	recv := NewRedisStreamRecv(&RedisStreamRecvCfg{
+		RedisConnCfg: &library.RedisConnCfg{Addr: srv.Addr()},
+		Name:         "redis-stream-test",
+		Streams:      []*RedisStreamCfg{{Stream: "logs", Tag: "redis.%{app}.sit"}},
+		Group:        "gofluentd",
+		Consumer:     "c1",
+		BatchSize:    1,
+	})
+	recv.SetCounter(counter)
+	recv.SetMsgPool(msgPool)
+	recv.SetAsyncOutChan(make(chan *library.FluentMsg, 1000))
+
+	// acker is not running, Ack should not block
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20000; i++ {
+			(&redisStreamAcker{stream: "logs", id: ids[i%len(ids)], recv: recv}).Ack()
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ack blocked")
+	}
+
+	// remaining acks should be flushed on shutdown
+	cancel()
+	recv.Run(ctx)
+	for i := 0; ; i++ {
+		pending, err := client.XPending(context.Background(), "logs", "gofluentd").Result()
+		if err != nil {
+			t.Fatalf("got error: %+v", err)
+		}
+		if pending.Count == 0 {
+			break
+		}
+		if i > 50 {
+			t.Fatalf("got %d", pending.Count)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestRedisStreamRecvClaim(t *testing.T) {
+	srv := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: srv.Addr()})
+	defer client.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := client.XGroupCreateMkStream(ctx, "logs", "gofluentd", "0").Err(); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	add := func(log string) {
+		if err := client.XAdd(ctx, &redis.XAddArgs{Stream: "logs", Values: map[string]interface{}{"app": "order", "log": log}}).Err(); err != nil {
+			t.Fatalf("got error: %+v", err)
+		}
+	}
+	read := func(consumer string, n int64) {
+		if err := client.XReadGroup(ctx, &redis.XReadGroupArgs{Group: "gofluentd", Consumer: consumer, Streams: []string{"logs", ">"}, Count: n, Block: -1}).Err(); err != nil {
+			t.Fatalf("got error: %+v", err)
+		}
+	}
+	// more unacked entries of this consumer than batch size,
+	// followed by a stale entry of another consumer
+	for _, log := range []string{"e1", "e2", "e3"} {
+		add(log)
+	}
+	read("c1", 3)
+	add("e4")
+	read("other", 1)
+
+	outChan := make(chan *library.FluentMsg, 1000)
+	recv := NewRedisStreamRecv(&RedisStreamRecvCfg{
+		RedisConnCfg:  &library.RedisConnCfg{Addr: srv.Addr()},
+		Name:          "redis-stream-test",
+		Streams:       []*RedisStreamCfg{{Stream: "logs", Tag: "redis.%{app}.sit"}},
+		Group:         "gofluentd",
+		Consumer:      "c1",
+		BatchSize:     2,
+		Block:         100 * time.Millisecond,
+		ClaimInterval: 100 * time.Millisecond,
+		ClaimMinIdle:  50 * time.Millisecond,
+	})
+	recv.SetCounter(counter)
+	recv.SetMsgPool(msgPool)
+	recv.SetAsyncOutChan(outChan)
+	recv.Run(ctx)
+
+	// never ack, entries of this consumer should be redelivered
+	delivered := map[string]int{}
+	for delivered["e1"] < 2 || delivered["e3"] < 2 || delivered["e4"] < 1 {
+		select {
+		case msg := <-outChan:
+			delivered[msg.Message["log"].(string)]++
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %+v", delivered)
+		}
+	}
+}
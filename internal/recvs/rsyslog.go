@@ -2,21 +2,41 @@ package recvs
 
 import (
 	"context"
+	"crypto/tls"
+	"fmt"
 	"time"
 
+	"gofluentd/internal/monitor"
 	"gofluentd/library"
 	"gofluentd/library/log"
 
 	"github.com/Laisky/go-syslog"
 	"github.com/Laisky/go-syslog/format"
+	utils "github.com/Laisky/go-utils"
 	"github.com/Laisky/zap"
+	"github.com/pkg/errors"
 )
 
 var (
 	defaultRetryWait = 3 * time.Second
 )
 
-func NewRsyslogSrv(addr string) (*syslog.Server, syslog.LogPartsChannel, error) {
+const (
+	// RsyslogFormatAutomatic detect RFC3164/RFC5424 and octet counting framing for each message
+	RsyslogFormatAutomatic = "automatic"
+	// RsyslogFormatRFC3164 BSD syslog, newline framing
+	RsyslogFormatRFC3164 = "rfc3164"
+	// RsyslogFormatRFC5424 IETF syslog, newline framing
+	RsyslogFormatRFC5424 = "rfc5424"
+	// RsyslogFormatRFC6587 IETF syslog, octet counting framing
+	RsyslogFormatRFC6587 = "rfc6587"
+
+	// rsyslogSDKey parsed structured data will be set as `msg.Message[rsyslogSDKey][<id>][<param>]`
+	rsyslogSDKey = "sd"
+)
+
+// NewRsyslogSrv listen udp & tcp on addr, and listen tls on tlsAddr if tlsConfig is not nil
+func NewRsyslogSrv(f format.Format, addr, tlsAddr string, tlsConfig *tls.Config) (*syslog.Server, syslog.LogPartsChannel, error) {
 	var (
 		inchan  = make(syslog.LogPartsChannel, 1000)
 		handler = syslog.NewChannelHandler(inchan)
@@ -24,15 +44,37 @@ func NewRsyslogSrv(addr string) (*syslog.Server, syslog.LogPartsChannel, error)
 		err     error
 	)
 
-	server.SetFormat(syslog.Automatic)
+	server.SetFormat(f)
 	server.SetHandler(handler)
-	if err = server.ListenUDP(addr); err != nil {
-		log.Logger.Error("listen udp", zap.Error(err), zap.String("addr", addr))
-		return nil, nil, err
+	if addr != "" {
+		if err = server.ListenUDP(addr); err != nil {
+			log.Logger.Error("listen udp", zap.Error(err), zap.String("addr", addr))
+			return nil, nil, err
+		}
+		if err = server.ListenTCP(addr); err != nil {
+			log.Logger.Error("listen tcp", zap.Error(err), zap.String("addr", addr))
+			if err := server.Kill(); err != nil {
+				log.Logger.Error("stop rsyslog got error", zap.Error(err))
+			}
+			return nil, nil, err
+		}
 	}
-	if err = server.ListenTCP(addr); err != nil {
-		log.Logger.Error("listen tcp", zap.Error(err), zap.String("addr", addr))
-		return nil, nil, err
+	if tlsConfig != nil {
+		// client without certificate is allowed if not required by tlsConfig
+		server.SetTlsPeerNameFunc(func(conn *tls.Conn) (string, bool) {
+			if certs := conn.ConnectionState().PeerCertificates; len(certs) != 0 {
+				return certs[0].Subject.CommonName, true
+			}
+			return "", true
+		})
+		if err = server.ListenTCPTLS(tlsAddr, tlsConfig); err != nil {
+			log.Logger.Error("listen tls", zap.Error(err), zap.String("addr", tlsAddr))
+			// release udp & tcp listeners
+			if err := server.Kill(); err != nil {
+				log.Logger.Error("stop rsyslog got error", zap.Error(err))
+			}
+			return nil, nil, err
+		}
 	}
 	return server, inchan, nil
 }
@@ -41,21 +83,82 @@ type RsyslogCfg struct {
 	RewriteTags map[string]string
 	TimeShift   time.Duration
 	Name, Addr, TagKey, MsgKey,
+	// Tag can be template like `syslog.%{app_name}.sit`,
+	// variables will be replaced by `library.ReplaceStrByMsg`
 	Tag,
 	NewTimeFormat, TimeKey, NewTimeKey string
+
+	// SourceMappings set tag & fields by the CIDR of client, the first matched one works
+	SourceMappings []*RsyslogSourceMapping
+	// MaxTags max distinct derived tags, new tags will be replaced by FallbackTag
+	MaxTags int
+	// FallbackTag used when derived tag is invalid or exceeds MaxTags,
+	// default to Tag with variables replaced by `unknown`
+	FallbackTag string
+
+	// Format: automatic/rfc3164/rfc5424/rfc6587
+	Format string
+	// TLSAddr listen RFC5425 syslog over TLS, like `0.0.0.0:6514`,
+	// the CN of client certificate will be set in `tls_peer`
+	TLSAddr string
+	TLS     *library.TLSCfg
 }
 
 // RsyslogRecv
 type RsyslogRecv struct {
 	*BaseRecv
 	*RsyslogCfg
+
+	format    format.Format
+	tlsConfig *tls.Config
+
+	tagDeriver      *tagDeriver
+	fallbackCounter *utils.Counter
 }
 
 func NewRsyslogRecv(cfg *RsyslogCfg) *RsyslogRecv {
-	return &RsyslogRecv{
-		BaseRecv:   &BaseRecv{},
-		RsyslogCfg: cfg,
+	r := &RsyslogRecv{
+		BaseRecv:        &BaseRecv{},
+		RsyslogCfg:      cfg,
+		fallbackCounter: utils.NewCounter(),
+	}
+	if err := r.valid(); err != nil {
+		log.Logger.Panic("config invalid", zap.Error(err))
 	}
+
+	return r
+}
+
+func (r *RsyslogRecv) valid() (err error) {
+	switch r.Format {
+	case "", RsyslogFormatAutomatic:
+		r.format = syslog.Automatic
+	case RsyslogFormatRFC3164:
+		r.format = syslog.RFC3164
+	case RsyslogFormatRFC5424:
+		r.format = syslog.RFC5424
+	case RsyslogFormatRFC6587:
+		r.format = syslog.RFC6587
+	default:
+		return errors.Errorf("unknown format `%s`", r.Format)
+	}
+
+	if r.TLS != nil && r.TLS.Enable {
+		if r.TLSAddr == "" {
+			return errors.New("tls_addr should not be empty if tls enabled")
+		}
+		if r.tlsConfig, err = library.NewServerTLSConfig(r.TLS); err != nil {
+			return errors.Wrap(err, "load tls config")
+		}
+	} else if r.Addr == "" {
+		return errors.New("addr should not be empty")
+	}
+
+	if r.tagDeriver, err = newRsyslogTagDeriver(r.RsyslogCfg); err != nil {
+		return errors.Wrap(err, "load tag config")
+	}
+
+	return nil
 }
 
 func (r *RsyslogRecv) GetName() string {
@@ -64,6 +167,12 @@ func (r *RsyslogRecv) GetName() string {
 
 func (r *RsyslogRecv) Run(ctx context.Context) {
 	log.Logger.Info("run RsyslogRecv", zap.String("tag", r.Tag))
+	monitor.AddMetric("rsyslogrecv."+r.Name, func() map[string]interface{} {
+		return map[string]interface{}{
+			"derivedTagsTotal": r.tagDeriver.nTags(),
+			"fallbackTotal":    r.fallbackCounter.Get(),
+		}
+	})
 
 	go func() {
 		defer log.Logger.Info("rsyslog reciver exit", zap.String("name", r.GetName()))
@@ -74,6 +183,9 @@ func (r *RsyslogRecv) Run(ctx context.Context) {
 			ctx2Srv                   context.Context
 			cancel                    func()
 			rewriteKey, rewriteNewKey string
+			ts                        time.Time
+			isDynamicTag              = r.tagDeriver.isDynamic()
+			isFallback                bool
 		)
 	SERVER_LOOP:
 		for {
@@ -83,20 +195,23 @@ func (r *RsyslogRecv) Run(ctx context.Context) {
 			default:
 			}
 
-			srv, inchan, err := NewRsyslogSrv(r.Addr)
+			srv, inchan, err := NewRsyslogSrv(r.format, r.Addr, r.TLSAddr, r.tlsConfig)
 			if err != nil {
 				log.Logger.Error("new rsyslog server", zap.String("addr", r.Addr), zap.Error(err))
 				time.Sleep(defaultRetryWait)
 				continue SERVER_LOOP
 			}
-			log.Logger.Info("listening rsyslog", zap.String("addr", r.Addr))
+			log.Logger.Info("listening rsyslog", zap.String("addr", r.Addr), zap.String("tls_addr", r.TLSAddr))
 			if err = srv.Boot(&syslog.BLBCfg{
 				ACK: []byte{},
 				SYN: "hello",
 			}); err != nil {
 				log.Logger.Error("try to start rsyslog server got error", zap.Error(err))
-				cancel()
-				continue
+				if err = srv.Kill(); err != nil {
+					log.Logger.Error("stop rsyslog got error", zap.Error(err))
+				}
+				time.Sleep(defaultRetryWait)
+				continue SERVER_LOOP
 			}
 
 			ctx2Srv, cancel = context.WithCancel(ctx)
@@ -119,32 +234,28 @@ func (r *RsyslogRecv) Run(ctx context.Context) {
 					}
 				}
 
-				switch t := logPart[r.TimeKey].(type) {
-				case time.Time:
-					logPart[r.NewTimeKey] = t.Add(r.TimeShift).UTC().Format(r.NewTimeFormat)
-					delete(logPart, r.TimeKey)
-				default:
-					log.Logger.Error("discard log since unknown timestamp format")
-				}
-
-				// rename to message because of the elasticsearch default query field is `message`
-				logPart["message"] = logPart[r.MsgKey]
-				delete(logPart, r.MsgKey)
+				ts = r.processLogPart(logPart)
 
 				msg = r.msgPool.Get().(*library.FluentMsg)
 				// log.Logger.Info(fmt.Sprintf("got %p", msg))
 				msg.ID = r.counter.Count()
 				msg.Tag = r.Tag
+				msg.Time = ts
 				msg.Message = logPart
+				if isDynamicTag {
+					if msg.Tag, isFallback = r.tagDeriver.derive(msg); isFallback {
+						r.fallbackCounter.Count()
+					}
+				}
 				for rewriteKey, rewriteNewKey = range r.RewriteTags { // rewrite key
 					msg.Message[rewriteNewKey] = msg.Message[rewriteKey]
 					delete(msg.Message, rewriteKey)
 				}
 				if r.TagKey != "" { // reset tag
-					msg.Message[r.TagKey] = r.Tag
+					msg.Message[r.TagKey] = msg.Tag
 				}
 
-				log.Logger.Debug("receive new msg", zap.String("tag", r.Tag), zap.Int64("id", msg.ID))
+				log.Logger.Debug("receive new msg", zap.String("tag", msg.Tag), zap.Int64("id", msg.ID))
 				r.asyncOutChan <- msg
 			}
 
@@ -154,3 +265,116 @@ func (r *RsyslogRecv) Run(ctx context.Context) {
 		}
 	}()
 }
+
+// processLogPart parse timestamp & structured data, return the time of log
+func (r *RsyslogRecv) processLogPart(logPart format.LogParts) (ts time.Time) {
+	// timestamp is zero if parse failed,
+	// use the received time to make sure TimeKey is always replaced by NewTimeKey.
+	if t, ok := logPart[r.TimeKey].(time.Time); ok && !t.IsZero() {
+		ts = t.Add(r.TimeShift).UTC()
+	} else {
+		ts = utils.Clock.GetUTCNow()
+		log.Logger.Warn("unknown timestamp format, use received time instead",
+			zap.String("name", r.Name),
+			zap.String(r.TimeKey, fmt.Sprint(logPart[r.TimeKey])))
+	}
+	delete(logPart, r.TimeKey)
+	logPart[r.NewTimeKey] = ts.Format(r.NewTimeFormat)
+
+	// rename to message because of the elasticsearch default query field is `message`,
+	// rfc5424 already set `message`.
+	if v, ok := logPart[r.MsgKey]; ok {
+		logPart["message"] = v
+		delete(logPart, r.MsgKey)
+	}
+
+	// rfc5424 only
+	if sd, ok := logPart["structured_data"].(string); ok {
+		if sd == "" || sd == "-" {
+			delete(logPart, "structured_data")
+		} else if m, err := parseStructuredData(sd); err != nil {
+			log.Logger.Warn("parse structured data", zap.Error(err), zap.String("structured_data", sd))
+		} else {
+			logPart[rsyslogSDKey] = m
+			delete(logPart, "structured_data")
+		}
+	}
+
+	return ts
+}
+
+// parseStructuredData parse RFC5424 STRUCTURED-DATA
+// `[id1 k1="v1" k2="v2"][id2 k3="v3"]` into
+// `{"id1": {"k1": "v1", "k2": "v2"}, "id2": {"k3": "v3"}}`,
+// repeated params in the same element will be merged into list.
+func parseStructuredData(sd string) (map[string]interface{}, error) {
+	var (
+		m = map[string]interface{}{}
+		i int
+	)
+	for i < len(sd) {
+		if sd[i] != '[' {
+			return nil, errors.Errorf("expect `[` at %d", i)
+		}
+		i++
+
+		// SD-ID
+		start := i
+		for i < len(sd) && sd[i] != ' ' && sd[i] != ']' {
+			i++
+		}
+		if i == len(sd) || i == start {
+			return nil, errors.Errorf("invalid SD-ID at %d", start)
+		}
+		elem := map[string]interface{}{}
+		m[sd[start:i]] = elem
+
+		// SD-PARAM
+		for {
+			for i < len(sd) && sd[i] == ' ' {
+				i++
+			}
+			if i == len(sd) {
+				return nil, errors.New("unexpected end of structured data")
+			}
+			if sd[i] == ']' {
+				i++
+				break
+			}
+
+			start = i
+			for i < len(sd) && sd[i] != '=' {
+				i++
+			}
+			if i+1 >= len(sd) || sd[i+1] != '"' {
+				return nil, errors.Errorf("invalid SD-PARAM at %d", start)
+			}
+			name := sd[start:i]
+			i += 2
+
+			val := make([]byte, 0, 16)
+			for ; i < len(sd) && sd[i] != '"'; i++ {
+				// only `"`, `\` & `]` are escaped
+				if sd[i] == '\\' && i+1 < len(sd) && (sd[i+1] == '"' || sd[i+1] == '\\' || sd[i+1] == ']') {
+					i++
+				}
+				val = append(val, sd[i])
+			}
+			if i == len(sd) {
+				return nil, errors.Errorf("unclosed PARAM-VALUE at %d", start)
+			}
+			i++
+
+			switch v := elem[name].(type) {
+			case nil:
+				elem[name] = string(val)
+			case string:
+				elem[name] = []interface{}{v, string(val)}
+			case []interface{}:
+				elem[name] = append(v, string(val))
+			}
+		}
+	}
+
+	return m, nil
+}
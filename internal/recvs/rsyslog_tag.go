@@ -0,0 +1,56 @@
+package recvs
+
+import (
+	"fmt"
+
+	"gofluentd/library"
+	"gofluentd/library/log"
+
+	"github.com/Laisky/zap"
+)
+
+// RsyslogSourceMapping set tag & fields for logs come from CIDR
+type RsyslogSourceMapping struct {
+	CIDR string
+	// Tag overwrite RsyslogCfg.Tag, can be template too
+	Tag string
+	// Fields will be set into msg.Message
+	Fields map[string]interface{}
+}
+
+func newRsyslogTagDeriver(cfg *RsyslogCfg) (d *tagDeriver, err error) {
+	mappings := make([]*tagSourceMapping, 0, len(cfg.SourceMappings))
+	for _, m := range cfg.SourceMappings {
+		mappings = append(mappings, &tagSourceMapping{
+			cidr:   m.CIDR,
+			tag:    m.Tag,
+			fields: m.Fields,
+		})
+	}
+	return newTagDeriver(cfg.Name, cfg.Tag, cfg.FallbackTag, cfg.MaxTags, mappings)
+}
+
+// ParseRsyslogSourceMappings parse settings to source mappings
+func ParseRsyslogSourceMappings(env string, cfg interface{}) []*RsyslogSourceMapping {
+	items, ok := cfg.([]interface{})
+	if !ok {
+		return nil
+	}
+
+	mappings := []*RsyslogSourceMapping{}
+	for _, itemI := range items {
+		item, ok := normalizeSettingVal(itemI).(map[string]interface{})
+		if !ok {
+			log.Logger.Panic("source mapping should be map", zap.String("mapping", fmt.Sprint(itemI)))
+		}
+		m := &RsyslogSourceMapping{}
+		m.CIDR, _ = item["cidr"].(string)
+		if tag, ok := item["tag"].(string); ok {
+			m.Tag = library.LoadTagReplaceEnv(env, tag)
+		}
+		m.Fields, _ = item["fields"].(map[string]interface{})
+		mappings = append(mappings, m)
+	}
+
+	return mappings
+}
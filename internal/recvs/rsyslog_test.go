@@ -0,0 +1,288 @@
+package recvs
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"gofluentd/library"
+)
+
+// writeSelfSignedCert generate self-signed certificate for 127.0.0.1,
+// it can be used as CA too.
+func writeSelfSignedCert(t *testing.T, dir, cn string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+
+	certFile = filepath.Join(dir, cn+".crt")
+	keyFile = filepath.Join(dir, cn+".key")
+	if err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	return certFile, keyFile
+}
+
+func TestParseStructuredData(t *testing.T) {
+	m, err := parseStructuredData(`[exampleSDID@32473 iut="3" eventSource="App\"li\]cation" eventID="1011"][examplePriority@32473 class="high" class="low"][meta]`)
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	expect := map[string]interface{}{
+		"exampleSDID@32473": map[string]interface{}{
+			"iut":         "3",
+			"eventSource": `App"li]cation`,
+			"eventID":     "1011",
+		},
+		"examplePriority@32473": map[string]interface{}{
+			"class": []interface{}{"high", "low"},
+		},
+		"meta": map[string]interface{}{},
+	}
+	if !reflect.DeepEqual(m, expect) {
+		t.Fatalf("got %+v", m)
+	}
+
+	for _, sd := range []string{
+		`exampleSDID@32473`,
+		`[exampleSDID@32473 iut="3"`,
+		`[exampleSDID@32473 iut=3]`,
+		`[exampleSDID@32473 iut="3]`,
+	} {
+		if _, err = parseStructuredData(sd); err == nil {
+			t.Fatalf("should got error for `%s`", sd)
+		}
+	}
+}
+
+func TestRsyslogRecv(t *testing.T) {
+	var (
+		dir               = t.TempDir()
+		certFile, keyFile = writeSelfSignedCert(t, dir, "server")
+		cliCert, cliKey   = writeSelfSignedCert(t, dir, "switch-1")
+		outChan           = make(chan *library.FluentMsg, 1000)
+		addr              = "127.0.0.1:24232"
+		tlsAddr           = "127.0.0.1:24233"
+	)
+	recv := NewRsyslogRecv(&RsyslogCfg{
+		Name:          "rsyslog-test",
+		Addr:          addr,
+		TLSAddr:       tlsAddr,
+		Tag:           "syslog.sit",
+		TagKey:        "tag",
+		MsgKey:        "content",
+		TimeKey:       "timestamp",
+		NewTimeKey:    "@timestamp",
+		NewTimeFormat: "2006-01-02T15:04:05.000Z",
+		TLS: &library.TLSCfg{
+			Enable:         true,
+			CertFile:       certFile,
+			KeyFile:        keyFile,
+			CAFile:         cliCert,
+			IsVerifyClient: true,
+		},
+	})
+	recv.SetCounter(counter)
+	recv.SetMsgPool(msgPool)
+	recv.SetAsyncOutChan(outChan)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	recv.Run(ctx)
+	time.Sleep(100 * time.Millisecond)
+
+	loadMsg := func() *library.FluentMsg {
+		select {
+		case msg := <-outChan:
+			return msg
+		case <-time.After(2 * time.Second):
+			t.Fatal("can not load msg")
+		}
+		return nil
+	}
+	// octetCount frame message by RFC6587 octet counting
+	octetCount := func(msg string) string {
+		return fmt.Sprintf("%d %s", len(msg), msg)
+	}
+
+	// octet counting over tcp, message contains newline
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	if _, err = conn.Write([]byte(
+		octetCount(`<165>1 2020-01-02T03:04:05.000Z switch-1 ifmgr 123 ID47 [port@1 name="ge-0/0/1" state="down"] link down`+"\nreason: cable") +
+			octetCount(`<165>1 - switch-1 ifmgr 123 ID48 - no timestamp`))); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	conn.Close()
+
+	msg := loadMsg()
+	if msg.Tag != "syslog.sit" ||
+		msg.Message["message"] != "link down\nreason: cable" ||
+		msg.Message["@timestamp"] != "2020-01-02T03:04:05.000Z" ||
+		!msg.Time.Equal(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Fatalf("got %+v, %v", msg.Message, msg.Time)
+	}
+	if _, ok := msg.Message["structured_data"]; ok {
+		t.Fatalf("got %+v", msg.Message)
+	}
+	if port := msg.Message["sd"].(map[string]interface{})["port@1"].(map[string]interface{}); port["name"] != "ge-0/0/1" || port["state"] != "down" {
+		t.Fatalf("got %+v", msg.Message)
+	}
+
+	// invalid timestamp should be replaced by received time
+	msg = loadMsg()
+	if _, ok := msg.Message["timestamp"]; ok {
+		t.Fatalf("got %+v", msg.Message)
+	}
+	if msg.Message["message"] != "no timestamp" ||
+		msg.Message["@timestamp"] == nil ||
+		time.Since(msg.Time) > time.Minute {
+		t.Fatalf("got %+v, %v", msg.Message, msg.Time)
+	}
+
+	// tls with client certificate
+	caPem, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(caPem)
+	cert, err := tls.LoadX509KeyPair(cliCert, cliKey)
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	tlsConn, err := tls.Dial("tcp", tlsAddr, &tls.Config{
+		RootCAs:      pool,
+		Certificates: []tls.Certificate{cert},
+	})
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	if _, err = tlsConn.Write([]byte(octetCount(`<165>1 2020-01-02T03:04:05.000Z switch-1 ifmgr 123 ID49 - over tls`))); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	tlsConn.Close()
+	if msg = loadMsg(); msg.Message["message"] != "over tls" || msg.Message["tls_peer"] != "switch-1" {
+		t.Fatalf("got %+v", msg.Message)
+	}
+
+	// tls without client certificate should be rejected
+	if tlsConn, err = tls.Dial("tcp", tlsAddr, &tls.Config{RootCAs: pool}); err == nil {
+		_, _ = tlsConn.Write([]byte(octetCount(`<165>1 2020-01-02T03:04:05.000Z switch-1 ifmgr 123 ID50 - no cert`)))
+		tlsConn.Close()
+	}
+	select {
+	case msg = <-outChan:
+		t.Fatalf("got unexpected msg %+v", msg.Message)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestRsyslogTagDeriver(t *testing.T) {
+	d, err := newRsyslogTagDeriver(&RsyslogCfg{
+		Name:    "rsyslog-tag-test",
+		Tag:     "syslog.%{app_name}.sit",
+		MaxTags: 3,
+		SourceMappings: ParseRsyslogSourceMappings("sit", []interface{}{
+			map[interface{}]interface{}{
+				"cidr": "10.1.0.0/16",
+				"tag":  "network.%{site}.{env}",
+				"fields": map[interface{}]interface{}{
+					"site": "dc1",
+					"meta": map[interface{}]interface{}{"vendor": "cisco"},
+				},
+			},
+			map[interface{}]interface{}{
+				"cidr":   "10.0.0.0/8",
+				"fields": map[interface{}]interface{}{"site": "other"},
+			},
+		}),
+	})
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	if d.fallbackTag != "syslog.unknown.sit" {
+		t.Fatalf("got %v", d.fallbackTag)
+	}
+
+	derive := func(m map[string]interface{}) (string, bool) {
+		return d.derive(&library.FluentMsg{Message: m})
+	}
+
+	// first matched mapping works
+	m := map[string]interface{}{"client": "10.1.2.3:514", "app_name": "sshd"}
+	if tag, isFallback := derive(m); tag != "network.dc1.sit" || isFallback ||
+		m["meta"].(map[string]interface{})["vendor"] != "cisco" {
+		t.Fatalf("got %v, %+v", tag, m)
+	}
+	m = map[string]interface{}{"client": "10.2.2.3:514", "app_name": "sshd"}
+	if tag, _ := derive(m); tag != "syslog.sshd.sit" || m["site"] != "other" {
+		t.Fatalf("got %v, %+v", tag, m)
+	}
+
+	// invalid chars are replaced
+	if tag, _ := derive(map[string]interface{}{"client": "1.1.1.1:514", "app_name": "kernel/ 1"}); tag != "syslog.kernel__1.sit" {
+		t.Fatalf("got %v", tag)
+	}
+
+	// empty app_name
+	if tag, isFallback := derive(map[string]interface{}{"app_name": "-"}); tag != "syslog.unknown.sit" || !isFallback {
+		t.Fatalf("got %v", tag)
+	}
+
+	// exceed max tags
+	if tag, isFallback := derive(map[string]interface{}{"app_name": "cron"}); tag != "syslog.unknown.sit" || !isFallback {
+		t.Fatalf("got %v", tag)
+	}
+	// known tags still work
+	if tag, isFallback := derive(map[string]interface{}{"app_name": "sshd"}); tag != "syslog.sshd.sit" || isFallback {
+		t.Fatalf("got %v", tag)
+	}
+	if d.nTags() != 3 {
+		t.Fatalf("got %d", d.nTags())
+	}
+
+	if _, err = newRsyslogTagDeriver(&RsyslogCfg{
+		Tag:            "syslog",
+		SourceMappings: []*RsyslogSourceMapping{{CIDR: "10.0.0.0"}},
+	}); err == nil {
+		t.Fatal("should got error")
+	}
+}
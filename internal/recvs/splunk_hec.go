@@ -0,0 +1,630 @@
+package recvs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gofluentd/internal/monitor"
+	"gofluentd/library"
+	"gofluentd/library/log"
+
+	utils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultSplunkHECPath          = "/services/collector"
+	defaultSplunkHECMaxBodySize   = 10 * 1024 * 1024
+	defaultSplunkHECChannelTTL    = 10 * time.Minute
+	defaultSplunkHECAckTTL        = 10 * time.Minute
+	defaultSplunkHECMaxPendingAck = 10000
+
+	splunkHECChannelHeader = "X-Splunk-Request-Channel"
+)
+
+var (
+	// splunkHECChannelRegexp channel should be GUID
+	splunkHECChannelRegexp = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+)
+
+// splunkHECError error response of HEC
+type splunkHECError struct {
+	status int
+	Text   string `json:"text"`
+	Code   int    `json:"code"`
+	// InvalidEventNumber: the index of invalid event in batch
+	InvalidEventNumber *int `json:"invalid-event-number,omitempty"`
+}
+
+var (
+	splunkHECErrTokenRequired   = &splunkHECError{status: http.StatusUnauthorized, Text: "Token is required", Code: 2}
+	splunkHECErrInvalidAuth     = &splunkHECError{status: http.StatusUnauthorized, Text: "Invalid authorization", Code: 3}
+	splunkHECErrInvalidToken    = &splunkHECError{status: http.StatusForbidden, Text: "Invalid token", Code: 4}
+	splunkHECErrNoData          = &splunkHECError{status: http.StatusBadRequest, Text: "No data", Code: 5}
+	splunkHECErrServerBusy      = &splunkHECError{status: http.StatusServiceUnavailable, Text: "Server is busy", Code: 9}
+	splunkHECErrChannelMissing  = &splunkHECError{status: http.StatusBadRequest, Text: "Data channel is missing", Code: 10}
+	splunkHECErrInvalidChannel  = &splunkHECError{status: http.StatusBadRequest, Text: "Invalid data channel", Code: 11}
+	splunkHECErrAckDisabled     = &splunkHECError{status: http.StatusBadRequest, Text: "ACK is disabled", Code: 14}
+	splunkHECErrInvalidAckQuery = &splunkHECError{status: http.StatusBadRequest, Text: "Error in handling indexed fields", Code: 15}
+)
+
+func newSplunkHECEventError(text string, code, i int) *splunkHECError {
+	return &splunkHECError{status: http.StatusBadRequest, Text: text, Code: code, InvalidEventNumber: &i}
+}
+
+// SplunkHECToken token of HEC
+type SplunkHECToken struct {
+	Token string
+	// Tag: tag of events without index
+	Tag string
+	// Indexes: map event index to tag, all indexes are allowed if empty
+	Indexes map[string]string
+}
+
+// getTag return tag by index, return false if index is not allowed
+func (t *SplunkHECToken) getTag(index string) (string, bool) {
+	if index == "" || len(t.Indexes) == 0 {
+		return t.Tag, true
+	}
+	tag, ok := t.Indexes[index]
+	return tag, ok
+}
+
+// ParseSplunkHECTokens parse settings to tokens
+func ParseSplunkHECTokens(env string, cfg interface{}) []*SplunkHECToken {
+	items, ok := cfg.([]interface{})
+	if !ok {
+		return nil
+	}
+
+	tokens := []*SplunkHECToken{}
+	for _, itemI := range items {
+		item, ok := normalizeSettingVal(itemI).(map[string]interface{})
+		if !ok {
+			log.Logger.Panic("token should be map", zap.String("token", fmt.Sprint(itemI)))
+		}
+		t := &SplunkHECToken{Indexes: map[string]string{}}
+		t.Token, _ = item["token"].(string)
+		if tag, ok := item["tag"].(string); ok {
+			t.Tag = library.LoadTagReplaceEnv(env, tag)
+		}
+		indexes, _ := item["indexes"].(map[string]interface{})
+		for index, tagI := range indexes {
+			t.Indexes[index] = library.LoadTagReplaceEnv(env, fmt.Sprint(tagI))
+		}
+		tokens = append(tokens, t)
+	}
+
+	return tokens
+}
+
+/*SplunkHECRecvCfg is the configuration for SplunkHECRecv
+
+Args:
+	Path: prefix of endpoints, default to `/services/collector`
+	Tokens: tokens accepted in `Authorization: Splunk <token>`
+	TagKey: set `msg.Message[TagKey] = msg.Tag`
+	MsgKey: put `event` into `msg.Message[MsgKey]`
+	TimeKey: optional, set event time in RFC3339Nano into `msg.Message[TimeKey]`
+	MaxBodySize: max size of request after decompression
+	IsAckEnabled: require channel, reply ackId that can be queried by `<Path>/ack`,
+		ackId is acked after all events in request persisted by journal.
+	ChannelTTL: remove channel not used in ChannelTTL
+	AckTTL: remove ackId not queried in AckTTL,
+		include ackId never acked since msgs are discarded or failed to persist.
+	MaxPendingAcks: max unacked requests per channel
+*/
+type SplunkHECRecvCfg struct {
+	HTTPSrv *gin.Engine
+	Name,
+	Path string
+	Tokens []*SplunkHECToken
+	TagKey, MsgKey,
+	TimeKey string
+	MaxBodySize  int64
+	IsAckEnabled bool
+	ChannelTTL,
+	AckTTL time.Duration
+	MaxPendingAcks int
+}
+
+// SplunkHECRecv recv compatible with splunk HTTP event collector
+type SplunkHECRecv struct {
+	*BaseRecv
+	*SplunkHECRecvCfg
+
+	tokens          map[string]*SplunkHECToken
+	channelsLock    sync.Mutex
+	channels        map[string]*splunkHECChannel
+	requestCounter  *utils.Counter
+	rejectedCounter *utils.Counter
+}
+
+// splunkHECChannel ack status of one channel
+type splunkHECChannel struct {
+	nextAckID int64
+	// pending: acker of each request, released after all msgs in request persisted
+	pending  map[int64]*splunkHECPendingAck
+	lastUsed time.Time
+}
+
+// splunkHECPendingAck ackId waiting to be queried, expired after AckTTL
+type splunkHECPendingAck struct {
+	acker *library.CountAcker
+	ts    time.Time
+}
+
+// NewSplunkHECRecv create new SplunkHECRecv and register endpoints on HTTPSrv
+func NewSplunkHECRecv(cfg *SplunkHECRecvCfg) *SplunkHECRecv {
+	r := &SplunkHECRecv{
+		BaseRecv:         &BaseRecv{},
+		SplunkHECRecvCfg: cfg,
+		tokens:           map[string]*SplunkHECToken{},
+		channels:         map[string]*splunkHECChannel{},
+		requestCounter:   utils.NewCounter(),
+		rejectedCounter:  utils.NewCounter(),
+	}
+	if err := r.valid(); err != nil {
+		log.Logger.Panic("config invalid", zap.Error(err))
+	}
+
+	log.Logger.Info("create SplunkHECRecv",
+		zap.String("name", r.Name),
+		zap.String("path", r.Path),
+		zap.Int("n_tokens", len(r.tokens)),
+		zap.Bool("ack", r.IsAckEnabled))
+	for _, path := range []string{"", "/event", "/event/1.0"} {
+		r.HTTPSrv.POST(r.Path+path, r.EventHandler)
+	}
+	for _, path := range []string{"/raw", "/raw/1.0"} {
+		r.HTTPSrv.POST(r.Path+path, r.RawHandler)
+	}
+	r.HTTPSrv.POST(r.Path+"/ack", r.AckHandler)
+	r.HTTPSrv.GET(r.Path+"/health", func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, map[string]interface{}{"text": "HEC is healthy", "code": 17})
+	})
+	return r
+}
+
+func (r *SplunkHECRecv) valid() error {
+	if r.HTTPSrv == nil {
+		return errors.New("http server should not be nil")
+	}
+	if len(r.Tokens) == 0 {
+		return errors.New("tokens should not be empty")
+	}
+	for _, t := range r.Tokens {
+		if t.Token == "" || t.Tag == "" {
+			return errors.New("token & tag should not be empty")
+		}
+		if _, ok := r.tokens[t.Token]; ok {
+			return errors.Errorf("duplicated token for tag `%s`", t.Tag)
+		}
+		r.tokens[t.Token] = t
+	}
+
+	r.Path = strings.TrimRight(r.Path, "/")
+	if r.Path == "" {
+		r.Path = defaultSplunkHECPath
+		log.Logger.Info("reset path", zap.String("path", r.Path))
+	}
+	if r.TagKey == "" {
+		r.TagKey = "tag"
+		log.Logger.Info("reset tag_key", zap.String("tag_key", r.TagKey))
+	}
+	if r.MsgKey == "" {
+		r.MsgKey = "event"
+		log.Logger.Info("reset msg_key", zap.String("msg_key", r.MsgKey))
+	}
+	if r.MaxBodySize <= 0 {
+		r.MaxBodySize = defaultSplunkHECMaxBodySize
+		log.Logger.Info("reset max_body_byte", zap.Int64("max_body_byte", r.MaxBodySize))
+	}
+	if r.ChannelTTL <= 0 {
+		r.ChannelTTL = defaultSplunkHECChannelTTL
+		log.Logger.Info("reset channel_ttl_sec", zap.Duration("channel_ttl", r.ChannelTTL))
+	}
+	if r.AckTTL <= 0 {
+		r.AckTTL = defaultSplunkHECAckTTL
+		log.Logger.Info("reset ack_ttl_sec", zap.Duration("ack_ttl", r.AckTTL))
+	}
+	if r.MaxPendingAcks <= 0 {
+		r.MaxPendingAcks = defaultSplunkHECMaxPendingAck
+		log.Logger.Info("reset max_pending_acks", zap.Int("max_pending_acks", r.MaxPendingAcks))
+	}
+
+	return nil
+}
+
+// GetName get the name of recv
+func (r *SplunkHECRecv) GetName() string {
+	return r.Name
+}
+
+// Run register metrics & clean idle channels, requests are handled by HTTPSrv
+func (r *SplunkHECRecv) Run(ctx context.Context) {
+	log.Logger.Info("run SplunkHECRecv", zap.String("name", r.Name))
+	monitor.AddMetric("splunkhecrecv."+r.Name, func() map[string]interface{} {
+		r.channelsLock.Lock()
+		nChannels := len(r.channels)
+		r.channelsLock.Unlock()
+		return map[string]interface{}{
+			"requestTotal":  r.requestCounter.Get(),
+			"rejectedTotal": r.rejectedCounter.Get(),
+			"channels":      nChannels,
+		}
+	})
+
+	if !r.IsAckEnabled {
+		return
+	}
+	gcInterval := r.ChannelTTL / 2
+	if r.AckTTL < r.ChannelTTL {
+		gcInterval = r.AckTTL / 2
+	}
+	go func() {
+		ticker := time.NewTicker(gcInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			r.gcChannels()
+		}
+	}()
+}
+
+// gcChannels remove channels not used in ChannelTTL & ackIds not queried in AckTTL
+func (r *SplunkHECRecv) gcChannels() {
+	r.channelsLock.Lock()
+	defer r.channelsLock.Unlock()
+	for id, c := range r.channels {
+		if time.Since(c.lastUsed) > r.ChannelTTL {
+			log.Logger.Debug("remove idle splunk hec channel", zap.String("name", r.Name), zap.String("channel", id))
+			delete(r.channels, id)
+			continue
+		}
+
+		for ackID, a := range c.pending {
+			if time.Since(a.ts) > r.AckTTL {
+				delete(c.pending, ackID)
+			}
+		}
+	}
+}
+
+// abort reply error like splunk
+func (r *SplunkHECRecv) abort(ctx *gin.Context, err *splunkHECError) {
+	r.rejectedCounter.Count()
+	log.Logger.Warn("reject splunk hec request",
+		zap.String("name", r.Name),
+		zap.String("remote", ctx.ClientIP()),
+		zap.String("error", err.Text),
+		zap.Int("code", err.Code))
+	ctx.AbortWithStatusJSON(err.status, err)
+}
+
+// authenticate load token from `Authorization: Splunk <token>`
+func (r *SplunkHECRecv) authenticate(ctx *gin.Context) (*SplunkHECToken, *splunkHECError) {
+	auth := ctx.GetHeader("Authorization")
+	if auth == "" {
+		return nil, splunkHECErrTokenRequired
+	}
+	if !strings.HasPrefix(auth, "Splunk ") {
+		return nil, splunkHECErrInvalidAuth
+	}
+	t, ok := r.tokens[strings.TrimSpace(strings.TrimPrefix(auth, "Splunk "))]
+	if !ok {
+		return nil, splunkHECErrInvalidToken
+	}
+	return t, nil
+}
+
+// loadChannel load channel id from header or query
+func (r *SplunkHECRecv) loadChannel(ctx *gin.Context) (string, *splunkHECError) {
+	id := ctx.GetHeader(splunkHECChannelHeader)
+	if id == "" {
+		id = ctx.Query("channel")
+	}
+	if id == "" {
+		return "", splunkHECErrChannelMissing
+	}
+	if !splunkHECChannelRegexp.MatchString(id) {
+		return "", splunkHECErrInvalidChannel
+	}
+	return id, nil
+}
+
+// readBody read & decompress body
+func (r *SplunkHECRecv) readBody(ctx *gin.Context) ([]byte, *splunkHECError) {
+	if ctx.Request.ContentLength > r.MaxBodySize {
+		return nil, &splunkHECError{status: http.StatusRequestEntityTooLarge, Text: "Content too large", Code: 27}
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(ctx.Request.Body, r.MaxBodySize+1))
+	if err != nil {
+		return nil, &splunkHECError{status: http.StatusBadRequest, Text: "Invalid data format", Code: 6}
+	}
+	if int64(len(body)) > r.MaxBodySize {
+		return nil, &splunkHECError{status: http.StatusRequestEntityTooLarge, Text: "Content too large", Code: 27}
+	}
+	if body, err = decompressHTTPBody(ctx.Request, body, r.MaxBodySize); err != nil {
+		return nil, &splunkHECError{status: http.StatusBadRequest, Text: "Invalid data format", Code: 6}
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil, splunkHECErrNoData
+	}
+	return body, nil
+}
+
+// splunkHECEvent event in `/event` request
+type splunkHECEvent struct {
+	Time       interface{}            `json:"time"`
+	Host       string                 `json:"host"`
+	Source     string                 `json:"source"`
+	SourceType string                 `json:"sourcetype"`
+	Index      string                 `json:"index"`
+	Event      interface{}            `json:"event"`
+	Fields     map[string]interface{} `json:"fields"`
+}
+
+// EventHandler process concatenated JSON events
+func (r *SplunkHECRecv) EventHandler(ctx *gin.Context) {
+	r.handle(ctx, func(body []byte, token *SplunkHECToken) (msgs []*library.FluentMsg, herr *splunkHECError) {
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		for i := 0; ; i++ {
+			evt := &splunkHECEvent{}
+			if err := decoder.Decode(evt); err == io.EOF {
+				return msgs, nil
+			} else if err != nil {
+				return msgs, newSplunkHECEventError("Invalid data format", 6, i)
+			}
+			if evt.Event == nil {
+				return msgs, newSplunkHECEventError("Event field is required", 12, i)
+			}
+			if s, ok := evt.Event.(string); ok && s == "" {
+				return msgs, newSplunkHECEventError("Event field cannot be blank", 13, i)
+			}
+
+			msg, herr := r.convertEvent(token, evt, i)
+			if herr != nil {
+				return msgs, herr
+			}
+			msgs = append(msgs, msg)
+		}
+	})
+}
+
+// RawHandler process raw events splitted by newline,
+// metadata are loaded from query.
+func (r *SplunkHECRecv) RawHandler(ctx *gin.Context) {
+	r.handle(ctx, func(body []byte, token *SplunkHECToken) (msgs []*library.FluentMsg, herr *splunkHECError) {
+		i := 0
+		for _, line := range bytes.Split(body, []byte("\n")) {
+			if line = bytes.TrimRight(line, "\r"); len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+
+			evt := &splunkHECEvent{
+				Host:       ctx.Query("host"),
+				Source:     ctx.Query("source"),
+				SourceType: ctx.Query("sourcetype"),
+				Index:      ctx.Query("index"),
+				Event:      string(line),
+			}
+			if ts := ctx.Query("time"); ts != "" {
+				evt.Time = ts
+			}
+			msg, herr := r.convertEvent(token, evt, i)
+			if herr != nil {
+				return msgs, herr
+			}
+			msgs = append(msgs, msg)
+			i++
+		}
+		return msgs, nil
+	})
+}
+
+// handle authenticate & parse request, then put msgs into pipeline,
+// the whole request will be rejected if any event is invalid.
+func (r *SplunkHECRecv) handle(ctx *gin.Context, parse func(body []byte, token *SplunkHECToken) ([]*library.FluentMsg, *splunkHECError)) {
+	r.requestCounter.Count()
+	token, herr := r.authenticate(ctx)
+	if herr != nil {
+		r.abort(ctx, herr)
+		return
+	}
+	var channelID string
+	if r.IsAckEnabled {
+		if channelID, herr = r.loadChannel(ctx); herr != nil {
+			r.abort(ctx, herr)
+			return
+		}
+	}
+	body, herr := r.readBody(ctx)
+	if herr != nil {
+		r.abort(ctx, herr)
+		return
+	}
+
+	msgs, herr := parse(body, token)
+	if herr != nil {
+		for _, msg := range msgs {
+			r.msgPool.Put(msg)
+		}
+		r.abort(ctx, herr)
+		return
+	}
+
+	resp := map[string]interface{}{"text": "Success", "code": 0}
+	if r.IsAckEnabled {
+		acker, ackID, herr := r.newAck(channelID)
+		if herr != nil {
+			for _, msg := range msgs {
+				r.msgPool.Put(msg)
+			}
+			r.abort(ctx, herr)
+			return
+		}
+		for _, msg := range msgs {
+			acker.Attach(msg)
+		}
+		acker.Ack() // release the hold by handler
+		resp["ackId"] = ackID
+	}
+
+	log.Logger.Debug("receive splunk hec msgs", zap.String("name", r.Name), zap.Int("n", len(msgs)))
+	ctx.JSON(http.StatusOK, resp)
+	for _, msg := range msgs {
+		r.asyncOutChan <- msg
+	}
+}
+
+// convertEvent convert event into msg, i is the index of event in request
+func (r *SplunkHECRecv) convertEvent(token *SplunkHECToken, evt *splunkHECEvent, i int) (*library.FluentMsg, *splunkHECError) {
+	tag, ok := token.getTag(evt.Index)
+	if !ok {
+		return nil, newSplunkHECEventError("Incorrect index", 7, i)
+	}
+	ts, err := parseSplunkHECTime(evt.Time)
+	if err != nil {
+		return nil, newSplunkHECEventError("Invalid data format", 6, i)
+	}
+
+	msg := r.msgPool.Get().(*library.FluentMsg)
+	msg.ID = r.counter.Count()
+	msg.Message = make(map[string]interface{}, len(evt.Fields)+7)
+	for k, v := range evt.Fields {
+		msg.Message[k] = v
+	}
+	msg.Message[r.MsgKey] = evt.Event
+	for k, v := range map[string]string{
+		"host":       evt.Host,
+		"source":     evt.Source,
+		"sourcetype": evt.SourceType,
+		"index":      evt.Index,
+	} {
+		if v != "" {
+			msg.Message[k] = v
+		}
+	}
+	msg.Time = ts
+	if r.TimeKey != "" && !ts.IsZero() {
+		msg.Message[r.TimeKey] = ts.Format(time.RFC3339Nano)
+	}
+	msg.Tag = tag
+	msg.Message[r.TagKey] = tag
+	msg.Ackers = nil
+	return msg, nil
+}
+
+// parseSplunkHECTime parse epoch seconds in number or string
+func parseSplunkHECTime(v interface{}) (ts time.Time, err error) {
+	var sec float64
+	switch v := v.(type) {
+	case nil:
+		return ts, nil
+	case float64:
+		sec = v
+	case string:
+		if v == "" {
+			return ts, nil
+		}
+		if sec, err = strconv.ParseFloat(v, 64); err != nil {
+			return ts, errors.Wrapf(err, "parse time `%s`", v)
+		}
+	default:
+		return ts, errors.Errorf("unknown type of time `%v`", v)
+	}
+
+	intPart, frac := math.Modf(sec)
+	return time.Unix(int64(intPart), int64(math.Round(frac*1e6))*int64(time.Microsecond)).UTC(), nil
+}
+
+// newAck allocate ack id in channel
+func (r *SplunkHECRecv) newAck(channelID string) (*library.CountAcker, int64, *splunkHECError) {
+	r.channelsLock.Lock()
+	defer r.channelsLock.Unlock()
+	c, ok := r.channels[channelID]
+	if !ok {
+		c = &splunkHECChannel{pending: map[int64]*splunkHECPendingAck{}}
+		r.channels[channelID] = c
+	}
+	c.lastUsed = time.Now()
+	if len(c.pending) >= r.MaxPendingAcks {
+		return nil, 0, splunkHECErrServerBusy
+	}
+
+	ackID := c.nextAckID
+	c.nextAckID++
+	acker := library.NewCountAcker() // hold by handler until all msgs attached
+	c.pending[ackID] = &splunkHECPendingAck{acker: acker, ts: c.lastUsed}
+	return acker, ackID, nil
+}
+
+// AckHandler reply `{"acks": {"<id>": true}}`,
+// acked id will be removed after queried.
+func (r *SplunkHECRecv) AckHandler(ctx *gin.Context) {
+	if _, herr := r.authenticate(ctx); herr != nil {
+		r.abort(ctx, herr)
+		return
+	}
+	if !r.IsAckEnabled {
+		r.abort(ctx, splunkHECErrAckDisabled)
+		return
+	}
+	channelID, herr := r.loadChannel(ctx)
+	if herr != nil {
+		r.abort(ctx, herr)
+		return
+	}
+	req := &struct {
+		Acks []int64 `json:"acks"`
+	}{}
+	if err := ctx.ShouldBindJSON(req); err != nil {
+		r.abort(ctx, splunkHECErrInvalidAckQuery)
+		return
+	}
+
+	r.channelsLock.Lock()
+	c, ok := r.channels[channelID]
+	if !ok {
+		r.channelsLock.Unlock()
+		r.abort(ctx, splunkHECErrInvalidChannel)
+		return
+	}
+	c.lastUsed = time.Now()
+	acks := make(map[string]bool, len(req.Acks))
+	for _, id := range req.Acks {
+		a, ok := c.pending[id]
+		if !ok {
+			acks[strconv.FormatInt(id, 10)] = false
+			continue
+		}
+		select {
+		case <-a.acker.Done():
+			acks[strconv.FormatInt(id, 10)] = true
+			delete(c.pending, id)
+		default:
+			acks[strconv.FormatInt(id, 10)] = false
+		}
+	}
+	r.channelsLock.Unlock()
+
+	ctx.JSON(http.StatusOK, map[string]interface{}{"acks": acks})
+}
@@ -0,0 +1,181 @@
+package recvs
+
+import (
+	"bytes"
+	"compress/gzip"
+	stdjson "encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gofluentd/library"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSplunkHECRecv(t *testing.T) {
+	var (
+		srv          = gin.New()
+		asyncOutChan = make(chan *library.FluentMsg, 1000)
+		channel      = "11111111-2222-3333-4444-555555555555"
+	)
+	recv := NewSplunkHECRecv(&SplunkHECRecvCfg{
+		Name:    "test-splunk",
+		HTTPSrv: srv,
+		Tokens: []*SplunkHECToken{
+			{Token: "token-a", Tag: "splunk.a.sit", Indexes: map[string]string{"fw": "splunk.fw.sit"}},
+			{Token: "token-b", Tag: "splunk.b.sit"},
+		},
+		TimeKey:      "@timestamp",
+		IsAckEnabled: true,
+	})
+	recv.SetCounter(counter)
+	recv.SetMsgPool(msgPool)
+	recv.SetAsyncOutChan(asyncOutChan)
+
+	post := func(path, token string, body []byte, gz bool) (int, map[string]interface{}) {
+		if gz {
+			buf := &bytes.Buffer{}
+			gw := gzip.NewWriter(buf)
+			gw.Write(body)
+			gw.Close()
+			body = buf.Bytes()
+		}
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Splunk "+token)
+		}
+		if gz {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+		req.Header.Set(splunkHECChannelHeader, channel)
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		resp := map[string]interface{}{}
+		if err := stdjson.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("got error: %+v", err)
+		}
+		return w.Code, resp
+	}
+	loadMsg := func() *library.FluentMsg {
+		select {
+		case msg := <-asyncOutChan:
+			return msg
+		default:
+			t.Fatal("can not load msg")
+		}
+		return nil
+	}
+
+	// concatenated events in gzip
+	code, resp := post(defaultSplunkHECPath+"/event", "token-a", []byte(
+		`{"time": 1577934245.123, "host": "fw-01", "index": "fw", "event": {"action": "deny"}, "fields": {"zone": "dmz"}}`+
+			`{"time": "1577934245", "event": "hello"}`), true)
+	if code != http.StatusOK || resp["code"].(float64) != 0 || resp["ackId"].(float64) != 0 {
+		t.Fatalf("got %d, %+v", code, resp)
+	}
+	msg := loadMsg()
+	if msg.Tag != "splunk.fw.sit" ||
+		msg.Message["tag"] != "splunk.fw.sit" ||
+		msg.Message["event"].(map[string]interface{})["action"] != "deny" ||
+		msg.Message["host"] != "fw-01" ||
+		msg.Message["index"] != "fw" ||
+		msg.Message["zone"] != "dmz" ||
+		msg.Message["@timestamp"] != "2020-01-02T03:04:05.123Z" ||
+		!msg.Time.Equal(time.Date(2020, 1, 2, 3, 4, 5, 123000000, time.UTC)) {
+		t.Fatalf("got %+v, %+v, %v", msg.Tag, msg.Message, msg.Time)
+	}
+	msgs := []*library.FluentMsg{msg, loadMsg()}
+	if msgs[1].Tag != "splunk.a.sit" || msgs[1].Message["event"] != "hello" {
+		t.Fatalf("got %+v, %+v", msgs[1].Tag, msgs[1].Message)
+	}
+
+	// raw
+	code, resp = post(defaultSplunkHECPath+"/raw?sourcetype=syslog", "token-b", []byte("line-1\r\n\nline-2\n"), false)
+	if code != http.StatusOK || resp["ackId"].(float64) != 1 {
+		t.Fatalf("got %d, %+v", code, resp)
+	}
+	for _, line := range []string{"line-1", "line-2"} {
+		msg = loadMsg()
+		if msg.Tag != "splunk.b.sit" || msg.Message["event"] != line || msg.Message["sourcetype"] != "syslog" {
+			t.Fatalf("got %+v, %+v", msg.Tag, msg.Message)
+		}
+		msgs = append(msgs, msg)
+	}
+
+	// ack after all msgs in request persisted
+	queryAck := func() map[string]interface{} {
+		code, resp := post(defaultSplunkHECPath+"/ack", "token-a", []byte(`{"acks": [0, 1, 5]}`), false)
+		if code != http.StatusOK {
+			t.Fatalf("got %d, %+v", code, resp)
+		}
+		return resp["acks"].(map[string]interface{})
+	}
+	msgs[0].Ack()
+	if acks := queryAck(); acks["0"] != false || acks["1"] != false || acks["5"] != false {
+		t.Fatalf("got %+v", acks)
+	}
+	msgs[1].Ack()
+	if acks := queryAck(); acks["0"] != true || acks["1"] != false {
+		t.Fatalf("got %+v", acks)
+	}
+	msgs[2].Ack()
+	msgs[3].Ack()
+	if acks := queryAck(); acks["0"] != false || acks["1"] != true {
+		t.Fatalf("got %+v", acks)
+	}
+
+	// invalid requests
+	for _, c := range []struct {
+		path, token, body string
+		status, code      int
+	}{
+		{"/event", "", `{"event": "x"}`, http.StatusUnauthorized, 2},
+		{"/event", "token-c", `{"event": "x"}`, http.StatusForbidden, 4},
+		{"/event", "token-a", ``, http.StatusBadRequest, 5},
+		{"/event", "token-a", `{"event": "x"}{"event": `, http.StatusBadRequest, 6},
+		{"/event", "token-a", `{"event": "x"}{"host": "h"}`, http.StatusBadRequest, 12},
+		{"/event", "token-a", `{"event": ""}`, http.StatusBadRequest, 13},
+		{"/event", "token-a", `{"event": "x", "index": "waf"}`, http.StatusBadRequest, 7},
+	} {
+		code, resp = post(defaultSplunkHECPath+c.path, c.token, []byte(c.body), false)
+		if code != c.status || int(resp["code"].(float64)) != c.code {
+			t.Fatalf("got %d, %+v for %+v", code, resp, c)
+		}
+	}
+	if resp["invalid-event-number"].(float64) != 0 {
+		t.Fatalf("got %+v", resp)
+	}
+	select {
+	case msg := <-asyncOutChan:
+		t.Fatalf("should not got msg: %+v", msg.Message)
+	default:
+	}
+}
+
+func TestSplunkHECRecvExpireAcks(t *testing.T) {
+	channel := "11111111-2222-3333-4444-555555555555"
+	recv := NewSplunkHECRecv(&SplunkHECRecvCfg{
+		Name:           "test-splunk",
+		HTTPSrv:        gin.New(),
+		Tokens:         []*SplunkHECToken{{Token: "token-a", Tag: "splunk.a.sit"}},
+		IsAckEnabled:   true,
+		AckTTL:         50 * time.Millisecond,
+		MaxPendingAcks: 1,
+	})
+
+	// ackId never acked & never queried
+	if _, _, herr := recv.newAck(channel); herr != nil {
+		t.Fatalf("got error: %+v", herr)
+	}
+	if _, _, herr := recv.newAck(channel); herr != splunkHECErrServerBusy {
+		t.Fatalf("got %+v", herr)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	recv.gcChannels()
+	if _, ackID, herr := recv.newAck(channel); herr != nil || ackID != 1 {
+		t.Fatalf("got %d, %+v", ackID, herr)
+	}
+}
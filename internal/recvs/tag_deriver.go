@@ -0,0 +1,162 @@
+package recvs
+
+import (
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+
+	"gofluentd/library"
+	"gofluentd/library/log"
+
+	"github.com/Laisky/zap"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultTagDeriverMaxTags = 100
+)
+
+var (
+	// tagVarRegexp match variables in tag template
+	tagVarRegexp = regexp.MustCompile(`\%\{[^}]+\}`)
+	// tagInvalidCharRegexp chars should not appear in derived tag
+	tagInvalidCharRegexp = regexp.MustCompile(`[^\w\-\.]`)
+)
+
+// tagSourceMapping set tag & fields for logs come from CIDR
+type tagSourceMapping struct {
+	cidr string
+	// tag overwrite the template of deriver, can be template too
+	tag string
+	// fields will be set into msg.Message
+	fields map[string]interface{}
+
+	ipnet *net.IPNet
+}
+
+// tagDeriver derive tag by template & source mapping,
+// limit the number of distinct tags since each tag will spawn new pipelines
+type tagDeriver struct {
+	name, template, fallbackTag string
+	maxTags                     int
+	mappings                    []*tagSourceMapping
+
+	sync.Mutex
+	// tags distinct derived tags
+	tags         map[string]struct{}
+	isCapReached bool
+}
+
+// newTagDeriver create deriver by template like `%{app}.{env}`,
+// mappings set tag & fields by `msg.Message["client"]`, can be nil.
+func newTagDeriver(name, template, fallbackTag string, maxTags int, mappings []*tagSourceMapping) (d *tagDeriver, err error) {
+	d = &tagDeriver{
+		name:        name,
+		template:    template,
+		fallbackTag: fallbackTag,
+		maxTags:     maxTags,
+		mappings:    mappings,
+		tags:        map[string]struct{}{},
+	}
+	if d.maxTags <= 0 {
+		d.maxTags = defaultTagDeriverMaxTags
+		log.Logger.Info("reset max_tags", zap.Int("max_tags", d.maxTags))
+	}
+	if d.fallbackTag == "" {
+		d.fallbackTag = tagVarRegexp.ReplaceAllString(d.template, "unknown")
+		log.Logger.Info("reset fallback_tag", zap.String("fallback_tag", d.fallbackTag))
+	}
+	if tagVarRegexp.MatchString(d.fallbackTag) {
+		return nil, errors.Errorf("fallback_tag `%s` should not contain variables", d.fallbackTag)
+	}
+
+	for _, m := range d.mappings {
+		if _, m.ipnet, err = net.ParseCIDR(m.cidr); err != nil {
+			return nil, errors.Wrapf(err, "parse cidr `%s`", m.cidr)
+		}
+	}
+
+	return d, nil
+}
+
+// isDynamic whether tag may be changed by msg
+func (d *tagDeriver) isDynamic() bool {
+	return len(d.mappings) != 0 || tagVarRegexp.MatchString(d.template)
+}
+
+// match return the first mapping that contains client ip
+func (d *tagDeriver) match(client string) *tagSourceMapping {
+	if len(d.mappings) == 0 {
+		return nil
+	}
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+	ip := net.ParseIP(client)
+	if ip == nil {
+		return nil
+	}
+	for _, m := range d.mappings {
+		if m.ipnet.Contains(ip) {
+			return m
+		}
+	}
+	return nil
+}
+
+// derive set mapping fields into msg, and return the tag of msg.
+// return fallback tag if derived tag is invalid or too many tags.
+func (d *tagDeriver) derive(msg *library.FluentMsg) (tag string, isFallback bool) {
+	template := d.template
+	if client, ok := msg.Message["client"].(string); ok {
+		if m := d.match(client); m != nil {
+			for k, v := range m.fields {
+				msg.Message[k] = v
+			}
+			if m.tag != "" {
+				template = m.tag
+			}
+		}
+	}
+
+	tag = tagVarRegexp.ReplaceAllStringFunc(template, func(v string) string {
+		v = library.ReplaceStrByMsg(msg, v)
+		if v == "-" { // NILVALUE in rfc5424
+			return ""
+		}
+		return tagInvalidCharRegexp.ReplaceAllString(v, "_")
+	})
+	if tag == "" ||
+		strings.HasPrefix(tag, ".") ||
+		strings.HasSuffix(tag, ".") ||
+		strings.Contains(tag, "..") {
+		log.Logger.Debug("invalid derived tag", zap.String("name", d.name), zap.String("tag", tag))
+		return d.fallbackTag, true
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	if _, ok := d.tags[tag]; !ok {
+		if len(d.tags) >= d.maxTags {
+			if !d.isCapReached { // only warn once
+				d.isCapReached = true
+				log.Logger.Warn("too many derived tags, use fallback tag for new tags",
+					zap.String("name", d.name),
+					zap.String("tag", tag),
+					zap.Int("max_tags", d.maxTags))
+			}
+			return d.fallbackTag, true
+		}
+		d.tags[tag] = struct{}{}
+	}
+
+	return tag, false
+}
+
+// nTags return the number of distinct derived tags
+func (d *tagDeriver) nTags() int {
+	d.Lock()
+	defer d.Unlock()
+	return len(d.tags)
+}
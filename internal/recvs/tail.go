@@ -0,0 +1,700 @@
+package recvs
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gofluentd/internal/monitor"
+	"gofluentd/library"
+	"gofluentd/library/log"
+
+	utils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultTailPollInterval = 1 * time.Second
+	defaultTailRotateWait   = 5 * time.Second
+	defaultTailMaxLineSize  = 1024 * 1024
+	tailReadBufSize         = 64 * 1024
+	// tailPosDone mark gzip file that has been read completely
+	tailPosDone = uint64(math.MaxUint64)
+
+	// TailFormatRaw emit each line as it is
+	TailFormatRaw = "raw"
+	// TailFormatCRI decode line in CRI format `<time> <stream> <P|F> <log>`
+	TailFormatCRI = "cri"
+	// TailFormatDocker decode line in docker json-file format
+	TailFormatDocker = "docker"
+)
+
+// TailRecvCfg configuration of TailRecv
+type TailRecvCfg struct {
+	Name string
+	// Paths & ExcludePaths: glob patterns of files to follow
+	Paths, ExcludePaths []string
+	// PosFile: persist read offsets of files, in format `<path>\t<inode>\t<offset>`,
+	// read offsets will not be persisted if empty
+	PosFile string
+
+	// Tag: template of tag, support variables:
+	//
+	//   * `${path}`: absolute path of file
+	//   * `${dir}`: directory of file
+	//   * `${basename}`: basename of file
+	//   * `${name}`: basename without extension
+	//   * `${path_tag}`: path with separators replaced by `.`
+	//   * `${namespace}`, `${pod_name}`, `${container_name}`, `${container_id}`:
+	//     parsed from name of kubernetes container log file
+	Tag,
+	// TagKey: set `msg.Message[TagKey] = tag`
+	TagKey,
+	// MsgKey: set `msg.Message[MsgKey] = line`
+	MsgKey,
+	// PathKey & InodeKey: set path & inode of file into msg
+	PathKey, InodeKey string
+
+	// PollInterval interval to scan paths & read files
+	PollInterval time.Duration
+	// RotateWait keep reading rotated file for RotateWait,
+	// in case of app still writing to the old file before reopen
+	RotateWait time.Duration
+	// IsReadFromHead read files found at startup from head,
+	// otherwise read from end. Files found after startup always read from head.
+	IsReadFromHead bool
+	// MaxLineSize split line if it's longer than MaxLineSize
+	MaxLineSize int
+
+	// Format: raw/cri/docker, partial lines of cri & docker will be reassembled
+	Format string
+	// K8s enrich container logs with pod metadata if Enable is set
+	K8s *K8sMetaCfg
+}
+
+// TailRecv recv that follows local files
+//
+// rotation handling:
+//
+//   - rename (logrotate create): keep reading the old file for RotateWait, then open new file from head
+//   - truncate & copytruncate: read from head if file size shrink below offset
+//   - `*.gz`: read the whole file once, notice that do not include the gzip-compressed
+//     copy of the file that has already been tailed, otherwise logs will be duplicated.
+type TailRecv struct {
+	*BaseRecv
+	*TailRecvCfg
+	logger *utils.LoggerType
+
+	// files inode -> file
+	files map[uint64]*tailFile
+	// positions inode -> offset loaded from pos file
+	positions map[uint64]*tailPos
+
+	lineCounter,
+	rotateCounter,
+	truncateCounter *utils.Counter
+
+	k8sClient *k8sMetaClient
+}
+
+type tailPos struct {
+	path   string
+	offset uint64
+}
+
+// tailFile the file being followed
+type tailFile struct {
+	path, tag string
+	inode     uint64
+	isGzip    bool
+
+	fp     *os.File
+	reader *bufio.Reader
+	// offset bytes consumed from file, including pending
+	offset int64
+	// pending incomplete line wait for newline
+	pending []byte
+	// isRotated file has been moved or deleted, close after RotateWait
+	isRotated bool
+	rotatedAt time.Time
+
+	// k8sMeta pod_name, namespace, container_name & container_id parsed from file name
+	k8sMeta map[string]interface{}
+	// partials stream -> partial container log wait to be reassembled
+	partials map[string][]byte
+}
+
+// NewTailRecv create new TailRecv
+func NewTailRecv(cfg *TailRecvCfg) (r *TailRecv) {
+	r = &TailRecv{
+		BaseRecv:        &BaseRecv{},
+		TailRecvCfg:     cfg,
+		logger:          log.Logger.Named(cfg.Name),
+		files:           map[uint64]*tailFile{},
+		positions:       map[uint64]*tailPos{},
+		lineCounter:     utils.NewCounter(),
+		rotateCounter:   utils.NewCounter(),
+		truncateCounter: utils.NewCounter(),
+	}
+	if err := r.valid(); err != nil {
+		log.Logger.Panic("config invalid", zap.Error(err))
+	}
+	if r.K8s != nil && r.K8s.Enable {
+		var err error
+		if r.k8sClient, err = newK8sMetaClient(r.K8s); err != nil {
+			log.Logger.Panic("new kubernetes client", zap.Error(err))
+		}
+	}
+	r.registerMonitor()
+
+	r.logger.Info("create tail recv",
+		zap.Strings("paths", r.Paths),
+		zap.Strings("exclude_paths", r.ExcludePaths),
+		zap.String("pos_file", r.PosFile),
+		zap.String("tag", r.Tag),
+		zap.Duration("poll_interval", r.PollInterval),
+		zap.Bool("is_read_from_head", r.IsReadFromHead),
+		zap.String("format", r.Format),
+		zap.Bool("is_k8s_meta", r.k8sClient != nil),
+	)
+	return r
+}
+
+func (r *TailRecv) valid() error {
+	if len(r.Paths) == 0 {
+		return errors.New("paths should not be empty")
+	}
+	for _, pattern := range append(r.Paths, r.ExcludePaths...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return errors.Wrapf(err, "invalid pattern `%s`", pattern)
+		}
+	}
+
+	if r.Tag == "" {
+		return errors.New("tag should not be empty")
+	}
+
+	if r.TagKey == "" {
+		r.TagKey = "tag"
+		log.Logger.Info("reset tag_key", zap.String("tag_key", r.TagKey))
+	}
+
+	if r.MsgKey == "" {
+		r.MsgKey = "log"
+		log.Logger.Info("reset msg_key", zap.String("msg_key", r.MsgKey))
+	}
+
+	if r.PathKey == "" {
+		r.PathKey = "path"
+		log.Logger.Info("reset path_key", zap.String("path_key", r.PathKey))
+	}
+
+	if r.InodeKey == "" {
+		r.InodeKey = "inode"
+		log.Logger.Info("reset inode_key", zap.String("inode_key", r.InodeKey))
+	}
+
+	if r.PollInterval <= 0 {
+		r.PollInterval = defaultTailPollInterval
+		log.Logger.Info("reset poll_interval_sec", zap.Duration("poll_interval_sec", r.PollInterval))
+	}
+
+	if r.RotateWait <= 0 {
+		r.RotateWait = defaultTailRotateWait
+		log.Logger.Info("reset rotate_wait_sec", zap.Duration("rotate_wait_sec", r.RotateWait))
+	}
+
+	if r.MaxLineSize <= 0 {
+		r.MaxLineSize = defaultTailMaxLineSize
+		log.Logger.Info("reset max_line_size", zap.Int("max_line_size", r.MaxLineSize))
+	}
+
+	switch r.Format {
+	case TailFormatRaw, TailFormatCRI, TailFormatDocker:
+	case "":
+		r.Format = TailFormatRaw
+		log.Logger.Info("reset format", zap.String("format", r.Format))
+	default:
+		return errors.Errorf("unknown format `%s`", r.Format)
+	}
+
+	return nil
+}
+
+func (r *TailRecv) registerMonitor() {
+	monitor.AddMetric("tailrecv."+r.Name, func() map[string]interface{} {
+		return map[string]interface{}{
+			"linesTotal":     r.lineCounter.Get(),
+			"linesPerSec":    r.lineCounter.GetSpeed(),
+			"rotationTotal":  r.rotateCounter.Get(),
+			"truncatedTotal": r.truncateCounter.Get(),
+		}
+	})
+}
+
+// GetName return the name of this recv
+func (r *TailRecv) GetName() string {
+	return r.Name
+}
+
+// Run starting this recv
+func (r *TailRecv) Run(ctx context.Context) {
+	r.logger.Info("run TailRecv")
+	defer r.logger.Info("tail recv exit")
+	if err := r.loadPositions(); err != nil {
+		r.logger.Error("load pos file", zap.Error(err), zap.String("pos_file", r.PosFile))
+	}
+
+	ticker := time.NewTicker(r.PollInterval)
+	defer ticker.Stop()
+	isReadFromHead := r.IsReadFromHead
+	for {
+		r.scan(isReadFromHead)
+		isReadFromHead = true // files found later are all new files
+		for _, f := range r.files {
+			r.readFile(ctx, f)
+		}
+		if err := r.savePositions(); err != nil {
+			r.logger.Error("save pos file", zap.Error(err), zap.String("pos_file", r.PosFile))
+		}
+
+		select {
+		case <-ctx.Done():
+			for _, f := range r.files {
+				f.close()
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// scan find files match paths, open new files & mark rotated files
+func (r *TailRecv) scan(isReadFromHead bool) {
+	found := map[uint64]string{}
+	for _, pattern := range r.Paths {
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			r.logger.Error("glob", zap.Error(err), zap.String("pattern", pattern))
+			continue
+		}
+
+	PATH_LOOP:
+		for _, fpath := range paths {
+			for _, exclude := range r.ExcludePaths {
+				if matched, _ := filepath.Match(exclude, fpath); matched {
+					continue PATH_LOOP
+				}
+			}
+
+			fi, err := os.Stat(fpath)
+			if err != nil {
+				r.logger.Warn("stat file", zap.Error(err), zap.String("path", fpath))
+				continue
+			}
+			if !fi.Mode().IsRegular() {
+				continue
+			}
+
+			inode := fileInode(fpath, fi)
+			found[inode] = fpath
+			if f, ok := r.files[inode]; ok {
+				if f.path != fpath { // renamed within paths, keep reading
+					r.logger.Info("file renamed", zap.String("from", f.path), zap.String("to", fpath))
+					f.path = fpath
+				}
+				continue
+			}
+
+			if err = r.openFile(fpath, inode, fi, isReadFromHead); err != nil {
+				r.logger.Error("open file", zap.Error(err), zap.String("path", fpath))
+			}
+		}
+	}
+
+	for inode, f := range r.files {
+		if _, ok := found[inode]; !ok && !f.isRotated {
+			r.logger.Info("file rotated", zap.String("path", f.path), zap.Uint64("inode", inode))
+			r.rotateCounter.Count()
+			f.isRotated = true
+			f.rotatedAt = utils.Clock.GetUTCNow()
+		}
+	}
+}
+
+func (r *TailRecv) openFile(fpath string, inode uint64, fi os.FileInfo, isReadFromHead bool) (err error) {
+	f := &tailFile{
+		path:     fpath,
+		inode:    inode,
+		isGzip:   strings.HasSuffix(fpath, ".gz"),
+		k8sMeta:  parseK8sLogFileName(fpath),
+		partials: map[string][]byte{},
+	}
+	f.tag = r.renderTag(fpath, f.k8sMeta)
+	pos, hasPos := r.positions[inode]
+	if hasPos && pos.path != fpath {
+		// inode has been reused by another file since last run
+		r.logger.Info("ignore position of other file",
+			zap.String("path", fpath),
+			zap.String("pos_path", pos.path),
+			zap.Uint64("inode", inode))
+		delete(r.positions, inode)
+		hasPos = false
+	}
+	if f.isGzip && hasPos && pos.offset == tailPosDone {
+		// already read, just track it
+		r.files[inode] = f
+		return nil
+	}
+
+	if f.fp, err = os.Open(fpath); err != nil {
+		return errors.Wrap(err, "open")
+	}
+
+	switch {
+	case f.isGzip:
+	case hasPos:
+		if int64(pos.offset) <= fi.Size() {
+			f.offset = int64(pos.offset)
+		} else {
+			r.logger.Info("file truncated since last run", zap.String("path", fpath))
+		}
+	case !isReadFromHead:
+		f.offset = fi.Size()
+	}
+
+	if f.offset != 0 {
+		if _, err = f.fp.Seek(f.offset, io.SeekStart); err != nil {
+			f.fp.Close()
+			return errors.Wrap(err, "seek")
+		}
+	}
+	f.reader = bufio.NewReaderSize(f.fp, tailReadBufSize)
+
+	r.logger.Info("follow file",
+		zap.String("path", fpath),
+		zap.Uint64("inode", inode),
+		zap.Int64("offset", f.offset),
+		zap.String("tag", f.tag))
+	r.files[inode] = f
+	return nil
+}
+
+// renderTag render tag template by file path & kubernetes metadata
+func (r *TailRecv) renderTag(fpath string, k8sMeta map[string]interface{}) string {
+	if abs, err := filepath.Abs(fpath); err == nil {
+		fpath = abs
+	}
+	basename := filepath.Base(fpath)
+	vars := map[string]interface{}{
+		"path":     fpath,
+		"dir":      filepath.Dir(fpath),
+		"basename": basename,
+		"name":     strings.TrimSuffix(basename, filepath.Ext(basename)),
+		"path_tag": strings.Trim(strings.ReplaceAll(filepath.ToSlash(fpath), "/", "."), "."),
+	}
+	for k, v := range k8sMeta {
+		vars[k] = v
+	}
+	return library.TemplateWithMap(r.Tag, vars)
+}
+
+// readFile read all new lines of file
+func (r *TailRecv) readFile(ctx context.Context, f *tailFile) {
+	if f.fp == nil { // gzip file already read
+		if f.isRotated {
+			delete(r.files, f.inode)
+		}
+		return
+	}
+	if !r.isK8sMetaReady(f) { // do not block other files
+		return
+	}
+
+	if f.isGzip {
+		if err := r.readGzipFile(ctx, f); err != nil {
+			r.logger.Error("read gzip file", zap.Error(err), zap.String("path", f.path))
+		}
+		f.close()
+		if f.isRotated {
+			delete(r.files, f.inode)
+		}
+		return
+	}
+
+	if fi, err := f.fp.Stat(); err != nil {
+		r.logger.Error("stat file", zap.Error(err), zap.String("path", f.path))
+		return
+	} else if fi.Size() < f.offset { // truncated
+		r.logger.Info("file truncated", zap.String("path", f.path), zap.Int64("offset", f.offset))
+		r.truncateCounter.Count()
+		if _, err = f.fp.Seek(0, io.SeekStart); err != nil {
+			r.logger.Error("seek file", zap.Error(err), zap.String("path", f.path))
+			return
+		}
+		f.offset = 0
+		f.pending = f.pending[:0]
+		f.reader.Reset(f.fp)
+	}
+
+	if err := r.readLines(ctx, f, f.reader, true); err != nil && err != io.EOF {
+		r.logger.Error("read file", zap.Error(err), zap.String("path", f.path))
+	}
+
+	if f.isRotated && utils.Clock.GetUTCNow().Sub(f.rotatedAt) >= r.RotateWait {
+		if len(f.pending) != 0 { // flush the last line without newline
+			r.processLine(f, f.pending)
+			f.pending = f.pending[:0]
+		}
+		r.flushPartials(f)
+		r.logger.Info("stop following rotated file", zap.String("path", f.path))
+		f.close()
+		delete(r.files, f.inode)
+	}
+}
+
+func (r *TailRecv) readGzipFile(ctx context.Context, f *tailFile) error {
+	gz, err := gzip.NewReader(f.reader)
+	if err != nil {
+		return errors.Wrap(err, "new gzip reader")
+	}
+	defer gz.Close()
+
+	if err = r.readLines(ctx, f, bufio.NewReaderSize(gz, tailReadBufSize), false); err != nil && err != io.EOF {
+		return err
+	}
+	if len(f.pending) != 0 {
+		r.processLine(f, f.pending)
+		f.pending = f.pending[:0]
+	}
+	r.flushPartials(f)
+
+	r.logger.Info("finished reading gzip file", zap.String("path", f.path))
+	r.positions[f.inode] = &tailPos{path: f.path, offset: tailPosDone}
+	return nil
+}
+
+// readLines emit lines until EOF, incomplete line will be kept in pending.
+func (r *TailRecv) readLines(ctx context.Context, f *tailFile, reader *bufio.Reader, isUpdatePos bool) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		line, err := reader.ReadSlice('\n')
+		f.offset += int64(len(line))
+		switch err {
+		case nil:
+			if len(f.pending) != 0 {
+				f.pending = append(f.pending, line...)
+				line = f.pending
+			}
+			r.processLine(f, line)
+			f.pending = f.pending[:0]
+		case bufio.ErrBufferFull, io.EOF:
+			f.pending = append(f.pending, line...)
+			if len(f.pending) >= r.MaxLineSize {
+				r.logger.Warn("split line since it exceeds max_line_size", zap.String("path", f.path))
+				r.processLine(f, f.pending)
+				f.pending = f.pending[:0]
+			}
+			if err == bufio.ErrBufferFull {
+				continue
+			}
+		}
+
+		if isUpdatePos {
+			r.positions[f.inode] = &tailPos{
+				path:   f.path,
+				offset: uint64(f.offset - int64(len(f.pending))),
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// processLine decode line by format, then emit msg
+func (r *TailRecv) processLine(f *tailFile, line []byte) {
+	line = bytes.TrimRight(line, "\r\n")
+	var (
+		ts        time.Time
+		stream    string
+		isPartial bool
+		content   []byte
+		err       error
+	)
+	switch r.Format {
+	case TailFormatCRI:
+		ts, stream, isPartial, content, err = parseCRILog(line)
+	case TailFormatDocker:
+		ts, stream, isPartial, content, err = parseDockerJSONLog(line)
+	default:
+		r.emit(f, map[string]interface{}{r.MsgKey: string(line)}, utils.Clock.GetUTCNow())
+		return
+	}
+	if err != nil {
+		r.logger.Warn("discard line since cannot decode",
+			zap.Error(err),
+			zap.String("path", f.path),
+			zap.ByteString("line", line))
+		return
+	}
+
+	if isPartial || len(f.partials[stream]) != 0 {
+		f.partials[stream] = append(f.partials[stream], content...)
+		if isPartial && len(f.partials[stream]) < r.MaxLineSize {
+			return
+		}
+		content = f.partials[stream]
+		f.partials[stream] = f.partials[stream][:0]
+	}
+
+	r.emit(f, map[string]interface{}{
+		r.MsgKey: string(content),
+		"stream": stream,
+	}, ts)
+}
+
+// flushPartials emit incomplete container logs
+func (r *TailRecv) flushPartials(f *tailFile) {
+	for stream, content := range f.partials {
+		if len(content) != 0 {
+			r.emit(f, map[string]interface{}{
+				r.MsgKey: string(content),
+				"stream": stream,
+			}, utils.Clock.GetUTCNow())
+		}
+		delete(f.partials, stream)
+	}
+}
+
+// emit put msg into downstream
+func (r *TailRecv) emit(f *tailFile, m map[string]interface{}, ts time.Time) {
+	m[r.TagKey] = f.tag
+	m[r.PathKey] = f.path
+	m[r.InodeKey] = f.inode
+	if f.k8sMeta != nil {
+		r.enrichK8sMeta(f, m)
+	}
+
+	msg := r.msgPool.Get().(*library.FluentMsg)
+	msg.Message = m
+	msg.Tag = f.tag
+	msg.Time = ts
+	msg.ID = r.counter.Count()
+	r.lineCounter.Count()
+	r.logger.Debug("receive new msg", zap.String("tag", msg.Tag), zap.Int64("id", msg.ID))
+	r.syncOutChan <- msg // blockable
+}
+
+// isK8sMetaReady check whether pod metadata of file has been loaded,
+// lines will not be read until metadata is ready.
+func (r *TailRecv) isK8sMetaReady(f *tailFile) bool {
+	if r.k8sClient == nil || f.k8sMeta == nil {
+		return true
+	}
+	_, isReady := r.k8sClient.getPod(f.k8sMeta["namespace"].(string), f.k8sMeta["pod_name"].(string))
+	return isReady
+}
+
+// enrichK8sMeta set container & pod metadata into msg
+func (r *TailRecv) enrichK8sMeta(f *tailFile, m map[string]interface{}) {
+	for k, v := range f.k8sMeta {
+		m[k] = v
+	}
+	if r.k8sClient == nil {
+		return
+	}
+
+	pod, _ := r.k8sClient.getPod(f.k8sMeta["namespace"].(string), f.k8sMeta["pod_name"].(string))
+	if pod == nil {
+		return
+	}
+	m["pod_id"] = pod.uid
+	m["node_name"] = pod.nodeName
+	labels := make(map[string]interface{}, len(pod.labels))
+	for k, v := range pod.labels {
+		labels[k] = v
+	}
+	m["labels"] = labels
+}
+
+func (f *tailFile) close() {
+	if f.fp != nil {
+		f.fp.Close()
+		f.fp = nil
+	}
+}
+
+// loadPositions load offsets from pos file
+func (r *TailRecv) loadPositions() error {
+	if r.PosFile == "" {
+		return nil
+	}
+
+	fp, err := os.Open(r.PosFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "open")
+	}
+	defer fp.Close()
+
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 3 {
+			continue
+		}
+		inode, err := strconv.ParseUint(fields[1], 16, 64)
+		if err != nil {
+			r.logger.Warn("unknown inode in pos file", zap.String("line", scanner.Text()))
+			continue
+		}
+		offset, err := strconv.ParseUint(fields[2], 16, 64)
+		if err != nil {
+			r.logger.Warn("unknown offset in pos file", zap.String("line", scanner.Text()))
+			continue
+		}
+		r.positions[inode] = &tailPos{path: fields[0], offset: offset}
+	}
+
+	return scanner.Err()
+}
+
+// savePositions write offsets of files still exist into pos file
+func (r *TailRecv) savePositions() error {
+	if r.PosFile == "" {
+		return nil
+	}
+
+	buf := &bytes.Buffer{}
+	for inode, pos := range r.positions {
+		if _, ok := r.files[inode]; !ok {
+			delete(r.positions, inode)
+			continue
+		}
+		buf.WriteString(fmt.Sprintf("%s\t%016x\t%016x\n", pos.path, inode, pos.offset))
+	}
+
+	tmpFile := r.PosFile + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, buf.Bytes(), 0644); err != nil {
+		return errors.Wrap(err, "write")
+	}
+	return errors.Wrap(os.Rename(tmpFile, r.PosFile), "rename")
+}
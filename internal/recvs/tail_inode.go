@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package recvs
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileInode return inode of file
+func fileInode(fpath string, fi os.FileInfo) uint64 {
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino)
+	}
+	return 0
+}
@@ -0,0 +1,13 @@
+package recvs
+
+import (
+	"os"
+
+	"github.com/cespare/xxhash"
+)
+
+// fileInode there is no inode on windows, use hash of path instead,
+// so rotation by rename can not be detected.
+func fileInode(fpath string, fi os.FileInfo) uint64 {
+	return xxhash.Sum64String(fpath)
+}
@@ -0,0 +1,198 @@
+package recvs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gofluentd/library"
+)
+
+func appendFile(t *testing.T, fpath, content string) {
+	fp, err := os.OpenFile(fpath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	defer fp.Close()
+	if _, err = fp.WriteString(content); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+}
+
+func loadTailLines(t *testing.T, outChan chan *library.FluentMsg, n int) (lines []string) {
+	for len(lines) < n {
+		select {
+		case msg := <-outChan:
+			lines = append(lines, msg.Message["log"].(string))
+		case <-time.After(2 * time.Second):
+			t.Fatalf("expect %d lines, got %v", n, lines)
+		}
+	}
+
+	select {
+	case msg := <-outChan:
+		t.Fatalf("got unexpected line %v", msg.Message)
+	case <-time.After(100 * time.Millisecond):
+	}
+	return lines
+}
+
+// runTailRecv run TailRecv, `done` will be closed after recv exit
+func runTailRecv(ctx context.Context, cfg *TailRecvCfg) (outChan chan *library.FluentMsg, done chan struct{}) {
+	outChan = make(chan *library.FluentMsg, 1000)
+	done = make(chan struct{})
+	recv := NewTailRecv(cfg)
+	recv.SetCounter(counter)
+	recv.SetMsgPool(msgPool)
+	recv.SetAsyncOutChan(outChan)
+	recv.SetSyncOutChan(outChan)
+	go func() {
+		recv.Run(ctx)
+		close(done)
+	}()
+	return outChan, done
+}
+
+func TestTailRecv(t *testing.T) {
+	var (
+		dir     = t.TempDir()
+		fpath   = filepath.Join(dir, "app.log")
+		posFile = filepath.Join(dir, "pos")
+		cfg     = &TailRecvCfg{
+			Name:           "tail-test",
+			Paths:          []string{filepath.Join(dir, "*.log"), filepath.Join(dir, "*.gz")},
+			PosFile:        posFile,
+			Tag:            "app.${name}",
+			PollInterval:   20 * time.Millisecond,
+			RotateWait:     300 * time.Millisecond,
+			IsReadFromHead: true,
+		}
+	)
+	appendFile(t, fpath, "line1\nline2\nline")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	outChan, done := runTailRecv(ctx, cfg)
+	lines := loadTailLines(t, outChan, 2)
+	if lines[0] != "line1" || lines[1] != "line2" {
+		t.Fatalf("got %v", lines)
+	}
+
+	// complete the partial line
+	appendFile(t, fpath, "3\r\n")
+	msg := <-outChan
+	if msg.Message["log"] != "line3" ||
+		msg.Tag != "app.app" ||
+		msg.Message["path"] != fpath {
+		t.Fatalf("got %+v", msg.Message)
+	}
+
+	// rename rotation, the rest lines of old file should be read
+	appendFile(t, fpath, "line4\n")
+	if err := os.Rename(fpath, fpath+".1"); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	appendFile(t, fpath+".1", "line5\n")
+	appendFile(t, fpath, "new1\n")
+	lines = loadTailLines(t, outChan, 3)
+	// files are read in random order
+	if strings.Join(lines, ",") != "line4,line5,new1" &&
+		strings.Join(lines, ",") != "line4,new1,line5" &&
+		strings.Join(lines, ",") != "new1,line4,line5" {
+		t.Fatalf("got %v", lines)
+	}
+
+	// app still writing to the old fd before reopen
+	appendFile(t, fpath+".1", "line6\n")
+	if lines = loadTailLines(t, outChan, 1); lines[0] != "line6" {
+		t.Fatalf("got %v", lines)
+	}
+	// old file is closed after rotate_wait
+	time.Sleep(cfg.RotateWait)
+	appendFile(t, fpath+".1", "line7\n")
+	loadTailLines(t, outChan, 0)
+
+	// copytruncate
+	if err := os.Truncate(fpath, 0); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	appendFile(t, fpath, "new2\n")
+	if lines = loadTailLines(t, outChan, 1); lines[0] != "new2" {
+		t.Fatalf("got %v", lines)
+	}
+
+	// gzip file should be read once
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	if _, err := gz.Write([]byte("gz1\ngz2")); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	gz.Close()
+	if err := ioutil.WriteFile(filepath.Join(dir, "old.log.gz"), buf.Bytes(), 0644); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	if lines = loadTailLines(t, outChan, 2); lines[0] != "gz1" || lines[1] != "gz2" {
+		t.Fatalf("got %v", lines)
+	}
+
+	// restart from pos file
+	cancel()
+	<-done
+	appendFile(t, fpath, "new3\n")
+	ctx, cancel = context.WithCancel(context.Background())
+	outChan, done = runTailRecv(ctx, cfg)
+	defer func() {
+		cancel()
+		<-done
+	}()
+	if lines = loadTailLines(t, outChan, 1); lines[0] != "new3" {
+		t.Fatalf("got %v", lines)
+	}
+}
+
+func TestTailRecvInodeReused(t *testing.T) {
+	var (
+		dir     = t.TempDir()
+		fpath   = filepath.Join(dir, "app.log")
+		posFile = filepath.Join(dir, "pos")
+		cfg     = &TailRecvCfg{
+			Name:         "tail-inode-test",
+			Paths:        []string{filepath.Join(dir, "*.log")},
+			PosFile:      posFile,
+			Tag:          "app",
+			PollInterval: 20 * time.Millisecond,
+		}
+	)
+	appendFile(t, fpath, "line1\nline2\n")
+	fi, err := os.Stat(fpath)
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+
+	// position of deleted file with the same inode
+	pos := fmt.Sprintf("%s\t%x\t%x\n", filepath.Join(dir, "deleted.log"), fileInode(fpath, fi), 6)
+	if err = ioutil.WriteFile(posFile, []byte(pos), 0644); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	outChan, done := runTailRecv(ctx, cfg)
+	defer func() {
+		cancel()
+		<-done
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// should not resume from the stale offset, but follow the file as a new file
+	appendFile(t, fpath, "line3\n")
+	if lines := loadTailLines(t, outChan, 1); lines[0] != "line3" {
+		t.Fatalf("got %v", lines)
+	}
+}
@@ -2,8 +2,10 @@ package senders
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
+	"os"
 	"sync"
 	"time"
 
@@ -12,6 +14,13 @@ import (
 
 	"github.com/Laisky/go-utils"
 	"github.com/Laisky/zap"
+	"github.com/pkg/errors"
+	"github.com/tinylib/msgp/msgp"
+)
+
+const (
+	fluentdDialTimeout      = 10 * time.Second
+	fluentdHandshakeTimeout = 10 * time.Second
 )
 
 type FluentSenderCfg struct {
@@ -21,11 +30,21 @@ type FluentSenderCfg struct {
 	MaxWait                      time.Duration
 	IsDiscardWhenBlocked         bool
 	ConcatCfg                    map[string]interface{}
+	// IsIntegerTime send time as integer seconds instead of EventTime,
+	// for compatibility with legacy fluentd (< v0.14)
+	IsIntegerTime bool
+
+	// Security enable forward protocol handshake if SharedKey is set
+	Security *library.ForwardSecurityCfg
+	// TLS connect by tls if Enable is set
+	TLS *library.TLSCfg
 }
 
 type FluentSender struct {
 	*BaseSender
 	*FluentSenderCfg
+
+	tlsConfig *tls.Config
 }
 
 func NewFluentSender(cfg *FluentSenderCfg) *FluentSender {
@@ -43,10 +62,69 @@ func NewFluentSender(cfg *FluentSenderCfg) *FluentSender {
 		},
 		FluentSenderCfg: cfg,
 	}
+	if err := s.valid(); err != nil {
+		log.Logger.Panic("config invalid", zap.Error(err))
+	}
 	s.SetSupportedTags(cfg.Tags)
 	return s
 }
 
+func (s *FluentSender) valid() (err error) {
+	if s.Security.IsEnabled() && s.Security.SelfHostname == "" {
+		if s.Security.SelfHostname, err = os.Hostname(); err != nil {
+			return errors.Wrap(err, "load hostname")
+		}
+		log.Logger.Info("reset self_hostname", zap.String("self_hostname", s.Security.SelfHostname))
+	}
+
+	if s.TLS != nil && s.TLS.Enable {
+		if s.TLS.ServerName == "" {
+			if s.TLS.ServerName, _, err = net.SplitHostPort(s.Addr); err != nil {
+				return errors.Wrapf(err, "parse addr `%s`", s.Addr)
+			}
+			log.Logger.Info("reset tls.server_name", zap.String("server_name", s.TLS.ServerName))
+		}
+		if s.tlsConfig, err = library.NewClientTLSConfig(s.TLS); err != nil {
+			return errors.Wrap(err, "load tls config")
+		}
+	}
+
+	return nil
+}
+
+// connect dial to downstream, then process tls & forward handshake if enabled
+func (s *FluentSender) connect() (conn net.Conn, err error) {
+	if conn, err = net.DialTimeout("tcp", s.Addr, fluentdDialTimeout); err != nil {
+		return nil, errors.Wrap(err, "dial")
+	}
+	if err = conn.SetDeadline(time.Now().Add(fluentdHandshakeTimeout)); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "set deadline")
+	}
+
+	if s.tlsConfig != nil {
+		tlsConn := tls.Client(conn, s.tlsConfig)
+		if err = tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, errors.Wrap(err, "tls handshake")
+		}
+		conn = tlsConn
+	}
+
+	if s.Security.IsEnabled() {
+		if err = library.ForwardClientHandshake(conn, msgp.NewReader(conn), s.Security); err != nil {
+			conn.Close()
+			return nil, errors.Wrap(err, "forward handshake")
+		}
+	}
+
+	if err = conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "reset deadline")
+	}
+	return conn, nil
+}
+
 func (s *FluentSender) GetName() string {
 	return s.Name
 }
@@ -122,7 +200,7 @@ func (s *FluentSender) spawnChildSenderForTag(ctx context.Context, tag string, i
 
 RECONNECT: // reconnect to downstream
 	for {
-		if conn, err = net.DialTimeout("tcp", s.Addr, 10*time.Second); err != nil {
+		if conn, err = s.connect(); err != nil {
 			logger.Error("connect to fluentd server",
 				zap.Error(err), zap.String("tag", tag))
 			time.Sleep(time.Second)
@@ -134,6 +212,7 @@ RECONNECT: // reconnect to downstream
 			zap.String("tag", tag))
 
 		encoder = library.NewFluentEncoder(conn) // one encoder for each connection
+		encoder.SetIntegerTime(s.IsIntegerTime)
 	NEW_MSG:
 		for {
 			select {
@@ -0,0 +1,264 @@
+package senders
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"gofluentd/library"
+	"gofluentd/library/log"
+
+	utils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+const (
+	// NATSSubjectTagVar will be replaced by the tag of msg
+	NATSSubjectTagVar = "{tag}"
+
+	defaultNATSPublishTimeout = 5 * time.Second
+	natsSenderRetryWait       = 3 * time.Second
+)
+
+// NATSSenderCfg configuration of NATSSender
+type NATSSenderCfg struct {
+	*library.NATSConnCfg
+	Name string
+	Tags []string
+	// Subject: subject template, `{tag}` will be replaced by tag of msg
+	Subject string
+	// IsJetStream: wait for publish acks of JetStream,
+	// subject should be captured by a stream.
+	IsJetStream bool
+	// PublishTimeout: timeout of flush (core) or publish acks (JetStream)
+	PublishTimeout               time.Duration
+	InChanSize, NFork, BatchSize int
+	MaxWait                      time.Duration
+	IsDiscardWhenBlocked         bool
+}
+
+// NATSSender publish msgs to NATS core or JetStream
+type NATSSender struct {
+	*BaseSender
+	*NATSSenderCfg
+}
+
+// NewNATSSender create new NATSSender
+func NewNATSSender(cfg *NATSSenderCfg) *NATSSender {
+	log.Logger.Info("new nats sender",
+		zap.String("subject", cfg.Subject),
+		zap.Bool("jetstream", cfg.IsJetStream),
+		zap.Strings("tags", cfg.Tags))
+
+	if cfg.NATSConnCfg == nil || len(cfg.Servers) == 0 {
+		log.Logger.Panic("servers should not be empty")
+	}
+	if cfg.Subject == "" {
+		cfg.Subject = NATSSubjectTagVar
+		log.Logger.Info("reset subject", zap.String("subject", cfg.Subject))
+	}
+	if cfg.PublishTimeout <= 0 {
+		cfg.PublishTimeout = defaultNATSPublishTimeout
+		log.Logger.Info("reset publish_timeout_sec", zap.Duration("publish_timeout", cfg.PublishTimeout))
+	}
+
+	s := &NATSSender{
+		BaseSender: &BaseSender{
+			IsDiscardWhenBlocked: cfg.IsDiscardWhenBlocked,
+		},
+		NATSSenderCfg: cfg,
+	}
+	s.SetSupportedTags(cfg.Tags)
+	return s
+}
+
+// GetName get the name of sender
+func (s *NATSSender) GetName() string {
+	return s.Name
+}
+
+// getSubject render subject by tag
+func (s *NATSSender) getSubject(tag string) string {
+	return strings.Replace(s.Subject, NATSSubjectTagVar, tag, -1)
+}
+
+// Spawn connect to NATS & publish msgs in batch
+func (s *NATSSender) Spawn(ctx context.Context) chan<- *library.FluentMsg {
+	log.Logger.Info("SpawnForTag")
+	inChan := make(chan *library.FluentMsg, s.InChanSize)
+
+	for i := 0; i < s.NFork; i++ {
+		go func(i int) {
+			defer log.Logger.Info("nats sender exit",
+				zap.String("name", s.GetName()),
+				zap.Int("i", i))
+			var (
+				ok               bool
+				nRetry           int
+				maxRetry         = 3
+				msg              *library.FluentMsg
+				msgBatch         = make([]*library.FluentMsg, s.BatchSize)
+				msgBatchDelivery []*library.FluentMsg
+				failed           []*library.FluentMsg
+				iBatch           = 0
+				lastT            = time.Unix(0, 0)
+				nc               *nats.Conn
+				js               nats.JetStreamContext
+				err              error
+				ticker           = time.NewTicker(s.MaxWait)
+			)
+			defer ticker.Stop()
+
+			for {
+				if nc, err = library.NewNATSConn(s.Name, s.NATSConnCfg); err == nil {
+					break
+				}
+				log.Logger.Error("connect to nats got error", zap.String("name", s.Name), zap.Error(err))
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(natsSenderRetryWait):
+				}
+			}
+			defer nc.Close()
+			if s.IsJetStream {
+				if js, err = nc.JetStream(nats.PublishAsyncMaxPending(s.BatchSize)); err != nil {
+					log.Logger.Panic("create jetstream context", zap.Error(err))
+				}
+			}
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case msg, ok = <-inChan:
+					if !ok {
+						log.Logger.Info("inChan closed")
+						return
+					}
+					msgBatch[iBatch] = msg
+					iBatch++
+				case <-ticker.C:
+					if iBatch == 0 {
+						continue
+					}
+					msg = msgBatch[iBatch-1]
+				}
+
+				if iBatch < s.BatchSize &&
+					utils.Clock.GetUTCNow().Sub(lastT) < s.MaxWait {
+					continue
+				}
+				lastT = utils.Clock.GetUTCNow()
+				msgBatchDelivery = msgBatch[:iBatch]
+				iBatch = 0
+
+				if utils.Settings.GetBool("dry") {
+					log.Logger.Info("send message to backend",
+						zap.Int("batch", len(msgBatchDelivery)),
+						zap.String("subject", s.getSubject(msg.Tag)))
+					for _, msg = range msgBatchDelivery {
+						s.successedChan <- msg
+					}
+					continue
+				}
+
+				nRetry = 0
+			SEND_MSG:
+				if s.IsJetStream {
+					failed, err = s.publishJetStream(js, msgBatchDelivery)
+				} else {
+					failed, err = s.publishCore(nc, msgBatchDelivery)
+				}
+				if len(failed) != 0 {
+					nRetry++
+					if nRetry > maxRetry {
+						log.Logger.Error("discard msg since of sender err",
+							zap.Error(err),
+							zap.String("tag", msg.Tag),
+							zap.Int("num", len(failed)))
+						for _, msg = range failed {
+							s.failedChan <- msg
+						}
+						continue
+					}
+
+					// only retry failed msgs, the others have been sent
+					msgBatchDelivery = append(msgBatchDelivery[:0], failed...)
+					goto SEND_MSG
+				}
+
+				log.Logger.Debug("success sent messages to nats",
+					zap.Int("batch", len(msgBatchDelivery)),
+					zap.String("tag", msg.Tag))
+			}
+		}(i)
+	}
+
+	return inChan
+}
+
+// publishCore publish msgs then flush, all msgs failed if flush failed
+func (s *NATSSender) publishCore(nc *nats.Conn, msgs []*library.FluentMsg) (failed []*library.FluentMsg, err error) {
+	var jb []byte
+	for _, msg := range msgs {
+		if jb, err = utils.JSON.Marshal(&msg.Message); err != nil {
+			return msgs, errors.Wrap(err, "try to marshal msg got error")
+		}
+		if err = nc.Publish(s.getSubject(msg.Tag), jb); err != nil {
+			return msgs, errors.Wrap(err, "try to publish msg got error")
+		}
+	}
+	if err = nc.FlushTimeout(s.PublishTimeout); err != nil {
+		return msgs, errors.Wrap(err, "try to flush msgs got error")
+	}
+
+	for _, msg := range msgs {
+		s.successedChan <- msg
+	}
+	return nil, nil
+}
+
+// publishJetStream publish msgs asynchronously,
+// each msg is successed only if its publish ack is received.
+func (s *NATSSender) publishJetStream(js nats.JetStreamContext, msgs []*library.FluentMsg) (failed []*library.FluentMsg, err error) {
+	var (
+		jb      []byte
+		futures = make([]nats.PubAckFuture, len(msgs))
+	)
+	for i, msg := range msgs {
+		if jb, err = utils.JSON.Marshal(&msg.Message); err != nil {
+			err = errors.Wrap(err, "try to marshal msg got error")
+			continue
+		}
+		if futures[i], err = js.PublishMsgAsync(&nats.Msg{Subject: s.getSubject(msg.Tag), Data: jb}); err != nil {
+			err = errors.Wrap(err, "try to publish msg got error")
+		}
+	}
+
+	timeout := time.NewTimer(s.PublishTimeout)
+	defer timeout.Stop()
+	for i, msg := range msgs {
+		if futures[i] == nil {
+			failed = append(failed, msg)
+			continue
+		}
+
+		select {
+		case <-futures[i].Ok():
+			s.successedChan <- msg
+		case err = <-futures[i].Err():
+			err = errors.Wrap(err, "publish ack got error")
+			failed = append(failed, msg)
+		case <-timeout.C:
+			// all the rest msgs are timeout
+			err = errors.Errorf("publish ack timeout after %v", s.PublishTimeout)
+			failed = append(failed, msgs[i:]...)
+			return failed, err
+		}
+	}
+
+	return failed, err
+}
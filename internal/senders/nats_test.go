@@ -0,0 +1,124 @@
+package senders
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gofluentd/library"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+func TestNATSSender(t *testing.T) {
+	srv, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      24241,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	go srv.Start()
+	if !srv.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats server not ready")
+	}
+	defer srv.Shutdown()
+
+	connCfg := &library.NATSConnCfg{Servers: []string{srv.ClientURL()}}
+	nc, err := library.NewNATSConn("test", connCfg)
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	defer nc.Close()
+	js, err := nc.JetStream()
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	if _, err = js.AddStream(&nats.StreamConfig{Name: "SENT", Subjects: []string{"sent.>"}}); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	sub, err := nc.SubscribeSync("core.>")
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	spawn := func(subject string, isJetStream bool) (inChan chan<- *library.FluentMsg, successedChan, failedChan chan *library.FluentMsg) {
+		successedChan = make(chan *library.FluentMsg, 100)
+		failedChan = make(chan *library.FluentMsg, 100)
+		s := NewNATSSender(&NATSSenderCfg{
+			NATSConnCfg:    connCfg,
+			Name:           "nats-test",
+			Tags:           []string{"app.sit"},
+			Subject:        subject,
+			IsJetStream:    isJetStream,
+			PublishTimeout: time.Second,
+			InChanSize:     100,
+			NFork:          1,
+			BatchSize:      2,
+			MaxWait:        100 * time.Millisecond,
+		})
+		s.SetSuccessedChan(successedChan)
+		s.SetFailedChan(failedChan)
+		return s.Spawn(ctx), successedChan, failedChan
+	}
+	newMsg := func(id int64) *library.FluentMsg {
+		return &library.FluentMsg{ID: id, Tag: "app.sit", Message: map[string]interface{}{"log": "hello"}}
+	}
+	loadMsg := func(c chan *library.FluentMsg) *library.FluentMsg {
+		select {
+		case msg := <-c:
+			return msg
+		case <-time.After(5 * time.Second):
+			t.Fatal("can not load msg")
+		}
+		return nil
+	}
+
+	// core
+	inChan, successedChan, _ := spawn("core.{tag}", false)
+	inChan <- newMsg(1)
+	inChan <- newMsg(2)
+	for _, id := range []int64{1, 2} {
+		if msg := loadMsg(successedChan); msg.ID != id {
+			t.Fatalf("got %d", msg.ID)
+		}
+		m, err := sub.NextMsg(time.Second)
+		if err != nil {
+			t.Fatalf("got error: %+v", err)
+		}
+		if m.Subject != "core.app.sit" || string(m.Data) != `{"log":"hello"}` {
+			t.Fatalf("got %s, %s", m.Subject, m.Data)
+		}
+	}
+
+	// jetstream
+	inChan, successedChan, _ = spawn("sent.{tag}", true)
+	inChan <- newMsg(3)
+	inChan <- newMsg(4)
+	for _, id := range []int64{3, 4} {
+		if msg := loadMsg(successedChan); msg.ID != id {
+			t.Fatalf("got %d", msg.ID)
+		}
+	}
+	info, err := js.StreamInfo("SENT")
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	if info.State.Msgs != 2 {
+		t.Fatalf("got %d", info.State.Msgs)
+	}
+
+	// jetstream without stream
+	inChan, _, failedChan := spawn("unknown.{tag}", true)
+	inChan <- newMsg(5)
+	if msg := loadMsg(failedChan); msg.ID != 5 {
+		t.Fatalf("got %d", msg.ID)
+	}
+}
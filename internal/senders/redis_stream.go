@@ -0,0 +1,249 @@
+package senders
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"gofluentd/library"
+	"gofluentd/library/log"
+
+	utils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+)
+
+const defaultRedisStreamPayloadKey = "data"
+
+// RedisStreamTarget stream that msgs of tag will be added to
+type RedisStreamTarget struct {
+	Stream string
+	// MaxLen: trim stream by MAXLEN, 0 means sender's default
+	MaxLen int64
+}
+
+// LoadRedisStreamTagMap load tag-stream map from settings,
+// value can be stream name or map with `stream` & `max_len`
+func LoadRedisStreamTagMap(env string, mapi interface{}) map[string]*RedisStreamTarget {
+	tagStreamMap := map[string]*RedisStreamTarget{}
+	for tag, vi := range mapi.(map[string]interface{}) {
+		target := &RedisStreamTarget{}
+		switch v := vi.(type) {
+		case string:
+			target.Stream = v
+		case map[string]interface{}:
+			target.Stream, _ = v["stream"].(string)
+			switch n := v["max_len"].(type) {
+			case int:
+				target.MaxLen = int64(n)
+			case int64:
+				target.MaxLen = n
+			case float64:
+				target.MaxLen = int64(n)
+			}
+		default:
+			log.Logger.Panic("unknown redis stream target", zap.String("tag", tag), zap.String("target", fmt.Sprint(vi)))
+		}
+		target.Stream = strings.Replace(target.Stream, "{env}", env, -1)
+		tagStreamMap[strings.Replace(tag, "{env}", env, -1)] = target
+	}
+
+	return tagStreamMap
+}
+
+// RedisStreamSenderCfg configuration of RedisStreamSender
+type RedisStreamSenderCfg struct {
+	*library.RedisConnCfg
+	Name string
+	Tags []string
+	// TagStreamMap: each tag in Tags should be mapped to a stream
+	TagStreamMap map[string]*RedisStreamTarget
+	// MaxLen: default MAXLEN of streams, 0 means no trimming
+	MaxLen int64
+	// IsExactMaxLen: trim by `MAXLEN n` rather than `MAXLEN ~ n`,
+	// exact trimming is much more expensive.
+	IsExactMaxLen bool
+	// PayloadKey: field of entry to store the JSON of msg
+	PayloadKey                   string
+	InChanSize, NFork, BatchSize int
+	MaxWait                      time.Duration
+	IsDiscardWhenBlocked         bool
+}
+
+// RedisStreamSender add msgs into redis streams by pipelined XADD
+type RedisStreamSender struct {
+	*BaseSender
+	*RedisStreamSenderCfg
+	client *redis.Client
+}
+
+// NewRedisStreamSender create new RedisStreamSender
+func NewRedisStreamSender(cfg *RedisStreamSenderCfg) *RedisStreamSender {
+	log.Logger.Info("new redis stream sender",
+		zap.String("name", cfg.Name),
+		zap.Strings("tags", cfg.Tags))
+
+	if cfg.RedisConnCfg == nil {
+		log.Logger.Panic("addr should not be empty")
+	}
+	client, err := library.NewRedisClient(cfg.RedisConnCfg)
+	if err != nil {
+		log.Logger.Panic("new redis client", zap.Error(err))
+	}
+	for _, tag := range cfg.Tags {
+		if target, ok := cfg.TagStreamMap[tag]; !ok || target.Stream == "" {
+			log.Logger.Panic("tag should be mapped to stream", zap.String("tag", tag))
+		}
+	}
+	if cfg.PayloadKey == "" {
+		cfg.PayloadKey = defaultRedisStreamPayloadKey
+		log.Logger.Info("reset payload_key", zap.String("payload_key", cfg.PayloadKey))
+	}
+
+	s := &RedisStreamSender{
+		BaseSender: &BaseSender{
+			IsDiscardWhenBlocked: cfg.IsDiscardWhenBlocked,
+		},
+		RedisStreamSenderCfg: cfg,
+		client:               client,
+	}
+	s.SetSupportedTags(cfg.Tags)
+	return s
+}
+
+// GetName get the name of sender
+func (s *RedisStreamSender) GetName() string {
+	return s.Name
+}
+
+// Spawn add msgs into streams in batch
+func (s *RedisStreamSender) Spawn(ctx context.Context) chan<- *library.FluentMsg {
+	log.Logger.Info("SpawnForTag")
+	inChan := make(chan *library.FluentMsg, s.InChanSize)
+
+	for i := 0; i < s.NFork; i++ {
+		go func(i int) {
+			defer log.Logger.Info("redis stream sender exit",
+				zap.String("name", s.GetName()),
+				zap.Int("i", i))
+			var (
+				ok               bool
+				nRetry           int
+				maxRetry         = 3
+				msg              *library.FluentMsg
+				msgBatch         = make([]*library.FluentMsg, s.BatchSize)
+				msgBatchDelivery []*library.FluentMsg
+				failed           []*library.FluentMsg
+				iBatch           = 0
+				lastT            = time.Unix(0, 0)
+				err              error
+				ticker           = time.NewTicker(s.MaxWait)
+			)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case msg, ok = <-inChan:
+					if !ok {
+						log.Logger.Info("inChan closed")
+						return
+					}
+					msgBatch[iBatch] = msg
+					iBatch++
+				case <-ticker.C:
+					if iBatch == 0 {
+						continue
+					}
+					msg = msgBatch[iBatch-1]
+				}
+
+				if iBatch < s.BatchSize &&
+					utils.Clock.GetUTCNow().Sub(lastT) < s.MaxWait {
+					continue
+				}
+				lastT = utils.Clock.GetUTCNow()
+				msgBatchDelivery = msgBatch[:iBatch]
+				iBatch = 0
+
+				if utils.Settings.GetBool("dry") {
+					log.Logger.Info("send message to backend",
+						zap.Int("batch", len(msgBatchDelivery)),
+						zap.String("stream", s.TagStreamMap[msg.Tag].Stream))
+					for _, msg = range msgBatchDelivery {
+						s.successedChan <- msg
+					}
+					continue
+				}
+
+				nRetry = 0
+			SEND_MSG:
+				if failed, err = s.xadd(ctx, msgBatchDelivery); len(failed) != 0 {
+					nRetry++
+					if nRetry > maxRetry {
+						log.Logger.Error("discard msg since of sender err",
+							zap.Error(err),
+							zap.String("tag", msg.Tag),
+							zap.Int("num", len(failed)))
+						for _, msg = range failed {
+							s.failedChan <- msg
+						}
+						continue
+					}
+
+					// only retry failed msgs, the others have been sent
+					msgBatchDelivery = append(msgBatchDelivery[:0], failed...)
+					goto SEND_MSG
+				}
+
+				log.Logger.Debug("success sent messages to redis stream",
+					zap.Int("batch", len(msgBatchDelivery)),
+					zap.String("tag", msg.Tag))
+			}
+		}(i)
+	}
+
+	return inChan
+}
+
+// xadd add msgs by pipeline, each msg is successed only if its XADD succeeded
+func (s *RedisStreamSender) xadd(ctx context.Context, msgs []*library.FluentMsg) (failed []*library.FluentMsg, err error) {
+	var (
+		jb   []byte
+		pipe = s.client.Pipeline()
+		cmds = make([]*redis.StringCmd, len(msgs))
+	)
+	for i, msg := range msgs {
+		if jb, err = utils.JSON.Marshal(&msg.Message); err != nil {
+			err = errors.Wrap(err, "try to marshal msg got error")
+			continue
+		}
+
+		target := s.TagStreamMap[msg.Tag]
+		args := &redis.XAddArgs{
+			Stream: target.Stream,
+			MaxLen: s.MaxLen,
+			Approx: !s.IsExactMaxLen,
+			Values: map[string]interface{}{s.PayloadKey: jb},
+		}
+		if target.MaxLen > 0 {
+			args.MaxLen = target.MaxLen
+		}
+		cmds[i] = pipe.XAdd(ctx, args)
+	}
+	if _, pipeErr := pipe.Exec(ctx); pipeErr != nil {
+		err = errors.Wrap(pipeErr, "try to exec pipeline got error")
+	}
+
+	for i, msg := range msgs {
+		if cmds[i] == nil || cmds[i].Err() != nil {
+			failed = append(failed, msg)
+			continue
+		}
+		s.successedChan <- msg
+	}
+	return failed, err
+}
@@ -0,0 +1,84 @@
+package senders
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gofluentd/library"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+func TestLoadRedisStreamTagMap(t *testing.T) {
+	m := LoadRedisStreamTagMap("sit", map[string]interface{}{
+		"app.{env}": "logs.{env}",
+		"pay.{env}": map[string]interface{}{"stream": "pay", "max_len": 100},
+	})
+	if m["app.sit"].Stream != "logs.sit" || m["app.sit"].MaxLen != 0 {
+		t.Fatalf("got %+v", m["app.sit"])
+	}
+	if m["pay.sit"].Stream != "pay" || m["pay.sit"].MaxLen != 100 {
+		t.Fatalf("got %+v", m["pay.sit"])
+	}
+}
+
+func TestRedisStreamSender(t *testing.T) {
+	srv := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: srv.Addr()})
+	defer client.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	successedChan := make(chan *library.FluentMsg, 100)
+	failedChan := make(chan *library.FluentMsg, 100)
+	s := NewRedisStreamSender(&RedisStreamSenderCfg{
+		RedisConnCfg: &library.RedisConnCfg{Addr: srv.Addr()},
+		Name:         "redis-stream-test",
+		Tags:         []string{"app.sit", "pay.sit"},
+		TagStreamMap: map[string]*RedisStreamTarget{
+			"app.sit": {Stream: "logs"},
+			"pay.sit": {Stream: "pay", MaxLen: 2},
+		},
+		MaxLen:        100,
+		IsExactMaxLen: true,
+		InChanSize:    100,
+		NFork:         1,
+		BatchSize:     5,
+		MaxWait:       100 * time.Millisecond,
+	})
+	s.SetSuccessedChan(successedChan)
+	s.SetFailedChan(failedChan)
+	inChan := s.Spawn(ctx)
+
+	for i, tag := range []string{"app.sit", "pay.sit", "pay.sit", "pay.sit", "app.sit"} {
+		inChan <- &library.FluentMsg{ID: int64(i), Tag: tag, Message: map[string]interface{}{"log": "hello"}}
+	}
+	for i := 0; i < 5; i++ {
+		select {
+		case <-successedChan:
+		case msg := <-failedChan:
+			t.Fatalf("got failed msg %+v", msg)
+		case <-time.After(5 * time.Second):
+			t.Fatal("can not load msg")
+		}
+	}
+
+	for stream, expect := range map[string]int64{"logs": 2, "pay": 2} {
+		n, err := client.XLen(ctx, stream).Result()
+		if err != nil {
+			t.Fatalf("got error: %+v", err)
+		}
+		if n != expect {
+			t.Fatalf("got %d", n)
+		}
+	}
+	entries, err := client.XRange(ctx, "logs", "-", "+").Result()
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	if entries[0].Values["data"] != `{"log":"hello"}` {
+		t.Fatalf("got %+v", entries[0].Values)
+	}
+}
@@ -22,6 +22,9 @@ func (cf *ParserFact) StartNewParser(ctx context.Context, outChan chan<- *librar
 		msg *library.FluentMsg
 		v   string
 		t   time.Time
+
+		// isEventTime use `msg.Time` if TimeKey not exists
+		isEventTime bool
 	)
 	for {
 		select {
@@ -119,6 +122,7 @@ func (cf *ParserFact) StartNewParser(ctx context.Context, outChan chan<- *librar
 
 		// parse time
 		if cf.TimeKey != "" {
+			isEventTime = false
 			switch ts := msg.Message[cf.TimeKey].(type) {
 			case []byte:
 				if cf.AppendTimeZone != "" {
@@ -133,6 +137,11 @@ func (cf *ParserFact) StartNewParser(ctx context.Context, outChan chan<- *librar
 					v = ts
 				}
 			default:
+				if ts == nil && !msg.Time.IsZero() {
+					// fallback to event time
+					isEventTime = true
+					break
+				}
 				log.Logger.Warn("discard since unknown time format",
 					zap.Error(err),
 					zap.String("ts", fmt.Sprint(msg.Message[cf.TimeKey])),
@@ -144,17 +153,22 @@ func (cf *ParserFact) StartNewParser(ctx context.Context, outChan chan<- *librar
 				continue
 			}
 
-			v = strings.Replace(v, ",", ".", -1)
-			if t, err = time.Parse(cf.TimeFormat, v); err != nil {
-				log.Logger.Warn("discard since parse time got error",
-					zap.Error(err),
-					zap.String("ts", v),
-					zap.String("tag", msg.Tag),
-					zap.String("time_key", cf.TimeKey),
-					zap.String("time_format", cf.TimeFormat),
-					zap.String("append_time_zone", cf.AppendTimeZone))
-				cf.DiscardMsg(msg)
-				continue
+			if isEventTime {
+				t = msg.Time
+			} else {
+				v = strings.Replace(v, ",", ".", -1)
+				if t, err = time.Parse(cf.TimeFormat, v); err != nil {
+					log.Logger.Warn("discard since parse time got error",
+						zap.Error(err),
+						zap.String("ts", v),
+						zap.String("tag", msg.Tag),
+						zap.String("time_key", cf.TimeKey),
+						zap.String("time_format", cf.TimeFormat),
+						zap.String("append_time_zone", cf.AppendTimeZone))
+					cf.DiscardMsg(msg)
+					continue
+				}
+				msg.Time = t.UTC()
 			}
 
 			if !cf.ReservedTimeKey {
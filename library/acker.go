@@ -0,0 +1,39 @@
+package library
+
+import "sync/atomic"
+
+// CountAcker is done after all msgs attached to it are acked,
+// can be used by recvs to ack a batch of msgs at once.
+//
+// CountAcker is held by its creator after created,
+// creator should release the hold by `Ack` after all msgs attached.
+type CountAcker struct {
+	n    int64
+	done chan struct{}
+}
+
+// NewCountAcker create CountAcker held by creator
+func NewCountAcker() *CountAcker {
+	return &CountAcker{
+		n:    1,
+		done: make(chan struct{}),
+	}
+}
+
+// Attach bind acker to msg
+func (a *CountAcker) Attach(msg *FluentMsg) {
+	atomic.AddInt64(&a.n, 1)
+	msg.Ackers = []AckerItf{a}
+}
+
+// Ack implement AckerItf
+func (a *CountAcker) Ack() {
+	if atomic.AddInt64(&a.n, -1) == 0 {
+		close(a.done)
+	}
+}
+
+// Done closed after all attached msgs acked and the hold of creator released
+func (a *CountAcker) Done() <-chan struct{} {
+	return a.done
+}
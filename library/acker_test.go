@@ -0,0 +1,29 @@
+package library
+
+import "testing"
+
+func TestCountAcker(t *testing.T) {
+	a := NewCountAcker()
+	msgs := []*FluentMsg{{}, {}}
+	for _, msg := range msgs {
+		a.Attach(msg)
+	}
+	a.Ack() // release the hold by creator
+
+	isDone := func() bool {
+		select {
+		case <-a.Done():
+			return true
+		default:
+			return false
+		}
+	}
+	msgs[0].Ack()
+	if isDone() {
+		t.Fatal("should not done before all msgs acked")
+	}
+	msgs[1].Ack()
+	if !isDone() {
+		t.Fatal("should done after all msgs acked")
+	}
+}
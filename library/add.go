@@ -20,6 +20,8 @@ const (
 	variableNow = "@now"
 	// variableNowUnix generate unix epoch in string
 	variableNowUnix = "@unix"
+	// variableEventTime event time of msg in RFC3339Nano, empty if unknown
+	variableEventTime = "@time"
 	// variableLower `%{@lower:<key>}` convert value of key to lowercase
 	variableLower = "@lower"
 	// variableUpper `%{@upper:<key>}` convert value of key to uppercase
@@ -55,6 +57,7 @@ type AddCfg map[string][]map[string]interface{}
 //   * `%{@str}`           ->    `<random_string>`
 //   * `%{@now}`           ->    `2006-01-02T15:04:05Z07:00`
 //   * `%{@unix}`          ->    `1590722923`
+//   * `%{@time}`          ->    `2006-01-02T15:04:05.999999999Z07:00`
 //   * `%{@lower:key}`     ->    `xxxx`
 //   * `%{@upper:key}`     ->    `XXXX`
 func ReplaceStrByMsg(msg *FluentMsg, v string) string {
@@ -94,6 +97,12 @@ func ReplaceStrByMsg(msg *FluentMsg, v string) string {
 			newVal = utils.Clock.GetUTCNow().Format(time.RFC3339)
 		case variableNowUnix:
 			newVal = utils.Clock.GetUTCNow().Unix()
+		case variableEventTime:
+			if msg.Time.IsZero() {
+				newVal = ""
+			} else {
+				newVal = msg.Time.UTC().Format(time.RFC3339Nano)
+			}
 		default:
 			cmds = strings.Split(key, ":")
 			if len(cmds) == 2 {
@@ -3,6 +3,7 @@ package library
 import (
 	"reflect"
 	"testing"
+	"time"
 )
 
 func Test_replaceByKey(t *testing.T) {
@@ -46,6 +47,10 @@ func Test_replaceByKey(t *testing.T) {
 		ID:  123,
 		Tag: "test",
 	}
+	msgWithTime := &FluentMsg{
+		Message: map[string]interface{}{},
+		Time:    time.Date(2020, 1, 2, 3, 4, 5, 123456789, time.UTC),
+	}
 
 	tests := []struct {
 		name string
@@ -75,6 +80,8 @@ func Test_replaceByKey(t *testing.T) {
 		{"20", args{msgArg, "%{float}"}, "1.21"},
 		{"21", args{msgArg, "%{@tag}"}, "test"},
 		{"22", args{msgArg, "%{@id}"}, "123"},
+		{"23", args{msgArg, "%{@time}"}, ""},
+		{"24", args{msgWithTime, "%{@time}"}, "2020-01-02T03:04:05.123456789Z"},
 	}
 	for _, tt := range tests {
 		if got := ReplaceStrByMsg(tt.args.msg, tt.args.v); got != tt.want {
@@ -1,13 +1,38 @@
 package library
 
+import "time"
+
 //go:generate msgp
 
 // FluentMsg is the structure of fluent message
 type FluentMsg struct {
 	Tag     string
 	Message map[string]interface{}
-	ID      int64
+	ID      int64 `msg:"Id"` // keep wire name of journal files
 	ExtIds  []int64
+	// Time is the event time of msg, zero means unknown
+	Time time.Time
+	// Ackers will be notified after msg has been persisted into journal
+	Ackers []AckerItf `msg:"-"`
+	// CommitAckers will be notified after msg has been committed into journal,
+	// means msg has been sent by all senders or discarded by filters
+	CommitAckers []AckerItf `msg:"-"`
 }
 
 type FluentBatchMsg []interface{}
+
+// Ack notify all ackers of msg, then clean ackers
+func (m *FluentMsg) Ack() {
+	for _, acker := range m.Ackers {
+		acker.Ack()
+	}
+	m.Ackers = nil
+}
+
+// AckCommit notify all commit ackers of msg, then clean commit ackers
+func (m *FluentMsg) AckCommit() {
+	for _, acker := range m.CommitAckers {
+		acker.Ack()
+	}
+	m.CommitAckers = nil
+}
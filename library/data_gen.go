@@ -150,7 +150,7 @@ func (z *FluentMsg) DecodeMsg(dc *msgp.Reader) (err error) {
 		case "Id":
 			z.ID, err = dc.ReadInt64()
 			if err != nil {
-				err = msgp.WrapError(err, "Id")
+				err = msgp.WrapError(err, "ID")
 				return
 			}
 		case "ExtIds":
@@ -172,6 +172,12 @@ func (z *FluentMsg) DecodeMsg(dc *msgp.Reader) (err error) {
 					return
 				}
 			}
+		case "Time":
+			z.Time, err = dc.ReadTime()
+			if err != nil {
+				err = msgp.WrapError(err, "Time")
+				return
+			}
 		default:
 			err = dc.Skip()
 			if err != nil {
@@ -185,9 +191,9 @@ func (z *FluentMsg) DecodeMsg(dc *msgp.Reader) (err error) {
 
 // EncodeMsg implements msgp.Encodable
 func (z *FluentMsg) EncodeMsg(en *msgp.Writer) (err error) {
-	// map header, size 4
+	// map header, size 5
 	// write "Tag"
-	err = en.Append(0x84, 0xa3, 0x54, 0x61, 0x67)
+	err = en.Append(0x85, 0xa3, 0x54, 0x61, 0x67)
 	if err != nil {
 		return
 	}
@@ -225,7 +231,7 @@ func (z *FluentMsg) EncodeMsg(en *msgp.Writer) (err error) {
 	}
 	err = en.WriteInt64(z.ID)
 	if err != nil {
-		err = msgp.WrapError(err, "Id")
+		err = msgp.WrapError(err, "ID")
 		return
 	}
 	// write "ExtIds"
@@ -245,15 +251,25 @@ func (z *FluentMsg) EncodeMsg(en *msgp.Writer) (err error) {
 			return
 		}
 	}
+	// write "Time"
+	err = en.Append(0xa4, 0x54, 0x69, 0x6d, 0x65)
+	if err != nil {
+		return
+	}
+	err = en.WriteTime(z.Time)
+	if err != nil {
+		err = msgp.WrapError(err, "Time")
+		return
+	}
 	return
 }
 
 // MarshalMsg implements msgp.Marshaler
 func (z *FluentMsg) MarshalMsg(b []byte) (o []byte, err error) {
 	o = msgp.Require(b, z.Msgsize())
-	// map header, size 4
+	// map header, size 5
 	// string "Tag"
-	o = append(o, 0x84, 0xa3, 0x54, 0x61, 0x67)
+	o = append(o, 0x85, 0xa3, 0x54, 0x61, 0x67)
 	o = msgp.AppendString(o, z.Tag)
 	// string "Message"
 	o = append(o, 0xa7, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65)
@@ -275,6 +291,9 @@ func (z *FluentMsg) MarshalMsg(b []byte) (o []byte, err error) {
 	for za0003 := range z.ExtIds {
 		o = msgp.AppendInt64(o, z.ExtIds[za0003])
 	}
+	// string "Time"
+	o = append(o, 0xa4, 0x54, 0x69, 0x6d, 0x65)
+	o = msgp.AppendTime(o, z.Time)
 	return
 }
 
@@ -335,7 +354,7 @@ func (z *FluentMsg) UnmarshalMsg(bts []byte) (o []byte, err error) {
 		case "Id":
 			z.ID, bts, err = msgp.ReadInt64Bytes(bts)
 			if err != nil {
-				err = msgp.WrapError(err, "Id")
+				err = msgp.WrapError(err, "ID")
 				return
 			}
 		case "ExtIds":
@@ -357,6 +376,12 @@ func (z *FluentMsg) UnmarshalMsg(bts []byte) (o []byte, err error) {
 					return
 				}
 			}
+		case "Time":
+			z.Time, bts, err = msgp.ReadTimeBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Time")
+				return
+			}
 		default:
 			bts, err = msgp.Skip(bts)
 			if err != nil {
@@ -378,6 +403,6 @@ func (z *FluentMsg) Msgsize() (s int) {
 			s += msgp.StringPrefixSize + len(za0001) + msgp.GuessSize(za0002)
 		}
 	}
-	s += 3 + msgp.Int64Size + 7 + msgp.ArrayHeaderSize + (len(z.ExtIds) * (msgp.Int64Size))
+	s += 3 + msgp.Int64Size + 7 + msgp.ArrayHeaderSize + (len(z.ExtIds) * (msgp.Int64Size)) + 5 + msgp.TimeSize
 	return
 }
@@ -2,13 +2,23 @@ package library
 
 import (
 	"bytes"
+	"encoding/binary"
+	"fmt"
 	"io"
 	"sync"
+	"time"
 
+	"github.com/Laisky/go-utils"
 	"github.com/tinylib/msgp/msgp"
 )
 
-const BufByte = 1024 * 1024 * 4
+const (
+	BufByte = 1024 * 1024 * 4
+
+	// EventTimeExtType is the msgpack ext type of fluentd EventTime
+	EventTimeExtType = 0
+	eventTimeExtLen  = 8
+)
 
 var fluentdWrapMsgPool = &sync.Pool{
 	New: func() interface{} {
@@ -16,6 +26,93 @@ var fluentdWrapMsgPool = &sync.Pool{
 	},
 }
 
+func init() {
+	msgp.RegisterExtension(EventTimeExtType, func() msgp.Extension {
+		return new(EventTime)
+	})
+}
+
+// EventTime is the fluentd forward protocol time with nanosecond precision,
+// encoded as msgpack ext type 0 with seconds & nanoseconds in uint32 big-endian.
+type EventTime struct {
+	time.Time
+}
+
+// ExtensionType implement msgp.Extension
+func (t *EventTime) ExtensionType() int8 {
+	return EventTimeExtType
+}
+
+// Len implement msgp.Extension
+func (t *EventTime) Len() int {
+	return eventTimeExtLen
+}
+
+// MarshalBinaryTo implement msgp.Extension
+func (t *EventTime) MarshalBinaryTo(b []byte) error {
+	binary.BigEndian.PutUint32(b, uint32(t.Unix()))
+	binary.BigEndian.PutUint32(b[4:], uint32(t.Nanosecond()))
+	return nil
+}
+
+// UnmarshalBinary implement msgp.Extension
+func (t *EventTime) UnmarshalBinary(b []byte) error {
+	if len(b) != eventTimeExtLen {
+		return fmt.Errorf("EventTime should be %d bytes, got %d", eventTimeExtLen, len(b))
+	}
+
+	t.Time = time.Unix(int64(binary.BigEndian.Uint32(b)), int64(binary.BigEndian.Uint32(b[4:]))).UTC()
+	return nil
+}
+
+// ParseFluentTime parse the time of fluentd entry,
+// support integer(unix seconds), float and EventTime.
+//
+// time `0` is regarded as unknown and return zero time.
+func ParseFluentTime(ts interface{}) (t time.Time, ok bool) {
+	var sec, nsec int64
+	switch ts := ts.(type) {
+	case *EventTime:
+		return ts.Time, true
+	case EventTime:
+		return ts.Time, true
+	case int64:
+		sec = ts
+	case uint64:
+		sec = int64(ts)
+	case int:
+		sec = int64(ts)
+	case uint32:
+		sec = int64(ts)
+	case float64:
+		sec = int64(ts)
+		nsec = int64((ts - float64(sec)) * 1e9)
+	default:
+		return time.Time{}, false
+	}
+
+	if sec == 0 && nsec == 0 {
+		return time.Time{}, true
+	}
+
+	return time.Unix(sec, nsec).UTC(), true
+}
+
+// newFluentTime return the time to encode for msg,
+// use current time if msg do not have event time.
+func newFluentTime(msg *FluentMsg, isIntegerTime bool) interface{} {
+	t := msg.Time
+	if t.IsZero() {
+		t = utils.Clock.GetUTCNow()
+	}
+
+	if isIntegerTime {
+		return t.Unix()
+	}
+
+	return &EventTime{Time: t}
+}
+
 type TinyFluentRecord struct {
 	Timestamp uint64
 	Data      map[string]interface{}
@@ -25,6 +122,9 @@ type FluentEncoder struct {
 	wrap, batchWrap FluentBatchMsg
 	writer          *msgp.Writer
 	msgBuf          *bytes.Buffer
+	// isIntegerTime encode time in unix seconds instead of EventTime,
+	// for legacy fluentd(< v0.14) that do not support EventTime.
+	isIntegerTime bool
 }
 
 func NewFluentEncoder(writer io.Writer) *FluentEncoder {
@@ -41,8 +141,14 @@ func NewFluentEncoder(writer io.Writer) *FluentEncoder {
 	return enc
 }
 
+// SetIntegerTime encode time in unix seconds instead of EventTime
+func (e *FluentEncoder) SetIntegerTime(isIntegerTime bool) {
+	e.isIntegerTime = isIntegerTime
+}
+
 func (e *FluentEncoder) Encode(msg *FluentMsg) error {
 	e.wrap[0] = msg.Tag
+	e.wrap[1].([]interface{})[0].([]interface{})[0] = newFluentTime(msg, e.isIntegerTime)
 	e.wrap[1].([]interface{})[0].([]interface{})[1] = msg.Message
 	return e.wrap.EncodeMsg(e.writer)
 }
@@ -52,6 +158,7 @@ func (e *FluentEncoder) EncodeBatch(tag string, msgBatch []*FluentMsg) (err erro
 	var tmpWrap []interface{}
 	for _, tmpMsg := range msgBatch {
 		tmpWrap = *fluentdWrapMsgPool.Get().(*[]interface{})
+		tmpWrap[0] = newFluentTime(tmpMsg, e.isIntegerTime)
 		tmpWrap[1] = tmpMsg.Message
 		e.batchWrap[1] = append(e.batchWrap[1].([]interface{}), tmpWrap)
 	}
@@ -0,0 +1,79 @@
+package library
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+func TestFluentEncoderEventTime(t *testing.T) {
+	var (
+		buf = &bytes.Buffer{}
+		enc = NewFluentEncoder(buf)
+		ts  = time.Date(2020, 1, 2, 3, 4, 5, 123456789, time.UTC)
+		msg = &FluentMsg{
+			Tag:     "test",
+			Message: map[string]interface{}{"log": "abc"},
+			Time:    ts,
+		}
+	)
+	if err := enc.Encode(msg); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err := enc.Flush(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	v, err := msgp.NewReader(buf).ReadIntf()
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	entry := v.([]interface{})[1].([]interface{})[0].([]interface{})
+	got, ok := ParseFluentTime(entry[0])
+	if !ok {
+		t.Fatalf("unknown time type %T", entry[0])
+	}
+	if !got.Equal(ts) {
+		t.Fatalf("expect %v, got %v", ts, got)
+	}
+
+	// legacy integer time
+	enc.SetIntegerTime(true)
+	if err = enc.EncodeBatch("test", []*FluentMsg{msg}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = enc.Flush(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if v, err = msgp.NewReader(buf).ReadIntf(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	entry = v.([]interface{})[1].([]interface{})[0].([]interface{})
+	if _, ok = entry[0].(int64); !ok {
+		t.Fatalf("expect int64, got %T", entry[0])
+	}
+	if got, _ = ParseFluentTime(entry[0]); !got.Equal(ts.Truncate(time.Second)) {
+		t.Fatalf("expect %v, got %v", ts.Truncate(time.Second), got)
+	}
+}
+
+func TestParseFluentTime(t *testing.T) {
+	for _, tc := range []struct {
+		ts     interface{}
+		expect time.Time
+		ok     bool
+	}{
+		{int64(1577934245), time.Unix(1577934245, 0).UTC(), true},
+		{uint64(1577934245), time.Unix(1577934245, 0).UTC(), true},
+		{int64(0), time.Time{}, true},
+		{&EventTime{time.Unix(1577934245, 5).UTC()}, time.Unix(1577934245, 5).UTC(), true},
+		{"2020", time.Time{}, false},
+	} {
+		got, ok := ParseFluentTime(tc.ts)
+		if ok != tc.ok || !got.Equal(tc.expect) {
+			t.Fatalf("parse %v, expect %v(%v), got %v(%v)", tc.ts, tc.expect, tc.ok, got, ok)
+		}
+	}
+}
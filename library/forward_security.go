@@ -0,0 +1,211 @@
+package library
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/hex"
+	"io"
+
+	"github.com/pkg/errors"
+	"github.com/tinylib/msgp/msgp"
+)
+
+const (
+	forwardSaltLen = 16
+)
+
+// ForwardSecurityCfg configuration of fluentd forward protocol handshake,
+// see https://github.com/fluent/fluentd/wiki/Forward-Protocol-Specification-v1#handshake-messages
+//
+//   server -> client: ["HELO", {"nonce": <nonce>, "auth": <auth_salt>, "keepalive": true}]
+//   client -> server: ["PING", <hostname>, <shared_key_salt>, <shared_key_digest>, <username>, <password_digest>]
+//   server -> client: ["PONG", <auth_result>, <reason>, <hostname>, <shared_key_digest>]
+type ForwardSecurityCfg struct {
+	// SharedKey enable handshake if not empty
+	SharedKey,
+	// SelfHostname hostname sent to peer
+	SelfHostname string
+
+	// Users username -> password, only for server side,
+	// client should provide username & password if not empty
+	Users map[string]string
+
+	// Username & Password, only for client side
+	Username, Password string
+}
+
+// IsEnabled whether handshake should be processed
+func (c *ForwardSecurityCfg) IsEnabled() bool {
+	return c != nil && c.SharedKey != ""
+}
+
+// ForwardServerHandshake process handshake from server side,
+// reader should be the reader that later used to decode msgs from the same connection.
+func ForwardServerHandshake(conn io.Writer, reader *msgp.Reader, cfg *ForwardSecurityCfg) (err error) {
+	var (
+		nonce, authSalt []byte
+		auth            interface{} = ""
+	)
+	if nonce, err = randomSalt(); err != nil {
+		return err
+	}
+	if len(cfg.Users) != 0 {
+		if authSalt, err = randomSalt(); err != nil {
+			return err
+		}
+		auth = authSalt
+	}
+
+	if err = writeForwardMsg(conn, []interface{}{
+		"HELO",
+		map[string]interface{}{
+			"nonce":     nonce,
+			"auth":      auth,
+			"keepalive": true,
+		},
+	}); err != nil {
+		return errors.Wrap(err, "send HELO")
+	}
+
+	ping, err := readForwardMsg(reader, "PING", 6)
+	if err != nil {
+		return err
+	}
+	var (
+		hostname   = forwardMsgBytes(ping[1])
+		salt       = forwardMsgBytes(ping[2])
+		username   = forwardMsgBytes(ping[4])
+		reason     string
+		pongDigest string
+	)
+	if !isForwardDigestEqual(forwardMsgBytes(ping[3]), forwardDigest(salt, hostname, nonce, []byte(cfg.SharedKey))) {
+		reason = "shared_key mismatch"
+	} else if len(cfg.Users) != 0 {
+		if password, ok := cfg.Users[string(username)]; !ok ||
+			!isForwardDigestEqual(forwardMsgBytes(ping[5]), forwardDigest(authSalt, username, []byte(password))) {
+			reason = "username/password mismatch"
+		}
+	}
+	if reason == "" {
+		pongDigest = forwardDigest(salt, []byte(cfg.SelfHostname), nonce, []byte(cfg.SharedKey))
+	}
+
+	if err = writeForwardMsg(conn, []interface{}{
+		"PONG",
+		reason == "",
+		reason,
+		cfg.SelfHostname,
+		pongDigest,
+	}); err != nil {
+		return errors.Wrap(err, "send PONG")
+	}
+
+	if reason != "" {
+		return errors.Errorf("authenticate client `%s` failed: %s", hostname, reason)
+	}
+	return nil
+}
+
+// ForwardClientHandshake process handshake from client side
+func ForwardClientHandshake(conn io.Writer, reader *msgp.Reader, cfg *ForwardSecurityCfg) (err error) {
+	helo, err := readForwardMsg(reader, "HELO", 2)
+	if err != nil {
+		return err
+	}
+	opt, ok := helo[1].(map[string]interface{})
+	if !ok {
+		return errors.Errorf("unknown HELO option `%v`", helo[1])
+	}
+	var (
+		nonce    = forwardMsgBytes(opt["nonce"])
+		authSalt = forwardMsgBytes(opt["auth"])
+		salt     []byte
+		pwd      string
+	)
+	if salt, err = randomSalt(); err != nil {
+		return err
+	}
+	if len(authSalt) != 0 {
+		pwd = forwardDigest(authSalt, []byte(cfg.Username), []byte(cfg.Password))
+	}
+
+	if err = writeForwardMsg(conn, []interface{}{
+		"PING",
+		cfg.SelfHostname,
+		salt,
+		forwardDigest(salt, []byte(cfg.SelfHostname), nonce, []byte(cfg.SharedKey)),
+		cfg.Username,
+		pwd,
+	}); err != nil {
+		return errors.Wrap(err, "send PING")
+	}
+
+	pong, err := readForwardMsg(reader, "PONG", 5)
+	if err != nil {
+		return err
+	}
+	if ok, _ = pong[1].(bool); !ok {
+		return errors.Errorf("authentication rejected by server: %s", forwardMsgBytes(pong[2]))
+	}
+	if !isForwardDigestEqual(forwardMsgBytes(pong[4]), forwardDigest(salt, forwardMsgBytes(pong[3]), nonce, []byte(cfg.SharedKey))) {
+		return errors.New("shared_key mismatch from server")
+	}
+
+	return nil
+}
+
+func randomSalt() ([]byte, error) {
+	b := make([]byte, forwardSaltLen)
+	if _, err := rand.Read(b); err != nil {
+		return nil, errors.Wrap(err, "generate salt")
+	}
+	return b, nil
+}
+
+// forwardDigest return hex(sha512(vals...))
+func forwardDigest(vals ...[]byte) string {
+	h := sha512.New()
+	for _, v := range vals {
+		h.Write(v)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// isForwardDigestEqual compare digests in constant time
+func isForwardDigestEqual(digest []byte, expect string) bool {
+	return subtle.ConstantTimeCompare(digest, []byte(expect)) == 1
+}
+
+// forwardMsgBytes convert str or bin in handshake messages to []byte
+func forwardMsgBytes(v interface{}) []byte {
+	switch v := v.(type) {
+	case []byte:
+		return v
+	case string:
+		return []byte(v)
+	}
+	return nil
+}
+
+func writeForwardMsg(conn io.Writer, v []interface{}) error {
+	b, err := msgp.AppendIntf(nil, v)
+	if err != nil {
+		return errors.Wrap(err, "encode")
+	}
+	_, err = conn.Write(b)
+	return err
+}
+
+// readForwardMsg read handshake message like `[<typ>, ...]` with at least minLen elements
+func readForwardMsg(reader *msgp.Reader, typ string, minLen int) ([]interface{}, error) {
+	vi, err := reader.ReadIntf()
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %s", typ)
+	}
+	v, ok := vi.([]interface{})
+	if !ok || len(v) < minLen || string(forwardMsgBytes(v[0])) != typ {
+		return nil, errors.Errorf("expect %s, got `%v`", typ, vi)
+	}
+	return v, nil
+}
@@ -0,0 +1,43 @@
+package library
+
+import (
+	"net"
+	"testing"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+func TestForwardHandshake(t *testing.T) {
+	serverCfg := &ForwardSecurityCfg{
+		SharedKey:    "secret",
+		SelfHostname: "server",
+		Users:        map[string]string{"user": "pwd"},
+	}
+	for _, tc := range []struct {
+		name   string
+		client *ForwardSecurityCfg
+		ok     bool
+	}{
+		{"ok", &ForwardSecurityCfg{SharedKey: "secret", SelfHostname: "client", Username: "user", Password: "pwd"}, true},
+		{"wrong key", &ForwardSecurityCfg{SharedKey: "wrong", SelfHostname: "client", Username: "user", Password: "pwd"}, false},
+		{"wrong password", &ForwardSecurityCfg{SharedKey: "secret", SelfHostname: "client", Username: "user", Password: "wrong"}, false},
+		{"unknown user", &ForwardSecurityCfg{SharedKey: "secret", SelfHostname: "client", Username: "nobody", Password: "pwd"}, false},
+	} {
+		sconn, cconn := net.Pipe()
+		serverErr := make(chan error, 1)
+		go func() {
+			serverErr <- ForwardServerHandshake(sconn, msgp.NewReader(sconn), serverCfg)
+		}()
+
+		clientErr := ForwardClientHandshake(cconn, msgp.NewReader(cconn), tc.client)
+		sErr := <-serverErr
+		sconn.Close()
+		cconn.Close()
+		if tc.ok && (clientErr != nil || sErr != nil) {
+			t.Fatalf("[%s] handshake should succeed, client: %+v, server: %+v", tc.name, clientErr, sErr)
+		}
+		if !tc.ok && (clientErr == nil || sErr == nil) {
+			t.Fatalf("[%s] handshake should fail", tc.name)
+		}
+	}
+}
@@ -4,3 +4,9 @@ type CounterIft interface {
 	Count() int64
 	CountN(int64) int64
 }
+
+// AckerItf will be invoked once the msg it attached is persisted or committed,
+// recvs can use it to implement end-to-end acknowledgement.
+type AckerItf interface {
+	Ack()
+}
@@ -0,0 +1,64 @@
+package library
+
+import (
+	"strings"
+	"time"
+
+	"gofluentd/library/log"
+
+	"github.com/Laisky/zap"
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultNATSReconnectWait = 3 * time.Second
+)
+
+// NATSConnCfg configuration of NATS connection for both recv & sender
+type NATSConnCfg struct {
+	// Servers: like `nats://127.0.0.1:4222`
+	Servers []string
+	// Username & Password, or Token, optional
+	Username, Password,
+	Token string
+	TLS *TLSCfg
+}
+
+// NewNATSConn connect to NATS servers, reconnect forever if disconnected
+func NewNATSConn(name string, c *NATSConnCfg) (*nats.Conn, error) {
+	if len(c.Servers) == 0 {
+		return nil, errors.New("servers should not be empty")
+	}
+
+	opts := []nats.Option{
+		nats.Name("gofluentd-" + name),
+		nats.MaxReconnects(-1),
+		nats.ReconnectWait(defaultNATSReconnectWait),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			log.Logger.Warn("disconnected from nats", zap.String("name", name), zap.Error(err))
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			log.Logger.Info("reconnected to nats", zap.String("name", name), zap.String("server", nc.ConnectedUrl()))
+		}),
+	}
+	if c.Username != "" {
+		opts = append(opts, nats.UserInfo(c.Username, c.Password))
+	}
+	if c.Token != "" {
+		opts = append(opts, nats.Token(c.Token))
+	}
+	if c.TLS != nil && c.TLS.Enable {
+		tlsCfg, err := NewClientTLSConfig(c.TLS)
+		if err != nil {
+			return nil, errors.Wrap(err, "load tls config")
+		}
+		opts = append(opts, nats.Secure(tlsCfg))
+	}
+
+	nc, err := nats.Connect(strings.Join(c.Servers, ","), opts...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "connect to nats `%s`", strings.Join(c.Servers, ","))
+	}
+	return nc, nil
+}
@@ -0,0 +1,35 @@
+package library
+
+import (
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+)
+
+// RedisConnCfg configuration of redis connection for both recv & sender
+type RedisConnCfg struct {
+	// Addr: like `127.0.0.1:6379`
+	Addr, Password string
+	DB             int
+	TLS            *TLSCfg
+}
+
+// NewRedisClient create redis client, connection is established lazily
+func NewRedisClient(c *RedisConnCfg) (*redis.Client, error) {
+	if c.Addr == "" {
+		return nil, errors.New("addr should not be empty")
+	}
+
+	opt := &redis.Options{
+		Addr:     c.Addr,
+		Password: c.Password,
+		DB:       c.DB,
+	}
+	if c.TLS != nil && c.TLS.Enable {
+		tlsCfg, err := NewClientTLSConfig(c.TLS)
+		if err != nil {
+			return nil, errors.Wrap(err, "load tls config")
+		}
+		opt.TLSConfig = tlsCfg
+	}
+	return redis.NewClient(opt), nil
+}
@@ -0,0 +1,214 @@
+package library
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"gofluentd/library/log"
+
+	"github.com/Laisky/zap"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultTLSReloadInterval = 1 * time.Minute
+)
+
+// TLSCfg configuration of TLS for both server & client side
+type TLSCfg struct {
+	Enable bool
+	// CertFile & KeyFile: server certificate (required by server),
+	// or client certificate (optional for client)
+	CertFile, KeyFile,
+	// CAFile: CA to verify client certificate (server),
+	// or CA to verify server certificate (client), use system CA if empty
+	CAFile string
+
+	// IsVerifyClient require & verify client certificate, server only
+	IsVerifyClient bool
+
+	// ServerName & InsecureSkipVerify, client only
+	ServerName         string
+	InsecureSkipVerify bool
+
+	// ReloadInterval check whether cert/key files changed in every interval,
+	// disable reload if < 0
+	ReloadInterval time.Duration
+}
+
+// certReloader load certificate, and reload it if files changed
+type certReloader struct {
+	sync.RWMutex
+	certFile, keyFile string
+	interval          time.Duration
+
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+func newCertReloader(certFile, keyFile string, interval time.Duration) (r *certReloader, err error) {
+	r = &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		interval: interval,
+	}
+	if r.modTime, err = r.getModTime(); err != nil {
+		return nil, err
+	}
+	if err = r.load(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *certReloader) getModTime() (t time.Time, err error) {
+	for _, fpath := range []string{r.certFile, r.keyFile} {
+		fi, err := os.Stat(fpath)
+		if err != nil {
+			return t, errors.Wrapf(err, "stat `%s`", fpath)
+		}
+		if fi.ModTime().After(t) {
+			t = fi.ModTime()
+		}
+	}
+
+	return t, nil
+}
+
+// load read certificate from files, should be called with lock held
+func (r *certReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return errors.Wrapf(err, "load cert `%s` and key `%s`", r.certFile, r.keyFile)
+	}
+
+	r.cert = &cert
+	r.lastCheck = time.Now()
+	return nil
+}
+
+// getCert return current certificate,
+// will reload certificate if files modified.
+func (r *certReloader) getCert() (*tls.Certificate, error) {
+	r.RLock()
+	cert := r.cert
+	isExpired := r.isExpired()
+	r.RUnlock()
+	if !isExpired {
+		return cert, nil
+	}
+
+	// check & reload under the same lock,
+	// concurrent handshakes will wait for the only one reloading.
+	r.Lock()
+	defer r.Unlock()
+	if !r.isExpired() {
+		return r.cert, nil
+	}
+	r.lastCheck = time.Now()
+	modTime, err := r.getModTime()
+	if err != nil {
+		log.Logger.Error("check certificate", zap.Error(err))
+		return r.cert, nil
+	}
+	if !modTime.After(r.modTime) {
+		return r.cert, nil
+	}
+
+	if err = r.load(); err != nil {
+		// keep using the old one
+		log.Logger.Error("reload certificate", zap.Error(err))
+		return r.cert, nil
+	}
+	r.modTime = modTime
+	log.Logger.Info("reload certificate",
+		zap.String("cert", r.certFile),
+		zap.String("key", r.keyFile))
+	return r.cert, nil
+}
+
+// isExpired whether should check files again, should be called with lock held
+func (r *certReloader) isExpired() bool {
+	return r.interval >= 0 && time.Since(r.lastCheck) > r.interval
+}
+
+func (c *TLSCfg) loadCA() (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(c.CAFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read ca `%s`", c.CAFile)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.Errorf("no certificate found in `%s`", c.CAFile)
+	}
+	return pool, nil
+}
+
+func (c *TLSCfg) reloadInterval() time.Duration {
+	if c.ReloadInterval == 0 {
+		return defaultTLSReloadInterval
+	}
+	return c.ReloadInterval
+}
+
+// NewServerTLSConfig create tls config for listener
+func NewServerTLSConfig(c *TLSCfg) (*tls.Config, error) {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, errors.New("cert_file & key_file should not be empty")
+	}
+
+	reloader, err := newCertReloader(c.CertFile, c.KeyFile, c.reloadInterval())
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return reloader.getCert()
+		},
+	}
+
+	if c.IsVerifyClient {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		if c.CAFile != "" {
+			if cfg.ClientCAs, err = c.loadCA(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return cfg, nil
+}
+
+// NewClientTLSConfig create tls config for dialer
+func NewClientTLSConfig(c *TLSCfg) (cfg *tls.Config, err error) {
+	cfg = &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if c.CAFile != "" {
+		if cfg.RootCAs, err = c.loadCA(); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.CertFile != "" && c.KeyFile != "" {
+		reloader, err := newCertReloader(c.CertFile, c.KeyFile, c.reloadInterval())
+		if err != nil {
+			return nil, err
+		}
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return reloader.getCert()
+		}
+	}
+
+	return cfg, nil
+}
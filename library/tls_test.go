@@ -0,0 +1,211 @@
+package library
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeTestCert generate self-signed certificate for 127.0.0.1
+func writeTestCert(t *testing.T, dir, cn string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	return certFile, keyFile
+}
+
+func TestTLSCertReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "first")
+	serverCfg, err := NewServerTLSConfig(&TLSCfg{
+		CertFile:       certFile,
+		KeyFile:        keyFile,
+		ReloadInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", serverCfg)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	peerCN := func() string {
+		clientCfg, err := NewClientTLSConfig(&TLSCfg{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		conn, err := tls.Dial("tcp", ln.Addr().String(), clientCfg)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+
+	if cn := peerCN(); cn != "first" {
+		t.Fatalf("expect first, got %s", cn)
+	}
+
+	// rewrite cert files
+	writeTestCert(t, dir, "second")
+	future := time.Now().Add(time.Minute)
+	for _, fpath := range []string{certFile, keyFile} {
+		if err = os.Chtimes(fpath, future, future); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	if cn := peerCN(); cn != "second" {
+		t.Fatalf("expect second, got %s", cn)
+	}
+}
+
+func TestCertReloaderConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "first")
+	r, err := newCertReloader(certFile, keyFile, 0)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	writeTestCert(t, dir, "second")
+	future := time.Now().Add(time.Minute)
+	for _, fpath := range []string{certFile, keyFile} {
+		if err = os.Chtimes(fpath, future, future); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := r.getCert(); err != nil {
+				t.Errorf("%+v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	cert, err := r.getCert()
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	x509Cert, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if x509Cert.Subject.CommonName != "second" {
+		t.Fatalf("expect second, got %s", x509Cert.Subject.CommonName)
+	}
+}
+
+func TestTLSVerifyClient(t *testing.T) {
+	var (
+		serverDir = t.TempDir()
+		clientDir = t.TempDir()
+	)
+	serverCert, serverKey := writeTestCert(t, serverDir, "server")
+	clientCert, clientKey := writeTestCert(t, clientDir, "client")
+	serverCfg, err := NewServerTLSConfig(&TLSCfg{
+		CertFile:       serverCert,
+		KeyFile:        serverKey,
+		CAFile:         clientCert,
+		IsVerifyClient: true,
+	})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", serverCfg)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if conn.(*tls.Conn).Handshake() == nil {
+				_, _ = conn.Write([]byte("ok"))
+			}
+			conn.Close()
+		}
+	}()
+
+	dial := func(c *TLSCfg) error {
+		clientCfg, err := NewClientTLSConfig(c)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		conn, err := tls.Dial("tcp", ln.Addr().String(), clientCfg)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		// tls1.3 client may finish handshake before server verify its certificate
+		_, err = conn.Read(make([]byte, 2))
+		return err
+	}
+
+	if err = dial(&TLSCfg{CAFile: serverCert}); err == nil {
+		t.Fatal("should reject client without certificate")
+	}
+	if err = dial(&TLSCfg{CAFile: serverCert, CertFile: clientCert, KeyFile: clientKey}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+}